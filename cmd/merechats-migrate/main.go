@@ -0,0 +1,43 @@
+// Command merechats-migrate runs resumable data backfills against the chat store.
+//
+//	merechats-migrate -migration readby-to-seq -batch 200
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"naevis/migrate"
+)
+
+func main() {
+	name := flag.String("migration", migrate.ReadWatermarksID, "migration to run")
+	batch := flag.Int64("batch", 100, "chats per batch")
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing")
+	reset := flag.Bool("reset", false, "discard the saved checkpoint and start over")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *reset {
+		if err := migrate.ResetCheckpoint(ctx, *name); err != nil {
+			log.Fatalf("reset checkpoint: %v", err)
+		}
+	}
+
+	switch *name {
+	case migrate.ReadWatermarksID:
+		stats, err := migrate.BackfillReadWatermarks(ctx, *batch, *dryRun)
+		if err != nil {
+			log.Fatalf("%s failed after chats=%d: %v (rerun to resume)", *name, stats.Chats, err)
+		}
+		log.Printf("%s done: chats=%d messages=%d memberships=%d dryRun=%v",
+			*name, stats.Chats, stats.Messages, stats.Memberships, *dryRun)
+	default:
+		log.Fatalf("unknown migration %q", *name)
+	}
+}
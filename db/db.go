@@ -2,6 +2,8 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -9,6 +11,7 @@ import (
 	"time"
 
 	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -16,9 +19,33 @@ import (
 var (
 	Client *mongo.Client
 	// Your collections:
-	ChatsCollection    *mongo.Collection
-	MereCollection     *mongo.Collection
-	MessagesCollection *mongo.Collection
+	ChatsCollection         *mongo.Collection
+	MereCollection          *mongo.Collection
+	MessagesCollection      *mongo.Collection
+	AttachmentsCollection   *mongo.Collection
+	MembershipsCollection   *mongo.Collection
+	MigrationsCollection    *mongo.Collection
+	WebhooksCollection      *mongo.Collection
+	BotsCollection          *mongo.Collection
+	UsersCollection         *mongo.Collection // user profiles, owned by the accounts service
+	JobsCollection          *mongo.Collection
+	CallsCollection         *mongo.Collection
+	StickersCollection      *mongo.Collection
+	VerificationsCollection *mongo.Collection
+	ChatUserStateCollection *mongo.Collection
+	JoinRequestsCollection  *mongo.Collection
+	InvitesCollection       *mongo.Collection
+	ReportsCollection       *mongo.Collection
+	OutboxCollection        *mongo.Collection
+	DeadLettersCollection   *mongo.Collection
+	AuditLogCollection      *mongo.Collection
+	SuspensionsCollection   *mongo.Collection
+	StorageQuotasCollection *mongo.Collection
+	MediaMetadataCollection *mongo.Collection
+	MediaJobsCollection     *mongo.Collection
+	ComplianceCollection    *mongo.Collection // compliance events waiting for the WORM target
+	SettingsCollection      *mongo.Collection // service-wide switches shared by all instances
+	StagedUploadsCollection *mongo.Collection // per-user reservations for staged resumable uploads
 )
 
 // limiter chan to cap concurrent Mongo ops
@@ -36,7 +63,8 @@ func init() {
 		ApplyURI(uri).
 		SetMaxPoolSize(100).
 		SetMinPoolSize(10).
-		SetRetryWrites(true)
+		SetRetryWrites(true).
+		SetMonitor(queryMonitor())
 
 	var err error
 	Client, err = mongo.Connect(context.Background(), clientOpts)
@@ -46,6 +74,10 @@ func init() {
 	if err := Client.Ping(context.Background(), nil); err != nil {
 		log.Fatalf("❌ Mongo ping failed: %v", err)
 	}
+	// messages are committed in transactions, which a standalone mongod refuses
+	if err := requireTransactions(context.Background()); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
 	log.Printf("✅ MongoDB connected (%s) maxPool=%d minPool=%d; Goroutines at start: %d",
 		uri, *clientOpts.MaxPoolSize, *clientOpts.MinPoolSize, runtime.NumGoroutine(),
@@ -69,6 +101,30 @@ func init() {
 	ChatsCollection = db.Collection("chats")
 	MereCollection = db.Collection("mere")
 	MessagesCollection = db.Collection("messages")
+	AttachmentsCollection = db.Collection("attachments")
+	MembershipsCollection = db.Collection("memberships")
+	MigrationsCollection = db.Collection("migrations")
+	WebhooksCollection = db.Collection("webhooks")
+	BotsCollection = db.Collection("bots")
+	UsersCollection = db.Collection("users")
+	JobsCollection = db.Collection("jobs")
+	CallsCollection = db.Collection("calls")
+	StickersCollection = db.Collection("stickers")
+	VerificationsCollection = db.Collection("verifications")
+	ChatUserStateCollection = db.Collection("chat_user_state")
+	JoinRequestsCollection = db.Collection("join_requests")
+	InvitesCollection = db.Collection("invites")
+	ReportsCollection = db.Collection("reports")
+	OutboxCollection = db.Collection("outbox")
+	DeadLettersCollection = db.Collection("dead_letters")
+	AuditLogCollection = db.Collection("admin_audit")
+	SuspensionsCollection = db.Collection("suspensions")
+	StorageQuotasCollection = db.Collection("storage_quotas")
+	MediaMetadataCollection = db.Collection("media_metadata")
+	MediaJobsCollection = db.Collection("media_jobs")
+	ComplianceCollection = db.Collection("compliance_queue")
+	SettingsCollection = db.Collection("settings")
+	StagedUploadsCollection = db.Collection("staged_uploads")
 }
 
 // logPoolStats logs basic goroutine and pool stats every 60s (optional)
@@ -79,6 +135,21 @@ func logPoolStats() {
 	}
 }
 
+// requireTransactions fails unless the deployment is a replica set or a sharded cluster.
+func requireTransactions(ctx context.Context) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := Client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return fmt.Errorf("mongo topology check failed: %w", err)
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return errors.New("MongoDB is a standalone server; sending messages needs transactions, so point MONGODB_URI at a replica set (a single-node one will do) or a mongos")
+	}
+	return nil
+}
+
 // PingMongo can be used in your /health endpoint
 func PingMongo() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
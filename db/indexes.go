@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureIndexes creates the indexes the chat queries rely on. It is idempotent.
+func EnsureIndexes(ctx context.Context) error {
+	specs := map[*mongo.Collection][]mongo.IndexModel{
+		MereCollection: {
+			{Keys: bson.D{{Key: "chatid", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "participants", Value: 1}, {Key: "updatedAt", Value: -1}}},
+		},
+		MessagesCollection: {
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "createdAt", Value: 1}}},
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "seq", Value: 1}}, Options: options.Index().
+				SetUnique(true).SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}})},
+			{Keys: bson.D{{Key: "content", Value: "text"}, {Key: "media.transcript", Value: "text"}}, Options: options.Index().SetName("message_text")},
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "kind", Value: 1}, {Key: "task.done", Value: 1}}},
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "media.url", Value: 1}}, Options: options.Index().SetSparse(true)},
+			// shared media gallery, see GetChatMedia
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "media.type", Value: 1}, {Key: "_id", Value: -1}}, Options: options.Index().
+				SetPartialFilterExpression(bson.M{"media.url": bson.M{"$exists": true}})},
+			{Keys: bson.D{{Key: "deletedAt", Value: 1}, {Key: "createdAt", Value: 1}}, Options: options.Index().
+				SetPartialFilterExpression(bson.M{"deleted": true})},
+			// payment callbacks, see paymentReferenceUsed
+			{Keys: bson.D{{Key: "payment.reference", Value: 1}}, Options: options.Index().SetSparse(true)},
+			// profile rewrites, see rewriteSenderProfile
+			{Keys: bson.D{{Key: "sender", Value: 1}}},
+		},
+		MembershipsCollection: {
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "userid", Value: 1}}},
+		},
+		BotsCollection: {
+			{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "owner", Value: 1}}},
+		},
+		WebhooksCollection: {
+			{Keys: bson.D{{Key: "chatid", Value: 1}}},
+		},
+		StickersCollection: {
+			{Keys: bson.D{{Key: "owner", Value: 1}}},
+		},
+		ChatUserStateCollection: {
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		JoinRequestsCollection: {
+			// one pending request per user and chat; decided ones are overwritten on re-request
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+		},
+		InvitesCollection: {
+			{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "chatid", Value: 1}}},
+		},
+		ReportsCollection: {
+			{Keys: bson.D{{Key: "messageId", Value: 1}, {Key: "reporter", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+			{Keys: bson.D{{Key: "reported", Value: 1}}},
+		},
+		VerificationsCollection: {
+			{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "userid", Value: 1}}},
+		},
+		CallsCollection: {
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "startedAt", Value: -1}}},
+		},
+		JobsCollection: {
+			{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "kind", Value: 1}, {Key: "createdAt", Value: -1}}},
+			{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+		},
+		AttachmentsCollection: {
+			{Keys: bson.D{{Key: "chatid", Value: 1}, {Key: "name", Value: 1}}},
+			{Keys: bson.D{{Key: "name", Value: 1}}},
+			{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+			{Keys: bson.D{{Key: "sha256", Value: 1}, {Key: "createdAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "path", Value: 1}}},
+			{Keys: bson.D{{Key: "uploader", Value: 1}, {Key: "size", Value: -1}}},
+		},
+		AuditLogCollection: {
+			{Keys: bson.D{{Key: "at", Value: -1}}},
+			{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "at", Value: -1}}},
+		},
+		SuspensionsCollection: {
+			{Keys: bson.D{{Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		DeadLettersCollection: {
+			{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "createdAt", Value: -1}}},
+		},
+		OutboxCollection: {
+			// dispatched events are purged after a day; pending ones have no dispatchedAt
+			{Keys: bson.D{{Key: "dispatchedAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(86400)},
+		},
+		MediaJobsCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "runAt", Value: 1}}},
+			{Keys: bson.D{{Key: "name", Value: 1}}},
+			// finished jobs are kept a week for the status API
+			{Keys: bson.D{{Key: "finishedAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(7 * 86400)},
+		},
+		ComplianceCollection: {
+			{Keys: bson.D{{Key: "claimedUntil", Value: 1}}},
+		},
+		StagedUploadsCollection: {
+			{Keys: bson.D{{Key: "sessions.id", Value: 1}}},
+			{Keys: bson.D{{Key: "sessions.createdAt", Value: 1}}},
+		},
+	}
+
+	// a collection has one text index; the old one, content only, is replaced by message_text
+	if _, err := MessagesCollection.Indexes().DropOne(ctx, "content_text"); err != nil {
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || (cmdErr.Code != 26 && cmdErr.Code != 27) { // NamespaceNotFound, IndexNotFound
+			return err
+		}
+	}
+
+	for col, models := range specs {
+		names, err := col.Indexes().CreateMany(ctx, models)
+		if err != nil {
+			return err
+		}
+		log.Printf("📇 Indexes ensured on %s: %v", col.Name(), names)
+	}
+	return nil
+}
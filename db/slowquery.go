@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// SlowQueryThreshold is the duration above which a Mongo command is logged and counted as slow.
+// Override with MONGO_SLOW_QUERY_MS.
+var SlowQueryThreshold = 200 * time.Millisecond
+
+// handlerKey is the context key naming the HTTP handler that issued a query.
+type handlerKey struct{}
+
+// WithHandler tags ctx so queries run under it are attributed to handler.
+func WithHandler(ctx context.Context, handler string) context.Context {
+	return context.WithValue(ctx, handlerKey{}, handler)
+}
+
+// HandlerFromContext returns the handler tag set by WithHandler, or "-".
+func HandlerFromContext(ctx context.Context) string {
+	if h, ok := ctx.Value(handlerKey{}).(string); ok && h != "" {
+		return h
+	}
+	return "-"
+}
+
+// pendingQuery is what we remember about a started command until it finishes.
+type pendingQuery struct {
+	handler    string
+	collection string
+	shape      string
+}
+
+// QueryStat aggregates slow commands for one handler and collection.
+type QueryStat struct {
+	Handler    string        `json:"handler"`
+	Collection string        `json:"collection"`
+	Command    string        `json:"command"`
+	Shape      string        `json:"shape"`
+	Count      int64         `json:"count"`
+	Total      time.Duration `json:"totalNanos"`
+	Max        time.Duration `json:"maxNanos"`
+}
+
+var (
+	pending sync.Map // connectionID/requestID => pendingQuery
+
+	slowStats = struct {
+		sync.Mutex
+		m map[string]*QueryStat
+	}{m: make(map[string]*QueryStat)}
+)
+
+func init() {
+	if v, err := strconv.Atoi(os.Getenv("MONGO_SLOW_QUERY_MS")); err == nil && v > 0 {
+		SlowQueryThreshold = time.Duration(v) * time.Millisecond
+	}
+}
+
+// queryMonitor records the handler and redacted filter of each command and reports slow ones.
+func queryMonitor() *event.CommandMonitor {
+	key := func(conn string, req int64) string { return conn + "/" + strconv.FormatInt(req, 10) }
+	finish := func(ctx context.Context, e event.CommandFinishedEvent) {
+		v, ok := pending.LoadAndDelete(key(e.ConnectionID, e.RequestID))
+		if !ok || e.Duration < SlowQueryThreshold {
+			return
+		}
+		q := v.(pendingQuery)
+		recordSlowQuery(q, e.CommandName, e.Duration)
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if len(e.Command) == 0 {
+				return // redacted by the driver (auth, hello, ...)
+			}
+			coll, _ := e.Command.Lookup(e.CommandName).StringValueOK()
+			pending.Store(key(e.ConnectionID, e.RequestID), pendingQuery{
+				handler:    HandlerFromContext(ctx),
+				collection: coll,
+				shape:      commandShape(e.CommandName, e.Command),
+			})
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			finish(ctx, e.CommandFinishedEvent)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			finish(ctx, e.CommandFinishedEvent)
+		},
+	}
+}
+
+func recordSlowQuery(q pendingQuery, command string, took time.Duration) {
+	log.Printf("🐢 slow mongo %s on %s took %v (handler=%s) shape=%s", command, q.collection, took, q.handler, q.shape)
+
+	k := q.handler + "|" + q.collection + "|" + command + "|" + q.shape
+	slowStats.Lock()
+	defer slowStats.Unlock()
+	s, ok := slowStats.m[k]
+	if !ok {
+		s = &QueryStat{Handler: q.handler, Collection: q.collection, Command: command, Shape: q.shape}
+		slowStats.m[k] = s
+	}
+	s.Count++
+	s.Total += took
+	if took > s.Max {
+		s.Max = took
+	}
+}
+
+// SlowQueryStats returns the slow-query aggregates, worst total time first.
+func SlowQueryStats() []QueryStat {
+	slowStats.Lock()
+	out := make([]QueryStat, 0, len(slowStats.m))
+	for _, s := range slowStats.m {
+		out = append(out, *s)
+	}
+	slowStats.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Total > out[j].Total })
+	return out
+}
+
+// commandShape renders the filter (or pipeline) of a command with every value replaced by "?",
+// so logs show which fields and operators were used without leaking user data.
+func commandShape(command string, cmd bson.Raw) string {
+	var field string
+	switch command {
+	case "find", "count", "distinct", "findAndModify":
+		field = "query"
+		if command == "find" {
+			field = "filter"
+		}
+	case "aggregate":
+		field = "pipeline"
+	case "update", "delete":
+		// updates: [{q: ...}], deletes: [{q: ...}]
+		arr, ok := cmd.Lookup(command + "s").ArrayOK()
+		if !ok {
+			return ""
+		}
+		first, err := arr.IndexErr(0)
+		if err != nil {
+			return ""
+		}
+		doc, ok := first.Value().DocumentOK()
+		if !ok {
+			return ""
+		}
+		return redactValue(doc.Lookup("q"))
+	default:
+		return ""
+	}
+	return redactValue(cmd.Lookup(field))
+}
+
+func redactValue(v bson.RawValue) string {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		elems, _ := v.Document().Elements()
+		parts := make([]string, 0, len(elems))
+		for _, e := range elems {
+			parts = append(parts, e.Key()+": "+redactValue(e.Value()))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case bsontype.Array:
+		vals, _ := v.Array().Values()
+		// operator arrays ($or, $and, pipelines) carry structure; value arrays ($in) do not
+		if len(vals) > 0 && vals[0].Type == bsontype.EmbeddedDocument {
+			parts := make([]string, 0, len(vals))
+			for _, el := range vals {
+				parts = append(parts, redactValue(el))
+			}
+			return "[" + strings.Join(parts, ", ") + "]"
+		}
+		return fmt.Sprintf("[?×%d]", len(vals))
+	case 0:
+		return ""
+	default:
+		return "?"
+	}
+}
@@ -106,7 +106,7 @@ func softDeleteByField(
 
 func DeleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	softDeleteByField(w, r, ps, db.MessagesCollection, "messageId", "_id", "message", "message-deleted",
-		bson.M{"$set": bson.M{"deleted": true}}, nil, nil)
+		bson.M{"$set": bson.M{"deleted": true, "deletedAt": time.Now()}}, nil, nil)
 }
 
 func DeletesMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
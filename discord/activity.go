@@ -0,0 +1,57 @@
+package discord
+
+import (
+	"context"
+	"log"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Composer activities carried by "typing" frames. Clients that predate activities send
+// none and are treated as typing; they also ignore the field on what they receive.
+const (
+	activityTyping         = "typing"
+	activityRecordingVoice = "recording_voice"
+	activityUploadingFile  = "uploading_file"
+	activityStopped        = "stopped" // sent when the composer goes idle, clearing the indicator
+)
+
+var validActivities = map[string]bool{
+	activityTyping:         true,
+	activityRecordingVoice: true,
+	activityUploadingFile:  true,
+	activityStopped:        true,
+}
+
+// handleTyping relays a participant's composer activity to the rest of the chat. It is
+// never stored; indicators are expected to time out on the client.
+func handleTyping(ctx context.Context, client *Client, in models.IncomingWSMessage) {
+	activity := in.Activity
+	if activity == "" {
+		activity = activityTyping
+	}
+	if !validActivities[activity] {
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": in.ChatID, "participants": client.UserID}).Decode(&chat); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("WS typing lookup failed (%s): %v", client.UserID, err)
+			return
+		}
+		client.reject(in, errCodeChatNotFound, "chat not found", nil)
+		return
+	}
+
+	sendToUsers(chat.Participants, map[string]interface{}{
+		"type":     "typing",
+		"sender":   client.UserID,
+		"chatid":   chat.ChatID,
+		"activity": activity,
+	})
+}
@@ -0,0 +1,226 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"naevis/db"
+	"naevis/middleware"
+	"naevis/migrate"
+	"naevis/models"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sweeps are the maintenance jobs operators can trigger by name; each returns how many items it touched.
+var sweeps = map[string]func(ctx context.Context) (int, error){
+	"orphans": func(ctx context.Context) (int, error) {
+		return cleanupOrphanAttachments(ctx, orphanGracePeriod)
+	},
+	"sender_profiles": backfillSenderProfiles,
+}
+
+// ListConnections lists WebSocket clients connected to this instance.
+func ListConnections(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	type conn struct {
+		UserID      string    `json:"userid"`
+		DeviceID    string    `json:"deviceId,omitempty"`
+		ConnectedAt time.Time `json:"connectedAt"`
+		Queued      int       `json:"queued"`
+	}
+
+	targets := allClients()
+	out := make([]conn, 0, len(targets))
+	for _, c := range targets {
+		out = append(out, conn{UserID: c.UserID, DeviceID: c.DeviceID, ConnectedAt: c.ConnectedAt, Queued: len(c.Send)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// CloseConnection revokes a user's sockets on this instance with a "revoked" close frame.
+func CloseConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := ps.ByName("userid")
+	clients.RLock()
+	conns := make([]*Client, 0, len(clients.m[user]))
+	for c := range clients.m[user] {
+		conns = append(conns, c)
+	}
+	clients.RUnlock()
+	if len(conns) == 0 {
+		writeErr(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	for _, c := range conns {
+		closeClient(c, closeRevoked)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RecomputeChat rebuilds a chat's derived state after participants changed or counters
+// drifted: the aggregate delivery/read status of every message from its deliveredTo/readBy
+// sets, the list summary (message count, last message) and each member's read watermark and
+// unread mentions.
+func RecomputeChat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "chat not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, bson.M{"chatid": chatID})
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	updated := 0
+	for cursor.Next(ctx) {
+		var msg models.Message
+		if err := cursor.Decode(&msg); err != nil {
+			continue
+		}
+		if status := aggregateStatus(&msg, &chat); status != msg.Status {
+			if _, err := db.MessagesCollection.UpdateOne(ctx, bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"status": status}}); err == nil {
+				updated++
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	summary := rebuildChatSummary(ctx, &chat)
+	members, err := migrate.RebuildMemberCounters(ctx, &chat)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int64{
+		"updated":      int64(updated),
+		"messageCount": summary.MessageCount,
+		"memberships":  members,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RebuildIndexes (re)creates the collection indexes.
+func RebuildIndexes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := db.EnsureIndexes(r.Context()); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunSweep triggers a named maintenance sweep (see sweeps).
+func RunSweep(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sweep, ok := sweeps[ps.ByName("sweep")]
+	if !ok {
+		writeErr(w, "unknown sweep", http.StatusNotFound)
+		return
+	}
+	n, err := sweep(r.Context())
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"affected": n}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ExportChat dumps a chat and all of its messages (including soft-deleted ones) as JSON.
+func ExportChat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "chat not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkResidency(&chat); err != nil {
+		writeResidencyErr(w, &chat)
+		return
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, bson.M{"chatid": chatID}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msgs == nil {
+		msgs = make([]models.Message, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="chat-`+chatID+`.json"`)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"chat":       chat,
+		"messages":   msgs,
+		"exportedAt": time.Now(),
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetMetrics reports per-handler request metrics and slow Mongo queries seen by this instance.
+func GetMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"handlers":             middleware.HandlerStats(),
+		"slowQueries":          db.SlowQueryStats(),
+		"slowQueryThresholdMs": db.SlowQueryThreshold.Milliseconds(),
+		"delivery":             deliveryStats(),
+		"retention":            retentionMetrics(),
+		"mediaJobs":            mediaJobMetrics(),
+		"wsCompression":        compressionMetrics(),
+		"searchShadow": map[string]int64{
+			"compared": shadowStats.compared.Load(),
+			"diverged": shadowStats.diverged.Load(),
+			"failed":   shadowStats.failed.Load(),
+		},
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
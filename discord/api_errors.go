@@ -0,0 +1,94 @@
+package discord
+
+import (
+	"log"
+	"net/http"
+
+	"naevis/models"
+)
+
+// Error codes for failures a client can act on; everything else gets the generic code
+// for its HTTP status.
+const (
+	errCodeContentRejected = "content_rejected"
+	errCodeQuotaExceeded   = "storage_quota_exceeded"
+	errCodeJobInProgress   = "job_in_progress"
+	errCodeMentionDenied   = "mention_denied"
+	errCodeReadOnly        = "read_only"
+	errCodeNoThreadRoot    = "reply_target_not_found"
+	errCodeMessageTooLong  = "message_too_long"
+	errCodeSuspended       = "suspended"
+	errCodeChatNotFound    = "chat_not_found"
+	errCodeChatFull        = "chat_full"
+)
+
+type sendError struct {
+	code   string
+	status int
+}
+
+// sendErrors maps errors returned by the send path to their codes, so HTTP and WS
+// report them the same way.
+var sendErrors = map[error]sendError{
+	errMentionDeny:    {errCodeMentionDenied, http.StatusForbidden},
+	errReadOnly:       {errCodeReadOnly, http.StatusServiceUnavailable},
+	errNoThreadRoot:   {errCodeNoThreadRoot, http.StatusBadRequest},
+	errMessageTooLong: {errCodeMessageTooLong, http.StatusRequestEntityTooLarge},
+	errSuspended:      {errCodeSuspended, http.StatusForbidden},
+}
+
+// writeErr answers with the JSON error envelope and the generic code for status. Messages
+// of 500s are logged rather than sent, as they are often raw driver errors.
+func writeErr(w http.ResponseWriter, msg string, status int) {
+	if status == http.StatusInternalServerError {
+		log.Printf("HTTP 500: %s", msg)
+		msg = "internal error"
+	}
+	writeErrCode(w, status, models.ErrCodeForStatus(status), msg, nil)
+}
+
+// writeErrCode answers with the JSON error envelope and a specific code.
+func writeErrCode(w http.ResponseWriter, status int, code, msg string, details interface{}) {
+	models.WriteAPIError(w, status, models.APIError{Code: code, Message: msg, Details: details})
+}
+
+// writeSendErr answers an error from the send path with its code and status, reporting
+// whether err was a content rejection or one of sendErrors.
+func writeSendErr(w http.ResponseWriter, err error) bool {
+	if rej, ok := asRejection(err); ok {
+		writeRejection(w, rej)
+		return true
+	}
+	e, ok := sendErrors[err]
+	if ok {
+		writeErrCode(w, e.status, e.code, err.Error(), nil)
+	}
+	return ok
+}
+
+// writeReadOnly answers a write refused by checkWritable.
+func writeReadOnly(w http.ResponseWriter) {
+	writeErrCode(w, http.StatusServiceUnavailable, errCodeReadOnly, errReadOnly.Error(), nil)
+}
+
+// wsError is an "error" frame about a client's frame, echoing its ids.
+func wsError(in models.IncomingWSMessage, code, msg string, details interface{}) map[string]interface{} {
+	frame := map[string]interface{}{
+		"type":    "error",
+		"code":    code,
+		"message": msg,
+	}
+	if in.RequestID != "" {
+		frame["requestId"] = in.RequestID
+	}
+	if in.ChatID != "" {
+		frame["chatid"] = in.ChatID
+	}
+	if in.ClientID != "" {
+		frame["clientId"] = in.ClientID
+	}
+	if details != nil {
+		frame["details"] = details
+	}
+	return frame
+}
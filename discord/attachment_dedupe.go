@@ -0,0 +1,87 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Chat uploads are deduplicated by content: an upload whose SHA-256 matches a stored file
+// gets its own attachment row pointing at that file instead of a second copy. The rows are
+// the reference count; releaseAttachment deletes the file with the last one.
+
+func init() {
+	filemgr.DedupeFunc = findStoredUpload
+}
+
+// findStoredUpload returns the oldest chat file in picType's folder with the given hash.
+func findStoredUpload(entity filemgr.EntityType, picType filemgr.PictureType, sha256 string) (filemgr.SavedFile, bool) {
+	if entity != filemgr.EntityChat {
+		return filemgr.SavedFile{}, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dir := filemgr.ResolvePath(entity, picType)
+	cursor, err := db.AttachmentsCollection.Find(ctx, bson.M{"sha256": sha256},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetLimit(20))
+	if err != nil {
+		log.Printf("dedupe lookup failed: %v", err)
+		return filemgr.SavedFile{}, false
+	}
+	var rows []models.Attachment
+	if err := cursor.All(ctx, &rows); err != nil {
+		return filemgr.SavedFile{}, false
+	}
+	for _, a := range rows {
+		if filepath.Dir(a.Path) != filepath.Clean(dir) || a.Name == "" {
+			continue
+		}
+		if len(a.Variants) > 0 {
+			stashVariants(a.Name, a.Variants)
+		}
+		saved := filemgr.SavedFile{Name: a.Name, Size: a.Size, MIME: a.MIME}
+		for _, v := range a.Variants {
+			saved.Animated = saved.Animated || v.Animated
+		}
+		if a.Pages > 0 {
+			saved.Document = &filemgr.DocumentInfo{Pages: a.Pages, Preview: len(a.Variants) > 0}
+		}
+		saved.Moderation = storedModeration(ctx, a.Name)
+		return saved, true
+	}
+	return filemgr.SavedFile{}, false
+}
+
+// releaseAttachment drops one reference to a stored file: the row always, the file (with its
+// variants) only when no other row shares it. The row goes first, so two releases of the
+// last rows racing each other cannot both see the other and leave the file behind, and a
+// row added for a deduplicated upload meanwhile keeps it. freed reports whether the file went.
+func releaseAttachment(ctx context.Context, a models.Attachment) (freed bool, err error) {
+	res, err := db.AttachmentsCollection.DeleteOne(ctx, bson.M{"_id": a.ID})
+	if err != nil {
+		return false, err
+	}
+	if res.DeletedCount == 0 {
+		return false, nil // released already
+	}
+	chargeQuota(ctx, a.UploaderID, -a.Size, -1)
+
+	shared, err := db.AttachmentsCollection.CountDocuments(ctx, bson.M{"path": a.Path}, options.Count().SetLimit(1))
+	if err != nil || shared > 0 {
+		return false, err
+	}
+	if err := filemgr.DeleteFile(a.Path); err != nil {
+		return false, err
+	}
+	forgetMediaMetadata(ctx, a.Name)
+	return true, nil
+}
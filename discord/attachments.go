@@ -0,0 +1,373 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	orphanGracePeriod = 24 * time.Hour // uploads younger than this may still be attached
+	orphanBatchSize   = 500
+	uploadScanLimit   = 5000 // untracked files handled per upload GC pass
+	uploadsSweepName  = "uploads"
+	mediaURLTTL       = 15 * time.Minute // lifetime of presigned download links
+)
+
+func init() {
+	sweeps[uploadsSweepName] = func(ctx context.Context) (int, error) {
+		return sweepUploadFiles(ctx, orphanGracePeriod)
+	}
+}
+
+// recordAttachment audits a freshly saved upload; it is linked to its message afterwards.
+func recordAttachment(ctx context.Context, a *models.Attachment) error {
+	a.CreatedAt = time.Now()
+	if a.Variants == nil {
+		a.Variants = takePendingVariants(a.Name)
+	}
+	if len(a.Processing) > 0 {
+		a.Processing, a.ProcessingFailed = takeFinishedProcessing(a.Name, a.Processing)
+	}
+	res, err := db.AttachmentsCollection.InsertOne(ctx, a)
+	if err != nil {
+		return err
+	}
+	a.ID = res.InsertedID.(primitive.ObjectID)
+	chargeQuota(ctx, a.UploaderID, a.Size, 1)
+	return nil
+}
+
+// linkAttachment marks the upload as owned by a message so the janitor keeps it.
+// Pre-uploaded files are matched by name within the chat.
+func linkAttachment(ctx context.Context, chatID, name string, msgID primitive.ObjectID) {
+	_, err := db.AttachmentsCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID, "name": name, "messageId": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"messageId": msgID}},
+	)
+	if err != nil {
+		log.Printf("attachment link failed (%s/%s): %v", chatID, name, err)
+	}
+}
+
+// findOrphanAttachments returns uploads older than grace that were never attached,
+// or whose owning message no longer exists (hard-deleted).
+func findOrphanAttachments(ctx context.Context, grace time.Duration) ([]models.Attachment, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "createdAt", Value: bson.D{{Key: "$lt", Value: time.Now().Add(-grace)}}},
+		}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: db.MessagesCollection.Name()},
+			{Key: "localField", Value: "messageId"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "as", Value: "owner"},
+		}}},
+		{{Key: "$match", Value: bson.D{
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "messageId", Value: bson.D{{Key: "$exists", Value: false}}}},
+				bson.D{{Key: "owner", Value: bson.D{{Key: "$size", Value: 0}}}},
+			}},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "owner", Value: 0}}}},
+		{{Key: "$limit", Value: orphanBatchSize}},
+	}
+
+	cursor, err := db.AttachmentsCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var orphans []models.Attachment
+	if err := cursor.All(ctx, &orphans); err != nil {
+		return nil, err
+	}
+	if orphans == nil {
+		orphans = make([]models.Attachment, 0)
+	}
+	return orphans, nil
+}
+
+// cleanupOrphanAttachments deletes orphaned files and their audit rows, returning how many were removed.
+func cleanupOrphanAttachments(ctx context.Context, grace time.Duration) (int, error) {
+	orphans, err := findOrphanAttachments(ctx, grace)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, a := range orphans {
+		if owner := referencingMessage(ctx, a.ChatID, a.Name); owner != nil {
+			// the file was reused by another message in the chat (savedname); move the reference instead
+			if _, err := db.AttachmentsCollection.UpdateOne(ctx, bson.M{"_id": a.ID}, bson.M{"$set": bson.M{"messageId": owner.ID}}); err != nil {
+				log.Printf("janitor: relink %s failed: %v", a.Name, err)
+			}
+			continue
+		}
+		if _, err := releaseAttachment(ctx, a); err != nil {
+			log.Printf("janitor: release %s failed: %v", a.Path, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// referencingMessage returns a message whose media is the saved file name, or nil. An empty
+// chatID matches messages in any chat.
+func referencingMessage(ctx context.Context, chatID, name string) *models.Message {
+	filter := bson.M{"media.url": name}
+	if chatID != "" {
+		filter["chatid"] = chatID
+	}
+	var msg models.Message
+	err := db.MessagesCollection.FindOne(ctx,
+		filter,
+		options.FindOne().SetProjection(bson.M{"_id": 1, "chatid": 1, "sender": 1}),
+	).Decode(&msg)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("janitor: reference lookup %s failed: %v", name, err)
+		}
+		return nil
+	}
+	return &msg
+}
+
+// thumbWidthSuffix is the "_<width>" of sized thumbnails (see filemgr.ThumbWidths) or the
+// "_anim"/"_blur" of animated and blurred previews.
+var thumbWidthSuffix = regexp.MustCompile(`_(\d+|anim|blur)$`)
+
+// sweepUploadFiles garbage-collects the chat upload folders on disk: files older than grace
+// with no attachment row are removed unless a message still references them, in which case
+// a row is backfilled so the janitor tracks them from then on. Thumbnails and posters go with
+// the file they were generated from. It returns how many files were removed.
+func sweepUploadFiles(ctx context.Context, grace time.Duration) (int, error) {
+	root := filepath.Dir(filemgr.ResolvePath(filemgr.EntityChat, filemgr.PicPhoto))
+	thumbs := filemgr.ResolvePath(filemgr.EntityChat, filemgr.PicThumb)
+	cutoff := time.Now().Add(-grace)
+
+	removed, scanned := 0, 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() && strings.HasSuffix(d.Name(), "_hls") {
+			return sweepHLSDir(ctx, path, d, cutoff, &removed)
+		}
+		if d.IsDir() || scanned >= uploadScanLimit {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		name := d.Name()
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		inThumbs := filepath.Dir(path) == thumbs
+		if inThumbs {
+			base = thumbWidthSuffix.ReplaceAllString(base, "")
+		}
+		// <base>.webp/.avif and the thumbnails <base>.jpg, <base>_<width>.jpg belong to <base>.<ext>
+		n, err := db.AttachmentsCollection.CountDocuments(ctx,
+			bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(base) + `\.`}},
+			options.Count().SetLimit(1))
+		if err != nil || n > 0 {
+			return nil // tracked rows are the janitor's job
+		}
+		// only untracked files count, so a pass is not used up by tracked ones and the
+		// untracked files sorting after them are still reached
+		scanned++
+		if !inThumbs {
+			if owner := referencingMessage(ctx, "", name); owner != nil {
+				if _, err := db.AttachmentsCollection.InsertOne(ctx, models.Attachment{
+					ChatID:     owner.ChatID,
+					UploaderID: owner.UserID,
+					Name:       name,
+					Path:       path,
+					Size:       info.Size(),
+					MessageID:  &owner.ID,
+					CreatedAt:  info.ModTime(),
+				}); err != nil {
+					log.Printf("janitor: backfill %s failed: %v", name, err)
+				} else {
+					chargeQuota(ctx, owner.UserID, info.Size(), 1)
+				}
+				return nil
+			}
+		}
+
+		if err := filemgr.DeleteFile(path); err != nil {
+			log.Printf("janitor: delete %s failed: %v", path, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// sweepHLSDir keeps a video's HLS folder while the video is tracked and removes it once it
+// is orphaned. The walk never descends into it: segments aren't tracked individually.
+func sweepHLSDir(ctx context.Context, path string, d fs.DirEntry, cutoff time.Time, removed *int) error {
+	base := strings.TrimSuffix(d.Name(), "_hls")
+	n, err := db.AttachmentsCollection.CountDocuments(ctx,
+		bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(base) + `\.`}},
+		options.Count().SetLimit(1))
+	if err != nil || n > 0 {
+		return filepath.SkipDir
+	}
+	if info, err := d.Info(); err != nil || info.ModTime().After(cutoff) {
+		return filepath.SkipDir
+	}
+	if err := filemgr.DeleteHLS(path); err != nil {
+		log.Printf("janitor: delete %s failed: %v", path, err)
+	} else {
+		*removed++
+	}
+	return filepath.SkipDir
+}
+
+// StartAttachmentJanitor periodically removes orphaned uploads and untracked files. Run it
+// in its own goroutine.
+func StartAttachmentJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		n, err := cleanupOrphanAttachments(ctx, orphanGracePeriod)
+		if err != nil {
+			log.Println("janitor: orphan scan failed:", err)
+		} else if n > 0 {
+			log.Printf("janitor: removed %d orphaned attachments", n)
+		}
+		n, err = sweepUploadFiles(ctx, orphanGracePeriod)
+		cancel()
+		if err != nil {
+			log.Println("janitor: upload scan failed:", err)
+		} else if n > 0 {
+			log.Printf("janitor: removed %d untracked upload files", n)
+		}
+		if n, err := filemgr.SweepStaleUploads(staleUploadAge); err != nil {
+			log.Println("janitor: staged upload scan failed:", err)
+		} else if n > 0 {
+			log.Printf("janitor: removed %d abandoned resumable uploads", n)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Minute)
+		if n, err := pruneUploadReservations(ctx, time.Now().Add(-staleUploadAge)); err != nil {
+			log.Println("janitor: upload reservation prune failed:", err)
+		} else if n > 0 {
+			log.Printf("janitor: released %d reservations of vanished uploads", n)
+		}
+		cancel()
+	}
+}
+
+// GetAttachmentURL redirects a participant to a chat upload: a short-lived presigned link when
+// the chat entity is stored in object storage, otherwise a signed ServeAttachment link.
+func GetAttachmentURL(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	n, err := db.MereCollection.CountDocuments(ctx, bson.M{"chatid": chatID, "participants": user}, options.Count().SetLimit(1))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		writeErr(w, "not found or access denied", http.StatusNotFound)
+		return
+	}
+
+	var a models.Attachment
+	if err := db.AttachmentsCollection.FindOne(ctx, bson.M{"chatid": chatID, "name": ps.ByName("name")}).Decode(&a); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "attachment not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !filemgr.IsRemote(filemgr.EntityChat) {
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(attachmentLinkTTL.Seconds()/2)))
+		http.Redirect(w, r, signedAttachmentURL(chatID, a.Name, user), http.StatusFound)
+		return
+	}
+	url, err := filemgr.FileURL(ctx, a.Path, mediaURLTTL)
+	if err != nil {
+		log.Printf("attachment url %s failed: %v", a.Path, err)
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(mediaURLTTL.Seconds()/2)))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// GetOrphanAttachments is the admin dry-run report: it lists what the janitor would remove.
+func GetOrphanAttachments(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	orphans, err := findOrphanAttachments(r.Context(), orphanGracePeriod)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var totalBytes int64
+	for _, a := range orphans {
+		totalBytes += a.Size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"dryRun":      true,
+		"count":       len(orphans),
+		"totalBytes":  totalBytes,
+		"attachments": orphans,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// CleanupOrphanAttachments runs one janitor pass on demand.
+func CleanupOrphanAttachments(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	n, err := cleanupOrphanAttachments(r.Context(), orphanGracePeriod)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"removed": n,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,221 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/middleware"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const botUserPrefix = "bot_"
+
+var commandRe = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+
+// isBotUser reports whether a chat identity belongs to a bot account.
+func isBotUser(userID string) bool {
+	return strings.HasPrefix(userID, botUserPrefix)
+}
+
+// RegisterBot creates a bot owned by the caller and returns its API token once.
+func RegisterBot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	var body struct {
+		Name        string   `json:"name"`
+		Commands    []string `json:"commands"`
+		CallbackURL string   `json:"callbackUrl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeErr(w, "name required", http.StatusBadRequest)
+		return
+	}
+	commands := make([]string, 0, len(body.Commands))
+	for _, c := range body.Commands {
+		c = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c), "/"))
+		if !commandRe.MatchString(c) {
+			writeErr(w, "invalid command: "+c, http.StatusBadRequest)
+			return
+		}
+		commands = append(commands, c)
+	}
+	if body.CallbackURL != "" {
+		if err := validateWebhookURL(body.CallbackURL); err != nil {
+			writeErr(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if len(commands) > 0 {
+		writeErr(w, "callbackUrl required to handle commands", http.StatusBadRequest)
+		return
+	}
+
+	token := utils.GenerateRandomString(40)
+	bot := models.Bot{
+		UserID:      botUserPrefix + utils.GenerateRandomString(12),
+		Name:        body.Name,
+		OwnerID:     user,
+		TokenHash:   middleware.HashBotToken(token),
+		Commands:    commands,
+		CallbackURL: body.CallbackURL,
+		CreatedAt:   time.Now(),
+	}
+	res, err := db.BotsCollection.InsertOne(ctx, bot)
+	if err != nil {
+		writeErr(w, "failed to create bot", http.StatusInternalServerError)
+		return
+	}
+	bot.ID = res.InsertedID.(primitive.ObjectID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"bot":   bot,
+		"token": token,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListBots returns the bots owned by the caller.
+func ListBots(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	cursor, err := db.BotsCollection.Find(ctx, bson.M{"owner": user})
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var bots []models.Bot
+	if err := cursor.All(ctx, &bots); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bots == nil {
+		bots = make([]models.Bot, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(bots); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// AddBotToChat lets a chat admin add a bot as a participant.
+func AddBotToChat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		BotUserID string `json:"botId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if !isBotUser(body.BotUserID) || db.BotsCollection.FindOne(ctx, bson.M{"userid": body.BotUserID}).Err() != nil {
+		writeErr(w, "bot not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID},
+		bson.M{
+			"$addToSet": bson.M{"participants": body.BotUserID},
+			"$set":      bson.M{"updatedAt": time.Now(), "joinedAt." + body.BotUserID: time.Now()},
+		},
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !utils.Contains(chat.Participants, body.BotUserID) {
+		chat.Participants = append(chat.Participants, body.BotUserID)
+		refreshSummaryMembers(ctx, &chat)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseSlashCommand splits "/cmd rest of line" into its lowercased command and arguments.
+func parseSlashCommand(content string) (string, string, bool) {
+	if !strings.HasPrefix(content, "/") {
+		return "", "", false
+	}
+	cmd, args, _ := strings.Cut(content[1:], " ")
+	cmd = strings.ToLower(cmd)
+	if !commandRe.MatchString(cmd) {
+		return "", "", false
+	}
+	return cmd, strings.TrimSpace(args), true
+}
+
+// dispatchCommand delivers a slash command to every bot in the chat subscribed to it.
+// The payload is signed like a webhook, keyed with the hex SHA-256 of the bot's token.
+func dispatchCommand(chat models.Chat, msg models.Message, cmd, args string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := db.BotsCollection.Find(ctx, bson.M{
+		"userid":   bson.M{"$in": chat.Participants},
+		"commands": cmd,
+	})
+	if err != nil {
+		log.Printf("commands: bot lookup failed (%s): %v", chat.ChatID, err)
+		return
+	}
+	var bots []models.Bot
+	if err := cursor.All(ctx, &bots); err != nil || len(bots) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type":    "command",
+		"chatid":  chat.ChatID,
+		"command": cmd,
+		"args":    args,
+		"message": msg,
+	})
+	if err != nil {
+		return
+	}
+	for _, b := range bots {
+		if b.CallbackURL == "" {
+			continue
+		}
+		deliverWebhook(ctx, models.Webhook{ID: b.ID, URL: b.CallbackURL, Secret: b.TokenHash}, body)
+	}
+}
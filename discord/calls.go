@@ -0,0 +1,210 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxSignalSize = 64 << 10 // SDP blobs are a few KB; anything bigger is not a real offer
+
+// handleCallSignal relays WebRTC signaling between the participants of a chat and records
+// the call's lifecycle. Frames for chats or calls the sender is not part of are dropped.
+func handleCallSignal(ctx context.Context, client *Client, in models.IncomingWSMessage) {
+	userID := client.UserID
+	if len(in.SDP) > maxSignalSize || len(in.Candidate) > maxSignalSize {
+		log.Printf("WS call signal too large (%s)", userID)
+		client.reject(in, errCodeValidation, "signal is too large", nil)
+		return
+	}
+
+	if in.Type == "call_offer" {
+		startCall(ctx, client, in)
+		return
+	}
+
+	callID, err := primitive.ObjectIDFromHex(in.CallID)
+	if err != nil {
+		client.reject(in, errCodeValidation, "invalid callId", map[string]string{"field": "callId"})
+		return
+	}
+	var call models.Call
+	if err := db.CallsCollection.FindOne(ctx, bson.M{"_id": callID}).Decode(&call); err != nil {
+		client.reject(in, errCodeCallNotFound, "call not found", nil)
+		return
+	}
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": call.ChatID, "participants": userID}).Decode(&chat); err != nil {
+		log.Printf("WS call signal from non-participant (%s): %s", userID, in.CallID)
+		client.reject(in, errCodeCallNotFound, "call not found", nil)
+		return
+	}
+	if call.Status != models.CallRinging && call.Status != models.CallActive {
+		client.reject(in, errCodeCallNotFound, "call has ended", nil)
+		return
+	}
+
+	// the caller's signals go to whoever answered (everyone else while ringing);
+	// everyone else's go to the caller
+	peers := []string{call.Caller}
+	if userID == call.Caller {
+		peers = otherParticipants(&chat, userID)
+		if call.Answerer != "" {
+			peers = []string{call.Answerer}
+		}
+	}
+
+	frame := map[string]interface{}{
+		"type":   in.Type,
+		"callId": in.CallID,
+		"chatid": call.ChatID,
+		"from":   userID,
+	}
+	switch in.Type {
+	case "call_answer":
+		if userID == call.Caller || !answerCall(ctx, &call, userID) {
+			return
+		}
+		frame["sdp"] = in.SDP
+		// other callees' devices stop ringing
+		sendToUsers(subtract(otherParticipants(&chat, call.Caller), []string{userID}), map[string]interface{}{
+			"type": "call_end", "callId": in.CallID, "chatid": call.ChatID, "from": userID, "reason": "answered_elsewhere",
+		})
+	case "ice_candidate":
+		frame["candidate"] = in.Candidate
+	case "call_end":
+		endCall(ctx, &call, userID, in.Reason)
+		peers = otherParticipants(&chat, userID)
+		frame["reason"] = in.Reason
+	}
+	sendToUsers(peers, frame)
+}
+
+// startCall records a ringing call and rings the other participants.
+func startCall(ctx context.Context, client *Client, in models.IncomingWSMessage) {
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": in.ChatID, "participants": client.UserID}).Decode(&chat); err != nil {
+		log.Printf("WS call offer to foreign chat (%s): %s", client.UserID, in.ChatID)
+		client.reject(in, errCodeChatNotFound, "chat not found", nil)
+		return
+	}
+	callType := in.CallType
+	if callType != "video" {
+		callType = "audio"
+	}
+	call := models.Call{
+		ChatID:    chat.ChatID,
+		Caller:    client.UserID,
+		Type:      callType,
+		Status:    models.CallRinging,
+		StartedAt: time.Now(),
+	}
+	res, err := db.CallsCollection.InsertOne(ctx, call)
+	if err != nil {
+		log.Printf("WS call record failed (%s): %v", client.UserID, err)
+		return
+	}
+	callID := res.InsertedID.(primitive.ObjectID).Hex()
+
+	// the caller learns the call id to tag its candidates with
+	client.send(map[string]interface{}{
+		"type":     "call_started",
+		"callId":   callID,
+		"chatid":   chat.ChatID,
+		"clientId": in.ClientID,
+	})
+	sendToUsers(otherParticipants(&chat, client.UserID), map[string]interface{}{
+		"type":     "call_offer",
+		"callId":   callID,
+		"chatid":   chat.ChatID,
+		"from":     client.UserID,
+		"callType": callType,
+		"sdp":      in.SDP,
+	})
+}
+
+// answerCall moves a ringing call to active; false if someone else answered first.
+func answerCall(ctx context.Context, call *models.Call, user string) bool {
+	now := time.Now()
+	res, err := db.CallsCollection.UpdateOne(ctx,
+		bson.M{"_id": call.ID, "status": models.CallRinging},
+		bson.M{"$set": bson.M{"status": models.CallActive, "answerer": user, "answeredAt": now}},
+	)
+	return err == nil && res.ModifiedCount == 1
+}
+
+// endCall closes the call record, classifying unanswered calls as missed or rejected.
+func endCall(ctx context.Context, call *models.Call, user, reason string) {
+	now := time.Now()
+	set := bson.M{"endedAt": now}
+	switch {
+	case call.Status == models.CallActive:
+		set["status"] = models.CallEnded
+		if call.AnsweredAt != nil {
+			set["duration"] = int64(now.Sub(*call.AnsweredAt).Seconds())
+		}
+	case reason == "rejected" && user != call.Caller:
+		set["status"] = models.CallRejected
+	default:
+		set["status"] = models.CallMissed
+	}
+	if _, err := db.CallsCollection.UpdateOne(ctx,
+		bson.M{"_id": call.ID, "status": call.Status},
+		bson.M{"$set": set},
+	); err != nil {
+		log.Printf("WS call end failed (%s): %v", call.ID.Hex(), err)
+	}
+}
+
+func otherParticipants(chat *models.Chat, user string) []string {
+	return subtract(chat.Participants, []string{user})
+}
+
+// GetChatCalls lists a chat's recent calls, newest first.
+func GetChatCalls(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	cursor, err := db.CallsCollection.Find(ctx, bson.M{"chatid": chatID},
+		options.Find().SetSort(bson.D{{Key: "startedAt", Value: -1}}).SetLimit(50))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var calls []models.Call
+	if err := cursor.All(ctx, &calls); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if calls == nil {
+		calls = make([]models.Call, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(calls); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,88 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"naevis/filemgr"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// uploadCapability describes what a client may upload for one picture type.
+type uploadCapability struct {
+	MaxBytes   int64    `json:"maxBytes"`
+	Extensions []string `json:"extensions"`
+	MIMETypes  []string `json:"mimeTypes"`
+}
+
+// enabledFeatures lists the optional features this deployment has configured, plus the
+// ones every server offers.
+func enabledFeatures() []string {
+	features := []string{
+		"threads", "mentions", "link_previews", "drafts", "tasks", "events",
+		"payments", "locations", "stickers", "gifs", "calls", "invites", "join_requests", "reports",
+		"composer_activity",
+	}
+	optional := []struct {
+		name    string
+		enabled bool
+	}{
+		{"translation", translationProvider != nil},
+		{"transcription", transcriptionProvider != nil},
+		{"push", pushProvider != nil},
+		{"external_search", externalSearch != nil},
+		{"compliance", complianceTarget != nil},
+		{"emoji_shortcodes", normalizeEmoji},
+	}
+	for _, f := range optional {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+// GetCapabilities advertises server features and limits so clients can adapt their UI and
+// pre-validate input. Upload limits are for chat attachments unless ?entity= names another
+// entity type; an optional ?tenant= query applies that tenant's upload overrides.
+func GetCapabilities(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tenant := r.URL.Query().Get("tenant")
+	entity := filemgr.EntityType(r.URL.Query().Get("entity"))
+	if entity == "" {
+		entity = filemgr.EntityChat
+	}
+
+	uploads := make(map[filemgr.PictureType]uploadCapability)
+	for picType, size := range filemgr.UploadLimitsFor(entity, tenant) {
+		uploads[picType] = uploadCapability{
+			MaxBytes:   size,
+			Extensions: filemgr.AllowedExtensions[picType],
+			MIMETypes:  filemgr.AllowedMIMEs[picType],
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"uploads":  uploads,
+		"region":   localRegion,
+		"readOnly": serviceReadOnly(),
+		"features": enabledFeatures(),
+		"limits": map[string]interface{}{
+			"maxMessageBytes": maxMessageLen,
+			"maxParticipants": maxParticipants,
+			"maxDraftBytes":   maxDraftLen,
+			"maxCustomEmojis": maxCustomEmojis,
+			"maxStickers":     maxStickersPerPack,
+			"maxGIFBytes":     maxGIFBytes,
+		},
+		"ws": map[string]interface{}{
+			"protocolVersions": wsProtocolVersions,
+			"encodings":        wsEncodings,
+			"capabilities":     serverCapabilities,
+		},
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
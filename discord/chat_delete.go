@@ -0,0 +1,105 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// chatOwner is the chat's creator, who StartNewChat makes the first admin.
+func chatOwner(chat *models.Chat) string {
+	if len(chat.Admins) == 0 {
+		return ""
+	}
+	return chat.Admins[0]
+}
+
+// DeleteChat removes a chat for everyone. Only its owner, or its last remaining participant,
+// may do so.
+func DeleteChat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if chatOwner(&chat) != user && len(chat.Participants) > 1 {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := deleteChat(ctx, &chat); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendToUsers(chat.Participants, map[string]interface{}{
+		"type":   "chat_deleted",
+		"chatid": chatID,
+		"by":     user,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteChat drops the chat and its per-user rows and soft-deletes its messages. Uploaded
+// files are removed in the background.
+func deleteChat(ctx context.Context, chat *models.Chat) error {
+	if _, err := db.MereCollection.DeleteOne(ctx, bson.M{"chatid": chat.ChatID}); err != nil {
+		return err
+	}
+	if _, err := db.MessagesCollection.UpdateMany(ctx,
+		bson.M{"chatid": chat.ChatID, "deleted": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"deleted": true, "deletedAt": time.Now()}},
+	); err != nil {
+		log.Printf("chat delete: messages of %s: %v", chat.ChatID, err)
+	}
+	for _, coll := range []*mongo.Collection{db.MembershipsCollection, db.ChatUserStateCollection, db.JoinRequestsCollection, db.InvitesCollection} {
+		if _, err := coll.DeleteMany(ctx, bson.M{"chatid": chat.ChatID}); err != nil {
+			log.Printf("chat delete: %s of %s: %v", coll.Name(), chat.ChatID, err)
+		}
+	}
+	go deleteChatAttachments(chat.ChatID)
+	return nil
+}
+
+// deleteChatAttachments removes every file uploaded to a deleted chat and its audit row.
+func deleteChatAttachments(chatID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	cursor, err := db.AttachmentsCollection.Find(ctx, bson.M{"chatid": chatID})
+	if err != nil {
+		log.Printf("chat delete: attachments of %s: %v", chatID, err)
+		return
+	}
+	var attachments []models.Attachment
+	if err := cursor.All(ctx, &attachments); err != nil {
+		log.Printf("chat delete: attachments of %s: %v", chatID, err)
+		return
+	}
+
+	removed := 0
+	for _, a := range attachments {
+		if _, err := releaseAttachment(ctx, a); err != nil {
+			log.Printf("chat delete: release %s failed: %v", a.Path, err)
+			continue
+		}
+		removed++
+	}
+	log.Printf("chat delete: removed %d/%d attachments of %s", removed, len(attachments), chatID)
+}
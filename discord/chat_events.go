@@ -0,0 +1,251 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxEventTitleLen = 200
+	maxEventLength   = 30 * 24 * time.Hour
+)
+
+// CreateChatEvent posts a calendar event participants can RSVP to.
+func CreateChatEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	var ev models.CalendarEvent
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	ev.Title = strings.TrimSpace(ev.Title)
+	switch {
+	case ev.Title == "" || len([]rune(ev.Title)) > maxEventTitleLen:
+		writeErr(w, "title required (max 200 characters)", http.StatusBadRequest)
+		return
+	case ev.Start.IsZero():
+		writeErr(w, "start required", http.StatusBadRequest)
+		return
+	}
+	if ev.End.IsZero() {
+		ev.End = ev.Start.Add(time.Hour)
+	}
+	if !ev.End.After(ev.Start) || ev.End.Sub(ev.Start) > maxEventLength {
+		writeErr(w, "end must be after start and within 30 days of it", http.StatusBadRequest)
+		return
+	}
+	ev.RSVPs = map[string]string{user: models.RSVPYes} // the organiser attends
+
+	msg, err := buildMessage(chatID, user, ev.Title, "", "")
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg.Kind, msg.Event = models.KindEvent, &ev
+	if _, err := insertMessage(ctx, msg); err != nil {
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
+		return
+	}
+	sendToUsers(chat.Participants, messagePayload(msg))
+	go pushOffline(chat, *msg)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RSVPChatEvent records the caller's response and broadcasts the new tally.
+func RSVPChatEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Response string `json:"response"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Response != models.RSVPYes && body.Response != models.RSVPNo && body.Response != models.RSVPMaybe {
+		writeErr(w, "response must be yes, no or maybe", http.StatusBadRequest)
+		return
+	}
+	if strings.ContainsAny(user, ".$") { // used as a document key below
+		writeErr(w, "invalid user", http.StatusBadRequest)
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var msg models.Message
+	err = db.MessagesCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": msgID, "chatid": chatID, "kind": models.KindEvent, "deleted": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"event.rsvps." + user: body.Response}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		writeErr(w, "event not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	counts := msg.Event.RSVPCounts()
+	sendToUsers(chat.Participants, map[string]interface{}{
+		"type":     "rsvp",
+		"id":       msg.ID.Hex(),
+		"chatid":   chatID,
+		"user":     user,
+		"response": body.Response,
+		"counts":   counts,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"rsvps":  msg.Event.RSVPs,
+		"counts": counts,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ExportChatEventICS serves an event as an iCalendar file for adding to a calendar app.
+func ExportChatEventICS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var msg models.Message
+	if err := db.MessagesCollection.FindOne(ctx, bson.M{"_id": msgID, "chatid": chatID, "kind": models.KindEvent}).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "event not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="event-`+msg.ID.Hex()+`.ics"`)
+	_, _ = w.Write([]byte(eventICS(&msg)))
+}
+
+// eventICS renders a single-event VCALENDAR (RFC 5545) with CRLF line endings.
+func eventICS(msg *models.Message) string {
+	const stamp = "20060102T150405Z"
+	ev := msg.Event
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//merechats//chat events//EN",
+		"BEGIN:VEVENT",
+		"UID:" + msg.ID.Hex() + "@merechats",
+		"DTSTAMP:" + msg.CreatedAt.UTC().Format(stamp),
+		"DTSTART:" + ev.Start.UTC().Format(stamp),
+		"DTEND:" + ev.End.UTC().Format(stamp),
+		"SUMMARY:" + icsEscape(ev.Title),
+	}
+	if ev.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+icsEscape(ev.Description))
+	}
+	if ev.Location != "" {
+		lines = append(lines, "LOCATION:"+icsEscape(ev.Location))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(icsFold(l))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icsEscape(s string) string {
+	return icsEscaper.Replace(s)
+}
+
+// icsFold wraps content lines at 75 octets without splitting UTF-8 sequences.
+func icsFold(line string) string {
+	if len(line) <= 75 {
+		return line
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	return b.String()
+}
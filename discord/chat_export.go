@@ -0,0 +1,334 @@
+package discord
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const jobKindChatExport = "chat_export"
+
+func init() {
+	jobRunners[jobKindChatExport] = runChatExport
+}
+
+// exportFormats maps a requested format to its file extension.
+var exportFormats = map[string]string{"json": "json", "csv": "csv", "html": "html"}
+
+// RequestChatExport starts an export of a chat's message history, as far back as the caller can
+// see, in JSON, CSV or a self-contained HTML transcript. Media is referenced by URL. The
+// result is fetched through the job's signed download link; one export runs per user at a time.
+func RequestChatExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var body struct {
+		Format string `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Format == "" {
+		body.Format = "json"
+	}
+	if _, ok := exportFormats[body.Format]; !ok {
+		writeErr(w, "format must be json, csv or html", http.StatusBadRequest)
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkResidency(&chat); err != nil {
+		writeResidencyErr(w, &chat)
+		return
+	}
+
+	var active models.Job
+	err := db.JobsCollection.FindOne(ctx, bson.M{
+		"userid": user,
+		"kind":   jobKindChatExport,
+		"status": bson.M{"$in": bson.A{models.JobPending, models.JobRunning}},
+	}).Decode(&active)
+	if err == nil {
+		writeErrCode(w, http.StatusConflict, errCodeJobInProgress, "a job is already in progress", active)
+		return
+	}
+
+	job, err := startJob(ctx, jobKindChatExport, user, map[string]string{"chatid": chatID, "format": body.Format})
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/merechats/jobs/"+job.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// exportRow is one message as it appears in an export.
+type exportRow struct {
+	ID         string        `json:"id"`
+	Seq        int64         `json:"seq,omitempty"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	Sender     string        `json:"sender"`
+	SenderName string        `json:"senderName,omitempty"`
+	Content    string        `json:"content,omitempty"`
+	Media      *models.Media `json:"media,omitempty"`
+	ReplyTo    string        `json:"replyTo,omitempty"`
+	EditedAt   *time.Time    `json:"editedAt,omitempty"`
+}
+
+// exportWriter emits rows in one format; begin and end frame the document.
+type exportWriter interface {
+	begin(chat *models.Chat) error
+	row(r exportRow) error
+	end() error
+}
+
+// runChatExport reloads the chat of an export job, still as one of its participants.
+func runChatExport(ctx context.Context, job *models.Job, report func(int)) ([]models.JobPart, error) {
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": job.Params["chatid"], "participants": job.UserID}).Decode(&chat); err != nil {
+		return nil, err
+	}
+	return buildChatExport(ctx, job, &chat, job.Params["format"], report)
+}
+
+// buildChatExport streams the chat's visible messages, oldest first, into a single file.
+func buildChatExport(ctx context.Context, job *models.Job, chat *models.Chat, format string, report func(int)) ([]models.JobPart, error) {
+	if err := os.MkdirAll(takeoutDir, 0o700); err != nil {
+		return nil, err
+	}
+	filter := bson.M{"chatid": chat.ChatID, "deleted": bson.M{"$ne": true}}
+	applyHistoryFloor(filter, chat, job.UserID)
+
+	total, err := db.MessagesCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	names := exportNames(ctx, chat.Participants)
+
+	name := fmt.Sprintf("chat-%s.%s", chat.ChatID, exportFormats[format])
+	path := filepath.Join(takeoutDir, job.ID.Hex()+"-"+name)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	parts := []models.JobPart{{Name: name, Path: path}}
+	defer f.Close()
+
+	var out exportWriter
+	switch format {
+	case "csv":
+		out = &csvExport{w: csv.NewWriter(f)}
+	case "html":
+		out = &htmlExport{w: f}
+	default:
+		out = &jsonExport{w: f}
+	}
+	if err := out.begin(chat); err != nil {
+		return parts, err
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return parts, err
+	}
+	defer cursor.Close(ctx)
+	var done int64
+	for cursor.Next(ctx) {
+		var m models.Message
+		if err := cursor.Decode(&m); err != nil {
+			return parts, err
+		}
+		row := exportRow{
+			ID:         m.ID.Hex(),
+			Seq:        m.Seq,
+			CreatedAt:  m.CreatedAt,
+			Sender:     m.UserID,
+			SenderName: names[m.UserID],
+			Content:    m.Content,
+			Media:      m.Media,
+			EditedAt:   m.EditedAt,
+		}
+		if m.ReplyTo != nil {
+			row.ReplyTo = m.ReplyTo.Hex()
+		}
+		if err := out.row(row); err != nil {
+			return parts, err
+		}
+		if done++; done%1000 == 0 && total > 0 {
+			report(int(done * 99 / total))
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return parts, err
+	}
+	if err := out.end(); err != nil {
+		return parts, err
+	}
+	if err := f.Close(); err != nil {
+		return parts, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		parts[0].Size = info.Size()
+	}
+	return parts, nil
+}
+
+// exportNames maps participants to display names, falling back to usernames.
+func exportNames(ctx context.Context, users []string) map[string]string {
+	names := make(map[string]string, len(users))
+	cursor, err := db.UsersCollection.Find(ctx,
+		bson.M{"userid": bson.M{"$in": users}},
+		options.Find().SetProjection(bson.M{"_id": 0, "userid": 1, "username": 1, "name": 1}),
+	)
+	if err != nil {
+		return names
+	}
+	var profiles []chatMember
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return names
+	}
+	for _, p := range profiles {
+		names[p.UserID] = p.Name
+		if p.Name == "" {
+			names[p.UserID] = p.Username
+		}
+	}
+	return names
+}
+
+// jsonExport writes {"chat": ..., "messages": [...]}.
+type jsonExport struct {
+	w     io.Writer
+	first bool
+}
+
+func (e *jsonExport) begin(chat *models.Chat) error {
+	head, err := json.Marshal(map[string]interface{}{
+		"chatid":       chat.ChatID,
+		"participants": chat.Participants,
+		"createdAt":    chat.CreatedAt,
+		"exportedAt":   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	e.first = true
+	_, err = fmt.Fprintf(e.w, "{\"chat\":%s,\"messages\":[\n", head)
+	return err
+}
+
+func (e *jsonExport) row(r exportRow) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if !e.first {
+		if _, err := io.WriteString(e.w, ",\n"); err != nil {
+			return err
+		}
+	}
+	e.first = false
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonExport) end() error {
+	_, err := io.WriteString(e.w, "\n]}\n")
+	return err
+}
+
+// csvExport writes one message per line with a header row.
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) begin(*models.Chat) error {
+	return e.w.Write([]string{"id", "seq", "createdAt", "sender", "senderName", "content", "mediaType", "mediaUrl", "replyTo", "editedAt"})
+}
+
+func (e *csvExport) row(r exportRow) error {
+	var mediaType, mediaURL, edited, seq string
+	if r.Media != nil {
+		mediaType, mediaURL = r.Media.Type, r.Media.URL
+	}
+	if r.EditedAt != nil {
+		edited = r.EditedAt.UTC().Format(time.RFC3339)
+	}
+	if r.Seq != 0 {
+		seq = fmt.Sprint(r.Seq)
+	}
+	return e.w.Write([]string{r.ID, seq, r.CreatedAt.UTC().Format(time.RFC3339), r.Sender, r.SenderName, r.Content, mediaType, mediaURL, r.ReplyTo, edited})
+}
+
+func (e *csvExport) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// htmlExport writes a transcript that opens offline: styles are inline and media is linked.
+type htmlExport struct {
+	w io.Writer
+}
+
+var exportHTML = template.Must(template.New("head").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Chat {{.ChatID}}</title>
+<style>
+body{font-family:system-ui,sans-serif;max-width:760px;margin:2em auto;color:#222}
+.m{padding:.5em 0;border-bottom:1px solid #eee}.who{font-weight:600}.at{color:#888;font-size:.85em;margin-left:.5em}
+.body{white-space:pre-wrap;margin-top:.25em}.media a{font-size:.9em}
+</style></head><body>
+<h1>Chat {{.ChatID}}</h1>
+`))
+
+var exportHTMLRow = template.Must(template.New("row").Parse(`<div class="m" id="m-{{.ID}}">
+<span class="who">{{if .SenderName}}{{.SenderName}}{{else}}{{.Sender}}{{end}}</span><span class="at">{{.CreatedAt.UTC.Format "2006-01-02 15:04"}}{{if .EditedAt}} (edited){{end}}</span>
+{{if .ReplyTo}}<div class="at">in reply to <a href="#m-{{.ReplyTo}}">a message</a></div>{{end}}
+{{if .Content}}<div class="body">{{.Content}}</div>{{end}}
+{{if .Media}}{{if .Media.URL}}<div class="media"><a href="{{.Media.URL}}">{{.Media.Type}} attachment</a></div>{{end}}{{end}}
+</div>
+`))
+
+func (e *htmlExport) begin(chat *models.Chat) error {
+	return exportHTML.Execute(e.w, chat)
+}
+
+func (e *htmlExport) row(r exportRow) error {
+	return exportHTMLRow.Execute(e.w, r)
+}
+
+func (e *htmlExport) end() error {
+	_, err := io.WriteString(e.w, "</body></html>\n")
+	return err
+}
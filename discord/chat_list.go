@@ -0,0 +1,117 @@
+package discord
+
+import (
+	"context"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// chatMember is the public profile of a participant shown in the chat list.
+type chatMember struct {
+	UserID   string `bson:"userid"   json:"userid"`
+	Username string `bson:"username" json:"username,omitempty"`
+	Name     string `bson:"name"     json:"name,omitempty"`
+	Avatar   string `bson:"avatar"   json:"avatar,omitempty"`
+
+	NameWarning *nameWarning `bson:"-" json:"nameWarning,omitempty"` // possible impersonation
+}
+
+// chatListItem is a chat together with what a chat list needs to render it.
+type chatListItem struct {
+	models.Chat `bson:",inline"`
+
+	LastMessage *models.Message `bson:"-"      json:"lastMessage,omitempty"` // from the summary; content is a snippet
+	Unread      int64           `bson:"unread" json:"unread"`
+	Members     []chatMember    `bson:"-"      json:"members"` // other participants, from the summary
+
+	State *models.ChatUserState `bson:"state" json:"state,omitempty"` // the caller's archive/pin/label
+}
+
+// chatListPipeline pages the user's chats, pinned ones first and then by recent activity,
+// and joins, per chat, the user's list state and unread count (from the read watermark with
+// messageSeqs, else by scanning readBy). The newest message and member profiles come from
+// the chat's summary. filter narrows the list by that state.
+func chatListPipeline(user, filter string, skip, limit int64) mongo.Pipeline {
+	visible := bson.D{
+		{Key: "$expr", Value: bson.M{"$eq": bson.A{"$chatid", "$$cid"}}},
+		{Key: "deleted", Value: bson.M{"$ne": true}},
+	}
+	byState := bson.M{}
+	switch filter {
+	case chatFilterArchived:
+		byState["state.archived"] = true
+	case chatFilterActive:
+		byState["state.archived"] = bson.M{"$ne": true}
+	case chatFilterPinned:
+		byState["state.pinnedToTop"] = true
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"participants": user}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": db.ChatUserStateCollection.Name(),
+			"let":  bson.M{"cid": "$chatid"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$chatid", "$$cid"}},
+					bson.M{"$eq": bson.A{"$userid", user}},
+				}}}},
+				bson.M{"$project": bson.M{"_id": 0}},
+			},
+			"as": "state",
+		}}},
+		{{Key: "$addFields", Value: bson.M{"state": bson.M{"$first": "$state"}}}},
+		{{Key: "$match", Value: byState}},
+		{{Key: "$sort", Value: bson.D{{Key: "state.pinnedToTop", Value: -1}, {Key: "updatedAt", Value: -1}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+	}
+	if messageSeqs {
+		return append(pipeline, watermarkUnreadStages(user)...)
+	}
+	return append(pipeline,
+		bson.D{{Key: "$lookup", Value: bson.M{
+			"from": db.MessagesCollection.Name(),
+			"let":  bson.M{"cid": "$chatid"},
+			"pipeline": bson.A{
+				bson.M{"$match": append(visible,
+					bson.E{Key: "sender", Value: bson.M{"$ne": user}},
+					bson.E{Key: "readBy", Value: bson.M{"$ne": user}},
+				)},
+				bson.M{"$count": "n"},
+			},
+			"as": "unread",
+		}}},
+		bson.D{{Key: "$addFields", Value: bson.M{
+			"unread": bson.M{"$ifNull": bson.A{bson.M{"$first": "$unread.n"}, 0}},
+		}}},
+	)
+}
+
+// fillFromSummary sets the list fields derived from the chat's summary, rebuilding the
+// summary first for chats that predate it.
+func (item *chatListItem) fillFromSummary(ctx context.Context, viewer string) {
+	summary := item.Summary
+	if summary == nil || summary.Members == nil {
+		summary = rebuildChatSummary(ctx, &item.Chat)
+		item.Summary = summary
+	}
+	if summary.LastAt != nil {
+		item.LastMessage = &models.Message{
+			ID:        summary.LastMessageID,
+			ChatID:    item.ChatID,
+			UserID:    summary.LastSender,
+			Content:   summary.LastSnippet,
+			CreatedAt: *summary.LastAt,
+		}
+	}
+	item.Members = make([]chatMember, 0, len(summary.Members))
+	for _, m := range summary.Members {
+		if m.UserID != viewer {
+			item.Members = append(item.Members, chatMember{UserID: m.UserID, Username: m.Username, Name: m.Name, Avatar: m.Avatar})
+		}
+	}
+}
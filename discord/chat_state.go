@@ -0,0 +1,102 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxCustomLabelLen = 40
+
+// Chat list filters accepted by GetUserChats
+const (
+	chatFilterArchived = "archived"
+	chatFilterActive   = "active"
+	chatFilterPinned   = "pinned"
+)
+
+// UpdateChatState archives, pins or labels a chat for the caller. Omitted fields are kept;
+// an empty customLabel clears it.
+func UpdateChatState(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var body struct {
+		Archived    *bool   `json:"archived"`
+		PinnedToTop *bool   `json:"pinnedToTop"`
+		CustomLabel *string `json:"customLabel"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	set := bson.M{"updatedAt": time.Now()}
+	unset := bson.M{}
+	if body.Archived != nil {
+		set["archived"] = *body.Archived
+	}
+	if body.PinnedToTop != nil {
+		set["pinnedToTop"] = *body.PinnedToTop
+	}
+	if body.CustomLabel != nil {
+		label := strings.TrimSpace(*body.CustomLabel)
+		if len([]rune(label)) > maxCustomLabelLen {
+			writeErr(w, "customLabel too long", http.StatusBadRequest)
+			return
+		}
+		if label == "" {
+			unset["customLabel"] = ""
+		} else {
+			set["customLabel"] = label
+		}
+	}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"chatid": chatID, "userid": user},
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	var state models.ChatUserState
+	if err := db.ChatUserStateCollection.FindOneAndUpdate(ctx,
+		bson.M{"chatid": chatID, "userid": user},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&state); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// keep the user's other devices' chat lists in step
+	sendToUsers([]string{user}, map[string]interface{}{
+		"type":  "chat_state",
+		"state": state,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
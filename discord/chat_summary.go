@@ -0,0 +1,138 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	summarySnippetLen = 100
+	// summaryMembers is how many profiles a summary keeps; one more than a list shows so
+	// dropping the viewer still leaves enough.
+	summaryMembers = 6
+)
+
+// messageSnippet is the one-line text a chat list shows for a message.
+func messageSnippet(msg *models.Message) string {
+	text := msg.Content
+	if text == "" && msg.Media != nil {
+		text = "Sent an attachment"
+	}
+	if r := []rune(text); len(r) > summarySnippetLen {
+		text = string(r[:summarySnippetLen]) + "…"
+	}
+	return text
+}
+
+// messageSeqs turns on seq-on-write (MESSAGE_SEQ=1). Enable it only after the
+// merechats-migrate readby-to-seq backfill has numbered existing messages.
+var messageSeqs = os.Getenv("MESSAGE_SEQ") == "1"
+
+// summaryOnInsert is the chat update that records msg as the newest message and, with
+// messageSeqs, takes the chat's next seq.
+func summaryOnInsert(msg *models.Message) bson.M {
+	at := msg.CreatedAt
+	inc := bson.M{"summary.messageCount": 1}
+	if messageSeqs {
+		inc["lastSeq"] = 1
+	}
+	return bson.M{
+		"$set": bson.M{
+			"updatedAt":             time.Now(),
+			"summary.lastMessageId": msg.ID,
+			"summary.lastSnippet":   messageSnippet(msg),
+			"summary.lastSender":    msg.UserID,
+			"summary.lastAt":        &at,
+		},
+		"$inc": inc,
+	}
+}
+
+// memberPreviews loads the public profiles of the chat's first participants.
+func memberPreviews(ctx context.Context, participants []string) []models.MemberPreview {
+	ids := participants
+	if len(ids) > summaryMembers {
+		ids = ids[:summaryMembers]
+	}
+	previews := make([]models.MemberPreview, 0, len(ids))
+	cursor, err := db.UsersCollection.Find(ctx,
+		bson.M{"userid": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"_id": 0, "userid": 1, "username": 1, "name": 1, "avatar": 1}),
+	)
+	if err != nil {
+		log.Printf("summary: profiles lookup failed: %v", err)
+		return previews
+	}
+	if err := cursor.All(ctx, &previews); err != nil {
+		log.Printf("summary: profiles lookup failed: %v", err)
+	}
+	return previews
+}
+
+// refreshSummaryMembers rewrites the participant part of a chat's summary after members
+// join or leave. chat.Participants must already reflect the change.
+func refreshSummaryMembers(ctx context.Context, chat *models.Chat) {
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chat.ChatID},
+		bson.M{"$set": bson.M{
+			"summary.participantCount": len(chat.Participants),
+			"summary.members":          memberPreviews(ctx, chat.Participants),
+		}},
+	); err != nil {
+		log.Printf("summary: members of %s: %v", chat.ChatID, err)
+	}
+}
+
+// rebuildChatSummary recomputes a chat's summary from its messages and participants. It
+// backfills chats created before summaries existed and repairs the last-message fields when
+// that message is edited or deleted.
+func rebuildChatSummary(ctx context.Context, chat *models.Chat) *models.ChatSummary {
+	visible := bson.M{"chatid": chat.ChatID, "deleted": bson.M{"$ne": true}}
+	summary := &models.ChatSummary{
+		ParticipantCount: len(chat.Participants),
+		Members:          memberPreviews(ctx, chat.Participants),
+	}
+
+	var last models.Message
+	if err := db.MessagesCollection.FindOne(ctx, visible,
+		options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}),
+	).Decode(&last); err == nil {
+		at := last.CreatedAt
+		summary.LastMessageID = last.ID
+		summary.LastSnippet = messageSnippet(&last)
+		summary.LastSender = last.UserID
+		summary.LastAt = &at
+	}
+	n, err := db.MessagesCollection.CountDocuments(ctx, visible)
+	if err != nil {
+		log.Printf("summary: count for %s: %v", chat.ChatID, err)
+	}
+	summary.MessageCount = n
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chat.ChatID},
+		bson.M{"$set": bson.M{"summary": summary}},
+	); err != nil {
+		log.Printf("summary: rebuild %s: %v", chat.ChatID, err)
+	}
+	return summary
+}
+
+func init() {
+	// an edit or delete of the newest message changes what the list shows
+	onMessageChange(func(ctx context.Context, msg *models.Message) {
+		var chat models.Chat
+		if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": msg.ChatID, "summary.lastMessageId": msg.ID}).Decode(&chat); err != nil {
+			return
+		}
+		rebuildChatSummary(ctx, &chat)
+	})
+}
@@ -0,0 +1,353 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// complianceSchema versions the archived record format. Each archived object is
+// newline-delimited JSON, one complianceRecord per line:
+//
+//	{"schema":"merechats.compliance/v1","event":"message.created","tenant":"...","chatid":"...",
+//	 "messageid":"...","sender":"...","content":"...","media":{...},"at":"RFC3339"}
+//
+// event is one of message.created, message.edited or message.deleted. Objects are never
+// rewritten: each flush writes a new key tenant/YYYY/MM/DD/<unixnano>-<instance>.jsonl under
+// an object-lock retention so records cannot be altered or removed before it lapses.
+const complianceSchema = "merechats.compliance/v1"
+
+const (
+	complianceFlushEvery = 10 * time.Second
+	complianceBatchSize  = 500
+	complianceClaim      = 2 * time.Minute // a flush that has not acked by then is retried elsewhere
+)
+
+type complianceRecord struct {
+	Schema    string        `bson:"schema"            json:"schema"`
+	Event     string        `bson:"event"             json:"event"`
+	Tenant    string        `bson:"tenant"            json:"tenant"`
+	ChatID    string        `bson:"chatid"            json:"chatid"`
+	MessageID string        `bson:"messageid"         json:"messageid"`
+	Sender    string        `bson:"sender"            json:"sender"`
+	Content   string        `bson:"content,omitempty" json:"content,omitempty"`
+	Media     *models.Media `bson:"media,omitempty"   json:"media,omitempty"`
+	At        time.Time     `bson:"at"                json:"at"`
+}
+
+// complianceQueued is a record in the compliance queue. It stays there until the target
+// has stored it, so events survive restarts and outages of the target.
+type complianceQueued struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	Record       complianceRecord   `bson:"record"`
+	Retention    int                `bson:"retention"` // days; not archived
+	Claim        string             `bson:"claim,omitempty"`
+	ClaimedUntil time.Time          `bson:"claimedUntil"` // zero while unclaimed
+}
+
+// wormTarget stores immutable objects that cannot be changed before retainUntil.
+type wormTarget interface {
+	Put(ctx context.Context, key string, body []byte, retainUntil time.Time) error
+}
+
+var (
+	tenantKeyRe = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+	// complianceTenants maps tenant (chat entity id) => retention in days, from
+	// COMPLIANCE_TENANTS="tenant=days,...". Chats of other tenants are not archived.
+	complianceTenants = parseComplianceTenants(os.Getenv("COMPLIANCE_TENANTS"))
+
+	complianceTarget wormTarget = newS3WormTarget()
+)
+
+func parseComplianceTenants(raw string) map[string]int {
+	out := make(map[string]int)
+	for _, pair := range strings.Split(raw, ",") {
+		tenant, days, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(strings.TrimSpace(days))
+		if ok && tenant != "" && err == nil && n > 0 {
+			out[strings.TrimSpace(tenant)] = n
+		}
+	}
+	return out
+}
+
+// recordCompliance queues a message event for archiving if the chat's tenant opted in.
+func recordCompliance(ctx context.Context, event string, msg *models.Message) {
+	if complianceTarget == nil || len(complianceTenants) == 0 {
+		return
+	}
+	var chat struct {
+		EntityID string `bson:"entityid"`
+	}
+	err := db.MereCollection.FindOne(ctx,
+		bson.M{"chatid": msg.ChatID},
+		options.FindOne().SetProjection(bson.M{"entityid": 1}),
+	).Decode(&chat)
+	if err != nil {
+		log.Printf("compliance: tenant lookup failed (%s): %v", msg.ChatID, err)
+		return
+	}
+	days, ok := complianceTenants[chat.EntityID]
+	if !ok {
+		return
+	}
+
+	rec := complianceRecord{
+		Schema:    complianceSchema,
+		Event:     event,
+		Tenant:    chat.EntityID,
+		ChatID:    msg.ChatID,
+		MessageID: msg.ID.Hex(),
+		Sender:    msg.UserID,
+		At:        time.Now().UTC(),
+	}
+	if event != "message.deleted" {
+		rec.Content, rec.Media = msg.Content, msg.Media
+	}
+	if _, err := db.ComplianceCollection.InsertOne(ctx, complianceQueued{Record: rec, Retention: days}); err != nil {
+		log.Printf("compliance: queue %s %s failed: %v", event, rec.MessageID, err)
+	}
+}
+
+// StartComplianceExporter flushes queued events to the WORM target. Run it in its own goroutine.
+func StartComplianceExporter() {
+	if complianceTarget == nil || len(complianceTenants) == 0 {
+		return
+	}
+	log.Printf("compliance: archiving %d tenants", len(complianceTenants))
+	ticker := time.NewTicker(complianceFlushEvery)
+	for range ticker.C {
+		FlushCompliance()
+	}
+}
+
+// FlushCompliance writes queued events, one object per tenant and batch, and removes them
+// from the queue once the target has acked them. Failed batches stay queued and are
+// retried on the next tick.
+func FlushCompliance() {
+	if complianceTarget == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	queued, err := claimComplianceBatch(ctx)
+	if err != nil {
+		log.Printf("compliance: claim failed: %v", err)
+		return
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	byTenant := make(map[string][]complianceQueued)
+	for _, q := range queued {
+		byTenant[q.Record.Tenant] = append(byTenant[q.Record.Tenant], q)
+	}
+	for tenant, list := range byTenant {
+		for start := 0; start < len(list); start += complianceBatchSize {
+			batch := list[start:min(start+complianceBatchSize, len(list))]
+			ids := make([]primitive.ObjectID, len(batch))
+			for i, q := range batch {
+				ids[i] = q.ID
+			}
+			if err := putComplianceBatch(ctx, tenant, batch); err != nil {
+				log.Printf("compliance: write for %s failed: %v", tenant, err)
+				_, _ = db.ComplianceCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}},
+					bson.M{"$set": bson.M{"claimedUntil": time.Time{}}, "$unset": bson.M{"claim": ""}})
+				continue
+			}
+			if _, err := db.ComplianceCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+				// archived again after the claim lapses; the target keeps both copies
+				log.Printf("compliance: dequeue for %s failed: %v", tenant, err)
+			}
+		}
+	}
+}
+
+// claimComplianceBatch leases the oldest queued events to this flush, so instances
+// flushing at the same time archive each event once.
+func claimComplianceBatch(ctx context.Context) ([]complianceQueued, error) {
+	now := time.Now()
+	cursor, err := db.ComplianceCollection.Find(ctx,
+		bson.M{"claimedUntil": bson.M{"$lt": now}},
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(complianceBatchSize*4).SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var due []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &due); err != nil || len(due) == 0 {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(due))
+	for i, d := range due {
+		ids[i] = d.ID
+	}
+
+	claim := instanceID + "-" + primitive.NewObjectID().Hex()
+	if _, err := db.ComplianceCollection.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "claimedUntil": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"claim": claim, "claimedUntil": now.Add(complianceClaim)}},
+	); err != nil {
+		return nil, err
+	}
+	cursor, err = db.ComplianceCollection.Find(ctx, bson.M{"claim": claim}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var claimed []complianceQueued
+	err = cursor.All(ctx, &claimed)
+	return claimed, err
+}
+
+func putComplianceBatch(ctx context.Context, tenant string, batch []complianceQueued) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, q := range batch {
+		if err := enc.Encode(q.Record); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s/%s/%d-%s.jsonl", tenantKeyRe.ReplaceAllString(tenant, "_"), now.Format("2006/01/02"), now.UnixNano(), instanceID)
+	retainUntil := now.AddDate(0, 0, batch[0].Retention)
+	return complianceTarget.Put(ctx, key, buf.Bytes(), retainUntil)
+}
+
+// s3WormTarget writes to an S3 bucket with Object Lock enabled, in COMPLIANCE mode.
+// Configured by COMPLIANCE_S3_ENDPOINT (e.g. https://s3.eu-west-1.amazonaws.com),
+// COMPLIANCE_S3_BUCKET, COMPLIANCE_S3_REGION, COMPLIANCE_S3_ACCESS_KEY and COMPLIANCE_S3_SECRET_KEY.
+type s3WormTarget struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3WormTarget returns nil when the bucket is not configured.
+func newS3WormTarget() wormTarget {
+	endpoint, err := url.Parse(os.Getenv("COMPLIANCE_S3_ENDPOINT"))
+	bucket := os.Getenv("COMPLIANCE_S3_BUCKET")
+	if err != nil || endpoint.Host == "" || bucket == "" {
+		return nil
+	}
+	return &s3WormTarget{
+		endpoint:  endpoint,
+		bucket:    bucket,
+		region:    envOr("COMPLIANCE_S3_REGION", "us-east-1"),
+		accessKey: os.Getenv("COMPLIANCE_S3_ACCESS_KEY"),
+		secretKey: os.Getenv("COMPLIANCE_S3_SECRET_KEY"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *s3WormTarget) Put(ctx context.Context, key string, body []byte, retainUntil time.Time) error {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:])) // required with object lock
+	req.Header.Set("x-amz-object-lock-mode", "COMPLIANCE")
+	req.Header.Set("x-amz-object-lock-retain-until-date", retainUntil.UTC().Format(time.RFC3339))
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 put %s: %d %s", key, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering every header set so far.
+func (s *s3WormTarget) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	names := []string{"host"}
+	for k := range req.Header {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		v := req.Host
+		if n != "host" {
+			v = strings.TrimSpace(req.Header.Get(n))
+		}
+		canonicalHeaders.WriteString(n + ":" + v + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
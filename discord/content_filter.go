@@ -0,0 +1,229 @@
+package discord
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Content filter strictness, set per chat by its admins; "" means standard
+const (
+	FilterOff      = "off"
+	FilterStandard = "standard"
+	FilterStrict   = "strict"
+)
+
+// contentRejection is returned when a filter refuses a message. Code is stable for clients
+// to switch on; Reason is for humans.
+type contentRejection struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func (e *contentRejection) Error() string { return "content_rejected: " + e.Code }
+
+// contentFilter inspects outgoing message text. Check returns nil to let it through.
+type contentFilter interface {
+	Check(chat *models.Chat, sender, content, level string) *contentRejection
+}
+
+// contentFilters run in order on every user message; the first rejection wins.
+var contentFilters []contentFilter
+
+// registerContentFilter adds a filter to the chain. Call it from init.
+func registerContentFilter(f contentFilter) {
+	contentFilters = append(contentFilters, f)
+}
+
+// filterContent runs the chat's filters over content. System messages are never filtered.
+func filterContent(chat *models.Chat, sender, content string) error {
+	level := chat.ContentFilter
+	if level == "" {
+		level = FilterStandard
+	}
+	if level == FilterOff || sender == systemSender || content == "" {
+		return nil
+	}
+	for _, f := range contentFilters {
+		if rej := f.Check(chat, sender, content, level); rej != nil {
+			return rej
+		}
+	}
+	return nil
+}
+
+// filterMessage runs the filters of msg's chat over its text, including an event card's
+// description and location. storeMessage calls it so no send path skips the filters.
+func filterMessage(ctx context.Context, msg *models.Message) error {
+	text := msg.Content
+	if msg.Event != nil {
+		text = strings.Join([]string{text, msg.Event.Description, msg.Event.Location}, "\n")
+	}
+	if msg.UserID == systemSender || strings.TrimSpace(text) == "" {
+		return nil
+	}
+	var chat models.Chat
+	err := db.MereCollection.FindOne(ctx,
+		bson.M{"chatid": msg.ChatID},
+		options.FindOne().SetProjection(bson.M{"chatid": 1, "contentFilter": 1, "joinedAt": 1}),
+	).Decode(&chat)
+	if err != nil {
+		return err
+	}
+	return filterContent(&chat, msg.UserID, text)
+}
+
+// asRejection reports whether err is a content filter rejection.
+func asRejection(err error) (*contentRejection, bool) {
+	var rej *contentRejection
+	ok := errors.As(err, &rej)
+	return rej, ok
+}
+
+// writeRejection answers a REST send or edit refused by a filter.
+func writeRejection(w http.ResponseWriter, rej *contentRejection) {
+	writeErrCode(w, http.StatusUnprocessableEntity, errCodeContentRejected, rej.Reason, rejectionDetails(rej))
+}
+
+// rejectionDetails names the rule that refused the content.
+func rejectionDetails(rej *contentRejection) map[string]string {
+	return map[string]string{"rule": rej.Code}
+}
+
+// wordlistFilter rejects blocked words from CONTENT_WORDLIST_FILE (one per line, "#"
+// comments). Standard matches whole words; strict also matches inside longer words.
+type wordlistFilter struct {
+	words []string
+}
+
+func loadWordlist(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("content filter: wordlist %s: %v", path, err)
+		return nil
+	}
+	defer f.Close()
+
+	var words []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		w := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if w != "" && !strings.HasPrefix(w, "#") {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+func (f wordlistFilter) Check(_ *models.Chat, _, content, level string) *contentRejection {
+	lower := strings.ToLower(content)
+	tokens := strings.FieldsFunc(lower, func(r rune) bool {
+		return !(r == '\'' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 127)
+	})
+	for _, w := range f.words {
+		if level == FilterStrict && strings.Contains(lower, w) {
+			return &contentRejection{Code: "blocked_word", Reason: "message contains a blocked word"}
+		}
+		if utils.Contains(tokens, w) {
+			return &contentRejection{Code: "blocked_word", Reason: "message contains a blocked word"}
+		}
+	}
+	return nil
+}
+
+// linkSpamFilter limits links per message. In strict chats members who joined recently may
+// not post links at all, the common pattern of join-and-spam accounts.
+type linkSpamFilter struct{}
+
+const (
+	maxLinksStandard = 5
+	maxLinksStrict   = 2
+	newMemberWindow  = 10 * time.Minute
+)
+
+func (linkSpamFilter) Check(chat *models.Chat, sender, content, level string) *contentRejection {
+	links := linkRe.FindAllString(content, -1)
+	if len(links) == 0 {
+		return nil
+	}
+	limit := maxLinksStandard
+	if level == FilterStrict {
+		limit = maxLinksStrict
+		if joined, ok := chat.JoinedAt[sender]; ok && time.Since(joined) < newMemberWindow {
+			return &contentRejection{Code: "link_new_member", Reason: "new members can't post links yet"}
+		}
+	}
+	if len(links) > limit {
+		return &contentRejection{Code: "link_spam", Reason: "too many links in one message"}
+	}
+	return nil
+}
+
+func init() {
+	if path := os.Getenv("CONTENT_WORDLIST_FILE"); path != "" {
+		if words := loadWordlist(path); len(words) > 0 {
+			registerContentFilter(wordlistFilter{words: words})
+			log.Printf("content filter: %d blocked words", len(words))
+		}
+	}
+	registerContentFilter(linkSpamFilter{})
+}
+
+// SetContentFilter lets a chat admin choose how strictly messages are filtered.
+func SetContentFilter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	switch body.Level {
+	case FilterOff, FilterStandard, FilterStrict:
+	default:
+		writeErr(w, "level must be off, standard or strict", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID},
+		bson.M{"$set": bson.M{"contentFilter": body.Level, "updatedAt": time.Now()}},
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,173 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordDeadLetter stores an event a delivery path gave up on. It never fails the caller;
+// if even this write fails the event is only logged.
+func recordDeadLetter(ctx context.Context, dl models.DeadLetter) {
+	dl.CreatedAt = time.Now()
+	if _, err := db.DeadLettersCollection.InsertOne(ctx, dl); err != nil {
+		log.Printf("dead letter lost (%s %s): %v; payload=%s", dl.Kind, dl.Reason, err, dl.Payload)
+	}
+}
+
+// deadLetterBroadcast records a fan-out publish that failed.
+func deadLetterBroadcast(users []string, payload interface{}, reason error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	recordDeadLetter(ctx, models.DeadLetter{
+		Kind:     models.DeadLetterBroadcast,
+		Users:    users,
+		Payload:  string(body),
+		Reason:   reason.Error(),
+		Attempts: 1,
+	})
+}
+
+// replayDeadLetter redelivers one dead letter through its original path, once.
+func replayDeadLetter(ctx context.Context, dl *models.DeadLetter) error {
+	switch dl.Kind {
+	case models.DeadLetterBroadcast:
+		return broadcaster.Publish(dl.Users, json.RawMessage(dl.Payload))
+	case models.DeadLetterPush:
+		if pushProvider == nil {
+			return errors.New("push is not configured")
+		}
+		var n pushNotification
+		if err := json.Unmarshal([]byte(dl.Payload), &n); err != nil {
+			return err
+		}
+		return pushProvider.Send(ctx, n)
+	case models.DeadLetterWebhook:
+		hook, err := webhookForReplay(ctx, dl.WebhookID)
+		if err != nil {
+			return err
+		}
+		return sendWebhook(ctx, hook, []byte(dl.Payload), 1)
+	}
+	return errors.New("unknown dead letter kind")
+}
+
+// webhookForReplay resolves the current URL and secret of a chat webhook or bot callback.
+func webhookForReplay(ctx context.Context, id primitive.ObjectID) (models.Webhook, error) {
+	var hook models.Webhook
+	err := db.WebhooksCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&hook)
+	if err == nil {
+		return hook, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return hook, err
+	}
+	var bot models.Bot
+	if err := db.BotsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&bot); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return hook, errors.New("webhook no longer exists")
+		}
+		return hook, err
+	}
+	if bot.CallbackURL == "" {
+		return hook, errors.New("bot has no callback url")
+	}
+	return models.Webhook{ID: bot.ID, URL: bot.CallbackURL, Secret: bot.TokenHash}, nil
+}
+
+// ListDeadLetters lists dead letters, newest first. ?kind= filters by delivery path and
+// ?pending=1 hides ones already replayed successfully.
+func ListDeadLetters(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	filter := bson.M{}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+	if r.URL.Query().Get("pending") == "1" {
+		filter["replayedAt"] = bson.M{"$exists": false}
+	}
+
+	cursor, err := db.DeadLettersCollection.Find(ctx, filter,
+		options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(500))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var letters []models.DeadLetter
+	if err := cursor.All(ctx, &letters); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if letters == nil {
+		letters = make([]models.DeadLetter, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(letters); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ReplayDeadLetter redelivers a dead letter. Replays are recorded on the letter; a failed
+// replay answers 502 with the delivery error and can be retried.
+func ReplayDeadLetter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		writeErr(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var dl models.DeadLetter
+	if err := db.DeadLettersCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&dl); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	replayErr := replayDeadLetter(ctx, &dl)
+	update := bson.M{"$inc": bson.M{"replayCount": 1}}
+	if replayErr != nil {
+		update["$set"] = bson.M{"lastError": replayErr.Error()}
+	} else {
+		update["$set"] = bson.M{"replayedAt": time.Now()}
+		update["$unset"] = bson.M{"lastError": ""}
+	}
+	if err := db.DeadLettersCollection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&dl); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if replayErr != nil {
+		writeErr(w, "replay failed: "+replayErr.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("dead letter %s replayed (%s)", id.Hex(), dl.Kind)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dl); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
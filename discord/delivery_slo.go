@@ -0,0 +1,161 @@
+package discord
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Delivery SLO: the time from a message being stored to it being written to a recipient's
+// socket, sampled on the writer goroutines of this instance.
+var (
+	deliverySampleRate = envFloat("DELIVERY_SLO_SAMPLE", 0.1)                                    // fraction of writes sampled
+	deliveryP95Target  = time.Duration(envFloat("DELIVERY_SLO_P95_MS", 500)) * time.Millisecond  // alert when p95 exceeds this
+	deliveryP99Target  = time.Duration(envFloat("DELIVERY_SLO_P99_MS", 2000)) * time.Millisecond // alert when p99 exceeds this
+)
+
+const (
+	deliveryWindow     = 5 * time.Minute // percentiles cover samples this recent
+	deliveryMaxSamples = 4096            // ring size; older samples are overwritten
+	deliveryMinSamples = 50              // fewer samples than this never alert
+)
+
+type deliverySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+var deliverySamples = struct {
+	sync.Mutex
+	ring []deliverySample
+	next int
+}{ring: make([]deliverySample, 0, deliveryMaxSamples)}
+
+// DeliveryStats is a snapshot of the rolling delivery latency.
+type DeliveryStats struct {
+	Samples  int           `json:"samples"`
+	P50      time.Duration `json:"p50Nanos"`
+	P95      time.Duration `json:"p95Nanos"`
+	P99      time.Duration `json:"p99Nanos"`
+	Max      time.Duration `json:"maxNanos"`
+	Breached bool          `json:"breached"` // p95 or p99 is over its target
+}
+
+// DeliveryAlert is passed to alert hooks when the SLO starts or stops being breached.
+type DeliveryAlert struct {
+	Breached bool
+	Stats    DeliveryStats
+}
+
+var deliveryAlertHooks = struct {
+	sync.RWMutex
+	fns []func(DeliveryAlert)
+}{}
+
+// OnDeliveryAlert registers a hook run when the delivery SLO is breached or recovers, e.g. to
+// page an operator. Hooks run on the monitor goroutine and should not block.
+func OnDeliveryAlert(fn func(DeliveryAlert)) {
+	deliveryAlertHooks.Lock()
+	deliveryAlertHooks.fns = append(deliveryAlertHooks.fns, fn)
+	deliveryAlertHooks.Unlock()
+}
+
+func init() {
+	OnDeliveryAlert(func(a DeliveryAlert) {
+		if a.Breached {
+			log.Printf("🚨 delivery SLO breached: p95=%v p99=%v over %d samples", a.Stats.P95, a.Stats.P99, a.Stats.Samples)
+			return
+		}
+		log.Printf("delivery SLO recovered: p95=%v p99=%v", a.Stats.P95, a.Stats.P99)
+	})
+}
+
+// sampleDelivery records how long ago a message event written to a socket was stored. Only
+// "message" events are measured, and only a deliverySampleRate fraction of them.
+func sampleDelivery(event interface{}) {
+	if rand.Float64() >= deliverySampleRate {
+		return
+	}
+	var stored time.Time
+	switch ev := event.(type) {
+	case map[string]interface{}:
+		if ev["type"] != "message" {
+			return
+		}
+		stored, _ = ev["createdAt"].(time.Time)
+	case json.RawMessage: // relayed through the redis fan-out
+		var head struct {
+			Type      string    `json:"type"`
+			CreatedAt time.Time `json:"createdAt"`
+		}
+		if json.Unmarshal(ev, &head) != nil || head.Type != "message" {
+			return
+		}
+		stored = head.CreatedAt
+	}
+	if stored.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	s := deliverySample{at: now, latency: now.Sub(stored)}
+	deliverySamples.Lock()
+	if len(deliverySamples.ring) < deliveryMaxSamples {
+		deliverySamples.ring = append(deliverySamples.ring, s)
+	} else {
+		deliverySamples.ring[deliverySamples.next] = s
+	}
+	deliverySamples.next = (deliverySamples.next + 1) % deliveryMaxSamples
+	deliverySamples.Unlock()
+}
+
+// deliveryStats computes percentiles over the samples inside deliveryWindow.
+func deliveryStats() DeliveryStats {
+	cutoff := time.Now().Add(-deliveryWindow)
+	deliverySamples.Lock()
+	latencies := make([]time.Duration, 0, len(deliverySamples.ring))
+	for _, s := range deliverySamples.ring {
+		if s.at.After(cutoff) {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	deliverySamples.Unlock()
+
+	stats := DeliveryStats{Samples: len(latencies)}
+	if len(latencies) == 0 {
+		return stats
+	}
+	slices.Sort(latencies)
+	pct := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	stats.P50, stats.P95, stats.P99 = pct(0.50), pct(0.95), pct(0.99)
+	stats.Max = latencies[len(latencies)-1]
+	stats.Breached = stats.Samples >= deliveryMinSamples &&
+		(stats.P95 > deliveryP95Target || stats.P99 > deliveryP99Target)
+	return stats
+}
+
+// StartDeliveryMonitor evaluates the delivery SLO on an interval and runs the alert hooks
+// when it starts or stops being breached. Run it in its own goroutine.
+func StartDeliveryMonitor(interval time.Duration) {
+	breached := false
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		stats := deliveryStats()
+		if stats.Breached == breached {
+			continue
+		}
+		breached = stats.Breached
+
+		deliveryAlertHooks.RLock()
+		fns := deliveryAlertHooks.fns
+		deliveryAlertHooks.RUnlock()
+		for _, fn := range fns {
+			fn(DeliveryAlert{Breached: breached, Stats: stats})
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxDraftLen = 16 << 10
+
+// GetDraft returns the caller's saved draft for a chat, or an empty draft.
+func GetDraft(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var m models.Membership
+	err := db.MembershipsCollection.FindOne(ctx, bson.M{"chatid": chatID, "userid": user}).Decode(&m)
+	if err != nil && err != mongo.ErrNoDocuments {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	draft := m.Draft
+	if draft == nil {
+		draft = &models.Draft{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(draft); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// SaveDraft stores (or with empty content clears) the caller's draft for a chat and tells the
+// caller's other devices. deviceId identifies the editing device so it is not echoed back.
+func SaveDraft(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var body struct {
+		Content  string `json:"content"`
+		DeviceID string `json:"deviceId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Content) > maxDraftLen {
+		writeErr(w, "draft too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	draft := models.Draft{Content: body.Content, DeviceID: body.DeviceID, UpdatedAt: now}
+	update := bson.M{"$set": bson.M{"draft": draft, "updatedAt": now}}
+	if strings.TrimSpace(body.Content) == "" {
+		draft = models.Draft{UpdatedAt: now}
+		update = bson.M{"$unset": bson.M{"draft": ""}, "$set": bson.M{"updatedAt": now}}
+	}
+	if _, err := db.MembershipsCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID, "userid": user},
+		update,
+		options.Update().SetUpsert(true),
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendToOtherDevices(user, body.DeviceID, map[string]interface{}{
+		"type":      "draft_updated",
+		"chatid":    chatID,
+		"content":   draft.Content,
+		"updatedAt": draft.UpdatedAt,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,192 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	shortcodeRe     = regexp.MustCompile(`:([a-z0-9_+\-]{1,32}):`)
+	emojiCodeRe     = regexp.MustCompile(`^[a-z0-9_+\-]{1,32}$`)
+	maxCustomEmojis = 200
+
+	// normalizeEmoji turns standard shortcodes into unicode when messages are stored;
+	// disable with EMOJI_SHORTCODES=false to keep content verbatim.
+	normalizeEmoji = true
+
+	// emojiHosts are the https hosts custom emoji may be linked from besides our own
+	// uploads (EMOJI_HOSTS=cdn.example.com,emoji.example.org).
+	emojiHosts = parseEmojiHosts(os.Getenv("EMOJI_HOSTS"))
+)
+
+func parseEmojiHosts(raw string) map[string]bool {
+	out := make(map[string]bool)
+	for _, h := range strings.Split(raw, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			out[h] = true
+		}
+	}
+	return out
+}
+
+// validEmojiURL accepts a chat or sticker upload path, or an https URL on an EMOJI_HOSTS host.
+func validEmojiURL(raw string) bool {
+	if strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "static/") {
+		if strings.Contains(raw, "..") || strings.Contains(raw, "\\") {
+			return false
+		}
+		_, entity, ok := filemgr.StorageKey(strings.TrimPrefix(raw, "/"))
+		return ok && (entity == filemgr.EntityChat || entity == filemgr.EntitySticker)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	return emojiHosts[strings.ToLower(u.Hostname())]
+}
+
+// standardEmoji maps the common shortcodes to their unicode form.
+var standardEmoji = map[string]string{
+	"smile":                 "😄",
+	"smiley":                "😃",
+	"grin":                  "😁",
+	"joy":                   "😂",
+	"laughing":              "😆",
+	"wink":                  "😉",
+	"blush":                 "😊",
+	"heart_eyes":            "😍",
+	"kissing_heart":         "😘",
+	"thinking":              "🤔",
+	"neutral_face":          "😐",
+	"unamused":              "😒",
+	"sweat_smile":           "😅",
+	"cry":                   "😢",
+	"sob":                   "😭",
+	"angry":                 "😠",
+	"rage":                  "😡",
+	"scream":                "😱",
+	"sunglasses":            "😎",
+	"sleeping":              "😴",
+	"upside_down_face":      "🙃",
+	"slightly_smiling_face": "🙂",
+	"heart":                 "❤️",
+	"broken_heart":          "💔",
+	"fire":                  "🔥",
+	"sparkles":              "✨",
+	"star":                  "⭐",
+	"tada":                  "🎉",
+	"rocket":                "🚀",
+	"eyes":                  "👀",
+	"wave":                  "👋",
+	"clap":                  "👏",
+	"pray":                  "🙏",
+	"muscle":                "💪",
+	"ok_hand":               "👌",
+	"+1":                    "👍",
+	"thumbsup":              "👍",
+	"-1":                    "👎",
+	"thumbsdown":            "👎",
+	"100":                   "💯",
+	"white_check_mark":      "✅",
+	"x":                     "❌",
+	"warning":               "⚠️",
+	"question":              "❓",
+	"coffee":                "☕",
+	"pizza":                 "🍕",
+	"beers":                 "🍻",
+	"sun":                   "☀️",
+	"moon":                  "🌙",
+	"zap":                   "⚡",
+}
+
+func init() {
+	if v, err := strconv.ParseBool(os.Getenv("EMOJI_SHORTCODES")); err == nil {
+		normalizeEmoji = v
+	}
+}
+
+// normalizeShortcodes replaces standard :shortcodes: with unicode. Codes the chat defines as
+// custom emoji win over standard ones and stay as text for clients to render from the manifest.
+func normalizeShortcodes(content string, chat *models.Chat) string {
+	if !normalizeEmoji || !strings.Contains(content, ":") {
+		return content
+	}
+	return shortcodeRe.ReplaceAllStringFunc(content, func(m string) string {
+		code := m[1 : len(m)-1]
+		if _, custom := chat.CustomEmoji[code]; custom {
+			return m
+		}
+		if e, ok := standardEmoji[code]; ok {
+			return e
+		}
+		return m
+	})
+}
+
+// SetCustomEmoji lets a chat admin add, replace or (with an empty url) remove a custom emoji.
+func SetCustomEmoji(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	code := strings.ToLower(strings.Trim(ps.ByName("code"), ":"))
+	if !emojiCodeRe.MatchString(code) {
+		writeErr(w, "invalid emoji code", http.StatusBadRequest)
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	update := bson.M{"$unset": bson.M{"customEmoji." + code: ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	if body.URL != "" {
+		if _, exists := chat.CustomEmoji[code]; !exists && len(chat.CustomEmoji) >= maxCustomEmojis {
+			writeErr(w, "too many custom emoji", http.StatusBadRequest)
+			return
+		}
+		if !validEmojiURL(body.URL) {
+			writeErr(w, "emoji url must be an uploaded file or an https url on an allowed host", http.StatusBadRequest)
+			return
+		}
+		update = bson.M{"$set": bson.M{"customEmoji." + code: body.URL, "updatedAt": time.Now()}}
+	}
+	if _, err := db.MereCollection.UpdateOne(ctx, bson.M{"chatid": chatID}, update); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,83 @@
+package discord
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"naevis/models"
+	"naevis/utils"
+)
+
+var (
+	linkRe = regexp.MustCompile(`https?://[^\s<>"]+[^\s<>".,;:!?)\]]`)
+	boldRe = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	codeRe = regexp.MustCompile("`([^`\n]+)`")
+)
+
+// utf16Len is the length of s in UTF-16 code units, the unit JavaScript strings index by.
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// parseEntities annotates content with mentions, links, bold and inline code spans.
+// Offsets and lengths are UTF-16 code units into the raw content; bold and code spans cover
+// the text between the markers. Mentions only resolve to current participants or groups,
+// so the target is unambiguous even if names change later. Links and mentions inside code
+// spans are ignored.
+func parseEntities(content string, chat *models.Chat) []models.Entity {
+	if content == "" {
+		return nil
+	}
+
+	var entities []models.Entity
+	var codeSpans [][]int
+	add := func(start, end int, e models.Entity) {
+		e.Offset = utf16Len(content[:start])
+		e.Length = utf16Len(content[start:end])
+		entities = append(entities, e)
+	}
+	inCode := func(i int) bool {
+		for _, span := range codeSpans {
+			if i >= span[0] && i < span[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, m := range codeRe.FindAllStringSubmatchIndex(content, -1) {
+		codeSpans = append(codeSpans, m[:2])
+		add(m[2], m[3], models.Entity{Type: models.EntityCode})
+	}
+	for _, m := range boldRe.FindAllStringSubmatchIndex(content, -1) {
+		if !inCode(m[0]) {
+			add(m[2], m[3], models.Entity{Type: models.EntityBold})
+		}
+	}
+	for _, m := range linkRe.FindAllStringIndex(content, -1) {
+		if !inCode(m[0]) {
+			add(m[0], m[1], models.Entity{Type: models.EntityLink, URL: content[m[0]:m[1]]})
+		}
+	}
+	for _, m := range mentionRe.FindAllStringSubmatchIndex(content, -1) {
+		start := m[2] - 1 // include the "@"
+		if inCode(start) {
+			continue
+		}
+		token := content[m[2]:m[3]]
+		lower := strings.ToLower(token)
+		switch {
+		case lower == mentionAll || lower == mentionHere || lower == mentionAdmins:
+			add(start, m[3], models.Entity{Type: models.EntityMentionGroup, Group: lower})
+		case chat.Groups[lower] != nil:
+			add(start, m[3], models.Entity{Type: models.EntityMentionGroup, Group: lower})
+		case utils.Contains(chat.Participants, token):
+			add(start, m[3], models.Entity{Type: models.EntityMention, UserID: token})
+		}
+	}
+
+	sort.SliceStable(entities, func(i, j int) bool { return entities[i].Offset < entities[j].Offset })
+	return entities
+}
@@ -0,0 +1,273 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	jobKindErasure = "erasure"
+
+	erasureAnonymize = "anonymize" // keep message content, detach it from the user
+	erasureDelete    = "delete"    // blank the user's messages and delete their uploads
+
+	// erasedUser replaces the userid on anonymized content.
+	erasedUser = "deleted-user"
+)
+
+// RequestErasure removes the caller from every chat and anonymizes or deletes what they
+// authored, as a background job. It cannot be undone; callers wanting a copy first use
+// POST /merechats/takeout. Body: {"mode": "anonymize"|"delete", "confirm": true}.
+func RequestErasure(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	var body struct {
+		Mode    string `json:"mode"`
+		Confirm bool   `json:"confirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Mode != erasureAnonymize && body.Mode != erasureDelete {
+		writeErr(w, "mode must be anonymize or delete", http.StatusBadRequest)
+		return
+	}
+	if !body.Confirm {
+		writeErr(w, "erasure is irreversible; resend with confirm: true", http.StatusBadRequest)
+		return
+	}
+
+	var active models.Job
+	err := db.JobsCollection.FindOne(ctx, bson.M{
+		"userid": user,
+		"kind":   bson.M{"$in": bson.A{jobKindErasure, jobKindTakeout}},
+		"status": bson.M{"$in": bson.A{models.JobPending, models.JobRunning}},
+	}).Decode(&active)
+	if err == nil {
+		writeErrCode(w, http.StatusConflict, errCodeJobInProgress, "a job is already in progress", active)
+		return
+	}
+
+	job, err := startJob(ctx, jobKindErasure, user, map[string]string{"mode": body.Mode})
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("erasure (%s) requested by %s: job %s", body.Mode, user, job.ID.Hex())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/merechats/jobs/"+job.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func init() {
+	jobRunners[jobKindErasure] = func(ctx context.Context, job *models.Job, report func(int)) ([]models.JobPart, error) {
+		return nil, eraseUser(ctx, job, job.Params["mode"], report)
+	}
+}
+
+// eraseUser runs the erasure cascade. Every step is idempotent, so a failed job can simply
+// be requested again.
+func eraseUser(ctx context.Context, job *models.Job, mode string, report func(int)) error {
+	user := job.UserID
+
+	if err := eraseMessages(ctx, user, mode); err != nil {
+		return err
+	}
+	report(40)
+	if err := eraseUploads(ctx, user, mode); err != nil {
+		return err
+	}
+	report(60)
+	if err := leaveAllChats(ctx, user); err != nil {
+		return err
+	}
+	report(90)
+
+	// per-user rows that only describe the user
+	for _, coll := range []*mongo.Collection{db.MembershipsCollection, db.ChatUserStateCollection, db.JoinRequestsCollection, db.VerificationsCollection} {
+		if _, err := coll.DeleteMany(ctx, bson.M{"userid": user}); err != nil {
+			return err
+		}
+	}
+	forgetBadge(models.GlobalTenant, user)
+	forgetSenderProfile(ctx, user)
+	// reports stay for moderation; each gets its own placeholder to keep (messageId, reporter) unique
+	if _, err := db.ReportsCollection.UpdateMany(ctx, bson.M{"reporter": user}, bson.A{
+		bson.M{"$set": bson.M{"reporter": bson.M{"$concat": bson.A{erasedUser + ":", bson.M{"$toString": "$_id"}}}}},
+	}); err != nil {
+		return err
+	}
+
+	// earlier takeouts hold copies of the erased data
+	cursor, err := db.JobsCollection.Find(ctx, bson.M{"userid": user, "_id": bson.M{"$ne": job.ID}})
+	if err != nil {
+		return err
+	}
+	var jobs []models.Job
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		removeJobParts(ctx, j.Parts)
+	}
+	if _, err := db.JobsCollection.DeleteMany(ctx, bson.M{"userid": user, "_id": bson.M{"$ne": job.ID}}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// eraseMessages anonymizes or blanks every message the user sent and removes them from
+// receipts and thread subscriptions on everyone else's.
+func eraseMessages(ctx context.Context, user, mode string) error {
+	update := bson.M{
+		"$set":   bson.M{"sender": erasedUser},
+		"$unset": bson.M{"senderName": "", "avatarUrl": ""},
+	}
+	topic := topicMessageEdited
+	if mode == erasureDelete {
+		update["$set"] = bson.M{"sender": erasedUser, "deleted": true, "deletedAt": time.Now(), "content": ""}
+		update["$unset"] = bson.M{
+			"senderName": "", "avatarUrl": "", "media": "", "entities": "", "mentions": "",
+			"mentionGroups": "", "linkPreview": "", "quote": "", "task": "", "event": "", "payment": "", "card": "",
+		}
+		topic = topicMessageDeleted
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, bson.M{"sender": user})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var m models.Message
+		if err := cursor.Decode(&m); err != nil {
+			return err
+		}
+		var erased models.Message
+		if err := db.MessagesCollection.FindOneAndUpdate(ctx, bson.M{"_id": m.ID}, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&erased); err != nil {
+			return err
+		}
+		// derived copies (search index, previews, CDN) are replaced with the redacted message
+		propagateMessageChange(ctx, &erased, topic)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	quoteUpdate := bson.M{"$set": bson.M{"quote.sender": erasedUser}}
+	if mode == erasureDelete {
+		quoteUpdate = bson.M{"$set": bson.M{"quote.sender": erasedUser, "quote.content": ""}}
+	}
+	if _, err := db.MessagesCollection.UpdateMany(ctx, bson.M{"quote.sender": user}, quoteUpdate); err != nil {
+		return err
+	}
+
+	_, err = db.MessagesCollection.UpdateMany(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"readBy": user}, bson.M{"deliveredTo": user},
+			bson.M{"watchers": user}, bson.M{"unwatchedBy": user},
+		}},
+		bson.M{"$pull": bson.M{"readBy": user, "deliveredTo": user, "watchers": user, "unwatchedBy": user}},
+	)
+	return err
+}
+
+// eraseUploads deletes the user's files from the upload directories, or with anonymize
+// keeps them for the messages that show them and only detaches the uploader.
+func eraseUploads(ctx context.Context, user, mode string) error {
+	if mode == erasureAnonymize {
+		if _, err := db.AttachmentsCollection.UpdateMany(ctx, bson.M{"uploader": user}, bson.M{"$set": bson.M{"uploader": erasedUser}}); err != nil {
+			return err
+		}
+		_, err := db.StorageQuotasCollection.DeleteOne(ctx, bson.M{"_id": user})
+		return err
+	}
+
+	cursor, err := db.AttachmentsCollection.Find(ctx, bson.M{"uploader": user})
+	if err != nil {
+		return err
+	}
+	var uploads []models.Attachment
+	if err := cursor.All(ctx, &uploads); err != nil {
+		return err
+	}
+	for _, a := range uploads {
+		// a file someone else also uploaded stays for them
+		if _, err := releaseAttachment(ctx, a); err != nil {
+			return err
+		}
+	}
+	_, err = db.StorageQuotasCollection.DeleteOne(ctx, bson.M{"_id": user})
+	return err
+}
+
+// leaveAllChats removes the user from every chat they are in, deleting chats they were
+// the last participant of.
+func leaveAllChats(ctx context.Context, user string) error {
+	cursor, err := db.MereCollection.Find(ctx, bson.M{"participants": user})
+	if err != nil {
+		return err
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		return err
+	}
+
+	for i := range chats {
+		chat := &chats[i]
+		if len(chat.Participants) == 1 {
+			if err := deleteChat(ctx, chat); err != nil {
+				return err
+			}
+			continue
+		}
+
+		pull := bson.M{"participants": user, "admins": user}
+		for group := range chat.Groups {
+			pull["groups."+group] = user
+		}
+		if _, err := db.MereCollection.UpdateOne(ctx,
+			bson.M{"chatid": chat.ChatID},
+			bson.M{
+				"$pull":  pull,
+				"$unset": bson.M{"joinedAt." + user: "", "settings." + user: ""},
+				"$set":   bson.M{"updatedAt": time.Now()},
+			},
+		); err != nil {
+			return err
+		}
+
+		remaining := make([]string, 0, len(chat.Participants))
+		for _, p := range chat.Participants {
+			if p != user {
+				remaining = append(remaining, p)
+			}
+		}
+		chat.Participants = remaining
+		// rebuilt rather than refreshed: it may also name the user as the last sender
+		rebuildChatSummary(ctx, chat)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxExpireAfter   = 365 * 24 * time.Hour
+	expiryBatchSize  = 500
+	expiredSweepName = "expired"
+)
+
+func init() {
+	sweeps[expiredSweepName] = sweepExpiredMessages
+}
+
+// messageExpiry returns when a message sent now to chatID should disappear, or nil.
+func messageExpiry(ctx context.Context, chatID string, sentAt time.Time) *time.Time {
+	var chat struct {
+		ExpireAfter int64 `bson:"expireAfter"`
+	}
+	err := db.MereCollection.FindOne(ctx,
+		bson.M{"chatid": chatID},
+		options.FindOne().SetProjection(bson.M{"expireAfter": 1}),
+	).Decode(&chat)
+	if err != nil || chat.ExpireAfter <= 0 {
+		return nil
+	}
+	at := sentAt.Add(time.Duration(chat.ExpireAfter) * time.Second)
+	return &at
+}
+
+// sweepExpiredMessages deletes messages past their expiresAt and tells each chat which ones went.
+func sweepExpiredMessages(ctx context.Context) (int, error) {
+	cursor, err := db.MessagesCollection.Find(ctx,
+		bson.M{"expiresAt": bson.M{"$lte": time.Now()}},
+		options.Find().SetLimit(expiryBatchSize),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for i := range msgs {
+		msg := &msgs[i]
+		res, err := db.MessagesCollection.DeleteOne(ctx, bson.M{"_id": msg.ID})
+		if err != nil {
+			log.Printf("expiry: delete %s failed: %v", msg.ID.Hex(), err)
+			continue
+		}
+		if res.DeletedCount == 0 {
+			continue // another instance got it
+		}
+		removed++
+		propagateMessageChange(ctx, msg, topicMessageDeleted)
+		broadcastToChat(ctx, msg.ChatID, map[string]interface{}{
+			"type":   "message_expired",
+			"id":     msg.ID.Hex(),
+			"chatid": msg.ChatID,
+		})
+	}
+	return removed, nil
+}
+
+// StartExpirySweeper removes disappearing messages on an interval. Run it in its own goroutine.
+func StartExpirySweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		n, err := sweepExpiredMessages(ctx)
+		cancel()
+		if err != nil {
+			log.Println("expiry: sweep failed:", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("expiry: removed %d messages", n)
+		}
+	}
+}
+
+// SetChatExpiry lets a chat admin turn disappearing messages on (expireAfter in seconds) or off (0).
+// It applies to messages sent afterwards.
+func SetChatExpiry(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		ExpireAfter int64 `json:"expireAfter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.ExpireAfter < 0 || time.Duration(body.ExpireAfter)*time.Second > maxExpireAfter {
+		writeErr(w, "invalid expireAfter", http.StatusBadRequest)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"expireAfter": body.ExpireAfter, "updatedAt": time.Now()}}
+	if body.ExpireAfter == 0 {
+		update = bson.M{"$unset": bson.M{"expireAfter": ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	}
+	if _, err := db.MereCollection.UpdateOne(ctx, bson.M{"chatid": chatID}, update); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+
+	"naevis/rdx"
+	"naevis/utils"
+)
+
+const fanoutChannel = "merechats-fanout"
+
+// Broadcaster delivers WS payloads to users wherever their socket lives.
+// A nil users slice means every connected user.
+type Broadcaster interface {
+	Publish(users []string, payload interface{}) error
+}
+
+// broadcaster is the active backend; local-only until SetupBroadcaster says otherwise.
+var broadcaster Broadcaster = localBroadcaster{}
+
+// instanceID tags envelopes so logs can tell which node published them.
+var instanceID = utils.GetUUID()
+
+// SetupBroadcaster selects the fan-out backend ("local" or "redis") and starts any subscribers.
+// An empty backend falls back to the BROADCAST_BACKEND environment variable.
+func SetupBroadcaster(backend string) {
+	if backend == "" {
+		backend = os.Getenv("BROADCAST_BACKEND")
+	}
+	switch backend {
+	case "redis":
+		rb := redisBroadcaster{channel: fanoutChannel}
+		go rb.subscribe(context.Background())
+		broadcaster = rb
+		log.Printf("WS fan-out via Redis channel %q (instance %s)", fanoutChannel, instanceID)
+	default:
+		broadcaster = localBroadcaster{}
+	}
+}
+
+// deviceScoped is a payload for one user's sockets except the device it came from.
+type deviceScoped struct {
+	ExceptDevice string
+	Payload      interface{}
+}
+
+// sendToOtherDevices reaches user's connections other than exceptDevice (all of them if empty).
+func sendToOtherDevices(user, exceptDevice string, payload interface{}) {
+	sendToUsers([]string{user}, deviceScoped{ExceptDevice: exceptDevice, Payload: payload})
+}
+
+// sendToUsers queues payload for each user through the active backend.
+func sendToUsers(users []string, payload interface{}) {
+	if err := broadcaster.Publish(users, payload); err != nil {
+		log.Printf("WS fan-out publish failed: %v", err)
+		deadLetterBroadcast(users, payload, err)
+	}
+}
+
+// errSlowClient is the dead-letter reason for events dropped because a socket's queue was full.
+var errSlowClient = errors.New("send queue full (slow client)")
+
+// deliverLocal queues payload on this instance's sockets. Slow clients miss it; the users
+// affected are dead-lettered together so the event can be replayed to them.
+func deliverLocal(users []string, payload interface{}) {
+	clients.RLock()
+	var targets []*Client
+	if users == nil {
+		targets = make([]*Client, 0, len(clients.m))
+		for _, conns := range clients.m {
+			for c := range conns {
+				targets = append(targets, c)
+			}
+		}
+	} else {
+		targets = make([]*Client, 0, len(users))
+		for _, u := range users {
+			for c := range clients.m[u] {
+				targets = append(targets, c)
+			}
+		}
+	}
+
+	var except string
+	if scoped, ok := payload.(deviceScoped); ok {
+		except, payload = scoped.ExceptDevice, scoped.Payload
+	}
+	// sends happen under the read lock: cleanup closes Send under the write lock, so a
+	// client unregistered meanwhile is never sent to
+	var dropped []string
+	for _, client := range targets {
+		if except != "" && client.DeviceID == except {
+			continue
+		}
+		// non-blocking send: drop if the client's send buffer is full
+		select {
+		case client.Send <- payload:
+		default:
+			log.Printf("WS dropping message to %s (slow client)", client.UserID)
+			if !slices.Contains(dropped, client.UserID) {
+				dropped = append(dropped, client.UserID)
+			}
+		}
+	}
+	clients.RUnlock()
+
+	if len(dropped) > 0 {
+		go deadLetterBroadcast(dropped, payload, errSlowClient)
+	}
+}
+
+// localBroadcaster only reaches clients connected to this process.
+type localBroadcaster struct{}
+
+func (localBroadcaster) Publish(users []string, payload interface{}) error {
+	deliverLocal(users, payload)
+	return nil
+}
+
+// fanoutEnvelope is what travels over Redis between instances.
+type fanoutEnvelope struct {
+	Origin       string          `json:"origin"`
+	Users        []string        `json:"users"`
+	ExceptDevice string          `json:"exceptDevice,omitempty"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// redisBroadcaster publishes to a Redis channel every instance subscribes to,
+// including the publisher itself, so delivery happens in exactly one place.
+type redisBroadcaster struct {
+	channel string
+}
+
+func (rb redisBroadcaster) Publish(users []string, payload interface{}) error {
+	var except string
+	if scoped, ok := payload.(deviceScoped); ok {
+		except, payload = scoped.ExceptDevice, scoped.Payload
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(fanoutEnvelope{Origin: instanceID, Users: users, ExceptDevice: except, Payload: raw})
+	if err != nil {
+		return err
+	}
+	return rdx.Conn.Publish(context.Background(), rb.channel, data).Err()
+}
+
+func (rb redisBroadcaster) subscribe(ctx context.Context) {
+	sub := rdx.Conn.Subscribe(ctx, rb.channel)
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		var env fanoutEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+			log.Printf("WS fan-out: bad envelope: %v", err)
+			continue
+		}
+		// RawMessage is written verbatim by WriteJSON
+		if env.ExceptDevice != "" {
+			deliverLocal(env.Users, deviceScoped{ExceptDevice: env.ExceptDevice, Payload: env.Payload})
+			continue
+		}
+		deliverLocal(env.Users, env.Payload)
+	}
+}
@@ -0,0 +1,200 @@
+package discord
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	snippetRadius      = 60 // characters kept on each side of the first match
+	defaultHitsPerChat = 3
+)
+
+// globalSearchHit is one matching message with a highlighted excerpt.
+type globalSearchHit struct {
+	ID        primitive.ObjectID `bson:"_id"       json:"messageid"`
+	Sender    string             `bson:"sender"    json:"sender"`
+	Content   string             `bson:"content"   json:"-"`
+	Snippet   string             `bson:"-"         json:"snippet"`
+	Score     float64            `bson:"score"     json:"score"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// globalSearchGroup holds the best hits of one chat.
+type globalSearchGroup struct {
+	ChatID     string            `bson:"_id"        json:"chatid"`
+	EntityType string            `bson:"entitytype" json:"entitytype,omitempty"`
+	EntityID   string            `bson:"entityid"   json:"entityid,omitempty"`
+	Total      int64             `bson:"total"      json:"total"`
+	TopScore   float64           `bson:"topScore"   json:"topScore"`
+	Hits       []globalSearchHit `bson:"hits"       json:"hits"`
+}
+
+// SearchAllChats searches every chat the caller participates in and groups hits per chat,
+// best chat first. Query: term (required), limit/skip (chats), perChat (hits per chat).
+func SearchAllChats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	query := r.URL.Query()
+	term := strings.TrimSpace(query.Get("term"))
+	if term == "" {
+		writeErr(w, "term required", http.StatusBadRequest)
+		return
+	}
+	limit, skip, perChat := int64(20), int64(0), int64(defaultHitsPerChat)
+	if v, err := parseInt64(query.Get("limit")); err == nil && v > 0 && v <= 100 {
+		limit = v
+	}
+	if v, err := parseInt64(query.Get("skip")); err == nil && v >= 0 {
+		skip = v
+	}
+	if v, err := parseInt64(query.Get("perChat")); err == nil && v > 0 && v <= 20 {
+		perChat = v
+	}
+
+	// Chats the user may search, honouring history that is hidden from late joiners.
+	cursor, err := db.MereCollection.Find(ctx, bson.M{"participants": user})
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scopes := make(bson.A, 0, len(chats))
+	for i := range chats {
+		scope := bson.M{"chatid": chats[i].ChatID}
+		if floor := historyFloor(&chats[i], user); !floor.IsZero() {
+			scope["createdAt"] = bson.M{"$gte": floor}
+		}
+		scopes = append(scopes, scope)
+	}
+	groups := make([]globalSearchGroup, 0)
+	if len(scopes) == 0 {
+		writeGlobalSearch(w, term, groups)
+		return
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"$text":   bson.M{"$search": term},
+			"deleted": bson.M{"$ne": true},
+			"$or":     scopes,
+		}}},
+		{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "createdAt", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      "$chatid",
+			"total":    bson.M{"$sum": 1},
+			"topScore": bson.M{"$max": "$score"},
+			"hits": bson.M{"$push": bson.M{
+				"_id": "$_id", "sender": "$sender", "content": "$content", "score": "$score", "createdAt": "$createdAt",
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "topScore", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.M{
+			"total": 1, "topScore": 1,
+			"hits": bson.M{"$slice": bson.A{"$hits", perChat}},
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         db.MereCollection.Name(),
+			"localField":   "_id",
+			"foreignField": "chatid",
+			"as":           "chat",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"entitytype": bson.M{"$first": "$chat.entitytype"},
+			"entityid":   bson.M{"$first": "$chat.entityid"},
+		}}},
+		{{Key: "$project", Value: bson.M{"chat": 0}}},
+	}
+
+	agg, err := db.MessagesCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := agg.All(ctx, &groups); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	words := searchWords(term)
+	for gi := range groups {
+		for hi := range groups[gi].Hits {
+			hit := &groups[gi].Hits[hi]
+			hit.Snippet = highlightSnippet(hit.Content, words)
+		}
+	}
+	writeGlobalSearch(w, term, groups)
+}
+
+func writeGlobalSearch(w http.ResponseWriter, term string, groups []globalSearchGroup) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"term":  term,
+		"chats": groups,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// searchWords extracts the plain words of a text query for highlighting.
+func searchWords(term string) []string {
+	var words []string
+	for _, f := range strings.Fields(term) {
+		f = strings.Trim(f, `"-`)
+		if f != "" {
+			words = append(words, regexp.QuoteMeta(f))
+		}
+	}
+	return words
+}
+
+// highlightSnippet cuts content around the first matching word and wraps matches in <mark>.
+// The content is HTML-escaped so the snippet is safe to render.
+func highlightSnippet(content string, words []string) string {
+	if len(words) == 0 {
+		return html.EscapeString(content)
+	}
+	re := regexp.MustCompile(`(?i)` + strings.Join(words, "|"))
+	runes := []rune(content)
+
+	start, end := 0, len(runes)
+	if loc := re.FindStringIndex(content); loc != nil {
+		first := len([]rune(content[:loc[0]]))
+		start = max(0, first-snippetRadius)
+		end = min(len(runes), first+snippetRadius)
+	} else if end > 2*snippetRadius {
+		end = 2 * snippetRadius
+	}
+
+	excerpt := html.EscapeString(string(runes[start:end]))
+	excerpt = re.ReplaceAllStringFunc(excerpt, func(m string) string { return "<mark>" + m + "</mark>" })
+	if start > 0 {
+		excerpt = "…" + excerpt
+	}
+	if end < len(runes) {
+		excerpt += "…"
+	}
+	return excerpt
+}
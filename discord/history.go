@@ -0,0 +1,166 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// historyFloor returns the earliest message time userID may see in chat, or the zero time
+// when the whole history is visible. Members who joined while history sharing is off only
+// see messages sent after they joined.
+func historyFloor(chat *models.Chat, userID string) time.Time {
+	if chat.SharesHistory() {
+		return time.Time{}
+	}
+	return chat.JoinedAt[userID]
+}
+
+// applyHistoryFloor narrows a messages filter to what userID may see.
+func applyHistoryFloor(filter bson.M, chat *models.Chat, userID string) {
+	floor := historyFloor(chat, userID)
+	if floor.IsZero() {
+		return
+	}
+	if existing, ok := filter["createdAt"].(bson.M); ok {
+		existing["$gte"] = floor
+		return
+	}
+	filter["createdAt"] = bson.M{"$gte": floor}
+}
+
+// SetHistorySharing lets a chat admin decide whether members added later can read earlier messages.
+func SetHistorySharing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		ShareHistory bool `json:"shareHistory"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID},
+		bson.M{"$set": bson.M{"shareHistory": body.ShareHistory, "updatedAt": time.Now()}},
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddParticipants lets a chat admin add members.
+func AddParticipants(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Participants []string `json:"participants"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	var added []string
+	for _, p := range body.Participants {
+		if p == "" || utils.Contains(chat.Participants, p) || utils.Contains(added, p) {
+			continue
+		}
+		added = append(added, p)
+	}
+	if len(added) == 0 {
+		writeErr(w, "no new participants", http.StatusBadRequest)
+		return
+	}
+	if err := addParticipants(ctx, &chat, added); err != nil {
+		if err == errChatFull {
+			writeErrCode(w, http.StatusConflict, errCodeChatFull, err.Error(), nil)
+			return
+		}
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"added": added,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// addParticipants adds users who are not yet members, records when each joined and announces
+// them. Growing a direct message into a group turns history sharing off unless an admin
+// already chose.
+func addParticipants(ctx context.Context, chat *models.Chat, added []string) error {
+	if len(chat.Participants)+len(added) > maxParticipants {
+		return errChatFull
+	}
+	now := time.Now()
+	set := bson.M{"updatedAt": now}
+	for _, p := range added {
+		set["joinedAt."+p] = now
+	}
+	if len(chat.Participants) == 2 && chat.ShareHistory == nil {
+		set["shareHistory"] = false
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chat.ChatID},
+		bson.M{"$addToSet": bson.M{"participants": bson.M{"$each": added}}, "$set": set},
+	); err != nil {
+		return err
+	}
+	chat.Participants = append(chat.Participants, added...)
+	refreshSummaryMembers(ctx, chat)
+	postSystemEvent(ctx, chat, systemJoin, added)
+	go noticeImpersonation(*chat, added)
+	if chat.Welcome != nil {
+		go sendWelcomeDMs(*chat, added)
+	}
+	return nil
+}
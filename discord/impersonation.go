@@ -0,0 +1,255 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// nameWarning flags a member whose display name is indistinguishable from someone else's.
+type nameWarning struct {
+	LooksLike string `json:"looksLike"`          // userid of the member or account being matched
+	Verified  bool   `json:"verified,omitempty"` // the matched account carries a badge
+}
+
+// confusables folds characters commonly used to imitate latin letters onto them. It is a
+// small hand-picked subset of the Unicode confusables list, covering the usual scams.
+var confusables = map[rune]rune{
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j',
+	'ѕ': 's', 'һ': 'h', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'к': 'k', 'м': 'm', 'т': 't', 'в': 'b',
+	'н': 'h', 'ɡ': 'g', 'ı': 'i', 'ℓ': 'l',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x',
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+	'|': 'l', '!': 'i', '$': 's', '@': 'a',
+}
+
+// normalizeName reduces a display name to a comparison key: case, accents, separators,
+// invisible characters and common look-alikes are folded away.
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		switch {
+		case r >= 'a' && r <= 'z':
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r), unicode.IsSpace(r), unicode.IsPunct(r), unicode.Is(unicode.Cf, r):
+			// accents, separators and zero-width characters
+		case r > unicode.MaxASCII && unicode.IsLetter(r):
+			b.WriteRune(r)
+		}
+	}
+	// "rn" reads as "m" and "I" (already folded to "i") as "l" in most UI fonts
+	key := strings.ReplaceAll(b.String(), "rn", "m")
+	return strings.ReplaceAll(key, "i", "l")
+}
+
+// nameKeys returns the comparison keys of a member's name and username.
+func nameKeys(m chatMember) []string {
+	var keys []string
+	for _, n := range []string{m.Name, m.Username} {
+		if k := normalizeName(n); len(k) >= 3 && !utils.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// flagNameCollisions sets NameWarning on members whose name collides with a verified account
+// of the chat's tenant or with another member. Verified members are never flagged; when two
+// unverified members collide, both are.
+func flagNameCollisions(ctx context.Context, chat *models.Chat, members []chatMember) {
+	if len(members) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.UserID)
+	}
+	badges := senderBadges(ctx, chat, ids)
+
+	owners := make(map[string][]string) // key => member userids
+	for _, m := range members {
+		for _, k := range nameKeys(m) {
+			owners[k] = append(owners[k], m.UserID)
+		}
+	}
+	verified := verifiedNames(ctx, chat.EntityId)
+
+	for i := range members {
+		m := &members[i]
+		if badges[m.UserID] != "" {
+			continue
+		}
+		for _, k := range nameKeys(*m) {
+			if v, ok := verified[k]; ok && v != m.UserID {
+				m.NameWarning = &nameWarning{LooksLike: v, Verified: true}
+				break
+			}
+			for _, other := range owners[k] {
+				if other != m.UserID {
+					m.NameWarning = &nameWarning{LooksLike: other, Verified: badges[other] != ""}
+					break
+				}
+			}
+			if m.NameWarning != nil {
+				break
+			}
+		}
+	}
+}
+
+type cachedNames struct {
+	names   map[string]string // key => verified userid
+	expires time.Time
+}
+
+var (
+	verifiedNamesMu    sync.Mutex
+	verifiedNamesCache = make(map[string]cachedNames) // tenant => names
+)
+
+// maxVerifiedNames caps how many verified accounts are compared against per tenant.
+const maxVerifiedNames = 1000
+
+// verifiedNames maps the name keys of accounts verified in a tenant (or globally) to their
+// userids. Results are cached for badgeTTL.
+func verifiedNames(ctx context.Context, tenant string) map[string]string {
+	verifiedNamesMu.Lock()
+	c, ok := verifiedNamesCache[tenant]
+	verifiedNamesMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.names
+	}
+
+	names := make(map[string]string)
+	cursor, err := db.VerificationsCollection.Find(ctx,
+		bson.M{"tenant": bson.M{"$in": bson.A{models.GlobalTenant, tenant}}},
+		options.Find().SetProjection(bson.M{"userid": 1}).SetLimit(maxVerifiedNames),
+	)
+	if err != nil {
+		log.Printf("verified names lookup failed (%s): %v", tenant, err)
+		return names
+	}
+	var grants []models.Verification
+	if err := cursor.All(ctx, &grants); err != nil {
+		log.Printf("verified names lookup failed (%s): %v", tenant, err)
+		return names
+	}
+	ids := make([]string, 0, len(grants))
+	for _, g := range grants {
+		ids = append(ids, g.UserID)
+	}
+
+	cursor, err = db.UsersCollection.Find(ctx,
+		bson.M{"$or": bson.A{bson.M{"userid": bson.M{"$in": ids}}, bson.M{"verified": true}}},
+		options.Find().SetProjection(bson.M{"_id": 0, "userid": 1, "username": 1, "name": 1}).SetLimit(maxVerifiedNames),
+	)
+	if err != nil {
+		log.Printf("verified profiles lookup failed (%s): %v", tenant, err)
+		return names
+	}
+	var profiles []chatMember
+	if err := cursor.All(ctx, &profiles); err != nil {
+		log.Printf("verified profiles lookup failed (%s): %v", tenant, err)
+		return names
+	}
+	for _, p := range profiles {
+		for _, k := range nameKeys(p) {
+			names[k] = p.UserID
+		}
+	}
+
+	verifiedNamesMu.Lock()
+	verifiedNamesCache[tenant] = cachedNames{names: names, expires: time.Now().Add(badgeTTL)}
+	verifiedNamesMu.Unlock()
+	return names
+}
+
+// impersonationNotices enables admin notices when newly added members collide with
+// someone's name (IMPERSONATION_NOTICES=1).
+var impersonationNotices = os.Getenv("IMPERSONATION_NOTICES") == "1"
+
+// maxNoticeProfiles bounds the profiles loaded to check a large chat.
+const maxNoticeProfiles = 5000
+
+// participantProfiles loads the names of up to maxNoticeProfiles of the chat's participants.
+func participantProfiles(ctx context.Context, chat *models.Chat) ([]chatMember, error) {
+	cursor, err := db.UsersCollection.Find(ctx,
+		bson.M{"userid": bson.M{"$in": chat.Participants}},
+		options.Find().SetProjection(bson.M{"_id": 0, "userid": 1, "username": 1, "name": 1}).SetLimit(maxNoticeProfiles),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var members []chatMember
+	err = cursor.All(ctx, &members)
+	return members, err
+}
+
+// flagListCollisions checks the whole chat for name collisions, not only the few members a
+// chat list shows, and copies the warnings onto the shown members.
+func flagListCollisions(ctx context.Context, item *chatListItem) {
+	if len(item.Members) == 0 {
+		return
+	}
+	all, err := participantProfiles(ctx, &item.Chat)
+	if err != nil {
+		log.Printf("impersonation check failed (%s): %v", item.ChatID, err)
+		return
+	}
+	flagNameCollisions(ctx, &item.Chat, all)
+	warnings := make(map[string]*nameWarning)
+	for _, m := range all {
+		if m.NameWarning != nil {
+			warnings[m.UserID] = m.NameWarning
+		}
+	}
+	for i := range item.Members {
+		item.Members[i].NameWarning = warnings[item.Members[i].UserID]
+	}
+}
+
+// noticeImpersonation tells the chat's admins, over WS only, which of the added members
+// have a colliding name. Other participants never see the notice.
+func noticeImpersonation(chat models.Chat, added []string) {
+	if !impersonationNotices || len(chat.Admins) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	members, err := participantProfiles(ctx, &chat)
+	if err != nil {
+		log.Printf("impersonation check failed (%s): %v", chat.ChatID, err)
+		return
+	}
+	flagNameCollisions(ctx, &chat, members)
+
+	for _, m := range members {
+		if m.NameWarning == nil || !utils.Contains(added, m.UserID) {
+			continue
+		}
+		sendToUsers(chat.Admins, map[string]interface{}{
+			"type":      "system_notice",
+			"notice":    "name_collision",
+			"chatid":    chat.ChatID,
+			"userid":    m.UserID,
+			"looksLike": m.NameWarning.LooksLike,
+			"verified":  m.NameWarning.Verified,
+		})
+	}
+}
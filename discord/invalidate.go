@@ -0,0 +1,71 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"naevis/models"
+	"naevis/mq"
+)
+
+const (
+	topicMessageEdited  = "message-edited"
+	topicMessageDeleted = "message-deleted"
+)
+
+// complianceEvents names change topics in the compliance archive schema.
+var complianceEvents = map[string]string{
+	topicMessageEdited:  "message.edited",
+	topicMessageDeleted: "message.deleted",
+}
+
+// messageInvalidators are in-process derived stores (caches) that must drop a message when it
+// changes. Out-of-process stores (external search index, link previews, CDN) listen on the event bus.
+var messageInvalidators = struct {
+	sync.RWMutex
+	fns []func(ctx context.Context, msg *models.Message)
+}{}
+
+// onMessageChange registers an in-process cache invalidation hook.
+func onMessageChange(fn func(ctx context.Context, msg *models.Message)) {
+	messageInvalidators.Lock()
+	messageInvalidators.fns = append(messageInvalidators.fns, fn)
+	messageInvalidators.Unlock()
+}
+
+// propagateMessageChange invalidates derived copies of an edited or deleted message:
+// local hooks run inline, then the change is published on the event bus so the search indexer,
+// link-preview cache and CDN purger can drop stale content. Media is announced separately so
+// the CDN can purge the file URL.
+func propagateMessageChange(ctx context.Context, msg *models.Message, topic string) {
+	messageInvalidators.RLock()
+	fns := messageInvalidators.fns
+	messageInvalidators.RUnlock()
+	for _, fn := range fns {
+		fn(ctx, msg)
+	}
+	recordCompliance(ctx, complianceEvents[topic], msg)
+
+	method := "PUT"
+	if topic == topicMessageDeleted {
+		method = "DELETE"
+	}
+	go mq.Emit(ctx, topic, models.Index{
+		EntityType: "message",
+		Method:     method,
+		EntityId:   msg.ChatID,
+		ItemId:     msg.ID.Hex(),
+		ItemType:   "message",
+	})
+	if topic == topicMessageDeleted && msg.Media != nil && msg.Media.URL != "" {
+		go mq.Emit(ctx, topic, models.Index{
+			EntityType: "message",
+			Method:     method,
+			EntityId:   msg.ChatID,
+			ItemId:     msg.Media.URL,
+			ItemType:   "media",
+		})
+	}
+	log.Printf("invalidate: %s %s/%s", topic, msg.ChatID, msg.ID.Hex())
+}
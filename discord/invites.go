@@ -0,0 +1,251 @@
+package discord
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxInviteTTL caps how long an invite link may stay valid.
+const maxInviteTTL = 30 * 24 * time.Hour
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateInvite lets a chat admin mint an invite link. expiresIn is in seconds (default and
+// max 30 days); maxUses 0 allows any number of joins. The token is returned only here.
+func CreateInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		ExpiresIn int64 `json:"expiresIn"`
+		MaxUses   int64 `json:"maxUses"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeErr(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+	}
+	if body.ExpiresIn < 0 || body.MaxUses < 0 {
+		writeErr(w, "expiresIn and maxUses must not be negative", http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(body.ExpiresIn) * time.Second
+	if ttl == 0 || ttl > maxInviteTTL {
+		ttl = maxInviteTTL
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	expires := now.Add(ttl)
+	invite := models.Invite{
+		ChatID:    chatID,
+		TokenHash: hashInviteToken(token),
+		CreatedBy: user,
+		CreatedAt: now,
+		ExpiresAt: &expires,
+		MaxUses:   body.MaxUses,
+	}
+	res, err := db.InvitesCollection.InsertOne(ctx, invite)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invite.ID = res.InsertedID.(primitive.ObjectID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"invite": invite,
+		"token":  token,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RevokeInvite disables an invite link before it expires.
+func RevokeInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	inviteID, err := primitive.ObjectIDFromHex(ps.ByName("inviteid"))
+	if err != nil {
+		writeErr(w, "invalid inviteId", http.StatusBadRequest)
+		return
+	}
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	res, err := db.InvitesCollection.UpdateOne(ctx,
+		bson.M{"_id": inviteID, "chatid": chatID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeErr(w, "invite not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JoinByInvite redeems an invite token. Chats requiring approval queue a join request
+// instead of adding the caller; either way the redemption counts as a use.
+func JoinByInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	hash := hashInviteToken(ps.ByName("token"))
+
+	var invite models.Invite
+	if err := db.InvitesCollection.FindOne(ctx, bson.M{"tokenHash": hash}).Decode(&invite); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "invalid invite", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": invite.ChatID}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "invalid invite", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if utils.Contains(chat.Participants, user) {
+		writeErr(w, "already a participant", http.StatusConflict)
+		return
+	}
+
+	if !chat.JoinApproval && len(chat.Participants) >= maxParticipants {
+		writeErrCode(w, http.StatusConflict, errCodeChatFull, errChatFull.Error(), nil)
+		return
+	}
+
+	// claim a use atomically so concurrent redemptions can't exceed maxUses
+	now := time.Now()
+	res, err := db.InvitesCollection.UpdateOne(ctx,
+		bson.M{
+			"_id":       invite.ID,
+			"revoked":   bson.M{"$ne": true},
+			"expiresAt": bson.M{"$gt": now},
+			"$or": bson.A{
+				bson.M{"maxUses": bson.M{"$exists": false}},
+				bson.M{"$expr": bson.M{"$lt": bson.A{"$uses", "$maxUses"}}},
+			},
+		},
+		bson.M{"$inc": bson.M{"uses": 1}},
+	)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeErr(w, "invite expired or used up", http.StatusGone)
+		return
+	}
+
+	if chat.JoinApproval {
+		req := models.JoinRequest{ChatID: chat.ChatID, UserID: user, Note: "via invite link", Status: models.JoinPending, CreatedAt: now}
+		_, err := db.JoinRequestsCollection.ReplaceOne(ctx,
+			bson.M{"chatid": chat.ChatID, "userid": user, "status": bson.M{"$ne": models.JoinPending}},
+			req,
+			options.Replace().SetUpsert(true),
+		)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			writeErr(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendToUsers(chat.Admins, map[string]interface{}{
+			"type":   "join_request",
+			"chatid": chat.ChatID,
+			"userid": user,
+			"note":   req.Note,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"chatid": chat.ChatID,
+			"status": models.JoinPending,
+		}); err != nil {
+			writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := addParticipants(ctx, &chat, []string{user}); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"chatid": chat.ChatID,
+		"status": models.JoinApproved,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
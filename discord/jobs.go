@@ -0,0 +1,371 @@
+package discord
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/globals"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	jobTimeout       = time.Hour
+	jobLease         = 2 * time.Minute // renewed while the job runs
+	jobOutputTTL     = 7 * 24 * time.Hour
+	expiredJobsSweep = "jobs"
+)
+
+func init() {
+	sweeps[expiredJobsSweep] = sweepExpiredJobs
+}
+
+// jobRunner does the work of a job. It reports progress through report and returns
+// the output files to publish. Runners must be safe to run again from the start, as a job
+// whose instance stopped is rerun elsewhere.
+type jobRunner func(ctx context.Context, job *models.Job, report func(progress int)) ([]models.JobPart, error)
+
+// jobRunners maps a job kind to its runner, so any instance can take over a job.
+var jobRunners = make(map[string]jobRunner)
+
+// startJob records a job leased to this instance and runs it in the background. params
+// are handed to the kind's runner in job.Params.
+func startJob(ctx context.Context, kind, user string, params map[string]string) (*models.Job, error) {
+	now := time.Now()
+	lease := now.Add(jobLease).Truncate(time.Millisecond) // as stored, so keepJobLease can match it
+	job := &models.Job{
+		Kind:       kind,
+		UserID:     user,
+		Status:     models.JobRunning,
+		CreatedAt:  now,
+		Params:     params,
+		LeaseUntil: &lease,
+	}
+	res, err := db.JobsCollection.InsertOne(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	job.ID = res.InsertedID.(primitive.ObjectID)
+
+	go runJob(*job)
+	return job, nil
+}
+
+// claimJob leases the next job left behind: a pending one, or a running one whose
+// instance stopped renewing its lease.
+func claimJob(ctx context.Context) (*models.Job, error) {
+	now := time.Now()
+	var job models.Job
+	err := db.JobsCollection.FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": models.JobPending},
+			bson.M{"status": models.JobRunning, "leaseUntil": bson.M{"$lt": now}},
+		}},
+		bson.M{"$set": bson.M{"status": models.JobRunning, "leaseUntil": now.Add(jobLease)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"createdAt": 1}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// reclaimJobs restarts on this instance every job whose lease ran out.
+func reclaimJobs(ctx context.Context) int {
+	n := 0
+	for {
+		job, err := claimJob(ctx)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Println("jobs: reclaim failed:", err)
+			}
+			return n
+		}
+		log.Printf("jobs: taking over %s %s", job.Kind, job.ID.Hex())
+		go runJob(*job)
+		n++
+	}
+}
+
+// keepJobLease renews the job's lease until ctx ends. If another instance took the job
+// over, the lease no longer matches and this run is cancelled.
+func keepJobLease(ctx context.Context, cancel context.CancelFunc, id primitive.ObjectID, lease time.Time) {
+	ticker := time.NewTicker(jobLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		next := time.Now().Add(jobLease).Truncate(time.Millisecond)
+		res, err := db.JobsCollection.UpdateOne(ctx,
+			bson.M{"_id": id, "status": models.JobRunning, "leaseUntil": lease},
+			bson.M{"$set": bson.M{"leaseUntil": next}},
+		)
+		if err != nil {
+			log.Printf("jobs: renew lease of %s failed: %v", id.Hex(), err)
+			continue
+		}
+		if res.MatchedCount == 0 {
+			log.Printf("jobs: lost lease of %s", id.Hex())
+			cancel()
+			return
+		}
+		lease = next
+	}
+}
+
+func runJob(job models.Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+
+	run, ok := jobRunners[job.Kind]
+	if !ok {
+		setJob(ctx, job.ID, bson.M{"status": models.JobFailed, "error": "unknown job kind", "finishedAt": time.Now()})
+		return
+	}
+	go keepJobLease(ctx, cancel, job.ID, *job.LeaseUntil)
+
+	report := func(progress int) {
+		setJob(ctx, job.ID, bson.M{"progress": progress})
+	}
+
+	parts, err := run(ctx, &job, report)
+	if err == nil {
+		parts, err = storeJobParts(ctx, job.ID, parts)
+	}
+	if ctx.Err() == context.Canceled {
+		return // taken over by another instance, which owns the outcome
+	}
+	now := time.Now()
+	if err != nil {
+		log.Printf("jobs: %s %s failed: %v", job.Kind, job.ID.Hex(), err)
+		removeJobParts(ctx, parts)
+		setJob(ctx, job.ID, bson.M{"status": models.JobFailed, "error": err.Error(), "finishedAt": now})
+		return
+	}
+	expires := now.Add(jobOutputTTL)
+	setJob(ctx, job.ID, bson.M{
+		"status":     models.JobDone,
+		"progress":   100,
+		"parts":      parts,
+		"finishedAt": now,
+		"expiresAt":  expires,
+	})
+	sendToUsers([]string{job.UserID}, map[string]interface{}{
+		"type":   "job_done",
+		"id":     job.ID.Hex(),
+		"kind":   job.Kind,
+		"status": models.JobDone,
+	})
+}
+
+func setJob(ctx context.Context, id primitive.ObjectID, fields bson.M) {
+	if _, err := db.JobsCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields}); err != nil {
+		log.Printf("jobs: update %s failed: %v", id.Hex(), err)
+	}
+}
+
+// storeJobParts moves finished output to the job entity's storage backend when that is
+// remote (STORAGE_JOB=s3), so any instance can serve it. Local output stays where the runner
+// wrote it, outside the public uploads folder.
+func storeJobParts(ctx context.Context, id primitive.ObjectID, parts []models.JobPart) ([]models.JobPart, error) {
+	if !filemgr.IsRemote(filemgr.EntityJob) {
+		return parts, nil
+	}
+	store := filemgr.StorageFor(filemgr.EntityJob)
+	for i := range parts {
+		p := &parts[i]
+		f, err := os.Open(p.Path)
+		if err != nil {
+			return parts, err
+		}
+		key := string(filemgr.EntityJob) + "/" + id.Hex() + "/" + p.Name
+		err = store.Put(ctx, key, f, p.Size, mime.TypeByExtension(filepath.Ext(p.Name)))
+		_ = f.Close()
+		if err != nil {
+			return parts, err
+		}
+		_ = os.Remove(p.Path)
+		p.Key, p.Path = key, ""
+	}
+	return parts, nil
+}
+
+func removeJobParts(ctx context.Context, parts []models.JobPart) {
+	for _, p := range parts {
+		if p.Key != "" {
+			if err := filemgr.StorageFor(filemgr.EntityJob).Delete(ctx, p.Key); err != nil {
+				log.Printf("jobs: remove %s failed: %v", p.Key, err)
+			}
+			continue
+		}
+		if err := os.Remove(p.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("jobs: remove %s failed: %v", p.Path, err)
+		}
+	}
+}
+
+// sweepExpiredJobs deletes finished jobs whose output has expired, along with their files.
+func sweepExpiredJobs(ctx context.Context) (int, error) {
+	cursor, err := db.JobsCollection.Find(ctx, bson.M{"expiresAt": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	var jobs []models.Job
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, j := range jobs {
+		removeJobParts(ctx, j.Parts)
+		if _, err := db.JobsCollection.DeleteOne(ctx, bson.M{"_id": j.ID}); err != nil {
+			log.Printf("jobs: delete %s failed: %v", j.ID.Hex(), err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// GetJob reports a job's status to its owner, with signed download links once it is done.
+func GetJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := utils.GetUserIDFromRequest(r)
+	id, err := primitive.ObjectIDFromHex(ps.ByName("jobid"))
+	if err != nil {
+		writeErr(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	var job models.Job
+	if err := db.JobsCollection.FindOne(r.Context(), bson.M{"_id": id, "userid": user}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if job.ExpiresAt != nil {
+		for i := range job.Parts {
+			job.Parts[i].URL = signedDownloadURL(job.ID, i, *job.ExpiresAt)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// signedDownloadURL builds the expiring link for one job output part.
+func signedDownloadURL(id primitive.ObjectID, part int, expires time.Time) string {
+	exp := expires.Unix()
+	return fmt.Sprintf("/merechats/jobs/%s/parts/%d?expires=%d&sig=%s", id.Hex(), part, exp, downloadSignature(id, part, exp))
+}
+
+// downloadSignature authenticates a download link without a bearer token, so the link
+// can be handed to a browser or download manager.
+func downloadSignature(id primitive.ObjectID, part int, expires int64) string {
+	mac := hmac.New(sha256.New, globals.JwtSecret)
+	fmt.Fprintf(mac, "job-download:%s:%d:%d", id.Hex(), part, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DownloadJobPart serves one output file of a finished job to holders of a valid signed link.
+func DownloadJobPart(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := primitive.ObjectIDFromHex(ps.ByName("jobid"))
+	if err != nil {
+		writeErr(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+	part, err := strconv.Atoi(ps.ByName("part"))
+	if err != nil || part < 0 {
+		writeErr(w, "invalid part", http.StatusBadRequest)
+		return
+	}
+	exp, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		writeErr(w, "link expired", http.StatusGone)
+		return
+	}
+	if !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(downloadSignature(id, part, exp))) {
+		writeErr(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	var job models.Job
+	if err := db.JobsCollection.FindOne(r.Context(), bson.M{"_id": id, "status": models.JobDone}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if part >= len(job.Parts) {
+		writeErr(w, "part not found", http.StatusNotFound)
+		return
+	}
+
+	p := job.Parts[part]
+	if p.Key != "" {
+		url, err := filemgr.StorageFor(filemgr.EntityJob).URL(r.Context(), p.Key, 15*time.Minute)
+		if err != nil {
+			writeErr(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+p.Name+`"`)
+	http.ServeFile(w, r, p.Path)
+}
+
+// StartJobJanitor takes over jobs whose instance stopped, checking every lease period, and
+// removes expired job output every interval. Run it in its own goroutine.
+func StartJobJanitor(interval time.Duration) {
+	reclaim := time.NewTicker(jobLease)
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-reclaim.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			reclaimJobs(ctx)
+			cancel()
+			continue
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		n, err := sweepExpiredJobs(ctx)
+		cancel()
+		if err != nil {
+			log.Println("jobs: expiry sweep failed:", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("jobs: removed %d expired jobs", n)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxJoinNoteLen = 500
+
+// SetJoinApproval lets a chat admin open the chat to join requests, or close it again.
+// Requests already pending stay listed until decided.
+func SetJoinApproval(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		JoinApproval bool `json:"joinApproval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID},
+		bson.M{"$set": bson.M{"joinApproval": body.JoinApproval, "updatedAt": time.Now()}},
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestToJoin queues the caller's request to join a chat that accepts them, replacing any
+// earlier decided request, and tells the chat's admins.
+func RequestToJoin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeErr(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+	}
+	body.Note = strings.TrimSpace(body.Note)
+	if len([]rune(body.Note)) > maxJoinNoteLen {
+		writeErr(w, "note too long", http.StatusBadRequest)
+		return
+	}
+
+	// chats that don't take requests look the same as missing ones
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "joinApproval": true}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if utils.Contains(chat.Participants, user) {
+		writeErr(w, "already a participant", http.StatusConflict)
+		return
+	}
+
+	req := models.JoinRequest{ChatID: chatID, UserID: user, Note: body.Note, Status: models.JoinPending, CreatedAt: time.Now()}
+	_, err := db.JoinRequestsCollection.ReplaceOne(ctx,
+		bson.M{"chatid": chatID, "userid": user, "status": bson.M{"$ne": models.JoinPending}},
+		req,
+		options.Replace().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		writeErr(w, "request already pending", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendToUsers(chat.Admins, map[string]interface{}{
+		"type":   "join_request",
+		"chatid": chatID,
+		"userid": user,
+		"note":   req.Note,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(req); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListJoinRequests lists a chat's pending join requests, oldest first, for its admins.
+func ListJoinRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	cursor, err := db.JoinRequestsCollection.Find(ctx,
+		bson.M{"chatid": chatID, "status": models.JoinPending},
+		options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(500),
+	)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var reqs []models.JoinRequest
+	if err := cursor.All(ctx, &reqs); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reqs == nil {
+		reqs = make([]models.JoinRequest, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reqs); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ApproveJoinRequest adds the requester to the chat.
+func ApproveJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	decideJoinRequest(w, r, ps, models.JoinApproved)
+}
+
+// DenyJoinRequest turns the requester away; they may ask again later.
+func DenyJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	decideJoinRequest(w, r, ps, models.JoinDenied)
+}
+
+func decideJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, status string) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+	requester := ps.ByName("userid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if status == models.JoinApproved && len(chat.Participants) >= maxParticipants {
+		writeErrCode(w, http.StatusConflict, errCodeChatFull, errChatFull.Error(), nil)
+		return
+	}
+
+	now := time.Now()
+	var req models.JoinRequest
+	if err := db.JoinRequestsCollection.FindOneAndUpdate(ctx,
+		bson.M{"chatid": chatID, "userid": requester, "status": models.JoinPending},
+		bson.M{"$set": bson.M{"status": status, "decidedBy": user, "decidedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&req); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "no pending request", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if status == models.JoinApproved && !utils.Contains(chat.Participants, requester) {
+		if err := addParticipants(ctx, &chat, []string{requester}); err != nil {
+			writeErr(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	decided := map[string]interface{}{
+		"type":   "join_request_decided",
+		"chatid": chatID,
+		"userid": requester,
+		"status": status,
+		"by":     user,
+	}
+	sendToUsers([]string{requester}, decided)
+	sendToUsers(chat.Admins, decided) // clears the request from the other admins' queues
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(req); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
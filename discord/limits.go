@@ -0,0 +1,36 @@
+package discord
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+)
+
+var (
+	errMessageTooLong = errors.New("message_too_long")
+	errChatFull       = errors.New("chat_full")
+)
+
+var (
+	// maxMessageLen caps message content in bytes (MAX_MESSAGE_BYTES). Clients that
+	// negotiated "partial" receive longer ones in chunks.
+	maxMessageLen = 64 << 10
+
+	// maxParticipants caps chat size, bots included (MAX_PARTICIPANTS).
+	maxParticipants = 5000
+)
+
+func init() {
+	for env, dst := range map[string]*int{"MAX_MESSAGE_BYTES": &maxMessageLen, "MAX_PARTICIPANTS": &maxParticipants} {
+		raw := os.Getenv(env)
+		if raw == "" {
+			continue
+		}
+		if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+			*dst = v
+		} else {
+			log.Printf("limits: ignoring %s=%q", env, raw)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	previewTimeout  = 4 * time.Second
+	previewMaxBytes = 512 << 10 // only the document head is needed
+	previewMaxField = 300
+)
+
+var (
+	metaTagRe    = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrRe   = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*("[^"]*"|'[^']*')`)
+	titleTagRe   = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	errBlockedIP = errors.New("address not allowed")
+)
+
+// publicDialer refuses to connect to loopback, private and link-local addresses. The check
+// runs on the resolved address at dial time so DNS rebinding and redirects are covered too.
+func publicDialer(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return (&net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				return errBlockedIP
+			}
+			return nil
+		},
+	}).DialContext
+}
+
+var previewClient = &http.Client{
+	Timeout: previewTimeout,
+	Transport: &http.Transport{
+		Proxy:                  nil,
+		DialContext:            publicDialer(previewTimeout),
+		MaxResponseHeaderBytes: 16 << 10,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("link preview: too many redirects")
+		}
+		return nil
+	},
+}
+
+// firstLink returns the first link entity's URL in msg, if any.
+func firstLink(msg *models.Message) string {
+	for _, e := range msg.Entities {
+		if e.Type == models.EntityLink {
+			return e.URL
+		}
+	}
+	return ""
+}
+
+// fetchLinkPreview downloads the head of an HTML page and extracts its OpenGraph metadata.
+func fetchLinkPreview(ctx context.Context, raw string) (*models.LinkPreview, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("link preview: invalid url %q", raw)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "merechats-linkpreview/1.0")
+
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("link preview: %s returned %d", u.Host, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "text/html") {
+		return nil, fmt.Errorf("link preview: unsupported content type %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, previewMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	p := parseOpenGraph(string(body), resp.Request.URL)
+	if p.Title == "" && p.Description == "" && p.Image == "" {
+		return nil, nil
+	}
+	p.URL = raw
+	return p, nil
+}
+
+// parseOpenGraph reads og:* (falling back to <title> and the description meta tag) from markup.
+func parseOpenGraph(doc string, base *url.URL) *models.LinkPreview {
+	p := &models.LinkPreview{}
+	var description string
+	for _, tag := range metaTagRe.FindAllString(doc, -1) {
+		var key, content string
+		for _, a := range metaAttrRe.FindAllStringSubmatch(tag, -1) {
+			val := html.UnescapeString(strings.Trim(a[2], `"'`))
+			switch strings.ToLower(a[1]) {
+			case "property", "name":
+				key = strings.ToLower(val)
+			case "content":
+				content = val
+			}
+		}
+		switch key {
+		case "og:title":
+			p.Title = content
+		case "og:description":
+			p.Description = content
+		case "og:image", "og:image:url":
+			if p.Image == "" {
+				p.Image = content
+			}
+		case "og:site_name":
+			p.SiteName = content
+		case "description":
+			description = content
+		}
+	}
+	if p.Title == "" {
+		if m := titleTagRe.FindStringSubmatch(doc); m != nil {
+			p.Title = html.UnescapeString(strings.TrimSpace(m[1]))
+		}
+	}
+	if p.Description == "" {
+		p.Description = description
+	}
+	if p.Image != "" {
+		if img, err := base.Parse(p.Image); err == nil && (img.Scheme == "http" || img.Scheme == "https") {
+			p.Image = img.String()
+		} else {
+			p.Image = ""
+		}
+	}
+	p.Title = truncateRunes(p.Title, previewMaxField)
+	p.Description = truncateRunes(p.Description, previewMaxField)
+	p.SiteName = truncateRunes(p.SiteName, previewMaxField)
+	return p
+}
+
+func truncateRunes(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
+
+// attachLinkPreview fetches a preview for the message's first link, stores it and
+// rebroadcasts the message so clients can render the card.
+func attachLinkPreview(chat models.Chat, msg models.Message) {
+	link := firstLink(&msg)
+	if link == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*previewTimeout)
+	defer cancel()
+
+	preview, err := fetchLinkPreview(ctx, link)
+	if err != nil {
+		log.Printf("link preview: %s: %v", msg.ID.Hex(), err)
+		return
+	}
+	if preview == nil {
+		return
+	}
+	if _, err := db.MessagesCollection.UpdateOne(ctx, bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"linkPreview": preview}}); err != nil {
+		log.Printf("link preview: store failed (%s): %v", msg.ID.Hex(), err)
+		return
+	}
+	msg.LinkPreview = preview
+	payload := messagePayload(&msg)
+	payload["type"] = "message_updated"
+	sendToUsers(chat.Participants, payload)
+}
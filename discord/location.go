@@ -0,0 +1,194 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxLiveLocation     = 8 * time.Hour
+	maxLocationLabelLen = 100
+)
+
+// validateLocation checks coordinates and trims the label; UpdatedAt is stamped here.
+func validateLocation(loc *models.Location) error {
+	if loc == nil {
+		return errors.New("location required")
+	}
+	if math.IsNaN(loc.Latitude) || loc.Latitude < -90 || loc.Latitude > 90 {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if math.IsNaN(loc.Longitude) || loc.Longitude < -180 || loc.Longitude > 180 {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	if math.IsNaN(loc.Accuracy) || loc.Accuracy < 0 {
+		return errors.New("invalid accuracy")
+	}
+	loc.Label = strings.TrimSpace(loc.Label)
+	if len([]rune(loc.Label)) > maxLocationLabelLen {
+		return errors.New("label too long")
+	}
+	loc.UpdatedAt = time.Now()
+	return nil
+}
+
+// ShareLocation posts a location message. With liveSeconds > 0 the sender may keep pushing
+// location_update frames until it lapses (at most maxLiveLocation).
+func ShareLocation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	var body struct {
+		models.Location
+		LiveSeconds int64 `json:"liveSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	loc := body.Location
+	if err := validateLocation(&loc); err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	live := time.Duration(body.LiveSeconds) * time.Second
+	if live < 0 || live > maxLiveLocation {
+		writeErr(w, "liveSeconds out of range", http.StatusBadRequest)
+		return
+	}
+
+	media := &models.Media{Type: models.MediaLocation, Location: &loc}
+	if live > 0 {
+		until := loc.UpdatedAt.Add(live)
+		media.LiveUntil = &until
+	}
+	msg, err := persistMediaMessage(ctx, chatID, user, media)
+	if err != nil {
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
+		return
+	}
+	broadcastToChat(ctx, chatID, messagePayload(msg))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleLocationUpdate moves a live location the client is sharing and tells the chat.
+// Updates after liveUntil or from anyone but the sender are ignored.
+func handleLocationUpdate(ctx context.Context, client *Client, in models.IncomingWSMessage) {
+	msgID, err := primitive.ObjectIDFromHex(in.MessageID)
+	if err != nil {
+		client.reject(in, errCodeValidation, "invalid messageId", map[string]string{"field": "messageId"})
+		return
+	}
+	if err := validateLocation(in.Location); err != nil {
+		log.Printf("WS location update rejected (%s): %v", client.UserID, err)
+		client.reject(in, errCodeValidation, err.Error(), map[string]string{"field": "location"})
+		return
+	}
+
+	var msg models.Message
+	err = db.MessagesCollection.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":             msgID,
+			"sender":          client.UserID,
+			"media.type":      models.MediaLocation,
+			"media.liveUntil": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$set": bson.M{"media.location": in.Location}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&msg)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("WS location update failed (%s): %v", client.UserID, err)
+			return
+		}
+		client.reject(in, errCodeMessageMissing, "no live location to update", nil)
+		return
+	}
+
+	broadcastToChat(ctx, msg.ChatID, map[string]interface{}{
+		"type":      "location_update",
+		"id":        msg.ID.Hex(),
+		"chatid":    msg.ChatID,
+		"sender":    msg.UserID,
+		"location":  msg.Media.Location,
+		"liveUntil": msg.Media.LiveUntil,
+	})
+}
+
+// StopLiveLocation ends live sharing early; the last position stays in the chat.
+func StopLiveLocation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	res, err := db.MessagesCollection.UpdateOne(ctx,
+		bson.M{
+			"_id":             msgID,
+			"chatid":          ps.ByName("chatid"),
+			"sender":          user,
+			"media.liveUntil": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"media.liveUntil": now}},
+	)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeErr(w, "no live location to stop", http.StatusNotFound)
+		return
+	}
+
+	broadcastToChat(ctx, ps.ByName("chatid"), map[string]interface{}{
+		"type":      "location_update",
+		"id":        msgID.Hex(),
+		"chatid":    ps.ByName("chatid"),
+		"sender":    user,
+		"liveUntil": now,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,143 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordAudioMetadata stores what probing an audio upload found.
+func recordAudioMetadata(ctx context.Context, chatID string, saved filemgr.SavedFile) {
+	info := saved.Audio
+	mime, _ := filemgr.AudioMIME(saved.Name)
+	meta := models.MediaMetadata{
+		Name:       saved.Name,
+		ChatID:     chatID,
+		MIME:       mime,
+		Size:       saved.Size,
+		Duration:   info.Duration,
+		Bitrate:    info.Bitrate,
+		Codec:      info.Codec,
+		SampleRate: info.SampleRate,
+		Channels:   info.Channels,
+		Format:     info.Format,
+		Waveform:   info.Waveform,
+		CreatedAt:  time.Now(),
+	}
+	if _, err := db.MediaMetadataCollection.ReplaceOne(ctx, bson.M{"_id": meta.Name}, meta, options.Replace().SetUpsert(true)); err != nil {
+		log.Printf("audio metadata of %s not recorded: %v", saved.Name, err)
+	}
+}
+
+// forgetMediaMetadata drops the metadata of a deleted file: its audio probe or moderation
+// verdict.
+func forgetMediaMetadata(ctx context.Context, name string) {
+	if _, err := db.MediaMetadataCollection.DeleteOne(ctx, bson.M{"_id": name}); err != nil {
+		log.Printf("media metadata of %s not removed: %v", name, err)
+	}
+}
+
+// StreamAttachmentAudio serves an audio upload for playback with byte-range support, so long
+// voice notes and songs can be scrubbed without downloading them first. It takes the same
+// signed link as ServeAttachment; object storage gets a presigned redirect, which honours
+// ranges itself.
+func StreamAttachmentAudio(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	a, ok := linkedAttachment(w, r, ps)
+	if !ok {
+		return
+	}
+	mime, ok := filemgr.AudioMIME(a.Name)
+	if !ok {
+		writeErr(w, "not an audio file", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if filemgr.IsRemote(filemgr.EntityChat) {
+		link, err := filemgr.FileURL(ctx, a.Path, mediaURLTTL)
+		if err != nil {
+			log.Printf("audio url %s failed: %v", a.Path, err)
+			writeErr(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+
+	f, err := os.Open(a.Path)
+	if err != nil {
+		writeErr(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var meta models.MediaMetadata
+	if err := db.MediaMetadataCollection.FindOne(ctx, bson.M{"_id": a.Name}).Decode(&meta); err == nil && meta.Duration > 0 {
+		w.Header().Set("X-Content-Duration", strconv.FormatFloat(meta.Duration, 'f', 2, 64))
+	}
+	w.Header().Set("Content-Type", mime)
+	// ServeContent answers Range and If-Range with 206 and advertises Accept-Ranges
+	http.ServeContent(w, r, a.Name, info.ModTime(), f)
+}
+
+// GetMediaMetadata returns the probed details of an audio upload to a participant.
+func GetMediaMetadata(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID, name := ps.ByName("chatid"), ps.ByName("name")
+
+	n, err := db.MereCollection.CountDocuments(ctx, bson.M{"chatid": chatID, "participants": user}, options.Count().SetLimit(1))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		writeErr(w, "not found or access denied", http.StatusNotFound)
+		return
+	}
+	// the file must belong to this chat, not just exist somewhere
+	n, err = db.AttachmentsCollection.CountDocuments(ctx, bson.M{"chatid": chatID, "name": name}, options.Count().SetLimit(1))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		writeErr(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+
+	var meta models.MediaMetadata
+	if err := db.MediaMetadataCollection.FindOne(ctx, bson.M{"_id": name}).Decode(&meta); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "no metadata for this file", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(meta); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
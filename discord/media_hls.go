@@ -0,0 +1,136 @@
+package discord
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	filemgr.HLSFunc = recordHLS
+}
+
+// recordHLS stores a finished transcode on the messages carrying the video and tells their
+// chats, so open clients can switch to streaming. The message may still be in flight when a
+// short video finishes, hence the retries.
+func recordHLS(entity filemgr.EntityType, name, manifest string, err error) {
+	if entity != filemgr.EntityChat {
+		return
+	}
+	defer mediaProcessed(entity, name, filemgr.JobHLS, err)
+	if err != nil {
+		log.Printf("hls: %s stays download-only: %v", name, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	filter := bson.M{"media.url": name}
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(5 * time.Second)
+		}
+		res, err := db.MessagesCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"media.hls": manifest}})
+		if err != nil {
+			log.Printf("hls: recording %s failed: %v", name, err)
+			return
+		}
+		if res.MatchedCount > 0 {
+			break
+		}
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "chatid": 1}))
+	if err != nil {
+		return
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return
+	}
+	for _, m := range msgs {
+		broadcastToChat(ctx, m.ChatID, map[string]interface{}{
+			"type":   "media_updated",
+			"id":     m.ID.Hex(),
+			"chatid": m.ChatID,
+			"hls":    true,
+		})
+	}
+}
+
+// ServeAttachmentHLS serves a transcoded video's playlists and segments under the video's
+// signed link. Playlists are rewritten so every URI they list carries the same signature
+// (or, with object storage, is a presigned segment URL): players drop the query string when
+// resolving relative URIs.
+func ServeAttachmentHLS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	a, ok := linkedAttachment(w, r, ps)
+	if !ok {
+		return
+	}
+	file := ps.ByName("file")
+	if file != filepath.Base(file) || (!strings.HasSuffix(file, ".m3u8") && !strings.HasSuffix(file, ".ts")) {
+		writeErr(w, "not found", http.StatusNotFound)
+		return
+	}
+	dir := filemgr.HLSDir(a.Path)
+	path := filepath.Join(dir, file)
+	remote := filemgr.IsRemote(filemgr.EntityChat)
+
+	if strings.HasSuffix(file, ".ts") {
+		if remote {
+			link, err := filemgr.FileURL(ctx, path, mediaURLTTL)
+			if err != nil {
+				writeErr(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, link, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, path)
+		return
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		writeErr(w, "not found", http.StatusNotFound)
+		return
+	}
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case remote && strings.HasSuffix(line, ".ts"):
+			// valid as long as the signed link, so a long video doesn't outlive its segments
+			link, err := filemgr.FileURL(ctx, filepath.Join(dir, filepath.Base(line)), attachmentLinkTTL)
+			if err != nil {
+				log.Printf("hls: presign %s failed: %v", line, err)
+				writeErr(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			line = link
+		default:
+			line += "?" + r.URL.RawQuery
+		}
+		out.WriteString(line + "\n")
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(out.Bytes())
+}
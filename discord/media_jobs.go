@@ -0,0 +1,332 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// mediaJobLease is how long a worker owns a job; transcodes of large images take a while.
+	mediaJobLease = 10 * time.Minute
+	// mediaJobBackoff is the delay before the first retry, doubled for each one after.
+	mediaJobBackoff = 30 * time.Second
+)
+
+var (
+	// mediaJobAttempts (MEDIA_JOB_ATTEMPTS, default 5) bounds the runs of a job before it fails.
+	mediaJobAttempts = int(envFloat("MEDIA_JOB_ATTEMPTS", 5))
+	// mediaJobWake nudges idle workers when a job is queued.
+	mediaJobWake = make(chan struct{}, 1)
+	// mediaJobHost names this instance on the jobs it queues (MEDIA_JOB_HOST, default the
+	// hostname). It must survive restarts, so jobs queued before one still run after it.
+	mediaJobHost = envOr("MEDIA_JOB_HOST", hostname())
+
+	mediaJobStats struct {
+		done, retried, failed atomic.Int64
+	}
+)
+
+func init() {
+	if os.Getenv("MEDIA_JOBS") != "off" {
+		filemgr.Jobs = mediaJobQueue{}
+	}
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		log.Printf("media jobs: no hostname, set MEDIA_JOB_HOST: %v", err)
+	}
+	return name
+}
+
+// mediaJobQueue keeps filemgr's media jobs in Mongo so they survive restarts.
+type mediaJobQueue struct{}
+
+func (mediaJobQueue) Enqueue(job filemgr.MediaJob) error {
+	extra := make([]models.MediaVariant, 0, len(job.Extra))
+	for _, v := range job.Extra {
+		extra = append(extra, models.MediaVariant(v))
+	}
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.MediaJobsCollection.InsertOne(ctx, models.MediaJob{
+		Kind:      job.Kind,
+		Entity:    string(job.Entity),
+		PicType:   string(job.PicType),
+		Name:      job.Name,
+		Host:      mediaJobHost,
+		Extra:     extra,
+		Status:    models.MediaJobPending,
+		RunAt:     now,
+		CreatedAt: now,
+	}); err != nil {
+		return err
+	}
+	select {
+	case mediaJobWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// claimMediaJob leases the next due job of this instance, or of none: a pending one, or a
+// running one whose worker died. Sources are on the local disk of the instance that saved
+// them until processed, so other instances would find them missing.
+func claimMediaJob(ctx context.Context) (*models.MediaJob, error) {
+	now := time.Now()
+	var job models.MediaJob
+	err := db.MediaJobsCollection.FindOneAndUpdate(ctx,
+		bson.M{
+			"host": bson.M{"$in": bson.A{mediaJobHost, nil}},
+			"$or": bson.A{
+				bson.M{"status": models.MediaJobPending, "runAt": bson.M{"$lte": now}},
+				bson.M{"status": models.MediaJobRunning, "lockedUntil": bson.M{"$lt": now}},
+			},
+		},
+		bson.M{
+			"$set": bson.M{"status": models.MediaJobRunning, "lockedUntil": now.Add(mediaJobLease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"runAt": 1}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// runMediaJob runs a leased job and records the outcome: done, pending again after a
+// backoff, or failed once its attempts are used up.
+func runMediaJob(ctx context.Context, job *models.MediaJob) {
+	var err error
+	if job.Kind == transcribeJob {
+		err = transcribeAttachment(ctx, job)
+	} else {
+		extra := make([]filemgr.ImageVariant, 0, len(job.Extra))
+		for _, v := range job.Extra {
+			extra = append(extra, filemgr.ImageVariant(v))
+		}
+		err = filemgr.RunJob(filemgr.MediaJob{
+			Kind:    job.Kind,
+			Entity:  filemgr.EntityType(job.Entity),
+			PicType: filemgr.PictureType(job.PicType),
+			Name:    job.Name,
+			Extra:   extra,
+		})
+	}
+
+	now := time.Now()
+	set := bson.M{"status": models.MediaJobDone, "finishedAt": now}
+	switch {
+	case err == nil:
+		mediaJobStats.done.Add(1)
+		defer mediaJobFinished(job, nil)
+	case errors.Is(err, filemgr.ErrJobSourceGone) && job.Host == mediaJobHost:
+		// deleted before we got to it; nothing left to do
+		set["lastError"] = err.Error()
+		mediaJobStats.done.Add(1)
+		defer mediaJobFinished(job, nil)
+	case errors.Is(err, filemgr.ErrJobSourceGone):
+		// queued before jobs named their host: the file may be on another instance's disk
+		set = bson.M{"status": models.MediaJobFailed, "finishedAt": now, "lastError": err.Error()}
+		mediaJobStats.failed.Add(1)
+		defer mediaJobFinished(job, err)
+	case job.Attempts >= mediaJobAttempts:
+		log.Printf("media jobs: %s %s failed for good after %d attempts: %v", job.Kind, job.Name, job.Attempts, err)
+		set = bson.M{"status": models.MediaJobFailed, "finishedAt": now, "lastError": err.Error()}
+		mediaJobStats.failed.Add(1)
+		defer mediaJobFinished(job, err)
+	default:
+		log.Printf("media jobs: %s %s (attempt %d): %v", job.Kind, job.Name, job.Attempts, err)
+		set = bson.M{"status": models.MediaJobPending, "runAt": now.Add(mediaJobBackoff << (job.Attempts - 1)), "lastError": err.Error()}
+		mediaJobStats.retried.Add(1)
+	}
+	if _, err := db.MediaJobsCollection.UpdateOne(ctx, bson.M{"_id": job.ID},
+		bson.M{"$set": set, "$unset": bson.M{"lockedUntil": ""}}); err != nil {
+		// the lease lapses and the job runs again, which is harmless
+		log.Printf("media jobs: record outcome of %s: %v", job.ID.Hex(), err)
+	}
+}
+
+// mediaJobFinished reports the final outcome of a job; transcripts are extra and don't
+// hold up the message's media status.
+func mediaJobFinished(job *models.MediaJob, err error) {
+	if job.Kind != transcribeJob {
+		mediaProcessed(filemgr.EntityType(job.Entity), job.Name, job.Kind, err)
+	}
+}
+
+// StartMediaJobWorkers runs MEDIA_JOB_WORKERS (default 2) workers that drain the media job
+// queue, checking for due retries every interval when idle. Run it in its own goroutine.
+func StartMediaJobWorkers(interval time.Duration) {
+	if filemgr.Jobs == nil {
+		log.Println("media jobs: queue disabled, derived files are made in-process")
+		return
+	}
+	for i := 1; i < int(envFloat("MEDIA_JOB_WORKERS", 2)); i++ {
+		go mediaJobWorker(interval)
+	}
+	mediaJobWorker(interval)
+}
+
+func mediaJobWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), mediaJobLease)
+		job, err := claimMediaJob(ctx)
+		if err == nil {
+			runMediaJob(ctx, job)
+			cancel()
+			continue
+		}
+		cancel()
+		if err != mongo.ErrNoDocuments {
+			log.Println("media jobs: claim failed:", err)
+		}
+		select {
+		case <-mediaJobWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// mediaJobMetrics reports worker outcomes since start.
+func mediaJobMetrics() map[string]int64 {
+	return map[string]int64{
+		"done":    mediaJobStats.done.Load(),
+		"retried": mediaJobStats.retried.Load(),
+		"failed":  mediaJobStats.failed.Load(),
+	}
+}
+
+// GetMediaJobs reports the processing of an attachment to a participant of its chat, so
+// clients know whether thumbnails and variants are still coming.
+func GetMediaJobs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID, name := ps.ByName("chatid"), ps.ByName("name")
+
+	n, err := db.MereCollection.CountDocuments(ctx, bson.M{"chatid": chatID, "participants": user}, options.Count().SetLimit(1))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		writeErr(w, "not found or access denied", http.StatusNotFound)
+		return
+	}
+	n, err = db.AttachmentsCollection.CountDocuments(ctx, bson.M{"chatid": chatID, "name": name}, options.Count().SetLimit(1))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		writeErr(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+
+	cursor, err := db.MediaJobsCollection.Find(ctx, bson.M{"name": name}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	jobs := make([]models.MediaJob, 0)
+	if err := cursor.All(ctx, &jobs); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	processing := false
+	for _, j := range jobs {
+		processing = processing || j.Status == models.MediaJobPending || j.Status == models.MediaJobRunning
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":       name,
+		"processing": processing,
+		"jobs":       jobs,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListMediaJobs lists queued media jobs for admins, newest first, optionally by ?status=.
+func ListMediaJobs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	filter := bson.M{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+
+	cursor, err := db.MediaJobsCollection.Find(ctx, filter,
+		options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(500))
+	if err != nil {
+		writeErr(w, "failed to list media jobs", http.StatusInternalServerError)
+		return
+	}
+	var jobs []models.MediaJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		writeErr(w, "failed to list media jobs", http.StatusInternalServerError)
+		return
+	}
+	if jobs == nil {
+		jobs = make([]models.MediaJob, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RetryMediaJob queues a failed media job again with a fresh set of attempts.
+func RetryMediaJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		writeErr(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.MediaJobsCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": models.MediaJobFailed},
+		bson.M{
+			"$set":   bson.M{"status": models.MediaJobPending, "attempts": 0, "runAt": time.Now()},
+			"$unset": bson.M{"finishedAt": "", "lockedUntil": ""},
+		})
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeErr(w, "no failed job with that id", http.StatusNotFound)
+		return
+	}
+	select {
+	case mediaJobWake <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
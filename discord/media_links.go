@@ -0,0 +1,148 @@
+package discord
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/globals"
+	"naevis/models"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// attachmentLinkTTL is how long a signed attachment link works.
+const attachmentLinkTTL = time.Hour
+
+// signedAttachmentURL builds an expiring link to a chat upload for one participant. It works
+// without a bearer token, so it can go straight into an <img> or <video> tag.
+func signedAttachmentURL(chatID, name, user string) string {
+	exp := time.Now().Add(attachmentLinkTTL).Unix()
+	return fmt.Sprintf("/merechats/media/%s/%s?u=%s&expires=%d&sig=%s",
+		url.PathEscape(chatID), url.PathEscape(name), url.QueryEscape(user), exp, attachmentSignature(chatID, name, user, exp))
+}
+
+func attachmentSignature(chatID, name, user string, expires int64) string {
+	mac := hmac.New(sha256.New, globals.JwtSecret)
+	fmt.Fprintf(mac, "attachment:%s:%s:%s:%d", chatID, name, user, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signMessageMedia fills Media.SignedURL on uploaded files in msgs for the reader. Locations,
+// stickers and proxied GIFs are not uploads and are left alone.
+func signMessageMedia(msgs []models.Message, user string) {
+	for i := range msgs {
+		signMedia(&msgs[i], user)
+	}
+}
+
+func signMedia(msg *models.Message, user string) {
+	m := msg.Media
+	if m == nil || m.URL == "" || m.Location != nil || m.Sticker != nil || strings.Contains(m.URL, "/") {
+		return
+	}
+	m.SignedURL = signedAttachmentURL(msg.ChatID, m.URL, user)
+	if m.HLS != "" {
+		// the same signature covers the rendition files, see ServeAttachmentHLS
+		path, query, _ := strings.Cut(m.SignedURL, "?")
+		m.HLSURL = path + "/hls/master.m3u8?" + query
+	}
+	if m.Sensitive {
+		m.BlurURL = m.SignedURL + "&blur=1"
+	}
+	if m.Preview {
+		m.PreviewURL = m.SignedURL + "&w=" + strconv.Itoa(filemgr.DocumentPreviewWidth)
+	}
+	if _, ok := filemgr.AudioMIME(m.URL); ok {
+		path, query, _ := strings.Cut(m.SignedURL, "?")
+		m.StreamURL = path + "/stream?" + query
+	}
+}
+
+// linkedAttachment checks a signed attachment link and that its user is still a participant,
+// and loads the attachment. It writes the error response when it returns false.
+func linkedAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (models.Attachment, bool) {
+	ctx := r.Context()
+	chatID, name := ps.ByName("chatid"), ps.ByName("name")
+	q := r.URL.Query()
+	user := q.Get("u")
+
+	var a models.Attachment
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		writeErr(w, "link expired", http.StatusGone)
+		return a, false
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(attachmentSignature(chatID, name, user, exp))) {
+		writeErr(w, "invalid signature", http.StatusForbidden)
+		return a, false
+	}
+
+	n, err := db.MereCollection.CountDocuments(ctx, bson.M{"chatid": chatID, "participants": user}, options.Count().SetLimit(1))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return a, false
+	}
+	if n == 0 {
+		writeErr(w, "not found or access denied", http.StatusNotFound)
+		return a, false
+	}
+
+	if err := db.AttachmentsCollection.FindOne(ctx, bson.M{"chatid": chatID, "name": name}).Decode(&a); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "attachment not found", http.StatusNotFound)
+			return a, false
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return a, false
+	}
+
+	// the link itself is the credential, so keep it out of shared caches
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.FormatInt(exp-time.Now().Unix(), 10))
+	return a, true
+}
+
+// ServeAttachment streams a chat upload to the holder of a valid signed link, as long as the
+// user it was issued to is still a participant. Images are negotiated: AVIF or WebP when the
+// Accept header allows, or a thumbnail with ?w=<width>. Files in object storage are redirected
+// to a short-lived presigned URL instead.
+func ServeAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	a, ok := linkedAttachment(w, r, ps)
+	if !ok {
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	path, mime := pickVariant(r, &a)
+	if filemgr.IsRemote(filemgr.EntityChat) {
+		link, err := filemgr.FileURL(ctx, path, mediaURLTTL)
+		if err != nil {
+			log.Printf("attachment url %s failed: %v", path, err)
+			writeErr(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+	if mime != "" {
+		w.Header().Set("Content-Type", mime)
+	}
+	if mime == "image/svg+xml" || strings.EqualFold(filepath.Ext(path), ".svg") {
+		// SVG is a document: never let one run script on our origin, even if the sanitizer missed something
+		w.Header().Set("Content-Security-Policy", "sandbox; frame-ancestors 'none'")
+	}
+	http.ServeFile(w, r, path)
+}
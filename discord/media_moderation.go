@@ -0,0 +1,86 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordModeration stores the image classifier's verdict with the upload's media metadata.
+func recordModeration(ctx context.Context, chatID string, saved filemgr.SavedFile) {
+	v := saved.Moderation
+	_, err := db.MediaMetadataCollection.UpdateOne(ctx, bson.M{"_id": saved.Name}, bson.M{
+		"$set": bson.M{"moderation": models.ModerationVerdict{
+			Action: v.Action, Label: v.Label, Score: v.Score, Scores: v.Scores, At: v.At,
+		}},
+		"$setOnInsert": bson.M{"chatid": chatID, "mime": saved.MIME, "size": saved.Size, "createdAt": time.Now()},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("moderation verdict of %s not recorded: %v", saved.Name, err)
+	}
+}
+
+// storedModeration returns the verdict recorded for a stored file, so a deduplicated upload
+// is treated like the original.
+func storedModeration(ctx context.Context, name string) *filemgr.ModerationVerdict {
+	var meta models.MediaMetadata
+	if err := db.MediaMetadataCollection.FindOne(ctx, bson.M{"_id": name}).Decode(&meta); err != nil || meta.Moderation == nil {
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Printf("moderation verdict of %s not loaded: %v", name, err)
+		}
+		return nil
+	}
+	m := meta.Moderation
+	return &filemgr.ModerationVerdict{Action: m.Action, Label: m.Label, Score: m.Score, Scores: m.Scores, At: m.At}
+}
+
+// reportModeratedUpload files a system report for a message whose image moderation flagged
+// or blurred, so it lands in the same review queue as participant reports.
+func reportModeratedUpload(ctx context.Context, msg *models.Message, v *filemgr.ModerationVerdict) {
+	if v == nil || (v.Action != filemgr.ModerationFlag && v.Action != filemgr.ModerationBlur) {
+		return
+	}
+	labels := make([]string, 0, len(v.Scores))
+	for l, s := range v.Scores {
+		labels = append(labels, fmt.Sprintf("%s=%.2f", l, s))
+	}
+	sort.Strings(labels)
+	_, err := db.ReportsCollection.InsertOne(ctx, models.Report{
+		MessageID: msg.ID,
+		ChatID:    msg.ChatID,
+		Reporter:  systemSender,
+		Reported:  msg.UserID,
+		Reason:    moderationReason(v.Label),
+		Note:      fmt.Sprintf("image moderation: %s (%s)", v.Action, strings.Join(labels, ", ")),
+		Status:    models.ReportOpen,
+		CreatedAt: time.Now(),
+	})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Printf("moderation report for message %s not filed: %v", msg.ID.Hex(), err)
+	}
+}
+
+// moderationReason maps a classifier label to a report reason.
+func moderationReason(label string) string {
+	switch l := strings.ToLower(label); {
+	case strings.Contains(l, "violen"), strings.Contains(l, "gore"):
+		return models.ReportViolence
+	case strings.Contains(l, "hate"):
+		return models.ReportHate
+	case strings.Contains(l, "nsfw"), strings.Contains(l, "nud"), strings.Contains(l, "sex"), strings.Contains(l, "porn"):
+		return models.ReportSexual
+	default:
+		return models.ReportOther
+	}
+}
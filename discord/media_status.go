@@ -0,0 +1,148 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// finishedProcessing holds media jobs that finished before their attachment row was written
+// (a small image can be done before the upload request returns). recordAttachment picks
+// them up; leftovers are dropped after a minute.
+var finishedProcessing = struct {
+	sync.Mutex
+	m map[string]finishedJobs // saved name => kinds
+}{m: make(map[string]finishedJobs)}
+
+type finishedJobs struct {
+	kinds map[string]bool // kind => failed
+	at    time.Time
+}
+
+func init() {
+	filemgr.ProcessedFunc = mediaProcessed
+}
+
+// mediaProcessed records that one kind of processing of a chat upload is over and, if it
+// was the last, settles the status of the messages carrying it.
+func mediaProcessed(entity filemgr.EntityType, name, kind string, err error) {
+	if entity != filemgr.EntityChat {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$pull": bson.M{"processing": kind}}
+	if err != nil {
+		update["$set"] = bson.M{"processingFailed": true}
+	}
+	res, uerr := db.AttachmentsCollection.UpdateMany(ctx, bson.M{"name": name, "processing": kind}, update)
+	if uerr != nil {
+		log.Printf("media status: %s of %s not recorded: %v", kind, name, uerr)
+		return
+	}
+	if res.MatchedCount == 0 {
+		stashFinishedProcessing(name, kind, err != nil)
+		return
+	}
+	settleMediaStatus(ctx, name)
+}
+
+func stashFinishedProcessing(name, kind string, failed bool) {
+	finishedProcessing.Lock()
+	defer finishedProcessing.Unlock()
+	for k, f := range finishedProcessing.m {
+		if time.Since(f.at) > time.Minute {
+			delete(finishedProcessing.m, k)
+		}
+	}
+	f, ok := finishedProcessing.m[name]
+	if !ok {
+		f = finishedJobs{kinds: make(map[string]bool)}
+	}
+	f.kinds[kind] = f.kinds[kind] || failed
+	f.at = time.Now()
+	finishedProcessing.m[name] = f
+}
+
+// takeFinishedProcessing removes the kinds that already finished from pending and reports
+// whether any of them failed.
+func takeFinishedProcessing(name string, pending []string) ([]string, bool) {
+	finishedProcessing.Lock()
+	defer finishedProcessing.Unlock()
+	f, ok := finishedProcessing.m[name]
+	if !ok {
+		return pending, false
+	}
+	delete(finishedProcessing.m, name)
+	left, anyFailed := make([]string, 0, len(pending)), false
+	for _, kind := range pending {
+		failed, done := f.kinds[kind]
+		if !done {
+			left = append(left, kind)
+		}
+		anyFailed = anyFailed || failed
+	}
+	return left, anyFailed
+}
+
+// mediaProcessing reports whether the chat's upload name still has processing to finish;
+// an empty chatID matches any chat.
+func mediaProcessing(ctx context.Context, chatID, name string) bool {
+	filter := bson.M{"name": name, "processing.0": bson.M{"$exists": true}}
+	if chatID != "" {
+		filter["chatid"] = chatID
+	}
+	n, err := db.AttachmentsCollection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		log.Printf("media status: lookup of %s failed: %v", name, err)
+		return false
+	}
+	return n > 0
+}
+
+// settleMediaStatus marks the processing messages carrying name ready, or failed, once no
+// processing of it is left, and tells their chats with a media_ready event.
+func settleMediaStatus(ctx context.Context, name string) {
+	// deduplicated copies share the file but only the first upload's row tracks processing
+	if mediaProcessing(ctx, "", name) {
+		return
+	}
+	status := models.MediaReady
+	if n, err := db.AttachmentsCollection.CountDocuments(ctx,
+		bson.M{"name": name, "processingFailed": true}, options.Count().SetLimit(1)); err == nil && n > 0 {
+		status = models.MediaFailed
+	}
+
+	filter := bson.M{"media.url": name, "media.status": models.MediaProcessing}
+	cursor, err := db.MessagesCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "chatid": 1}))
+	if err != nil {
+		log.Printf("media status: messages of %s not loaded: %v", name, err)
+		return
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil || len(msgs) == 0 {
+		return
+	}
+	if _, err := db.MessagesCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"media.status": status}}); err != nil {
+		log.Printf("media status: messages of %s not updated: %v", name, err)
+		return
+	}
+	for _, m := range msgs {
+		broadcastToChat(ctx, m.ChatID, map[string]interface{}{
+			"type":   "media_ready",
+			"id":     m.ID.Hex(),
+			"chatid": m.ChatID,
+			"name":   name,
+			"status": status,
+		})
+	}
+}
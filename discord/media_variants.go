@@ -0,0 +1,128 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// pendingVariants holds variants that were ready before their attachment row was written
+// (object storage generates them inline, ahead of recordAttachment). recordAttachment picks
+// them up; leftovers are dropped after a minute.
+var pendingVariants = struct {
+	sync.Mutex
+	m map[string]pendingVariant // saved name => variants
+}{m: make(map[string]pendingVariant)}
+
+type pendingVariant struct {
+	variants []models.MediaVariant
+	at       time.Time
+}
+
+func init() {
+	filemgr.VariantFunc = recordVariants
+}
+
+// recordVariants stores the variants of a chat upload on its attachment row.
+func recordVariants(entity filemgr.EntityType, _ filemgr.PictureType, name string, variants []filemgr.ImageVariant) {
+	if entity != filemgr.EntityChat || len(variants) == 0 {
+		return
+	}
+	out := make([]models.MediaVariant, 0, len(variants))
+	for _, v := range variants {
+		out = append(out, models.MediaVariant(v))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// every row sharing the file (see findStoredUpload) gets them
+	res, err := db.AttachmentsCollection.UpdateMany(ctx, bson.M{"name": name}, bson.M{"$set": bson.M{"variants": out}})
+	if err != nil {
+		log.Printf("variants of %s not recorded: %v", name, err)
+		return
+	}
+	if res.MatchedCount > 0 {
+		return
+	}
+
+	stashVariants(name, out)
+}
+
+// stashVariants keeps variants for the attachment row about to be written for name.
+func stashVariants(name string, variants []models.MediaVariant) {
+	pendingVariants.Lock()
+	defer pendingVariants.Unlock()
+	for k, p := range pendingVariants.m {
+		if time.Since(p.at) > time.Minute {
+			delete(pendingVariants.m, k)
+		}
+	}
+	pendingVariants.m[name] = pendingVariant{variants: variants, at: time.Now()}
+}
+
+// takePendingVariants returns and forgets variants recorded before the attachment row existed.
+func takePendingVariants(name string) []models.MediaVariant {
+	pendingVariants.Lock()
+	defer pendingVariants.Unlock()
+	p, ok := pendingVariants.m[name]
+	delete(pendingVariants.m, name)
+	if !ok {
+		return nil
+	}
+	return p.variants
+}
+
+// pickVariant chooses what to send for a request: with ?w= the smallest thumbnail at least
+// that wide (the original if none is), otherwise the best full-size encoding the Accept
+// header allows. Thumbnails of animations are still posters unless ?animated=1 asks for the
+// looping preview, and ?blur=1 gets the blurred preview of a sensitive image. It returns the
+// path and MIME type to serve.
+func pickVariant(r *http.Request, a *models.Attachment) (string, string) {
+	if r.URL.Query().Get("blur") == "1" {
+		for _, v := range a.Variants {
+			if v.Blurred {
+				return v.Path, v.MIME
+			}
+		}
+	}
+	if w, err := strconv.Atoi(r.URL.Query().Get("w")); err == nil && w > 0 {
+		animated := r.URL.Query().Get("animated") == "1"
+		var best *models.MediaVariant
+		for i := range a.Variants {
+			v := &a.Variants[i]
+			if v.Blurred || v.Animated != animated || (!animated && v.MIME != "image/jpeg") {
+				continue
+			}
+			if v.Width >= w && (best == nil || v.Width < best.Width) {
+				best = v
+			}
+		}
+		if best != nil {
+			return best.Path, best.MIME
+		}
+		return a.Path, a.MIME
+	}
+
+	accept := r.Header.Get("Accept")
+	for _, mime := range []string{"image/avif", "image/webp"} {
+		if !strings.Contains(accept, mime) {
+			continue
+		}
+		for _, v := range a.Variants {
+			if v.MIME == mime { // WebP and AVIF variants are always full size
+				return v.Path, v.MIME
+			}
+		}
+	}
+	return a.Path, a.MIME
+}
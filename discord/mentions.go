@@ -0,0 +1,291 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	mentionAll    = "all"
+	mentionHere   = "here" // participants currently connected
+	mentionAdmins = "admins"
+
+	// bigChatThreshold is the participant count above which only admins may @all
+	bigChatThreshold = 10
+)
+
+var (
+	mentionRe      = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_\-]+)`)
+	groupNameRe    = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+	errMentionDeny = errors.New("only chat admins can mention @all or @here in large chats")
+)
+
+// isChatAdmin reports whether userID administers the chat.
+func isChatAdmin(chat *models.Chat, userID string) bool {
+	for _, a := range chat.Admins {
+		if a == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGroupMentions returns the distinct group tokens (@all, @admins, custom groups) in content.
+// Plain user mentions are ignored here.
+func parseGroupMentions(content string, chat *models.Chat) []string {
+	var groups []string
+	seen := make(map[string]struct{})
+	for _, m := range mentionRe.FindAllStringSubmatch(content, -1) {
+		token := strings.ToLower(m[1])
+		if _, ok := seen[token]; ok {
+			continue
+		}
+		_, custom := chat.Groups[token]
+		if token != mentionAll && token != mentionHere && token != mentionAdmins && !custom {
+			continue
+		}
+		seen[token] = struct{}{}
+		groups = append(groups, token)
+	}
+	return groups
+}
+
+// parseUserMentions returns the distinct participants mentioned by @userid in content,
+// excluding the sender and group tokens.
+func parseUserMentions(content string, chat *models.Chat, sender string) []string {
+	var users []string
+	seen := make(map[string]struct{})
+	for _, m := range mentionRe.FindAllStringSubmatch(content, -1) {
+		token := m[1]
+		if _, ok := seen[token]; ok || token == sender || !utils.Contains(chat.Participants, token) {
+			continue
+		}
+		seen[token] = struct{}{}
+		users = append(users, token)
+	}
+	return users
+}
+
+// checkGroupMentions enforces who may use which group mention.
+func checkGroupMentions(chat *models.Chat, sender string, groups []string) error {
+	for _, g := range groups {
+		if (g == mentionAll || g == mentionHere) && len(chat.Participants) > bigChatThreshold && !isChatAdmin(chat, sender) {
+			return errMentionDeny
+		}
+	}
+	return nil
+}
+
+// isChannelWide reports whether a group token addresses the whole chat rather than chosen members.
+func isChannelWide(group string) bool {
+	return group == mentionAll || group == mentionHere
+}
+
+// expandGroupMentions resolves group tokens to the participants they notify, excluding the sender.
+// Users who muted the chat and suppress channel-wide mentions are skipped unless a targeted
+// group (@admins or a custom group) also reaches them.
+func expandGroupMentions(chat *models.Chat, sender string, groups []string) []string {
+	members := make(map[string]struct{}, len(chat.Participants))
+	for _, p := range chat.Participants {
+		members[p] = struct{}{}
+	}
+
+	// user => reached by a targeted (not channel-wide) mention
+	targets := make(map[string]bool)
+	for _, g := range groups {
+		var users []string
+		switch g {
+		case mentionAll:
+			users = chat.Participants
+		case mentionHere:
+			users = connectedUsers(chat.Participants)
+		case mentionAdmins:
+			users = chat.Admins
+		default:
+			users = chat.Groups[g]
+		}
+		for _, u := range users {
+			if _, ok := members[u]; ok && u != sender {
+				targets[u] = targets[u] || !isChannelWide(g)
+			}
+		}
+	}
+
+	out := make([]string, 0, len(targets))
+	for u, targeted := range targets {
+		if !targeted && chat.Settings[u].SuppressesChannelMentions() {
+			continue
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// mergeUsers returns the union of a and b, keeping first-seen order.
+func mergeUsers(a, b []string) []string {
+	out := make([]string, 0, len(a)+len(b))
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for _, list := range [][]string{a, b} {
+		for _, u := range list {
+			if _, ok := seen[u]; !ok {
+				seen[u] = struct{}{}
+				out = append(out, u)
+			}
+		}
+	}
+	return out
+}
+
+// connectedUsers filters users down to those with a live WebSocket on this instance
+// or reported online in the shared presence store (other instances).
+func connectedUsers(users []string) []string {
+	out := make([]string, 0, len(users))
+	for _, u := range users {
+		clients.RLock()
+		local := len(clients.m[u]) > 0
+		clients.RUnlock()
+		if local || getPresence(context.Background(), u).Online {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// notifyMentions fans a mention notification out to the mentioned users (direct and via groups),
+// carrying each recipient's notification sound and priority for the chat.
+func notifyMentions(chat *models.Chat, msg *models.Message, users []string) {
+	if len(users) == 0 {
+		return
+	}
+	for _, g := range groupByNotificationPrefs(chat, users) {
+		title, body := notificationPreview(msg, g.Preview)
+		sendToUsers(g.Users, map[string]interface{}{
+			"type":          "mention",
+			"title":         title,
+			"body":          body,
+			"chatid":        msg.ChatID,
+			"id":            msg.ID.Hex(),
+			"sender":        msg.UserID,
+			"mentionGroups": msg.MentionGroups,
+			"mentions":      msg.Mentions,
+			"createdAt":     msg.CreatedAt,
+			"sound":         g.Sound,
+			"priority":      g.Priority,
+		})
+	}
+}
+
+// SetChatGroup creates, replaces or (with no members) removes a custom mention group.
+// Only chat admins may manage groups; members must be chat participants.
+func SetChatGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	chatID := ps.ByName("chatid")
+	group := strings.ToLower(strings.TrimSpace(ps.ByName("group")))
+	if !groupNameRe.MatchString(group) || group == mentionAll || group == mentionAdmins {
+		writeErr(w, "invalid group name", http.StatusBadRequest)
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Members []string `json:"members"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	for _, m := range body.Members {
+		if !utils.Contains(chat.Participants, m) {
+			writeErr(w, "members must be chat participants", http.StatusBadRequest)
+			return
+		}
+	}
+
+	update := bson.M{"$set": bson.M{"groups." + group: body.Members, "updatedAt": time.Now()}}
+	if len(body.Members) == 0 {
+		update = bson.M{"$unset": bson.M{"groups." + group: ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	}
+	if _, err := db.MereCollection.UpdateOne(ctx, bson.M{"chatid": chatID}, update); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendChatMessage validates group mentions, persists the message together with its
+// broadcast (see commitMessage) and fans out mention and thread notifications. clientID
+// is echoed in the broadcast.
+func sendChatMessage(ctx context.Context, chat *models.Chat, sender, content, mediaURL, mediaType, replyTo, clientID string) (*models.Message, error) {
+	if err := checkWritable(chat); err != nil {
+		return nil, err
+	}
+	content = normalizeShortcodes(content, chat)
+	groups := parseGroupMentions(content, chat)
+	if err := checkGroupMentions(chat, sender, groups); err != nil {
+		return nil, err
+	}
+
+	msg, err := buildMessage(chat.ChatID, sender, content, mediaURL, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	msg.MentionGroups = groups
+	msg.Mentions = parseUserMentions(content, chat, sender)
+	msg.Entities = parseEntities(content, chat)
+	if replyTo != "" {
+		if msg.ReplyTo, err = resolveThreadRoot(ctx, chat.ChatID, replyTo); err != nil {
+			return nil, err
+		}
+	}
+
+	event := &models.OutboxEvent{Kind: models.OutboxMessageCreated, ClientID: clientID}
+	if _, err := storeMessage(ctx, msg, event); err != nil {
+		return nil, err
+	}
+	msg.SenderBadge = senderBadges(ctx, chat, []string{sender})[sender]
+
+	notifyMentions(chat, msg, mergeUsers(msg.Mentions, expandGroupMentions(chat, sender, groups)))
+	if msg.ReplyTo != nil {
+		root := loadThreadRoot(ctx, msg)
+		if root != nil {
+			followThread(ctx, root.ID, root.UserID)
+		}
+		followThread(ctx, *msg.ReplyTo, sender)
+		notifyThreadWatchers(chat, msg, root)
+	}
+	go deliverTranslations(*chat, *msg)
+	go pushOffline(*chat, *msg)
+	go attachLinkPreview(*chat, *msg)
+	if cmd, args, ok := parseSlashCommand(content); ok && !isBotUser(sender) {
+		go dispatchCommand(*chat, *msg, cmd, args)
+	}
+	return msg, nil
+}
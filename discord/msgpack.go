@@ -0,0 +1,312 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A minimal MessagePack codec for WS frames. It converts to and from the JSON form of a
+// frame rather than reflecting over Go types, so both encodings carry exactly the same
+// fields: times are RFC 3339 strings and byte slices base64, as in JSON.
+
+const msgpackMaxDepth = 32
+
+var errMsgpackTruncated = errors.New("msgpack: truncated input")
+
+// jsonToMsgpack re-encodes a JSON document as MessagePack.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgpackEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackToJSON decodes one MessagePack value and returns it as JSON.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	d := msgpackDecoder{buf: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.buf) {
+		return nil, errors.New("msgpack: trailing bytes")
+	}
+	return json.Marshal(v)
+}
+
+func msgpackEncode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			msgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		msgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		msgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := msgpackEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		msgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for k, e := range v {
+			msgpackHeader(buf, len(k), 0xa0, 32, 0xd9, 0xda, 0xdb)
+			buf.WriteString(k)
+			if err := msgpackEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// msgpackHeader writes a length-prefixed type header: fixed below fixMax, else the 8-bit
+// (when the type has one), 16-bit or 32-bit form.
+func msgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, b8, b16, b32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		_ = binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		_ = binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		_ = binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		_ = binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+type msgpackDecoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.buf)-d.pos < n {
+		return nil, errMsgpackTruncated
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// length reads an n-byte big-endian length.
+func (d *msgpackDecoder) length(n int) (int, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nested too deeply")
+	}
+	b, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return d.mapOf(int(t&0x0f), depth)
+	case t&0xf0 == 0x90:
+		return d.arrayOf(int(t&0x0f), depth)
+	case t&0xe0 == 0xa0:
+		return d.str(int(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin, surfaced as base64 like []byte in JSON
+		n, err := d.length(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.take(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), raw...), nil
+	case 0xca:
+		raw, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), nil
+	case 0xcb:
+		raw, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		raw, err := d.take(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, c := range raw {
+			u = u<<8 | uint64(c)
+		}
+		return u, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		raw, err := d.take(size)
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, c := range raw {
+			u = u<<8 | uint64(c)
+		}
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(n, depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", t)
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	raw, err := d.take(n)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+func (d *msgpackDecoder) arrayOf(n, depth int) ([]interface{}, error) {
+	if n > len(d.buf)-d.pos { // every element takes at least a byte
+		return nil, errMsgpackTruncated
+	}
+	out := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (d *msgpackDecoder) mapOf(n, depth int) (map[string]interface{}, error) {
+	if 2*n > len(d.buf)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	out := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+		if out[key], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,183 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// outboxLease is how long a dispatcher owns an event before another may retry it.
+	outboxLease = 30 * time.Second
+	// outboxBatch bounds the events one sweep delivers.
+	outboxBatch = 500
+)
+
+// commitMessage numbers msg with the chat's next seq (see messageSeqs), stores it and updates the chat's
+// summary in one transaction; an aborted send rolls its seq back, so a chat's seqs have no
+// gaps. A non-nil
+// event is written to the outbox in the same transaction and dispatched right after
+// commit, so a stored message is never left unannounced. Transactions need MONGODB_URI
+// to point at a replica set or mongos; db refuses to start against a standalone server.
+func commitMessage(ctx context.Context, msg *models.Message, event *models.OutboxEvent) error {
+	if msg.ID.IsZero() {
+		msg.ID = primitive.NewObjectID()
+	}
+	if event != nil {
+		event.ID = primitive.NewObjectID()
+		event.ChatID = msg.ChatID
+		event.MessageID = msg.ID
+		event.CreatedAt = time.Now()
+	}
+
+	sess, err := db.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		// the chat document is the seq counter; concurrent sends conflict here and retry
+		var counter struct {
+			LastSeq int64 `bson:"lastSeq"`
+		}
+		if err := db.MereCollection.FindOneAndUpdate(sc,
+			bson.M{"chatid": msg.ChatID},
+			summaryOnInsert(msg),
+			options.FindOneAndUpdate().SetProjection(bson.M{"lastSeq": 1}).SetReturnDocument(options.After),
+		).Decode(&counter); err != nil {
+			return nil, err
+		}
+		if messageSeqs {
+			msg.Seq = counter.LastSeq
+		}
+		if _, err := db.MessagesCollection.InsertOne(sc, msg); err != nil {
+			return nil, err
+		}
+		if event != nil {
+			if _, err := db.OutboxCollection.InsertOne(sc, event); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if event != nil {
+		go dispatchOutboxEvent(event.ID)
+	}
+	return nil
+}
+
+// claimOutboxEvent leases the oldest undelivered event matching filter whose lease is free.
+func claimOutboxEvent(ctx context.Context, filter bson.M) (*models.OutboxEvent, error) {
+	now := time.Now()
+	filter["dispatchedAt"] = nil
+	filter["$or"] = bson.A{bson.M{"lockedUntil": nil}, bson.M{"lockedUntil": bson.M{"$lt": now}}}
+
+	var ev models.OutboxEvent
+	err := db.OutboxCollection.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"lockedUntil": now.Add(outboxLease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.M{"_id": 1}).SetReturnDocument(options.After),
+	).Decode(&ev)
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// deliverOutboxEvent publishes a leased event and marks it dispatched. On failure the
+// lease is left to lapse so a later sweep retries it.
+func deliverOutboxEvent(ctx context.Context, ev *models.OutboxEvent) error {
+	var msg models.Message
+	err := db.MessagesCollection.FindOne(ctx, bson.M{"_id": ev.MessageID, "deleted": bson.M{"$ne": true}}).Decode(&msg)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err == nil {
+		var chat models.Chat
+		if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": ev.ChatID}).Decode(&chat); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		} else if err == nil {
+			msg.SenderBadge = senderBadges(ctx, &chat, []string{msg.UserID})[msg.UserID]
+			payload := messagePayload(&msg)
+			if ev.ClientID != "" {
+				payload["clientId"] = ev.ClientID
+			}
+			if err := broadcaster.Publish(chat.Participants, payload); err != nil {
+				return err
+			}
+		}
+	}
+	// a message or chat deleted before delivery has nothing left to announce
+
+	_, err = db.OutboxCollection.UpdateOne(ctx,
+		bson.M{"_id": ev.ID},
+		bson.M{"$set": bson.M{"dispatchedAt": time.Now()}, "$unset": bson.M{"lockedUntil": ""}},
+	)
+	return err
+}
+
+// dispatchOutboxEvent delivers a just-committed event without waiting for the next sweep.
+func dispatchOutboxEvent(id primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ev, err := claimOutboxEvent(ctx, bson.M{"_id": id})
+	if err != nil {
+		if err != mongo.ErrNoDocuments { // already taken by a sweep
+			log.Printf("outbox: claim %s: %v", id.Hex(), err)
+		}
+		return
+	}
+	if err := deliverOutboxEvent(ctx, ev); err != nil {
+		log.Printf("outbox: deliver %s: %v", id.Hex(), err)
+	}
+}
+
+// drainOutbox delivers events that were never dispatched or whose dispatcher died.
+func drainOutbox(ctx context.Context) (int, error) {
+	delivered := 0
+	for i := 0; i < outboxBatch; i++ {
+		ev, err := claimOutboxEvent(ctx, bson.M{})
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return delivered, err
+		}
+		if err := deliverOutboxEvent(ctx, ev); err != nil {
+			log.Printf("outbox: deliver %s (attempt %d): %v", ev.ID.Hex(), ev.Attempts, err)
+			continue
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// StartOutboxDispatcher retries undelivered outbox events on an interval. Run it in its own goroutine.
+func StartOutboxDispatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		n, err := drainOutbox(ctx)
+		cancel()
+		if err != nil {
+			log.Println("outbox: sweep failed:", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("outbox: redelivered %d events", n)
+		}
+	}
+}
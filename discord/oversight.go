@@ -0,0 +1,307 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"naevis/db"
+	"naevis/middleware"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errSuspended is returned by send paths for users an operator suspended from messaging.
+var errSuspended = errors.New("suspended")
+
+// suspensionTTL bounds how long a suspension lookup is reused; suspending or lifting on
+// another instance takes effect here within this long.
+const suspensionTTL = 30 * time.Second
+
+type cachedSuspension struct {
+	suspended bool
+	expires   time.Time
+}
+
+var (
+	suspensionMu    sync.Mutex
+	suspensionCache = make(map[string]cachedSuspension)
+)
+
+// checkSuspended returns errSuspended while user has an active suspension. Lookup errors
+// let the send through.
+func checkSuspended(ctx context.Context, user string) error {
+	now := time.Now()
+	suspensionMu.Lock()
+	c, ok := suspensionCache[user]
+	suspensionMu.Unlock()
+	if !ok || now.After(c.expires) {
+		err := db.SuspensionsCollection.FindOne(ctx, bson.M{
+			"userid": user,
+			"$or":    bson.A{bson.M{"until": nil}, bson.M{"until": bson.M{"$gt": now}}},
+		}).Err()
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Printf("suspension lookup failed (%s): %v", user, err)
+			return nil
+		}
+		c = cachedSuspension{suspended: err == nil, expires: now.Add(suspensionTTL)}
+		suspensionMu.Lock()
+		suspensionCache[user] = c
+		suspensionMu.Unlock()
+	}
+	if c.suspended {
+		return errSuspended
+	}
+	return nil
+}
+
+func forgetSuspension(user string) {
+	suspensionMu.Lock()
+	delete(suspensionCache, user)
+	suspensionMu.Unlock()
+}
+
+// OperatorListChats pages through all chats, most recently active first. Optional filters:
+// ?participant=, ?entityid=.
+func OperatorListChats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	filter := bson.M{}
+	if p := q.Get("participant"); p != "" {
+		filter["participants"] = p
+	}
+	if e := q.Get("entityid"); e != "" {
+		filter["entityid"] = e
+	}
+	limit, skip := int64(50), int64(0)
+	if v, err := parseInt64(q.Get("limit")); err == nil && v > 0 && v <= 500 {
+		limit = v
+	}
+	if v, err := parseInt64(q.Get("skip")); err == nil && v >= 0 {
+		skip = v
+	}
+
+	cursor, err := db.MereCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.M{"updatedAt": -1}).SetSkip(skip).SetLimit(limit).
+		SetProjection(bson.M{"chatid": 1, "participants": 1, "admins": 1, "entitytype": 1, "entityid": 1, "createdAt": 1, "updatedAt": 1, "readOnly": 1, "summary": 1}))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if chats == nil {
+		chats = make([]models.Chat, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(chats); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// OperatorChatVolume reports a chat's messages per day and its busiest senders over the
+// last ?days= (default 30, at most 365).
+func OperatorChatVolume(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	chatID := ps.ByName("chatid")
+
+	days := int64(30)
+	if v, err := parseInt64(r.URL.Query().Get("days")); err == nil && v > 0 && v <= 365 {
+		days = v
+	}
+	match := bson.M{"chatid": chatID, "createdAt": bson.M{"$gte": time.Now().AddDate(0, 0, -int(days))}}
+
+	cursor, err := db.MessagesCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$facet", Value: bson.M{
+			"daily": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":     bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$createdAt"}},
+					"count":   bson.M{"$sum": 1},
+					"deleted": bson.M{"$sum": bson.M{"$cond": bson.A{"$deleted", 1, 0}}},
+				}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+			"senders": bson.A{
+				bson.M{"$group": bson.M{"_id": "$sender", "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.M{"count": -1}},
+				bson.M{"$limit": 10},
+			},
+		}}},
+	})
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var out []struct {
+		Daily []struct {
+			Day     string `bson:"_id"     json:"day"`
+			Count   int64  `bson:"count"   json:"count"`
+			Deleted int64  `bson:"deleted" json:"deleted"`
+		} `bson:"daily"   json:"daily"`
+		Senders []struct {
+			UserID string `bson:"_id"   json:"userid"`
+			Count  int64  `bson:"count" json:"count"`
+		} `bson:"senders" json:"senders"`
+	}
+	if err := cursor.All(ctx, &out); err != nil || len(out) == 0 {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"chatid":  chatID,
+		"days":    days,
+		"daily":   out[0].Daily,
+		"senders": out[0].Senders,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// OperatorDeleteMessage removes a message's content whoever sent it. Body: {"reason": "..."}.
+func OperatorDeleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	middleware.AuditDetail(r, "reason", body.Reason)
+
+	var msg models.Message
+	err = db.MessagesCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": msgID},
+		bson.M{
+			"$set":   bson.M{"deleted": true, "deletedAt": time.Now(), "content": ""},
+			"$unset": bson.M{"media": "", "entities": "", "linkPreview": ""},
+		},
+	).Decode(&msg) // the original, so derived copies can be found and dropped
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "message not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	middleware.AuditDetail(r, "chatid", msg.ChatID)
+	middleware.AuditDetail(r, "sender", msg.UserID)
+
+	propagateMessageChange(ctx, &msg, topicMessageDeleted)
+	broadcastToChat(ctx, msg.ChatID, map[string]interface{}{
+		"type":   "message_deleted",
+		"id":     msg.ID.Hex(),
+		"chatid": msg.ChatID,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// OperatorSuspendUser stops a user from sending messages, for ?hours= or until lifted.
+// Body: {"reason": "...", "hours": 24}.
+func OperatorSuspendUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := ps.ByName("userid")
+
+	var body struct {
+		Reason string `json:"reason"`
+		Hours  int    `json:"hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Reason == "" || body.Hours < 0 {
+		writeErr(w, "reason required and hours must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	s := models.Suspension{UserID: user, Reason: body.Reason, SuspendedBy: utils.GetUserIDFromRequest(r), CreatedAt: time.Now()}
+	if body.Hours > 0 {
+		until := s.CreatedAt.Add(time.Duration(body.Hours) * time.Hour)
+		s.Until = &until
+	}
+	if _, err := db.SuspensionsCollection.ReplaceOne(ctx, bson.M{"userid": user}, s, options.Replace().SetUpsert(true)); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	forgetSuspension(user)
+	middleware.AuditDetail(r, "reason", body.Reason)
+	middleware.AuditDetail(r, "hours", body.Hours)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// OperatorLiftSuspension lets a suspended user send messages again.
+func OperatorLiftSuspension(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := ps.ByName("userid")
+	res, err := db.SuspensionsCollection.DeleteOne(r.Context(), bson.M{"userid": user})
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeErr(w, "not found", http.StatusNotFound)
+		return
+	}
+	forgetSuspension(user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// OperatorAuditLog lists operator actions, newest first. Optional filters: ?actor=, ?action=.
+func OperatorAuditLog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	filter := bson.M{}
+	if a := r.URL.Query().Get("actor"); a != "" {
+		filter["actor"] = a
+	}
+	if a := r.URL.Query().Get("action"); a != "" {
+		filter["action"] = a
+	}
+
+	cursor, err := db.AuditLogCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"at": -1}).SetLimit(500))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var entries []models.AuditEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = make([]models.AuditEntry, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,246 @@
+package discord
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const paymentSignatureMaxAge = 5 * time.Minute
+
+var (
+	currencyRe = regexp.MustCompile(`^[A-Z]{3}$`)
+
+	// paymentsSecret signs status callbacks from the payments service (PAYMENTS_WEBHOOK_SECRET).
+	paymentsSecret = os.Getenv("PAYMENTS_WEBHOOK_SECRET")
+)
+
+// paymentTransitions lists the statuses a payment request may move to from each status.
+var paymentTransitions = map[string][]string{
+	models.PaymentPending: {models.PaymentPaid, models.PaymentCancelled, models.PaymentFailed, models.PaymentExpired},
+	models.PaymentFailed:  {models.PaymentPending, models.PaymentCancelled},
+}
+
+// CreatePaymentRequest posts a payment card into the chat, addressed to another participant.
+func CreatePaymentRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	var body struct {
+		Amount      int64  `json:"amount"` // minor units, e.g. cents
+		Currency    string `json:"currency"`
+		Payer       string `json:"payer"`
+		Description string `json:"description"`
+		Reference   string `json:"reference"` // id in the payments service
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	body.Currency = strings.ToUpper(strings.TrimSpace(body.Currency))
+	switch {
+	case body.Amount <= 0:
+		writeErr(w, "amount must be positive", http.StatusBadRequest)
+		return
+	case !currencyRe.MatchString(body.Currency):
+		writeErr(w, "invalid currency", http.StatusBadRequest)
+		return
+	case body.Payer == user || !utils.Contains(chat.Participants, body.Payer):
+		writeErr(w, "payer must be another participant", http.StatusBadRequest)
+		return
+	}
+
+	content := strings.TrimSpace(body.Description)
+	if content == "" {
+		content = fmt.Sprintf("Payment request: %s %s", formatMinorUnits(body.Amount), body.Currency)
+	}
+	msg, err := buildMessage(chatID, user, content, "", "")
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Reference != "" {
+		used, err := paymentReferenceUsed(ctx, body.Reference, primitive.NilObjectID)
+		if err != nil {
+			writeErr(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if used {
+			writeErr(w, "reference belongs to another payment", http.StatusConflict)
+			return
+		}
+	}
+	msg.Kind = models.KindPaymentRequest
+	msg.Payment = &models.PaymentRequest{
+		Reference: body.Reference,
+		Amount:    body.Amount,
+		Currency:  body.Currency,
+		Payer:     body.Payer,
+		Status:    models.PaymentPending,
+		UpdatedAt: msg.CreatedAt,
+	}
+	if _, err := insertMessage(ctx, msg); err != nil {
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
+		return
+	}
+	broadcastToChat(ctx, chatID, messagePayload(msg))
+	go pushOffline(chat, *msg)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// UpdatePaymentStatus is the callback for the payments service. Requests carry the
+// timestamp and signature headers of outgoing webhooks, the signature being HMAC-SHA256
+// over "<messageid>|<reference>|<status>|<timestamp>" with PAYMENTS_WEBHOOK_SECRET, so a
+// callback for one payment cannot be replayed against another.
+func UpdatePaymentStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	if paymentsSecret == "" {
+		writeErr(w, "payments integration disabled", http.StatusNotFound)
+		return
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Status    string `json:"status"`
+		Reference string `json:"reference"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil || body.Reference == "" {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if !validPaymentSignature(r, msgID.Hex(), body.Reference, body.Status) {
+		writeErr(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var current models.Message
+	if err := db.MessagesCollection.FindOne(ctx, bson.M{"_id": msgID, "kind": models.KindPaymentRequest}).Decode(&current); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "payment request not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	stored := current.Payment.Reference
+	if stored != "" && stored != body.Reference {
+		writeErr(w, "reference does not match the payment", http.StatusConflict)
+		return
+	}
+	if stored == "" {
+		used, err := paymentReferenceUsed(ctx, body.Reference, msgID)
+		if err != nil {
+			writeErr(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if used {
+			writeErr(w, "reference belongs to another payment", http.StatusConflict)
+			return
+		}
+	}
+	from := current.Payment.Status
+	if !utils.Contains(paymentTransitions[from], body.Status) {
+		writeErr(w, "invalid status transition from "+from, http.StatusConflict)
+		return
+	}
+
+	set := bson.M{"payment.status": body.Status, "payment.updatedAt": time.Now(), "payment.reference": body.Reference}
+	var msg models.Message
+	err = db.MessagesCollection.FindOneAndUpdate(ctx,
+		// guards against concurrent callbacks, and a reference bound since the read
+		bson.M{"_id": msgID, "payment.status": from, "payment.reference": bson.M{"$in": bson.A{stored, nil}}},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		writeErr(w, "payment status changed concurrently", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	payload := messagePayload(&msg)
+	payload["type"] = "message_updated"
+	broadcastToChat(ctx, msg.ChatID, payload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validPaymentSignature(r *http.Request, messageID, reference, status string) bool {
+	ts, err := strconv.ParseInt(r.Header.Get(webhookTimestampHeader), 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)).Abs() > paymentSignatureMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(paymentsSecret))
+	mac.Write([]byte(messageID + "|" + reference + "|" + status + "|" + strconv.FormatInt(ts, 10)))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(r.Header.Get(webhookSignatureHeader)), []byte(expected))
+}
+
+// paymentReferenceUsed reports whether another payment request already carries reference.
+func paymentReferenceUsed(ctx context.Context, reference string, except primitive.ObjectID) (bool, error) {
+	n, err := db.MessagesCollection.CountDocuments(ctx, bson.M{
+		"kind":              models.KindPaymentRequest,
+		"payment.reference": reference,
+		"_id":               bson.M{"$ne": except},
+	}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// formatMinorUnits renders 1250 as "12.50"; all currencies are shown with two decimals.
+func formatMinorUnits(amount int64) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
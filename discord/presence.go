@@ -0,0 +1,153 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/rdx"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	presenceKeyPrefix = "presence:"
+	presenceTTL       = 30 * 24 * time.Hour // forget users not seen for a month
+	maxPresenceLookup = 100
+)
+
+// setPresence persists a user's online flag and lastSeenAt in Redis.
+func setPresence(ctx context.Context, userID string, online bool) (models.Presence, error) {
+	now := time.Now().UTC()
+	key := presenceKeyPrefix + userID
+
+	onlineVal := "0"
+	if online {
+		onlineVal = "1"
+	}
+	pipe := rdx.Conn.TxPipeline()
+	pipe.HSet(ctx, key, map[string]interface{}{
+		"online":     onlineVal,
+		"lastSeenAt": now.Format(time.RFC3339Nano),
+	})
+	pipe.Expire(ctx, key, presenceTTL)
+	_, err := pipe.Exec(ctx)
+
+	return models.Presence{UserID: userID, Online: online, LastSeenAt: &now}, err
+}
+
+// getPresence reads a user's presence; unknown users are reported offline with no lastSeenAt.
+func getPresence(ctx context.Context, userID string) models.Presence {
+	p := models.Presence{UserID: userID}
+	vals, err := rdx.Conn.HGetAll(ctx, presenceKeyPrefix+userID).Result()
+	if err != nil || len(vals) == 0 {
+		return p
+	}
+	p.Online = vals["online"] == "1"
+	if t, err := time.Parse(time.RFC3339Nano, vals["lastSeenAt"]); err == nil {
+		p.LastSeenAt = &t
+	}
+	return p
+}
+
+// chatPeers returns every user sharing at least one chat with userID (excluding userID).
+func chatPeers(ctx context.Context, userID string) (map[string]struct{}, error) {
+	raw, err := db.MereCollection.Distinct(ctx, "participants", bson.M{"participants": userID})
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[string]struct{}, len(raw))
+	for _, v := range raw {
+		if p, ok := v.(string); ok && p != userID {
+			peers[p] = struct{}{}
+		}
+	}
+	return peers, nil
+}
+
+// updatePresence stores the new state and notifies connected chat peers.
+func updatePresence(ctx context.Context, userID string, online bool) {
+	p, err := setPresence(ctx, userID, online)
+	if err != nil {
+		log.Printf("WS presence store failed (%s): %v", userID, err)
+	}
+	broadcastPresence(ctx, p)
+}
+
+// broadcastPresence sends a presence change only to users who share a chat with the subject.
+func broadcastPresence(ctx context.Context, p models.Presence) {
+	peers, err := chatPeers(ctx, p.UserID)
+	if err != nil {
+		log.Printf("WS presence peers lookup failed (%s): %v", p.UserID, err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"type":       "presence",
+		"from":       p.UserID,
+		"online":     p.Online,
+		"lastSeenAt": p.LastSeenAt,
+	}
+
+	users := make([]string, 0, len(peers))
+	for uid := range peers {
+		users = append(users, uid)
+	}
+	sendToUsers(users, payload)
+}
+
+// GetPresence returns online state and lastSeenAt for ?users=a,b,c.
+// Only the caller and users sharing a chat with the caller are resolved; others are omitted.
+func GetPresence(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	raw := r.URL.Query().Get("users")
+	if strings.TrimSpace(raw) == "" {
+		writeErr(w, "users required", http.StatusBadRequest)
+		return
+	}
+	var requested []string
+	seen := make(map[string]struct{})
+	for _, uid := range strings.Split(raw, ",") {
+		uid = strings.TrimSpace(uid)
+		if uid == "" {
+			continue
+		}
+		if _, ok := seen[uid]; !ok {
+			seen[uid] = struct{}{}
+			requested = append(requested, uid)
+		}
+	}
+	if len(requested) > maxPresenceLookup {
+		writeErr(w, "too many users", http.StatusBadRequest)
+		return
+	}
+
+	peers, err := chatPeers(ctx, user)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]models.Presence, 0, len(requested))
+	for _, uid := range requested {
+		if _, ok := peers[uid]; !ok && uid != user {
+			continue
+		}
+		result = append(result, getPresence(ctx, uid))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
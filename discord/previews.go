@@ -0,0 +1,68 @@
+package discord
+
+import (
+	"os"
+	"strings"
+
+	"naevis/models"
+)
+
+// pushPreviewLen caps the message text shown in a notification.
+const pushPreviewLen = 120
+
+const genericPreview = "New message"
+
+// previewRank orders preview modes by how much they reveal; higher is more private.
+var previewRank = map[string]int{
+	models.PreviewFull:    0,
+	models.PreviewSender:  1,
+	models.PreviewGeneric: 2,
+}
+
+// tenantPreview caps preview modes per tenant (chat entity id), from
+// NOTIFICATION_PREVIEW_TENANTS="tenant=mode,...". Members can only choose something stricter.
+var tenantPreview = parseTenantPreview(os.Getenv("NOTIFICATION_PREVIEW_TENANTS"))
+
+func parseTenantPreview(raw string) map[string]string {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		tenant, mode, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if _, known := previewRank[mode]; ok && tenant != "" && known {
+			out[strings.TrimSpace(tenant)] = mode
+		}
+	}
+	return out
+}
+
+// previewMode is the stricter of the member's own preview setting and their tenant's.
+func previewMode(chat *models.Chat, user string) string {
+	mode := chat.Settings[user].Preview
+	if _, ok := previewRank[mode]; !ok {
+		mode = models.PreviewFull
+	}
+	if t, ok := tenantPreview[chat.EntityId]; ok && previewRank[t] > previewRank[mode] {
+		mode = t
+	}
+	return mode
+}
+
+// notificationPreview builds the title and body of a push or WS notification for a message.
+// It is the only place notification text is derived from message content.
+func notificationPreview(msg *models.Message, mode string) (title, body string) {
+	switch mode {
+	case models.PreviewGeneric:
+		return genericPreview, ""
+	case models.PreviewSender:
+		return msg.UserID, genericPreview
+	}
+
+	body = msg.Content
+	if body == "" && msg.Media != nil {
+		body = "Sent an attachment"
+	}
+	if r := []rune(body); len(r) > pushPreviewLen {
+		body = string(r[:pushPreviewLen]) + "…"
+	}
+	return msg.UserID, body
+}
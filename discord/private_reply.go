@@ -0,0 +1,164 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const quoteExcerptLen = 280
+
+// findOrCreateDM returns the plain (non-entity) two-person chat between a and b, creating it if needed.
+func findOrCreateDM(ctx context.Context, a, b string) (*models.Chat, error) {
+	participants := []string{a, b}
+	sort.Strings(participants)
+
+	filter := bson.M{"participants": participants, "entitytype": ""}
+	var chat models.Chat
+	err := db.MereCollection.FindOne(ctx, filter).Decode(&chat)
+	if err == nil {
+		return &chat, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	now := time.Now()
+	chat = models.Chat{
+		ChatID:       utils.GenerateRandomString(16),
+		Participants: participants,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Admins:       participants,
+	}
+	if _, err := db.MereCollection.InsertOne(ctx, chat); err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+// ReplyPrivately opens (or reuses) a DM with the sender of a group message and posts a reply
+// quoting it. The quote keeps the origin chat and message ids so clients can link back.
+func ReplyPrivately(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+
+	var original models.Message
+	if err := db.MessagesCollection.FindOne(ctx, bson.M{"_id": msgID, "deleted": bson.M{"$ne": true}}).Decode(&original); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "message not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if original.UserID == user {
+		writeErr(w, "cannot reply privately to yourself", http.StatusBadRequest)
+		return
+	}
+
+	// caller must be able to see the original message, including past the history gate
+	var origin models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": original.ChatID, "participants": user}).Decode(&origin); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if original.CreatedAt.Before(historyFloor(&origin, user)) {
+		writeErr(w, "not found or access denied", http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Content  string `json:"content"`
+		ClientID string `json:"clientId,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	body.Content = strings.TrimSpace(body.Content)
+	if body.Content == "" {
+		writeErr(w, "content required", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkWritable(nil); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	dm, err := findOrCreateDM(ctx, user, original.UserID)
+	if err != nil {
+		writeErr(w, "failed to open direct chat", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(dm); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	msg, err := buildMessage(dm.ChatID, user, body.Content, "", "")
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg.Quote = quoteOf(&original)
+	if _, err := insertMessage(ctx, msg); err != nil {
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	payload := messagePayload(msg)
+	if body.ClientID != "" {
+		payload["clientId"] = body.ClientID
+	}
+	broadcastToChat(ctx, dm.ChatID, payload)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"chat":    dm,
+		"message": payload,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// quoteOf snapshots a message for quoting in another chat.
+func quoteOf(m *models.Message) *models.Quote {
+	excerpt := m.Content
+	if r := []rune(excerpt); len(r) > quoteExcerptLen {
+		excerpt = string(r[:quoteExcerptLen]) + "…"
+	}
+	return &models.Quote{
+		MessageID: m.ID,
+		ChatID:    m.ChatID,
+		Sender:    m.UserID,
+		Content:   excerpt,
+		CreatedAt: m.CreatedAt,
+	}
+}
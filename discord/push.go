@@ -0,0 +1,189 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"naevis/models"
+	"naevis/utils"
+)
+
+// pushNotification is a platform-neutral push; adapters map it onto FCM/APNs fields.
+type pushNotification struct {
+	Users []string
+	Title string
+	Body  string
+	// CollapseKey makes devices replace an earlier undelivered/displayed notification with the
+	// same key, so a busy chat shows one updating notification instead of a stack.
+	CollapseKey string
+	// ThreadID groups notifications of one conversation together on the device.
+	ThreadID string
+	Sound    string // empty plays the device default
+	Priority string // models.PrioritySilent, PriorityNormal or PriorityUrgent
+	Data     map[string]string
+}
+
+// pushAdapter delivers notifications to devices.
+type pushAdapter interface {
+	Send(ctx context.Context, n pushNotification) error
+}
+
+// pushProvider is nil (no offline push) unless PUSH_GATEWAY_URL is set.
+var pushProvider pushAdapter
+
+func init() {
+	if url := os.Getenv("PUSH_GATEWAY_URL"); url != "" {
+		pushProvider = &gatewayPushAdapter{
+			url:    url,
+			apiKey: os.Getenv("PUSH_GATEWAY_KEY"),
+			client: &http.Client{Timeout: 5 * time.Second},
+		}
+	}
+}
+
+// gatewayPushAdapter posts to a push gateway that resolves user devices and speaks FCM/APNs.
+// Collapse and threading are expressed in both platforms' terms.
+type gatewayPushAdapter struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (g *gatewayPushAdapter) Send(ctx context.Context, n pushNotification) error {
+	androidPriority, apnsPriority, interruption := "normal", "10", "active"
+	switch n.Priority {
+	case models.PrioritySilent:
+		apnsPriority, interruption = "5", "passive"
+	case models.PriorityUrgent:
+		androidPriority, interruption = "high", "time-sensitive"
+	}
+	sound := n.Sound
+	if sound == "" {
+		sound = "default"
+	}
+	aps := map[string]interface{}{"thread-id": n.ThreadID, "interruption-level": interruption}
+	androidNotification := map[string]string{"tag": n.CollapseKey}
+	if n.Priority != models.PrioritySilent {
+		aps["sound"] = sound
+		androidNotification["sound"] = sound
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"users": n.Users,
+		"notification": map[string]string{
+			"title": n.Title,
+			"body":  n.Body,
+		},
+		"data": n.Data,
+		"android": map[string]interface{}{
+			"collapse_key": n.CollapseKey,
+			"priority":     androidPriority,
+			"notification": androidNotification,
+		},
+		"apns": map[string]interface{}{
+			"headers": map[string]string{"apns-collapse-id": n.CollapseKey, "apns-priority": apnsPriority},
+			"payload": map[string]interface{}{"aps": aps},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("push gateway status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pushOffline notifies participants without a live socket about a new message, skipping
+// the sender and members who muted the chat. Notifications collapse and thread per chat.
+func pushOffline(chat models.Chat, msg models.Message) {
+	if pushProvider == nil {
+		return
+	}
+	// direct mentions and thread watchers get through a mute; thread unwatchers never hear replies
+	var watchers, unwatched []string
+	if root := loadThreadRoot(context.Background(), &msg); root != nil {
+		watchers, unwatched = root.Watchers, root.UnwatchedBy
+	}
+	var offline []string
+	for _, p := range chat.Participants {
+		if p == msg.UserID || isBotUser(p) || utils.Contains(unwatched, p) {
+			continue
+		}
+		if chat.Settings[p].Muted && !utils.Contains(watchers, p) && !utils.Contains(msg.Mentions, p) {
+			continue
+		}
+		offline = append(offline, p)
+	}
+	offline = subtract(offline, connectedUsers(offline))
+	if len(offline) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, g := range groupByNotificationPrefs(&chat, offline) {
+		title, body := notificationPreview(&msg, g.Preview)
+		n := pushNotification{
+			Users:       g.Users,
+			Title:       title,
+			Body:        body,
+			CollapseKey: "chat:" + chat.ChatID,
+			ThreadID:    chat.ChatID,
+			Sound:       g.Sound,
+			Priority:    g.Priority,
+			Data: map[string]string{
+				"type":      "message",
+				"chatid":    chat.ChatID,
+				"messageid": msg.ID.Hex(),
+			},
+		}
+		if err := pushProvider.Send(ctx, n); err != nil {
+			log.Printf("push: delivery for %s failed: %v", msg.ID.Hex(), err)
+			if payload, mErr := json.Marshal(n); mErr == nil {
+				recordDeadLetter(ctx, models.DeadLetter{
+					Kind:     models.DeadLetterPush,
+					ChatID:   chat.ChatID,
+					Users:    n.Users,
+					Payload:  string(payload),
+					Reason:   err.Error(),
+					Attempts: 1,
+				})
+			}
+		}
+	}
+}
+
+// subtract returns the items of a that are not in b.
+func subtract(a, b []string) []string {
+	if len(b) == 0 {
+		return a
+	}
+	drop := toSet(b)
+	out := a[:0:0]
+	for _, s := range a {
+		if _, ok := drop[s]; !ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
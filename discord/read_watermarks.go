@@ -0,0 +1,122 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxMentionSeqs bounds the unread mentions a membership remembers.
+const maxMentionSeqs = 100
+
+// unreadCount is a chat's unread badge for one user.
+type unreadCount struct {
+	Count    int64
+	Mentions int64
+}
+
+// advanceReadWatermark moves the user's read watermark in a chat up to seq; it never moves
+// back. Mentions at or below it are read too.
+func advanceReadWatermark(ctx context.Context, chatID, user string, seq int64) {
+	if seq <= 0 {
+		return
+	}
+	_, err := db.MembershipsCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID, "userid": user},
+		bson.M{
+			"$max":  bson.M{"lastReadSeq": seq},
+			"$set":  bson.M{"updatedAt": time.Now()},
+			"$pull": bson.M{"mentionSeqs": bson.M{"$lte": seq}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("read watermark of %s in %s not advanced: %v", user, chatID, err)
+	}
+}
+
+// trackSentMessage keeps watermarks current for a new message: senders have read their own
+// messages, and the users it mentions get an unread mention.
+func trackSentMessage(ctx context.Context, msg *models.Message) {
+	if msg.Seq <= 0 {
+		return
+	}
+	advanceReadWatermark(ctx, msg.ChatID, msg.UserID, msg.Seq)
+	for _, u := range msg.Mentions {
+		if u == msg.UserID {
+			continue
+		}
+		if _, err := db.MembershipsCollection.UpdateOne(ctx,
+			bson.M{"chatid": msg.ChatID, "userid": u},
+			bson.M{"$push": bson.M{"mentionSeqs": bson.M{"$each": bson.A{msg.Seq}, "$slice": -maxMentionSeqs}}},
+			options.Update().SetUpsert(true),
+		); err != nil {
+			log.Printf("mention of %s in %s not tracked: %v", u, msg.ChatID, err)
+		}
+	}
+}
+
+// watermarkUnreadCounts computes the user's badges from each chat's lastSeq and the user's
+// watermark in it: two indexed reads however long the chats are. Deleted messages above the
+// watermark still count until the user reads past them.
+func watermarkUnreadCounts(ctx context.Context, user string, chats []models.Chat) (map[string]unreadCount, error) {
+	cursor, err := db.MembershipsCollection.Find(ctx, bson.M{"userid": user},
+		options.Find().SetProjection(bson.M{"chatid": 1, "lastReadSeq": 1, "mentionSeqs": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var memberships []models.Membership
+	if err := cursor.All(ctx, &memberships); err != nil {
+		return nil, err
+	}
+	byChat := make(map[string]models.Membership, len(memberships))
+	for _, m := range memberships {
+		byChat[m.ChatID] = m
+	}
+
+	counts := make(map[string]unreadCount, len(chats))
+	for _, chat := range chats {
+		m := byChat[chat.ChatID]
+		c := unreadCount{Count: max(0, chat.LastSeq-m.LastReadSeq)}
+		for _, seq := range m.MentionSeqs {
+			if seq > m.LastReadSeq {
+				c.Mentions++
+			}
+		}
+		counts[chat.ChatID] = c
+	}
+	return counts, nil
+}
+
+// watermarkUnreadStages adds the user's unread count to each chat in a chat list pipeline
+// from their read watermark.
+func watermarkUnreadStages(user string) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from": db.MembershipsCollection.Name(),
+			"let":  bson.M{"cid": "$chatid"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$chatid", "$$cid"}},
+					bson.M{"$eq": bson.A{"$userid", user}},
+				}}}},
+				bson.M{"$project": bson.M{"_id": 0, "lastReadSeq": 1}},
+			},
+			"as": "membership",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"unread": bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{
+				bson.M{"$ifNull": bson.A{"$lastSeq", 0}},
+				bson.M{"$ifNull": bson.A{bson.M{"$first": "$membership.lastReadSeq"}, 0}},
+			}}}},
+		}}},
+		{{Key: "$project", Value: bson.M{"membership": 0}}},
+	}
+}
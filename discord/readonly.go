@@ -0,0 +1,134 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errReadOnly is returned by send paths while the service or chat is in read-only mode.
+var errReadOnly = errors.New("read_only")
+
+const (
+	readOnlySetting = "readOnly"      // _id of the switch in db.SettingsCollection
+	readOnlyTTL     = 5 * time.Second // how long an instance trusts its copy of the switch
+)
+
+var (
+	// envReadOnly (MERECHATS_READ_ONLY=1) keeps this instance read-only whatever the switch says.
+	envReadOnly, _ = strconv.ParseBool(os.Getenv("MERECHATS_READ_ONLY"))
+
+	// readOnlyState caches the global switch, which lives in Mongo so a toggle through the
+	// admin API reaches every instance within readOnlyTTL.
+	readOnlyState struct {
+		sync.Mutex
+		enabled bool
+		checked time.Time
+	}
+)
+
+// serviceReadOnly reports whether all sends are blocked. A failed lookup keeps the last
+// known state.
+func serviceReadOnly() bool {
+	if envReadOnly {
+		return true
+	}
+	readOnlyState.Lock()
+	defer readOnlyState.Unlock()
+	if time.Since(readOnlyState.checked) < readOnlyTTL {
+		return readOnlyState.enabled
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var setting struct {
+		Enabled bool `bson:"enabled"`
+	}
+	err := db.SettingsCollection.FindOne(ctx, bson.M{"_id": readOnlySetting}).Decode(&setting)
+	switch {
+	case err == nil || err == mongo.ErrNoDocuments:
+		readOnlyState.enabled = setting.Enabled
+	default:
+		log.Printf("read-only lookup failed: %v", err)
+	}
+	readOnlyState.checked = time.Now()
+	return readOnlyState.enabled
+}
+
+// checkWritable returns errReadOnly when sends to chat are currently disabled.
+func checkWritable(chat *models.Chat) error {
+	if serviceReadOnly() || (chat != nil && chat.ReadOnly) {
+		return errReadOnly
+	}
+	return nil
+}
+
+// GetReadOnly reports the global read-only switch.
+func GetReadOnly(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]bool{"enabled": serviceReadOnly()}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// SetReadOnly flips the global read-only switch for every instance.
+func SetReadOnly(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.SettingsCollection.UpdateOne(r.Context(),
+		bson.M{"_id": readOnlySetting},
+		bson.M{"$set": bson.M{"enabled": body.Enabled, "updatedAt": time.Now()}},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readOnlyState.Lock()
+	readOnlyState.enabled, readOnlyState.checked = body.Enabled, time.Now()
+	readOnlyState.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetChatReadOnly flips read-only mode for a single chat.
+func SetChatReadOnly(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.MereCollection.UpdateOne(r.Context(),
+		bson.M{"chatid": ps.ByName("chatid")},
+		bson.M{"$set": bson.M{"readOnly": body.Enabled, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeErr(w, "chat not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
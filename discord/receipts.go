@@ -0,0 +1,155 @@
+package discord
+
+import (
+	"context"
+	"log"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	statusSent      = "sent"
+	statusDelivered = "delivered"
+	statusRead      = "read"
+
+	maxReceiptBatch = 100
+)
+
+// parseMessageIDs converts hex ids from a client frame, skipping invalid ones.
+func parseMessageIDs(hexIDs []string) []primitive.ObjectID {
+	if len(hexIDs) > maxReceiptBatch {
+		hexIDs = hexIDs[:maxReceiptBatch]
+	}
+	ids := make([]primitive.ObjectID, 0, len(hexIDs))
+	for _, h := range hexIDs {
+		if id, err := primitive.ObjectIDFromHex(h); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// recordReceipts stores delivery or read receipts from userID, recomputes each message's
+// aggregate Status and tells the senders. kind is statusDelivered or statusRead.
+func recordReceipts(ctx context.Context, userID string, ids []primitive.ObjectID, kind string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	// receipts only count in chats userID belongs to
+	chatIDs, err := db.MessagesCollection.Distinct(ctx, "chatid", bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		log.Printf("receipts: chat lookup failed (%s): %v", userID, err)
+		return
+	}
+	chatCursor, err := db.MereCollection.Find(ctx, bson.M{"chatid": bson.M{"$in": chatIDs}, "participants": userID})
+	if err != nil {
+		log.Printf("receipts: chat lookup failed (%s): %v", userID, err)
+		return
+	}
+	var joined []models.Chat
+	if err := chatCursor.All(ctx, &joined); err != nil {
+		log.Printf("receipts: chat lookup failed (%s): %v", userID, err)
+		return
+	}
+	if len(joined) == 0 {
+		return
+	}
+	chats := make(map[string]*models.Chat, len(joined))
+	memberOf := make([]string, 0, len(joined))
+	for i := range joined {
+		chats[joined[i].ChatID] = &joined[i]
+		memberOf = append(memberOf, joined[i].ChatID)
+	}
+
+	// a read message is implicitly delivered
+	add := bson.M{"deliveredTo": userID}
+	if kind == statusRead {
+		add["readBy"] = userID
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "chatid": bson.M{"$in": memberOf}, "sender": bson.M{"$ne": userID}}
+	if _, err := db.MessagesCollection.UpdateMany(ctx, filter, bson.M{"$addToSet": add}); err != nil {
+		log.Printf("receipts: update failed (%s): %v", userID, err)
+		return
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, filter)
+	if err != nil {
+		log.Printf("receipts: reload failed (%s): %v", userID, err)
+		return
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		log.Printf("receipts: decode failed (%s): %v", userID, err)
+		return
+	}
+
+	readUpTo := make(map[string]int64) // chat => highest seq read
+	for i := range msgs {
+		msg := &msgs[i]
+		chat := chats[msg.ChatID]
+		if kind == statusRead && msg.Seq > readUpTo[msg.ChatID] {
+			readUpTo[msg.ChatID] = msg.Seq
+		}
+
+		status := aggregateStatus(msg, chat)
+		if status != msg.Status {
+			_, _ = db.MessagesCollection.UpdateOne(ctx,
+				bson.M{"_id": msg.ID},
+				bson.M{"$set": bson.M{"status": status}},
+			)
+		}
+
+		sendToUsers([]string{msg.UserID}, map[string]interface{}{
+			"type":   kind,
+			"id":     msg.ID.Hex(),
+			"chatid": msg.ChatID,
+			"by":     userID,
+			"status": status,
+		})
+	}
+	// reading a message reads everything before it
+	for chatID, seq := range readUpTo {
+		advanceReadWatermark(ctx, chatID, userID, seq)
+	}
+}
+
+// aggregateStatus is "read" once every other participant read the message,
+// "delivered" once every other participant received it, else "sent".
+func aggregateStatus(msg *models.Message, chat *models.Chat) string {
+	delivered := toSet(msg.DeliveredTo)
+	read := toSet(msg.ReadBy)
+
+	allDelivered, allRead := true, true
+	for _, p := range chat.Participants {
+		if p == msg.UserID {
+			continue
+		}
+		if _, ok := delivered[p]; !ok {
+			allDelivered = false
+		}
+		if _, ok := read[p]; !ok {
+			allRead = false
+		}
+	}
+	switch {
+	case allRead:
+		return statusRead
+	case allDelivered:
+		return statusDelivered
+	default:
+		return statusSent
+	}
+}
+
+func toSet(items []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(items))
+	for _, it := range items {
+		set[it] = struct{}{}
+	}
+	return set
+}
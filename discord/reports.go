@@ -0,0 +1,268 @@
+package discord
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/mq"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	topicMessageReported = "message-reported"
+	topicModeration      = "moderation-action"
+
+	maxReportNoteLen = 1000
+)
+
+var reportReasons = map[string]bool{
+	models.ReportSpam:       true,
+	models.ReportHarassment: true,
+	models.ReportHate:       true,
+	models.ReportViolence:   true,
+	models.ReportSexual:     true,
+	models.ReportScam:       true,
+	models.ReportOther:      true,
+}
+
+// ReportMessage files the caller's report against a message in one of their chats.
+// Each user can report a given message once.
+func ReportMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if !reportReasons[body.Reason] {
+		writeErr(w, "reason must be spam, harassment, hate, violence, sexual, scam or other", http.StatusBadRequest)
+		return
+	}
+	body.Note = strings.TrimSpace(body.Note)
+	if len([]rune(body.Note)) > maxReportNoteLen {
+		writeErr(w, "note too long", http.StatusBadRequest)
+		return
+	}
+
+	var msg models.Message
+	if err := db.MessagesCollection.FindOne(ctx, bson.M{"_id": msgID, "deleted": bson.M{"$ne": true}}).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "message not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": msg.ChatID, "participants": user}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "message not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if msg.UserID == user {
+		writeErr(w, "cannot report your own message", http.StatusBadRequest)
+		return
+	}
+
+	report := models.Report{
+		MessageID: msg.ID,
+		ChatID:    msg.ChatID,
+		Reporter:  user,
+		Reported:  msg.UserID,
+		Reason:    body.Reason,
+		Note:      body.Note,
+		Status:    models.ReportOpen,
+		CreatedAt: time.Now(),
+	}
+	res, err := db.ReportsCollection.InsertOne(ctx, report)
+	if mongo.IsDuplicateKeyError(err) {
+		writeErr(w, "already reported", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report.ID = res.InsertedID.(primitive.ObjectID)
+
+	go mq.Emit(ctx, topicMessageReported, models.Index{
+		EntityType: "message",
+		Method:     "POST",
+		EntityId:   msg.ChatID,
+		ItemId:     report.ID.Hex(),
+		ItemType:   "report",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListReports pages the moderation queue, oldest first; ?status= defaults to open.
+func ListReports(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	filter := bson.M{"status": models.ReportOpen}
+	if s := q.Get("status"); s != "" {
+		filter["status"] = s
+	}
+	if c := q.Get("chatid"); c != "" {
+		filter["chatid"] = c
+	}
+	if u := q.Get("reported"); u != "" {
+		filter["reported"] = u
+	}
+	limit := int64(50)
+	if l := q.Get("limit"); l != "" {
+		if v, err := parseInt64(l); err == nil && v > 0 && v <= 500 {
+			limit = v
+		}
+	}
+	skip := int64(0)
+	if s := q.Get("skip"); s != "" {
+		if v, err := parseInt64(s); err == nil && v >= 0 {
+			skip = v
+		}
+	}
+
+	cursor, err := db.ReportsCollection.Find(ctx, filter,
+		options.Find().SetSort(bson.M{"createdAt": 1}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var reports []models.Report
+	if err := cursor.All(ctx, &reports); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reports == nil {
+		reports = make([]models.Report, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reports); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ResolveReport closes an open report, optionally hiding the message and/or warning its
+// sender. Hiding closes every other open report on the same message too. With no actions
+// the report is dismissed.
+func ResolveReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	admin := utils.GetUserIDFromRequest(r)
+
+	reportID, err := primitive.ObjectIDFromHex(ps.ByName("reportid"))
+	if err != nil {
+		writeErr(w, "invalid reportId", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Actions []string `json:"actions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	for _, a := range body.Actions {
+		if a != models.ActionHideMessage && a != models.ActionWarnUser {
+			writeErr(w, "actions must be hide or warn", http.StatusBadRequest)
+			return
+		}
+	}
+
+	status := models.ReportDismissed
+	if len(body.Actions) > 0 {
+		status = models.ReportResolved
+	}
+	now := time.Now()
+	decision := bson.M{"status": status, "actions": body.Actions, "resolvedBy": admin, "resolvedAt": now}
+
+	var report models.Report
+	if err := db.ReportsCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": reportID, "status": models.ReportOpen},
+		bson.M{"$set": decision},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&report); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "no open report", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if utils.Contains(body.Actions, models.ActionHideMessage) {
+		var msg models.Message
+		err := db.MessagesCollection.FindOneAndUpdate(ctx,
+			bson.M{"_id": report.MessageID},
+			bson.M{"$set": bson.M{"deleted": true, "deletedAt": time.Now()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&msg)
+		if err == nil {
+			propagateMessageChange(ctx, &msg, topicMessageDeleted)
+		} else if err != mongo.ErrNoDocuments {
+			log.Printf("reports: hide %s failed: %v", report.MessageID.Hex(), err)
+		}
+		if _, err := db.ReportsCollection.UpdateMany(ctx,
+			bson.M{"messageId": report.MessageID, "status": models.ReportOpen},
+			bson.M{"$set": decision},
+		); err != nil {
+			log.Printf("reports: close duplicates of %s failed: %v", report.MessageID.Hex(), err)
+		}
+	}
+	if utils.Contains(body.Actions, models.ActionWarnUser) {
+		sendToUsers([]string{report.Reported}, map[string]interface{}{
+			"type":      "moderation_warning",
+			"chatid":    report.ChatID,
+			"messageId": report.MessageID.Hex(),
+			"reason":    report.Reason,
+		})
+	}
+
+	for _, a := range body.Actions {
+		go mq.Emit(ctx, topicModeration, models.Index{
+			EntityType: "user",
+			Method:     a,
+			EntityId:   report.Reported,
+			ItemId:     report.ID.Hex(),
+			ItemType:   "report",
+		})
+	}
+	log.Printf("reports: %s %s by %s %v", report.ID.Hex(), status, admin, body.Actions)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,107 @@
+package discord
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// errWrongRegion is returned when a chat's data must stay in a region this instance does not serve.
+var errWrongRegion = errors.New("data residency: chat is pinned to another region")
+
+var (
+	regionRe = regexp.MustCompile(`^[a-z0-9\-]{1,32}$`)
+
+	// localRegion is the region this instance stores data in (APP_REGION); empty means unrestricted.
+	localRegion = strings.ToLower(os.Getenv("APP_REGION"))
+
+	// tenantResidency pins chats of a tenant (the chat's entity id) to a region,
+	// seeded from RESIDENCY_TENANTS="entityId=region,...".
+	tenantResidency = parseTenantResidency(os.Getenv("RESIDENCY_TENANTS"))
+)
+
+func parseTenantResidency(raw string) map[string]string {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		tenant, region, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		region = strings.ToLower(strings.TrimSpace(region))
+		if ok && tenant != "" && regionRe.MatchString(region) {
+			out[strings.TrimSpace(tenant)] = region
+		}
+	}
+	return out
+}
+
+// residencyFor picks the region for a new chat: an explicit request, else its tenant's pin,
+// else this instance's region.
+func residencyFor(requested, entityID string) (string, error) {
+	if requested = strings.ToLower(strings.TrimSpace(requested)); requested != "" {
+		if !regionRe.MatchString(requested) {
+			return "", errors.New("invalid residency")
+		}
+		if pinned, ok := tenantResidency[entityID]; ok && pinned != requested {
+			return "", errors.New("residency conflicts with tenant policy")
+		}
+		return requested, nil
+	}
+	if pinned, ok := tenantResidency[entityID]; ok {
+		return pinned, nil
+	}
+	return localRegion, nil
+}
+
+// checkResidency rejects storing or exporting a chat's data from an instance outside its region.
+// Untagged chats and unregioned instances are unrestricted.
+func checkResidency(chat *models.Chat) error {
+	if chat == nil || chat.Residency == "" || localRegion == "" || chat.Residency == localRegion {
+		return nil
+	}
+	return errWrongRegion
+}
+
+// writeResidencyErr answers with 421 so a regional gateway can retry against the right region.
+func writeResidencyErr(w http.ResponseWriter, chat *models.Chat) {
+	w.Header().Set("X-Data-Region", chat.Residency)
+	writeErr(w, errWrongRegion.Error(), http.StatusMisdirectedRequest)
+}
+
+// SetChatResidency tags a chat with the region its data must stay in. An empty region clears the tag.
+func SetChatResidency(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		Region string `json:"region"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	region := strings.ToLower(strings.TrimSpace(body.Region))
+	if region != "" && !regionRe.MatchString(region) {
+		writeErr(w, "invalid region", http.StatusBadRequest)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"residency": region, "updatedAt": time.Now()}}
+	if region == "" {
+		update = bson.M{"$unset": bson.M{"residency": ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	}
+	res, err := db.MereCollection.UpdateOne(r.Context(), bson.M{"chatid": ps.ByName("chatid")}, update)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeErr(w, "chat not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
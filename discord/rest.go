@@ -1,11 +1,17 @@
 package discord
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log"
+	"mime/multipart"
 	"naevis/db"
+	"naevis/filemgr"
 	"naevis/models"
 	"naevis/utils"
 	"net/http"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -55,11 +61,24 @@ func EditMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		writeErr(w, "content required", http.StatusBadRequest)
 		return
 	}
+	var chat models.Chat
+	_ = db.MereCollection.FindOne(ctx, bson.M{"chatid": existing.ChatID}).Decode(&chat)
+	body.Content = normalizeShortcodes(body.Content, &chat)
+	if err := filterContent(&chat, user, body.Content); err != nil {
+		rej, _ := asRejection(err)
+		writeRejection(w, rej)
+		return
+	}
+	entities := parseEntities(body.Content, &chat)
+	mentions := parseUserMentions(body.Content, &chat, user)
 	now := time.Now()
-	res, err := db.MessagesCollection.UpdateOne(ctx,
-		bson.M{"_id": msgID},
-		bson.M{"$set": bson.M{"content": body.Content, "editedAt": now}},
-	)
+	update := bson.M{"$set": bson.M{"content": body.Content, "entities": entities, "mentions": mentions, "editedAt": now}}
+	oldLink := firstLink(&existing)
+	relink := oldLink != firstLink(&models.Message{Entities: entities})
+	if relink && existing.LinkPreview != nil {
+		update["$unset"] = bson.M{"linkPreview": ""}
+	}
+	res, err := db.MessagesCollection.UpdateOne(ctx, bson.M{"_id": msgID}, update)
 	if err != nil {
 		writeErr(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -68,6 +87,12 @@ func EditMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		writeErr(w, "not found or no permission", http.StatusNotFound)
 		return
 	}
+	existing.Content, existing.Entities, existing.Mentions, existing.EditedAt = body.Content, entities, mentions, &now
+	if relink {
+		existing.LinkPreview = nil
+		go attachLinkPreview(chat, existing)
+	}
+	propagateMessageChange(ctx, &existing, topicMessageEdited)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -100,7 +125,7 @@ func DeleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 
 	res, err := db.MessagesCollection.UpdateOne(ctx,
 		bson.M{"_id": msgID},
-		bson.M{"$set": bson.M{"deleted": true}},
+		bson.M{"$set": bson.M{"deleted": true, "deletedAt": time.Now()}},
 	)
 	if err != nil {
 		writeErr(w, err.Error(), http.StatusInternalServerError)
@@ -110,6 +135,8 @@ func DeleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		writeErr(w, "not found or no permission", http.StatusNotFound)
 		return
 	}
+	existing.Deleted = true
+	propagateMessageChange(ctx, &existing, topicMessageDeleted)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -119,7 +146,8 @@ func SearchMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 
 	chatID := ps.ByName("chatid")
 	// verify access
-	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
 		if err == mongo.ErrNoDocuments {
 			writeErr(w, "not found or access denied", http.StatusNotFound)
 			return
@@ -128,47 +156,49 @@ func SearchMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		return
 	}
 
-	term := r.URL.Query().Get("term")
+	query := r.URL.Query()
+	q := searchQuery{
+		ChatID:    chatID,
+		Term:      strings.TrimSpace(query.Get("term")),
+		Sender:    query.Get("sender"),
+		MediaOnly: query.Get("media") == "1" || query.Get("media") == "true",
+		Since:     historyFloor(&chat, user),
+	}
+	for param, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if raw := query.Get(param); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeErr(w, "invalid "+param+" (want RFC3339)", http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
 
 	// pagination
-	limit := int64(50)
-	if l := r.URL.Query().Get("limit"); l != "" {
+	q.Limit = 50
+	if l := query.Get("limit"); l != "" {
 		if v, err := parseInt64(l); err == nil && v > 0 {
-			limit = v
+			q.Limit = v
 		}
 	}
-	skip := int64(0)
-	if s := r.URL.Query().Get("skip"); s != "" {
+	if s := query.Get("skip"); s != "" {
 		if v, err := parseInt64(s); err == nil && v >= 0 {
-			skip = v
+			q.Skip = v
 		}
 	}
 
-	filter := bson.M{"chatid": chatID, "deleted": bson.M{"$ne": true}}
-	if term != "" {
-		filter["content"] = bson.M{"$regex": primitive.Regex{Pattern: term, Options: "i"}}
-	}
-
-	opts := options.Find().
-		SetSort(bson.M{"createdAt": 1}).
-		SetLimit(limit).
-		SetSkip(skip)
-
-	cursor, err := db.MessagesCollection.Find(ctx, filter, opts)
+	msgs, err := runSearch(ctx, q)
 	if err != nil {
 		writeErr(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var msgs []models.Message
-	if err := cursor.All(ctx, &msgs); err != nil {
-		writeErr(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 	if msgs == nil {
 		msgs = make([]models.Message, 0)
 	}
+	attachSenderBadges(ctx, &chat, msgs)
+	attachSenderProfiles(ctx, msgs)
+	signMessageMedia(msgs, user)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(msgs); err != nil {
@@ -177,8 +207,9 @@ func SearchMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	}
 }
 
-// GetUnreadCount returns unread counts per chat the user participates in.
-// Uses an aggregation for message counts and merges results with the chat list so chats with zero unread are included.
+// GetUnreadCount returns unread counts per chat the user participates in, chats with zero
+// unread included. With messageSeqs the counts come from read watermarks in constant time
+// per chat; before that, from an aggregation over readBy.
 func GetUnreadCount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	user := utils.GetUserIDFromRequest(r)
 	ctx := r.Context()
@@ -197,6 +228,41 @@ func GetUnreadCount(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		return
 	}
 
+	var counts map[string]unreadCount
+	if messageSeqs {
+		counts, err = watermarkUnreadCounts(ctx, user, chats)
+	} else {
+		counts, err = readByUnreadCounts(ctx, user)
+	}
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type Unread struct {
+		ChatID   string `json:"chatid"`
+		Count    int64  `json:"count"`
+		Mentions int64  `json:"mentions"` // unread messages mentioning the user directly
+	}
+	var result []Unread
+	for _, chat := range chats {
+		c := counts[chat.ChatID]
+		result = append(result, Unread{ChatID: chat.ChatID, Count: c.Count, Mentions: c.Mentions})
+	}
+	if result == nil {
+		result = make([]Unread, 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// readByUnreadCounts counts unread, non-deleted messages per chat by scanning readBy. It
+// serves until the readby-to-seq migration has run and MESSAGE_SEQ is on; its cost grows
+// with every unread message the user has.
+func readByUnreadCounts(ctx context.Context, user string) (map[string]unreadCount, error) {
 	// Aggregation: group unread, non-deleted messages by chatid
 	pipeline := mongo.Pipeline{
 		{{Key: "$match", Value: bson.D{
@@ -206,47 +272,34 @@ func GetUnreadCount(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		{{Key: "$group", Value: bson.D{
 			{Key: "_id", Value: "$chatid"},
 			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "mentions", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$in", Value: bson.A{user, bson.D{{Key: "$ifNull", Value: bson.A{"$mentions", bson.A{}}}}}}},
+				1, 0,
+			}}}}}},
 		}}},
 	}
 
 	aggCursor, err := db.MessagesCollection.Aggregate(ctx, pipeline)
 	if err != nil {
-		writeErr(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer aggCursor.Close(ctx)
 
 	type aggRes struct {
-		ID    string `bson:"_id"`
-		Count int64  `bson:"count"`
+		ID       string `bson:"_id"`
+		Count    int64  `bson:"count"`
+		Mentions int64  `bson:"mentions"`
 	}
 
-	countMap := make(map[string]int64, 0)
+	countMap := make(map[string]unreadCount)
 	for aggCursor.Next(ctx) {
 		var a aggRes
 		if err := aggCursor.Decode(&a); err != nil {
 			continue
 		}
-		countMap[a.ID] = a.Count
-	}
-
-	type Unread struct {
-		ChatID string `json:"chatid"`
-		Count  int64  `json:"count"`
-	}
-	var result []Unread
-	for _, chat := range chats {
-		c := countMap[chat.ChatID]
-		result = append(result, Unread{ChatID: chat.ChatID, Count: c})
-	}
-	if result == nil {
-		result = make([]Unread, 0)
-	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(result); err != nil {
-		writeErr(w, "failed to encode response", http.StatusInternalServerError)
-		return
+		countMap[a.ID] = unreadCount{Count: a.Count, Mentions: a.Mentions}
 	}
+	return countMap, nil
 }
 
 func MarkAsRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -258,22 +311,31 @@ func MarkAsRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 	user := utils.GetUserIDFromRequest(r)
 
-	res, err := db.MessagesCollection.UpdateOne(ctx,
-		bson.M{"_id": msgID},
-		bson.M{"$addToSet": bson.M{"readBy": user}},
-	)
-	if err != nil {
-		writeErr(w, err.Error(), http.StatusInternalServerError)
-		return
+	// messages in chats the caller isn't in look the same as missing ones
+	var msg struct {
+		ChatID string `bson:"chatid"`
 	}
-	if res.MatchedCount == 0 {
-		writeErr(w, "message not found", http.StatusNotFound)
+	err = db.MessagesCollection.FindOne(ctx, bson.M{"_id": msgID}, options.FindOne().SetProjection(bson.M{"chatid": 1})).Decode(&msg)
+	if err == nil {
+		err = db.MereCollection.FindOne(ctx, bson.M{"chatid": msg.ChatID, "participants": user}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	}
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "message not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	// records the receipt, recomputes status and notifies the sender
+	recordReceipts(ctx, user, []primitive.ObjectID{msgID}, statusRead)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// UploadAttachment handles media/file upload into a chat
+// UploadAttachment handles media/file upload into a chat.
+// The file is either sent directly as multipart "file" (with an optional hex SHA-256 in the
+// "sha256" field or X-Content-SHA256 header that must match before the file is kept), or
+// referenced by an already saved "savedname"/"contenttype" pair.
 func UploadAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ctx := r.Context()
 	user := utils.GetUserIDFromRequest(r)
@@ -293,13 +355,44 @@ func UploadAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 		writeErr(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+	if err := checkResidency(&chat); err != nil {
+		writeResidencyErr(w, &chat)
+		return
+	}
+
+	media := &models.Media{URL: savedName, Type: contentType}
+	var verdict *filemgr.ModerationVerdict
+	if r.MultipartForm != nil && len(r.MultipartForm.File["file"]) > 0 {
+		saved, status, err := saveChatUpload(r, &chat, user, r.MultipartForm.File["file"][0])
+		if q, ok := asQuotaExceeded(err); ok {
+			writeQuotaErr(w, q)
+			return
+		}
+		if rej, ok := asRejection(err); ok {
+			writeRejection(w, rej)
+			return
+		}
+		if err != nil {
+			writeErr(w, err.Error(), status)
+			return
+		}
+		media, verdict = savedMedia(saved), saved.Moderation
+	}
 
 	// Persist media message
-	msg, err := persistMediaMessage(ctx, chatID, user, savedName, contentType)
+	msg, err := persistMediaMessage(ctx, chatID, user, media)
 	if err != nil {
-		writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
 		return
 	}
+	reportModeratedUpload(ctx, msg, verdict)
+	signMedia(msg, user)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(msg); err != nil {
@@ -309,6 +402,113 @@ func UploadAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}
 }
 
+// saveChatUpload stores a directly uploaded chat attachment, verifying the client checksum if given,
+// and records it for auditing. It returns the HTTP status to use when saving fails; uploads over
+// the user's storage quota fail with *quotaExceeded.
+func saveChatUpload(r *http.Request, chat *models.Chat, user string, header *multipart.FileHeader) (filemgr.SavedFile, int, error) {
+	picType, ok := chatPictureType(header.Header.Get("Content-Type"))
+	if !ok {
+		return filemgr.SavedFile{}, http.StatusBadRequest, errors.New("unsupported file type")
+	}
+	if err := checkQuota(r.Context(), user, header.Size); err != nil {
+		if _, ok := asQuotaExceeded(err); ok {
+			return filemgr.SavedFile{}, http.StatusRequestEntityTooLarge, err
+		}
+		return filemgr.SavedFile{}, http.StatusInternalServerError, errors.New("internal error")
+	}
+
+	expected := strings.TrimSpace(r.FormValue("sha256"))
+	if expected == "" {
+		expected = strings.TrimSpace(r.Header.Get("X-Content-SHA256"))
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return filemgr.SavedFile{}, http.StatusBadRequest, errors.New("cannot read file")
+	}
+	saved, err := filemgr.SaveFileForTenant(file, header, filemgr.EntityChat, chat.EntityId, picType, expected)
+	if err != nil {
+		status, err := uploadError(err)
+		return saved, status, err
+	}
+	auditChatUpload(r.Context(), chat.ChatID, user, picType, saved)
+	return saved, http.StatusOK, nil
+}
+
+// uploadError maps a filemgr save error to the status and message shown to the client.
+func uploadError(err error) (int, error) {
+	switch {
+	case errors.Is(err, filemgr.ErrChecksumMismatch):
+		return http.StatusUnprocessableEntity, errors.New("checksum mismatch")
+	case errors.Is(err, filemgr.ErrFileTooLarge):
+		return http.StatusRequestEntityTooLarge, errors.New("file too large")
+	case errors.Is(err, filemgr.ErrInvalidExtension), errors.Is(err, filemgr.ErrInvalidMIME):
+		return http.StatusBadRequest, errors.New("unsupported file type")
+	case errors.Is(err, filemgr.ErrContentRejected):
+		return http.StatusUnprocessableEntity, &contentRejection{Code: "image_rejected", Reason: "image was rejected by moderation"}
+	default:
+		return http.StatusInternalServerError, errors.New("cannot save file")
+	}
+}
+
+// auditChatUpload records a saved chat upload so the janitor can track it.
+func auditChatUpload(ctx context.Context, chatID, user string, picType filemgr.PictureType, saved filemgr.SavedFile) {
+	var pages int
+	if saved.Document != nil {
+		pages = saved.Document.Pages
+	}
+	if err := recordAttachment(ctx, &models.Attachment{
+		ChatID:     chatID,
+		UploaderID: user,
+		Name:       saved.Name,
+		Path:       filepath.Join(filemgr.ResolvePath(filemgr.EntityChat, picType), saved.Name),
+		MIME:       saved.MIME,
+		Size:       saved.Size,
+		SHA256:     saved.SHA256,
+		Pages:      pages,
+		Processing: saved.Processing,
+	}); err != nil {
+		log.Printf("attachment audit failed (%s): %v", saved.Name, err)
+	}
+	if saved.Audio != nil {
+		recordAudioMetadata(ctx, chatID, saved)
+		queueTranscription(picType, saved)
+	}
+	if saved.Moderation != nil {
+		recordModeration(ctx, chatID, saved)
+	}
+}
+
+// savedMedia describes a saved upload as message media.
+func savedMedia(saved filemgr.SavedFile) *models.Media {
+	media := &models.Media{URL: saved.Name, Type: saved.MIME, Size: saved.Size, SHA256: saved.SHA256}
+	if saved.Audio != nil {
+		media.Duration, media.Waveform = saved.Audio.Duration, saved.Audio.Waveform
+	}
+	media.Sensitive = saved.Moderation != nil && saved.Moderation.Action == filemgr.ModerationBlur
+	media.HLS, media.Animated = saved.HLS, saved.Animated
+	if saved.Document != nil {
+		media.Pages, media.Preview = saved.Document.Pages, saved.Document.Preview
+	}
+	return media
+}
+
+// chatPictureType maps an upload's declared content type to the filemgr picture type.
+func chatPictureType(contentType string) (filemgr.PictureType, bool) {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return filemgr.PicPhoto, true
+	case strings.HasPrefix(contentType, "video/"):
+		return filemgr.PicVideo, true
+	case strings.HasPrefix(contentType, "audio/"):
+		return filemgr.PicAudio, true
+	case strings.HasPrefix(contentType, "application/"), strings.HasPrefix(contentType, "text/"):
+		return filemgr.PicFile, true
+	default:
+		return "", false
+	}
+}
+
 // // UploadAttachment handles media/file upload into a chat
 // func UploadAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 // 	ctx := r.Context()
@@ -421,23 +621,33 @@ func GetUserChats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		}
 	}
 
-	findOpts := options.Find().SetSkip(skip).SetLimit(limit).SetSort(bson.D{{Key: "updatedAt", Value: -1}})
+	filter := r.URL.Query().Get("filter")
+	switch filter {
+	case "", chatFilterArchived, chatFilterActive, chatFilterPinned:
+	default:
+		writeErr(w, "filter must be archived, active or pinned", http.StatusBadRequest)
+		return
+	}
 
-	cursor, err := db.MereCollection.Find(ctx, bson.M{"participants": user}, findOpts)
+	cursor, err := db.MereCollection.Aggregate(ctx, chatListPipeline(user, filter, skip, limit))
 	if err != nil {
 		writeErr(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer cursor.Close(ctx)
 
-	var chats []models.Chat
+	var chats []chatListItem
 	if err := cursor.All(ctx, &chats); err != nil {
 		writeErr(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if chats == nil {
-		chats = make([]models.Chat, 0)
+		chats = make([]chatListItem, 0)
+	}
+	for i := range chats {
+		chats[i].fillFromSummary(ctx, user)
+		flagListCollisions(ctx, &chats[i])
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -479,6 +689,7 @@ func StartNewChat(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		Participants []string `json:"participants"`
 		EntityType   string   `json:"entityType"`
 		EntityId     string   `json:"entityId"`
+		Residency    string   `json:"residency"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
@@ -490,6 +701,11 @@ func StartNewChat(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		writeErr(w, "participants required", http.StatusBadRequest)
 		return
 	}
+	residency, err := residencyFor(body.Residency, body.EntityId)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Deduplicate and include requester
 	seen := make(map[string]struct{})
@@ -511,6 +727,10 @@ func StartNewChat(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		writeErr(w, "no valid participants", http.StatusBadRequest)
 		return
 	}
+	if len(participants) > maxParticipants {
+		writeErrCode(w, http.StatusBadRequest, errCodeChatFull, errChatFull.Error(), nil)
+		return
+	}
 
 	// Sort participants for consistent array ordering
 	sort.Strings(participants)
@@ -527,7 +747,7 @@ func StartNewChat(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 
 	var existing models.Chat
-	err := db.MereCollection.FindOne(ctx, filter).Decode(&existing)
+	err = db.MereCollection.FindOne(ctx, filter).Decode(&existing)
 	if err == nil {
 		// Chat already exists
 		w.Header().Set("Content-Type", "application/json")
@@ -547,6 +767,8 @@ func StartNewChat(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		EntityId:     body.EntityId,
 		CreatedAt:    now,
 		UpdatedAt:    now,
+		Admins:       []string{user},
+		Residency:    residency,
 	}
 
 	_, err = db.MereCollection.InsertOne(ctx, newChat)
@@ -774,10 +996,11 @@ func GetChatMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	}
 
 	// verify user can access the chat
+	var chat models.Chat
 	if err := db.MereCollection.FindOne(ctx, bson.M{
 		"chatid":       chatID,
 		"participants": user,
-	}).Err(); err != nil {
+	}).Decode(&chat); err != nil {
 		if err == mongo.ErrNoDocuments {
 			writeErr(w, "not found or access denied", http.StatusNotFound)
 			return
@@ -793,18 +1016,31 @@ func GetChatMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 			limit = v
 		}
 	}
-	skip := int64(0)
-	if s := r.URL.Query().Get("skip"); s != "" {
-		if v, err := parseInt64(s); err == nil && v >= 0 {
-			skip = v
-		}
-	}
 
 	// exclude deleted messages
 	filter := bson.M{
 		"chatid":  chatID, // field in messages collection
 		"deleted": bson.M{"$ne": true},
 	}
+	applyHistoryFloor(filter, &chat, user)
+
+	if before, after := r.URL.Query().Get("before"), r.URL.Query().Get("after"); before != "" || after != "" {
+		getChatMessagesByCursor(w, r, &chat, filter, before, after, limit)
+		return
+	}
+	if from, to := r.URL.Query().Get("fromSeq"), r.URL.Query().Get("toSeq"); from != "" || to != "" {
+		getChatMessagesBySeq(w, r, &chat, filter, from, to, limit)
+		return
+	}
+
+	// Deprecated: skip/limit pagination, kept for older clients
+	skip := int64(0)
+	if s := r.URL.Query().Get("skip"); s != "" {
+		if v, err := parseInt64(s); err == nil && v >= 0 {
+			skip = v
+		}
+		w.Header().Set("Deprecation", "true")
+	}
 	opts := options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(limit).SetSkip(skip)
 	cursor, err := db.MessagesCollection.Find(ctx, filter, opts)
 	if err != nil {
@@ -821,6 +1057,9 @@ func GetChatMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	if msgs == nil {
 		msgs = make([]models.Message, 0)
 	}
+	attachSenderBadges(ctx, &chat, msgs)
+	attachSenderProfiles(ctx, msgs)
+	signMessageMedia(msgs, user)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(msgs); err != nil {
@@ -829,6 +1068,125 @@ func GetChatMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	}
 }
 
+// getChatMessagesByCursor pages through a chat by message id. "before" walks back in history,
+// "after" walks forward; messages are always returned oldest first and nextCursor continues
+// in the same direction.
+func getChatMessagesByCursor(w http.ResponseWriter, r *http.Request, chat *models.Chat, filter bson.M, before, after string, limit int64) {
+	ctx := r.Context()
+
+	hex, op, order := before, "$lt", -1
+	if before == "" {
+		hex, op, order = after, "$gt", 1
+	}
+	cursorID, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		writeErr(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+	filter["_id"] = bson.M{op: cursorID}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: order}}).SetLimit(limit + 1)
+	cursor, err := db.MessagesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := int64(len(msgs)) > limit
+	if hasMore {
+		msgs = msgs[:limit]
+	}
+	var next string
+	if hasMore {
+		next = msgs[len(msgs)-1].ID.Hex()
+	}
+	if order < 0 {
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
+	if msgs == nil {
+		msgs = make([]models.Message, 0)
+	}
+	attachSenderBadges(ctx, chat, msgs)
+	attachSenderProfiles(ctx, msgs)
+	signMessageMedia(msgs, utils.GetUserIDFromRequest(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages":   msgs,
+		"nextCursor": next,
+		"hasMore":    hasMore,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getChatMessagesBySeq returns the messages with fromSeq <= seq <= toSeq, either bound
+// optional, oldest first. Clients use it to fill gaps they detect in the seqs they hold;
+// deleted messages leave holes, which lastSeq on the chat lets them tell apart from loss.
+func getChatMessagesBySeq(w http.ResponseWriter, r *http.Request, chat *models.Chat, filter bson.M, from, to string, limit int64) {
+	ctx := r.Context()
+
+	bounds := bson.M{"$gte": int64(1)}
+	if from != "" {
+		v, err := parseInt64(from)
+		if err != nil || v < 1 {
+			writeErr(w, "invalid fromSeq", http.StatusBadRequest)
+			return
+		}
+		bounds["$gte"] = v
+	}
+	if to != "" {
+		v, err := parseInt64(to)
+		if err != nil || v < 1 {
+			writeErr(w, "invalid toSeq", http.StatusBadRequest)
+			return
+		}
+		bounds["$lte"] = v
+	}
+	filter["seq"] = bounds
+
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(limit + 1)
+	cursor, err := db.MessagesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := int64(len(msgs)) > limit
+	if hasMore {
+		msgs = msgs[:limit]
+	}
+	if msgs == nil {
+		msgs = make([]models.Message, 0)
+	}
+	attachSenderBadges(ctx, chat, msgs)
+	attachSenderProfiles(ctx, msgs)
+	signMessageMedia(msgs, utils.GetUserIDFromRequest(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": msgs,
+		"lastSeq":  chat.LastSeq,
+		"hasMore":  hasMore,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
 // SendMessageREST handles plain text messages via HTTP
 func SendMessageREST(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ctx := r.Context()
@@ -837,7 +1195,8 @@ func SendMessageREST(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 
 	// verify access
 	user := utils.GetUserIDFromRequest(r)
-	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
 		if err == mongo.ErrNoDocuments {
 			writeErr(w, "not found or access denied", http.StatusNotFound)
 			return
@@ -849,6 +1208,7 @@ func SendMessageREST(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	var body struct {
 		Content  string `json:"content"`
 		ClientID string `json:"clientId,omitempty"`
+		ReplyTo  string `json:"replyTo,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeErr(w, "invalid body", http.StatusBadRequest)
@@ -859,7 +1219,14 @@ func SendMessageREST(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 		return
 	}
 
-	msg, err := persistMessage(ctx, chatID, user, body.Content, "", "")
+	msg, err := sendChatMessage(ctx, &chat, user, body.Content, "", "", body.ReplyTo, body.ClientID)
+	if rej, ok := asRejection(err); ok {
+		writeRejection(w, rej)
+		return
+	}
+	if err != nil && writeSendErr(w, err) {
+		return
+	}
 	if err != nil {
 		writeErr(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -873,6 +1240,13 @@ func SendMessageREST(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 		"createdAt": msg.CreatedAt,
 		"media":     msg.Media,
 		"chatid":    msg.ChatID,
+		"seq":       msg.Seq,
+	}
+	if len(msg.MentionGroups) > 0 {
+		resp["mentionGroups"] = msg.MentionGroups
+	}
+	if msg.ReplyTo != nil {
+		resp["replyTo"] = msg.ReplyTo.Hex()
 	}
 	if body.ClientID != "" {
 		resp["clientId"] = body.ClientID
@@ -0,0 +1,391 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxUploadChunk = 8 << 20        // bytes per PATCH; small enough to beat the server read timeout on slow links
+	staleUploadAge = 24 * time.Hour // staged uploads idle this long are discarded
+)
+
+// Per-user caps on staged uploads, so one user can't fill the shared staging disk with
+// sessions they never finish: at most maxOpenUploads at once (UPLOAD_MAX_OPEN, default 5)
+// whose declared sizes add up to at most maxStagedBytes (UPLOAD_MAX_STAGED_MB, default 2048).
+var (
+	maxOpenUploads       = int(envFloat("UPLOAD_MAX_OPEN", 5))
+	maxStagedBytes int64 = int64(envFloat("UPLOAD_MAX_STAGED_MB", 2048)) << 20
+)
+
+var errTooManyUploads = errors.New("too many uploads in progress; finish or cancel one first")
+
+// reserveUpload counts a staged upload against its owner's caps. Each owner has one document
+// listing their open sessions; the caps are checked in the filter of a single upsert, so
+// concurrent inits on any instance can't overshoot. When the caps are full the filter misses
+// and the upsert collides with the existing _id; a collision can also be two first uploads
+// racing to create the document, so it is retried once before the upload is refused.
+func reserveUpload(ctx context.Context, u *filemgr.Upload) error {
+	if u.Size > maxStagedBytes {
+		return errTooManyUploads
+	}
+	filter := bson.M{
+		"_id": u.Owner,
+		fmt.Sprintf("sessions.%d", maxOpenUploads-1): bson.M{"$exists": false},
+		"$expr": bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{bson.M{"$sum": "$sessions.size"}, u.Size}},
+			maxStagedBytes,
+		}},
+	}
+	push := bson.M{"$push": bson.M{"sessions": bson.M{"id": u.ID, "size": u.Size, "createdAt": u.CreatedAt}}}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err = db.StagedUploadsCollection.UpdateOne(ctx, filter, push, options.Update().SetUpsert(true))
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return errTooManyUploads
+}
+
+// releaseUpload gives back a finished or discarded upload's reservation.
+func releaseUpload(ctx context.Context, u *filemgr.Upload) {
+	if _, err := db.StagedUploadsCollection.UpdateOne(ctx,
+		bson.M{"_id": u.Owner},
+		bson.M{"$pull": bson.M{"sessions": bson.M{"id": u.ID}}},
+	); err != nil {
+		log.Printf("resumable upload %s: release failed: %v", u.ID, err)
+	}
+}
+
+// discardUpload removes a staged upload and its reservation.
+func discardUpload(ctx context.Context, u *filemgr.Upload) {
+	u.Abort()
+	releaseUpload(ctx, u)
+}
+
+// pruneUploadReservations drops reservations made before cutoff whose staged upload is gone,
+// e.g. swept by the janitor or lost with an instance, and returns how many it dropped.
+func pruneUploadReservations(ctx context.Context, cutoff time.Time) (int, error) {
+	cursor, err := db.StagedUploadsCollection.Find(ctx, bson.M{"sessions.createdAt": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, err
+	}
+	var owners []struct {
+		Owner    string `bson:"_id"`
+		Sessions []struct {
+			ID        string    `bson:"id"`
+			CreatedAt time.Time `bson:"createdAt"`
+		} `bson:"sessions"`
+	}
+	if err := cursor.All(ctx, &owners); err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, o := range owners {
+		var gone []string
+		for _, s := range o.Sessions {
+			if !s.CreatedAt.Before(cutoff) {
+				continue
+			}
+			if _, err := filemgr.LoadUpload(s.ID); errors.Is(err, filemgr.ErrUploadNotFound) {
+				gone = append(gone, s.ID)
+			}
+		}
+		if len(gone) == 0 {
+			continue
+		}
+		if _, err := db.StagedUploadsCollection.UpdateOne(ctx,
+			bson.M{"_id": o.Owner},
+			bson.M{"$pull": bson.M{"sessions": bson.M{"id": bson.M{"$in": gone}}}},
+		); err != nil {
+			return pruned, err
+		}
+		pruned += len(gone)
+	}
+	return pruned, nil
+}
+
+// InitResumableUpload starts a resumable upload into a chat. Body:
+// {"chatid", "filename", "contentType", "size", "sha256"}; sha256 (hex) is optional and
+// verified on completion. The client then PATCHes chunks to /merechats/uploads/:uploadid and
+// POSTs .../complete. It is mounted at POST /merechats/uploads rather than .../init, which
+// httprouter can't register beside the :uploadid wildcard.
+func InitResumableUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	var body struct {
+		ChatID      string `json:"chatid"`
+		Filename    string `json:"filename"`
+		ContentType string `json:"contentType"`
+		Size        int64  `json:"size"`
+		SHA256      string `json:"sha256"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": body.ChatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "chat not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+	if err := checkResidency(&chat); err != nil {
+		writeResidencyErr(w, &chat)
+		return
+	}
+	picType, ok := chatPictureType(body.ContentType)
+	if !ok {
+		writeErr(w, "unsupported file type", http.StatusBadRequest)
+		return
+	}
+	if err := checkQuota(ctx, user, body.Size); err != nil {
+		if q, ok := asQuotaExceeded(err); ok {
+			writeQuotaErr(w, q)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	upload, err := filemgr.InitUpload(filemgr.Upload{
+		Owner:       user,
+		Filename:    body.Filename,
+		ContentType: body.ContentType,
+		Size:        body.Size,
+		SHA256:      strings.TrimSpace(body.SHA256),
+		Entity:      filemgr.EntityChat,
+		Tenant:      chat.EntityId,
+		PicType:     picType,
+		Meta:        chat.ChatID,
+	}, 0)
+	if err != nil {
+		status, err := uploadError(err)
+		writeErr(w, err.Error(), status)
+		return
+	}
+	if err := reserveUpload(ctx, upload); err != nil {
+		upload.Abort()
+		if errors.Is(err, errTooManyUploads) {
+			writeErr(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/merechats/uploads/"+upload.ID)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        upload.ID,
+		"size":      upload.Size,
+		"offset":    0,
+		"chunkSize": maxUploadChunk,
+	}); err != nil {
+		log.Printf("failed to encode response: %v", err)
+	}
+}
+
+// ownUpload loads the caller's staged upload, writing the error response when it can't.
+func ownUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *filemgr.Upload {
+	upload, err := filemgr.LoadUpload(ps.ByName("uploadid"))
+	if err != nil || upload.Owner != utils.GetUserIDFromRequest(r) {
+		if err != nil && !errors.Is(err, filemgr.ErrUploadNotFound) {
+			log.Printf("resumable upload load failed: %v", err)
+		}
+		writeErr(w, "upload not found", http.StatusNotFound)
+		return nil
+	}
+	return upload
+}
+
+// GetResumableUpload reports how much of an upload the server has, so a client can resume.
+func GetResumableUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload := ownUpload(w, r, ps)
+	if upload == nil {
+		return
+	}
+	offset, err := upload.Offset()
+	if err != nil {
+		writeErr(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     upload.ID,
+		"size":   upload.Size,
+		"offset": offset,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// PatchResumableUpload appends one chunk. The Content-Range header ("bytes 0-1048575/5242880")
+// must start at the current offset; on a mismatch the server's offset is returned with 409
+// in the Upload-Offset header.
+func PatchResumableUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload := ownUpload(w, r, ps)
+	if upload == nil {
+		return
+	}
+	start, end, err := parseContentRange(r.Header.Get("Content-Range"), upload.Size)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if end-start+1 > maxUploadChunk {
+		writeErr(w, fmt.Sprintf("chunk larger than %d bytes", maxUploadChunk), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	offset, err := upload.WriteChunk(start, http.MaxBytesReader(w, r.Body, end-start+1))
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	switch {
+	case errors.Is(err, filemgr.ErrOffsetMismatch):
+		writeErr(w, "chunk does not start at the upload offset", http.StatusConflict)
+		return
+	case errors.Is(err, filemgr.ErrUploadNotFound):
+		writeErr(w, "upload not found", http.StatusNotFound)
+		return
+	case errors.Is(err, filemgr.ErrFileTooLarge):
+		writeErr(w, "chunk runs past the declared size", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		// the received part is kept; the client resumes from Upload-Offset
+		writeErr(w, "incomplete chunk", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"offset":   offset,
+		"complete": offset == upload.Size,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseContentRange parses "bytes start-end/total" and checks it against the declared size.
+// The total may be "*".
+func parseContentRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	rng, total, ok2 := strings.Cut(spec, "/")
+	from, to, ok3 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, errors.New("invalid Content-Range")
+	}
+	start, err1 := strconv.ParseInt(from, 10, 64)
+	end, err2 := strconv.ParseInt(to, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start || end >= size {
+		return 0, 0, errors.New("invalid Content-Range")
+	}
+	if total != "*" && total != strconv.FormatInt(size, 10) {
+		return 0, 0, errors.New("Content-Range total does not match the upload size")
+	}
+	return start, end, nil
+}
+
+// CompleteResumableUpload finishes an upload once every byte is in and posts it to the chat
+// as a media message, like UploadAttachment.
+func CompleteResumableUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	upload := ownUpload(w, r, ps)
+	if upload == nil {
+		return
+	}
+
+	// membership may have changed while the upload ran
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": upload.Meta, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			discardUpload(ctx, upload)
+			writeErr(w, "chat not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	saved, err := upload.Complete()
+	if err != nil {
+		if errors.Is(err, filemgr.ErrUploadIncomplete) {
+			offset, _ := upload.Offset()
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			writeErr(w, "upload is incomplete", http.StatusConflict)
+			return
+		}
+		discardUpload(ctx, upload) // rejected content won't get better on retry
+		status, err := uploadError(err)
+		if rej, ok := asRejection(err); ok {
+			writeRejection(w, rej)
+			return
+		}
+		writeErr(w, err.Error(), status)
+		return
+	}
+	releaseUpload(ctx, upload)
+	auditChatUpload(ctx, chat.ChatID, user, upload.PicType, saved)
+
+	msg, err := persistMediaMessage(ctx, chat.ChatID, user, savedMedia(saved))
+	if err != nil {
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
+		return
+	}
+	reportModeratedUpload(ctx, msg, saved.Moderation)
+	signMedia(msg, user)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// AbortResumableUpload discards a staged upload.
+func AbortResumableUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload := ownUpload(w, r, ps)
+	if upload == nil {
+		return
+	}
+	discardUpload(r.Context(), upload)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxResumeChats    = 50
+	maxReplayMessages = 200 // per chat; clients page the rest over REST
+)
+
+// handleResume replays messages persisted since the client's last seen cursor for each chat.
+// A cursor is either the last received message ID or an RFC3339 timestamp. Replayed batches go
+// out as one "replay" frame per chat ahead of a final "resumed" frame; live messages may arrive
+// in between, so clients should de-duplicate by message id.
+func handleResume(ctx context.Context, client *Client, cursors map[string]string) {
+	replayed := 0
+	for chatID, cursor := range cursors {
+		if replayed >= maxResumeChats {
+			break
+		}
+		replayed++
+
+		filter, ok := resumeFilter(chatID, cursor)
+		if !ok {
+			continue
+		}
+		var chat models.Chat
+		if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": client.UserID}).Decode(&chat); err != nil {
+			continue
+		}
+		applyHistoryFloor(filter, &chat, client.UserID)
+
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(maxReplayMessages + 1)
+		cur, err := db.MessagesCollection.Find(ctx, filter, opts)
+		if err != nil {
+			log.Printf("WS resume query failed (%s/%s): %v", client.UserID, chatID, err)
+			continue
+		}
+		var msgs []models.Message
+		if err := cur.All(ctx, &msgs); err != nil {
+			log.Printf("WS resume decode failed (%s/%s): %v", client.UserID, chatID, err)
+			continue
+		}
+
+		hasMore := len(msgs) > maxReplayMessages
+		if hasMore {
+			msgs = msgs[:maxReplayMessages]
+		}
+		attachSenderProfiles(ctx, msgs)
+		payloads := make([]map[string]interface{}, 0, len(msgs))
+		for i := range msgs {
+			payloads = append(payloads, messagePayload(&msgs[i]))
+		}
+
+		client.send(map[string]interface{}{
+			"type":     "replay",
+			"chatid":   chatID,
+			"messages": payloads,
+			"hasMore":  hasMore,
+		})
+	}
+
+	client.send(map[string]interface{}{
+		"type": "resumed",
+	})
+}
+
+// resumeFilter builds the "newer than cursor" query for a chat.
+func resumeFilter(chatID, cursor string) (bson.M, bool) {
+	filter := bson.M{"chatid": chatID, "deleted": bson.M{"$ne": true}}
+	if id, err := primitive.ObjectIDFromHex(cursor); err == nil {
+		filter["_id"] = bson.M{"$gt": id}
+		return filter, true
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, cursor); err == nil {
+		filter["createdAt"] = bson.M{"$gt": ts}
+		return filter, true
+	}
+	return nil, false
+}
@@ -0,0 +1,162 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	retentionSweepName = "retention"
+	retentionBatchSize = 500
+)
+
+// deletedRetention is how long soft-deleted messages are kept before they are purged for good
+// (DELETED_RETENTION_DAYS; unset keeps them forever).
+var deletedRetention = time.Duration(envFloat("DELETED_RETENTION_DAYS", 0) * float64(24*time.Hour))
+
+// retentionStats counts what the purge job removed since start, for GetMetrics.
+var retentionStats struct {
+	runs        atomic.Int64
+	messages    atomic.Int64
+	attachments atomic.Int64
+	bytes       atomic.Int64
+	failed      atomic.Int64
+	lastRun     atomic.Int64 // unix seconds
+}
+
+func init() {
+	sweeps[retentionSweepName] = purgeDeletedMessages
+}
+
+// purgeDeletedMessages hard-deletes one batch of messages soft-deleted longer than the
+// retention window, together with their uploaded files. Messages deleted before deletedAt
+// was recorded are stamped with the current time first, so their window starts now rather
+// than at their send time.
+func purgeDeletedMessages(ctx context.Context) (int, error) {
+	if deletedRetention <= 0 {
+		return 0, nil
+	}
+	retentionStats.runs.Add(1)
+	retentionStats.lastRun.Store(time.Now().Unix())
+
+	now := time.Now()
+	if _, err := db.MessagesCollection.UpdateMany(ctx,
+		bson.M{"deleted": true, "deletedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deletedAt": now}},
+	); err != nil {
+		retentionStats.failed.Add(1)
+		return 0, err
+	}
+
+	cutoff := now.Add(-deletedRetention)
+	cursor, err := db.MessagesCollection.Find(ctx,
+		bson.M{"deleted": true, "deletedAt": bson.M{"$lte": cutoff}},
+		options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(retentionBatchSize),
+	)
+	if err != nil {
+		retentionStats.failed.Add(1)
+		return 0, err
+	}
+	var expired []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &expired); err != nil {
+		retentionStats.failed.Add(1)
+		return 0, err
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(expired))
+	for _, m := range expired {
+		ids = append(ids, m.ID)
+	}
+
+	// files first: if this fails the messages stay and the next run retries
+	purgeMessageAttachments(ctx, ids)
+
+	res, err := db.MessagesCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "deleted": true})
+	if err != nil {
+		retentionStats.failed.Add(1)
+		return 0, err
+	}
+	retentionStats.messages.Add(res.DeletedCount)
+	return int(res.DeletedCount), nil
+}
+
+// purgeMessageAttachments removes the files owned by the given messages and their audit rows.
+func purgeMessageAttachments(ctx context.Context, ids []primitive.ObjectID) {
+	cursor, err := db.AttachmentsCollection.Find(ctx, bson.M{"messageId": bson.M{"$in": ids}})
+	if err != nil {
+		log.Printf("retention: attachment lookup failed: %v", err)
+		return
+	}
+	var atts []models.Attachment
+	if err := cursor.All(ctx, &atts); err != nil {
+		log.Printf("retention: attachment lookup failed: %v", err)
+		return
+	}
+	for _, a := range atts {
+		freed, err := releaseAttachment(ctx, a)
+		if err != nil {
+			log.Printf("retention: release %s failed: %v", a.Path, err)
+			retentionStats.failed.Add(1)
+			continue // left for the orphan janitor once the message is gone
+		}
+		retentionStats.attachments.Add(1)
+		if freed {
+			retentionStats.bytes.Add(a.Size)
+		}
+	}
+}
+
+// retentionMetrics reports the purge volume since start.
+func retentionMetrics() map[string]interface{} {
+	return map[string]interface{}{
+		"retentionDays": deletedRetention.Hours() / 24,
+		"runs":          retentionStats.runs.Load(),
+		"messages":      retentionStats.messages.Load(),
+		"attachments":   retentionStats.attachments.Load(),
+		"bytes":         retentionStats.bytes.Load(),
+		"failed":        retentionStats.failed.Load(),
+		"lastRun":       retentionStats.lastRun.Load(),
+	}
+}
+
+// StartRetentionPurger hard-deletes expired soft-deleted messages on an interval, draining
+// full batches before sleeping. Run it in its own goroutine.
+func StartRetentionPurger(interval time.Duration) {
+	if deletedRetention <= 0 {
+		log.Println("retention: disabled, soft-deleted messages are kept")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		total := 0
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			n, err := purgeDeletedMessages(ctx)
+			cancel()
+			if err != nil {
+				log.Println("retention: purge failed:", err)
+				break
+			}
+			total += n
+			if n < retentionBatchSize {
+				break
+			}
+		}
+		if total > 0 {
+			log.Printf("retention: purged %d deleted messages", total)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// sandboxEntityType marks chats generated by the seeder; their entityid is the tenant.
+const sandboxEntityType = "sandbox"
+
+// sandboxTenants are the tenants fake data may be seeded into (SANDBOX_TENANTS=demo,dev).
+// Seeding and wiping refuse every other tenant, so production data is never touched.
+var sandboxTenants = parseSandboxTenants(os.Getenv("SANDBOX_TENANTS"))
+
+func parseSandboxTenants(raw string) map[string]bool {
+	out := make(map[string]bool)
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out[t] = true
+		}
+	}
+	return out
+}
+
+var (
+	sandboxFirstNames = []string{"Aarav", "Maya", "Liam", "Zoe", "Kenji", "Priya", "Noah", "Amara", "Lucas", "Sofia", "Omar", "Chloe", "Mateo", "Ines", "Ravi", "Hana", "Elijah", "Leila", "Diego", "Nora"}
+	sandboxLastNames  = []string{"Sharma", "Chen", "Okafor", "Müller", "Silva", "Tanaka", "Haddad", "Kowalski", "Nguyen", "Rossi", "Dubois", "Patel", "Andersen", "García", "Kim"}
+	sandboxGroupNames = []string{"Weekend trip", "Book club", "Project Falcon", "Family", "Running crew", "Design review", "Flatmates", "Launch party"}
+	sandboxLines      = []string{
+		"Hey! How's it going?", "Running 10 minutes late, sorry", "Did anyone see the update?", "Sounds good to me 👍",
+		"Can we move it to Thursday?", "I'll send the notes after lunch", "Haha that's amazing", "Who's bringing snacks?",
+		"Just pushed the fix, can you check?", "On my way", "Let's catch up tomorrow", "Thanks so much!",
+		"Has anyone tried the new place downtown?", "Meeting notes are in the shared folder", "Love this idea",
+		"Can someone review my draft?", "Photos from yesterday coming soon", "What time works for everyone?",
+		"Good morning ☀️", "I'm in!", "Let me check and get back to you", "Reminder: deadline is Friday",
+	}
+)
+
+type sandboxSpec struct {
+	Tenant   string `json:"tenant"`
+	Seed     uint64 `json:"seed"`
+	Users    int    `json:"users"`    // fake users, default 8
+	Chats    int    `json:"chats"`    // default 5, the caller is in every one
+	Messages int    `json:"messages"` // per chat, default 200
+	Days     int    `json:"days"`     // history spread over this many days, default 14
+}
+
+// SeedSandbox replaces a sandbox tenant's data with generated users, chats and message
+// history. The same seed always produces the same names, chat ids and texts.
+func SeedSandbox(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	spec := sandboxSpec{Users: 8, Chats: 5, Messages: 200, Days: 14}
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if !sandboxTenants[spec.Tenant] {
+		writeErr(w, "not a sandbox tenant", http.StatusForbidden)
+		return
+	}
+	if spec.Users < 2 || spec.Users > 50 || spec.Chats < 1 || spec.Chats > 50 || spec.Messages < 0 || spec.Messages > 2000 || spec.Days < 1 || spec.Days > 365 {
+		writeErr(w, "users 2-50, chats 1-50, messages 0-2000 and days 1-365", http.StatusBadRequest)
+		return
+	}
+
+	if err := purgeSandbox(ctx, spec.Tenant); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chats, total, err := seedSandbox(ctx, spec, user)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("sandbox %s seeded by %s: seed=%d chats=%d messages=%d", spec.Tenant, user, spec.Seed, len(chats), total)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"tenant":   spec.Tenant,
+		"seed":     spec.Seed,
+		"chats":    chats,
+		"messages": total,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// WipeSandbox deletes everything seeded into a sandbox tenant.
+func WipeSandbox(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tenant := ps.ByName("tenant")
+	if !sandboxTenants[tenant] {
+		writeErr(w, "not a sandbox tenant", http.StatusForbidden)
+		return
+	}
+	if err := purgeSandbox(r.Context(), tenant); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func seedSandbox(ctx context.Context, spec sandboxSpec, owner string) ([]string, int, error) {
+	// the tenant is mixed in so two tenants seeded alike don't draw the same chat ids
+	h := fnv.New64a()
+	h.Write([]byte(spec.Tenant))
+	rng := rand.New(rand.NewPCG(spec.Seed, h.Sum64()))
+	pick := func(s []string) string { return s[rng.IntN(len(s))] }
+
+	users := make([]interface{}, 0, spec.Users)
+	ids := make([]string, 0, spec.Users)
+	for i := 0; i < spec.Users; i++ {
+		first, last := pick(sandboxFirstNames), pick(sandboxLastNames)
+		id := fmt.Sprintf("sbx-%s-%d", spec.Tenant, i+1)
+		ids = append(ids, id)
+		users = append(users, bson.M{
+			"userid":   id,
+			"username": strings.ToLower(first) + fmt.Sprint(rng.IntN(100)),
+			"name":     first + " " + last,
+			"sandbox":  spec.Tenant,
+		})
+	}
+	if _, err := db.UsersCollection.InsertMany(ctx, users); err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	start := now.AddDate(0, 0, -spec.Days)
+	var chatIDs []string
+	total := 0
+	for c := 0; c < spec.Chats; c++ {
+		members := []string{owner, ids[rng.IntN(len(ids))]}
+		if c%2 == 1 { // every other chat is a group
+			for _, i := range rng.Perm(len(ids))[:min(len(ids), 3+rng.IntN(4))] {
+				if !utils.Contains(members, ids[i]) {
+					members = append(members, ids[i])
+				}
+			}
+		}
+		chat := models.Chat{
+			ChatID:       sandboxChatID(rng),
+			Participants: members,
+			EntityType:   sandboxEntityType,
+			EntityId:     spec.Tenant,
+			Sandbox:      spec.Tenant,
+			CreatedAt:    start,
+			UpdatedAt:    now,
+			Admins:       []string{owner},
+		}
+		if len(members) > 2 {
+			chat.Groups = map[string][]string{strings.ToLower(strings.ReplaceAll(pick(sandboxGroupNames), " ", "-")): members[1:]}
+		}
+
+		msgs := make([]interface{}, 0, spec.Messages)
+		step := now.Sub(start) / time.Duration(spec.Messages+1)
+		var last *models.Message
+		for m := 0; m < spec.Messages; m++ {
+			at := start.Add(step * time.Duration(m+1))
+			msg := &models.Message{
+				ID:        primitive.NewObjectIDFromTimestamp(at),
+				ChatID:    chat.ChatID,
+				UserID:    members[rng.IntN(len(members))],
+				Content:   pick(sandboxLines),
+				CreatedAt: at,
+				Status:    statusRead,
+				Sandbox:   spec.Tenant,
+			}
+			if last != nil && rng.IntN(10) == 0 {
+				root := last.ID
+				if last.ReplyTo != nil {
+					root = *last.ReplyTo
+				}
+				msg.ReplyTo = &root
+			}
+			if messageSeqs {
+				msg.Seq = int64(m + 1)
+				chat.LastSeq = msg.Seq
+			}
+			msgs = append(msgs, msg)
+			last = msg
+		}
+
+		if _, err := db.MereCollection.InsertOne(ctx, chat); err != nil {
+			return chatIDs, total, err
+		}
+		if len(msgs) > 0 {
+			if _, err := db.MessagesCollection.InsertMany(ctx, msgs); err != nil {
+				return chatIDs, total, err
+			}
+		}
+		rebuildChatSummary(ctx, &chat)
+		chatIDs = append(chatIDs, chat.ChatID)
+		total += len(msgs)
+	}
+	return chatIDs, total, nil
+}
+
+// sandboxChatID draws a chat id from the seeded generator so reseeding reproduces it.
+func sandboxChatID(rng *rand.Rand) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 16)
+	for i := range b {
+		b[i] = alphabet[rng.IntN(len(alphabet))]
+	}
+	return string(b)
+}
+
+// purgeSandbox hard-deletes a sandbox tenant's chats, their messages and per-member rows,
+// and its fake users. Chats are found by the sandbox tag, which no API sets, so a real chat
+// bound to a "sandbox" entity is never matched.
+func purgeSandbox(ctx context.Context, tenant string) error {
+	cursor, err := db.MereCollection.Find(ctx, bson.M{"sandbox": tenant})
+	if err != nil {
+		return err
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(chats))
+	for _, c := range chats {
+		ids = append(ids, c.ChatID)
+	}
+	if len(ids) > 0 {
+		inChats := bson.M{"chatid": bson.M{"$in": ids}}
+		for _, coll := range []*mongo.Collection{db.MessagesCollection, db.MembershipsCollection, db.ChatUserStateCollection} {
+			if _, err := coll.DeleteMany(ctx, inChats); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := db.MereCollection.DeleteMany(ctx, bson.M{"sandbox": tenant}); err != nil {
+		return err
+	}
+	_, err = db.UsersCollection.DeleteMany(ctx, bson.M{"sandbox": tenant, "userid": bson.M{"$regex": "^sbx-"}})
+	return err
+}
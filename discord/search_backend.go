@@ -0,0 +1,268 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search modes, selected with SEARCH_MODE.
+const (
+	searchModeMongo    = "mongo"    // Mongo only (default)
+	searchModeShadow   = "shadow"   // serve Mongo, compare against the external backend in the background
+	searchModeExternal = "external" // serve the external backend
+)
+
+// searchQuery is a message search within one chat.
+type searchQuery struct {
+	ChatID string
+	Term   string
+	Limit  int64
+	Skip   int64
+	Since  time.Time // hide messages older than this (history not shared with late joiners)
+
+	Sender    string
+	From, To  time.Time // createdAt range, either bound optional
+	MediaOnly bool
+}
+
+// filter builds the Mongo filter shared by every search backend, excluding the term itself.
+func (q searchQuery) filter() bson.M {
+	filter := bson.M{"chatid": q.ChatID, "deleted": bson.M{"$ne": true}}
+	if q.Sender != "" {
+		filter["sender"] = q.Sender
+	}
+	created := bson.M{}
+	if !q.From.IsZero() {
+		created["$gte"] = q.From
+	}
+	if !q.Since.IsZero() && q.Since.After(q.From) {
+		created["$gte"] = q.Since
+	}
+	if !q.To.IsZero() {
+		created["$lte"] = q.To
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+	if q.MediaOnly {
+		filter["media"] = bson.M{"$exists": true, "$ne": nil}
+	}
+	return filter
+}
+
+// searchBackend returns matching messages in display order.
+type searchBackend interface {
+	Search(ctx context.Context, q searchQuery) ([]models.Message, error)
+}
+
+var (
+	searchMode                   = searchModeMongo
+	mongoSearch    searchBackend = mongoSearchBackend{}
+	externalSearch searchBackend
+
+	shadowStats struct {
+		compared  atomic.Int64
+		diverged  atomic.Int64
+		failed    atomic.Int64
+		overlapPM atomic.Int64 // running sum of overlap ratios, in per-mille
+	}
+)
+
+func init() {
+	base := strings.TrimRight(os.Getenv("SEARCH_BACKEND_URL"), "/")
+	if base == "" {
+		return
+	}
+	externalSearch = &httpSearchBackend{
+		baseURL: base,
+		client:  &http.Client{Timeout: 3 * time.Second},
+	}
+	switch m := os.Getenv("SEARCH_MODE"); m {
+	case searchModeShadow, searchModeExternal:
+		searchMode = m
+	}
+}
+
+// runSearch serves a query according to the configured mode.
+func runSearch(ctx context.Context, q searchQuery) ([]models.Message, error) {
+	switch {
+	case searchMode == searchModeExternal && externalSearch != nil:
+		return externalSearch.Search(ctx, q)
+	case searchMode == searchModeShadow && externalSearch != nil:
+		start := time.Now()
+		msgs, err := mongoSearch.Search(ctx, q)
+		if err == nil {
+			go shadowCompare(q, msgs, time.Since(start))
+		}
+		return msgs, err
+	default:
+		return mongoSearch.Search(ctx, q)
+	}
+}
+
+// shadowCompare queries the external backend and logs how far it diverges from the served results.
+func shadowCompare(q searchQuery, served []models.Message, servedIn time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	shadow, err := externalSearch.Search(ctx, q)
+	took := time.Since(start)
+	if err != nil {
+		shadowStats.failed.Add(1)
+		log.Printf("search shadow: external backend failed for chat %s: %v", q.ChatID, err)
+		return
+	}
+
+	want := make(map[primitive.ObjectID]struct{}, len(served))
+	for _, m := range served {
+		want[m.ID] = struct{}{}
+	}
+	common := 0
+	for _, m := range shadow {
+		if _, ok := want[m.ID]; ok {
+			common++
+		}
+	}
+	union := len(served) + len(shadow) - common
+	overlap := 1.0
+	if union > 0 {
+		overlap = float64(common) / float64(union)
+	}
+
+	n := shadowStats.compared.Add(1)
+	shadowStats.overlapPM.Add(int64(overlap * 1000))
+	if overlap < 1 {
+		d := shadowStats.diverged.Add(1)
+		log.Printf("search shadow: divergence chat=%s term=%q mongo=%d external=%d overlap=%.2f mongoTook=%v externalTook=%v (diverged %d/%d, avg overlap %.3f)",
+			q.ChatID, q.Term, len(served), len(shadow), overlap, servedIn, took,
+			d, n, float64(shadowStats.overlapPM.Load())/1000/float64(n))
+	}
+}
+
+// mongoSearchBackend searches message content and voice note transcripts through the
+// "message_text" text index, ranking by relevance. Without a term it lists the filtered
+// messages oldest first.
+type mongoSearchBackend struct{}
+
+func (mongoSearchBackend) Search(ctx context.Context, q searchQuery) ([]models.Message, error) {
+	filter := q.filter()
+	opts := options.Find().
+		SetSort(bson.M{"createdAt": 1}).
+		SetLimit(q.Limit).
+		SetSkip(q.Skip)
+	if q.Term != "" {
+		filter["$text"] = bson.M{"$search": q.Term}
+		opts.SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}}).
+			SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "createdAt", Value: -1}})
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// httpSearchBackend queries an external engine that answers
+// GET {base}/search?chatid=&q=&limit=&offset= with {"ids": ["<message id hex>", ...]};
+// messages are then loaded from Mongo in the engine's order.
+type httpSearchBackend struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (b *httpSearchBackend) Search(ctx context.Context, q searchQuery) ([]models.Message, error) {
+	v := url.Values{}
+	v.Set("chatid", q.ChatID)
+	v.Set("q", q.Term)
+	v.Set("limit", strconv.FormatInt(q.Limit, 10))
+	v.Set("offset", strconv.FormatInt(q.Skip, 10))
+	if q.Sender != "" {
+		v.Set("sender", q.Sender)
+	}
+	if !q.From.IsZero() {
+		v.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.Format(time.RFC3339))
+	}
+	if q.MediaOnly {
+		v.Set("media", "1")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.baseURL+"/search?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("search backend status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode search response: %w", err)
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(body.IDs))
+	for _, h := range body.IDs {
+		if id, err := primitive.ObjectIDFromHex(h); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	filter := q.filter()
+	filter["_id"] = bson.M{"$in": ids}
+	cursor, err := db.MessagesCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var found []models.Message
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[primitive.ObjectID]models.Message, len(found))
+	for _, m := range found {
+		byID[m.ID] = m
+	}
+	msgs := make([]models.Message, 0, len(found))
+	for _, id := range ids {
+		if m, ok := byID[id]; ok {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
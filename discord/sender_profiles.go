@@ -0,0 +1,259 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/rdx"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	profileCachePrefix = "profile:"
+	// profileCacheTTL bounds how stale a cached profile gets when the accounts service
+	// never calls UpdateSenderProfile.
+	profileCacheTTL = 10 * time.Minute
+	// profileBackfillSenders caps how many senders one backfill sweep rewrites.
+	profileBackfillSenders = 500
+)
+
+// senderProfiles resolves public profiles for users, from Redis where cached and the users
+// collection otherwise. Users without a profile are cached as empty so they are not looked
+// up on every message.
+func senderProfiles(ctx context.Context, users []string) map[string]models.MemberPreview {
+	out := make(map[string]models.MemberPreview, len(users))
+	seen := make(map[string]bool, len(users))
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		if u == "" || u == systemSender || u == erasedUser || seen[u] {
+			continue
+		}
+		seen[u] = true
+		ids = append(ids, u)
+	}
+	if len(ids) == 0 {
+		return out
+	}
+
+	keys := make([]string, len(ids))
+	for i, u := range ids {
+		keys[i] = profileCachePrefix + u
+	}
+	missing := ids
+	if vals, err := rdx.Conn.MGet(ctx, keys...).Result(); err == nil {
+		missing = missing[:0:0]
+		for i, v := range vals {
+			s, ok := v.(string)
+			var p models.MemberPreview
+			if !ok || json.Unmarshal([]byte(s), &p) != nil {
+				missing = append(missing, ids[i])
+				continue
+			}
+			if p.UserID != "" {
+				out[ids[i]] = p
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return out
+	}
+
+	found, err := lookupProfiles(ctx, missing)
+	if err != nil {
+		log.Printf("profiles: lookup failed: %v", err)
+		return out
+	}
+	pipe := rdx.Conn.Pipeline()
+	for _, u := range missing {
+		p := found[u]
+		if p.UserID != "" {
+			out[u] = p
+		}
+		data, _ := json.Marshal(p)
+		pipe.Set(ctx, profileCachePrefix+u, data, profileCacheTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("profiles: cache write failed: %v", err)
+	}
+	return out
+}
+
+func lookupProfiles(ctx context.Context, users []string) (map[string]models.MemberPreview, error) {
+	cursor, err := db.UsersCollection.Find(ctx,
+		bson.M{"userid": bson.M{"$in": users}},
+		options.Find().SetProjection(bson.M{"_id": 0, "userid": 1, "username": 1, "name": 1, "avatar": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []models.MemberPreview
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, err
+	}
+	out := make(map[string]models.MemberPreview, len(profiles))
+	for _, p := range profiles {
+		out[p.UserID] = p
+	}
+	return out, nil
+}
+
+// profileName is the name shown for a sender: their display name, else their username.
+func profileName(p models.MemberPreview) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.Username
+}
+
+// fillSenderProfile stamps the sender's current name and avatar on a message before it
+// is stored, so every copy of it (outbox, webhooks, search) carries them.
+func fillSenderProfile(ctx context.Context, msg *models.Message) {
+	if msg.SenderName != "" {
+		return
+	}
+	p, ok := senderProfiles(ctx, []string{msg.UserID})[msg.UserID]
+	if !ok {
+		return
+	}
+	msg.SenderName, msg.AvatarURL = profileName(p), p.Avatar
+}
+
+// attachSenderProfiles refreshes SenderName and AvatarURL on messages about to be
+// returned to a client; the stored copies may predate a profile change.
+func attachSenderProfiles(ctx context.Context, msgs []models.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	senders := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		senders = append(senders, m.UserID)
+	}
+	profiles := senderProfiles(ctx, senders)
+	for i := range msgs {
+		if p, ok := profiles[msgs[i].UserID]; ok {
+			msgs[i].SenderName, msgs[i].AvatarURL = profileName(p), p.Avatar
+		}
+	}
+}
+
+func forgetSenderProfile(ctx context.Context, user string) {
+	if err := rdx.Conn.Del(ctx, profileCachePrefix+user).Err(); err != nil {
+		log.Printf("profiles: cache evict %s: %v", user, err)
+	}
+}
+
+// rewriteSenderProfile copies a user's current profile onto the messages they sent and
+// the member previews of their chats.
+func rewriteSenderProfile(ctx context.Context, user string) (int64, error) {
+	forgetSenderProfile(ctx, user)
+	found, err := lookupProfiles(ctx, []string{user})
+	if err != nil {
+		return 0, err
+	}
+	update := bson.M{"$unset": bson.M{"senderName": "", "avatarUrl": ""}}
+	if p, ok := found[user]; ok {
+		set, unset := bson.M{"senderName": profileName(p)}, bson.M{"senderUnresolved": ""}
+		if p.Avatar != "" {
+			set["avatarUrl"] = p.Avatar
+		} else {
+			unset["avatarUrl"] = ""
+		}
+		update = bson.M{"$set": set, "$unset": unset}
+	}
+	res, err := db.MessagesCollection.UpdateMany(ctx, bson.M{"sender": user}, update)
+	if err != nil {
+		return 0, err
+	}
+
+	cursor, err := db.MereCollection.Find(ctx, bson.M{"participants": user, "summary.members.userid": user})
+	if err != nil {
+		return res.ModifiedCount, err
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		return res.ModifiedCount, err
+	}
+	for i := range chats {
+		refreshSummaryMembers(ctx, &chats[i])
+	}
+	return res.ModifiedCount, nil
+}
+
+// backfillSenderProfiles fills SenderName and AvatarURL on messages stored before they
+// were denormalized, a batch of senders at a time. Messages of senders without a profile
+// are marked senderUnresolved so later batches move on to other senders;
+// rewriteSenderProfile clears the mark once the profile exists.
+func backfillSenderProfiles(ctx context.Context) (int, error) {
+	senders, err := db.MessagesCollection.Distinct(ctx, "sender", bson.M{
+		"senderName":       bson.M{"$exists": false},
+		"senderUnresolved": bson.M{"$ne": true},
+		"sender":           bson.M{"$nin": bson.A{systemSender, erasedUser}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(senders) > profileBackfillSenders {
+		senders = senders[:profileBackfillSenders]
+	}
+	ids := make([]string, 0, len(senders))
+	for _, s := range senders {
+		if id, ok := s.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	found, err := lookupProfiles(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, p := range found {
+		set := bson.M{"senderName": profileName(p)}
+		if p.Avatar != "" {
+			set["avatarUrl"] = p.Avatar
+		}
+		res, err := db.MessagesCollection.UpdateMany(ctx,
+			bson.M{"sender": p.UserID, "senderName": bson.M{"$exists": false}},
+			bson.M{"$set": set},
+		)
+		if err != nil {
+			return int(n), err
+		}
+		n += res.ModifiedCount
+	}
+	for _, id := range ids {
+		if _, ok := found[id]; ok {
+			continue
+		}
+		if _, err := db.MessagesCollection.UpdateMany(ctx,
+			bson.M{"sender": id, "senderName": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"senderUnresolved": true}},
+		); err != nil {
+			return int(n), err
+		}
+	}
+	return int(n), nil
+}
+
+// UpdateSenderProfile is called by the accounts service after a user changes their name or
+// avatar. It re-reads the profile and rewrites the copies denormalized onto messages.
+func UpdateSenderProfile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n, err := rewriteSenderProfile(r.Context(), ps.ByName("userid"))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int64{"updated": n}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
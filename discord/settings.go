@@ -0,0 +1,117 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// soundRe limits sound names to what clients can map onto bundled sound files.
+var soundRe = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+
+// notificationGroup is a set of recipients sharing the same sound, priority and preview mode.
+type notificationGroup struct {
+	Sound    string
+	Priority string
+	Preview  string
+	Users    []string
+}
+
+// groupByNotificationPrefs splits users by their per-chat sound, priority and effective
+// preview mode so each notification carries the recipient's own choices.
+func groupByNotificationPrefs(chat *models.Chat, users []string) []notificationGroup {
+	index := make(map[[3]string]int)
+	var groups []notificationGroup
+	for _, u := range users {
+		s := chat.Settings[u]
+		key := [3]string{s.Sound, s.NotificationPriority(), previewMode(chat, u)}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, notificationGroup{Sound: key[0], Priority: key[1], Preview: key[2]})
+		}
+		groups[i].Users = append(groups[i].Users, u)
+	}
+	return groups
+}
+
+// GetChatSettings returns the caller's own preferences for a chat.
+func GetChatSettings(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": ps.ByName("chatid"), "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(chat.Settings[user]); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// UpdateChatSettings replaces the caller's preferences for a chat.
+func UpdateChatSettings(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	var body models.MemberSettings
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Language != "" && !langRe.MatchString(body.Language) {
+		writeErr(w, "invalid language", http.StatusBadRequest)
+		return
+	}
+	switch body.Priority {
+	case "", models.PrioritySilent, models.PriorityNormal, models.PriorityUrgent:
+	default:
+		writeErr(w, "invalid priority", http.StatusBadRequest)
+		return
+	}
+	if body.Sound != "" && !soundRe.MatchString(body.Sound) {
+		writeErr(w, "invalid sound", http.StatusBadRequest)
+		return
+	}
+	if _, ok := previewRank[body.Preview]; !ok && body.Preview != "" {
+		writeErr(w, "invalid preview", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": ps.ByName("chatid"), "participants": user},
+		bson.M{"$set": bson.M{"settings." + user: body, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeErr(w, "not found or access denied", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,116 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxSharedMediaPage bounds one page of GetChatMedia.
+const maxSharedMediaPage = 100
+
+// sharedMediaFilter narrows a chat's media messages to a gallery tab: image, video or file
+// (anything else, documents and audio included). "" lists all of them.
+func sharedMediaFilter(kind string) (bson.M, bool) {
+	filter := bson.M{
+		"media.url":      bson.M{"$nin": bson.A{nil, ""}},
+		"media.location": nil,
+		"media.sticker":  nil,
+	}
+	switch kind {
+	case "":
+	case "image", "video":
+		filter["media.type"] = bson.M{"$regex": "^" + kind + "/"}
+	case "file":
+		filter["media.type"] = bson.M{"$not": primitive.Regex{Pattern: "^(image|video)/"}}
+	default:
+		return nil, false
+	}
+	return filter, true
+}
+
+// GetChatMedia lists a chat's media messages newest first for a "shared media" gallery,
+// optionally by ?type=image|video|file, a page (?limit=, default 50) at a time; ?before=
+// takes the previous response's nextCursor.
+func GetChatMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := strings.TrimSpace(ps.ByName("chatid"))
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	filter, ok := sharedMediaFilter(q.Get("type"))
+	if !ok {
+		writeErr(w, "type must be image, video or file", http.StatusBadRequest)
+		return
+	}
+	filter["chatid"] = chatID
+	filter["deleted"] = bson.M{"$ne": true}
+	applyHistoryFloor(filter, &chat, user)
+
+	if before := q.Get("before"); before != "" {
+		cursorID, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			writeErr(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter["_id"] = bson.M{"$lt": cursorID}
+	}
+	limit := int64(50)
+	if v, err := parseInt64(q.Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxSharedMediaPage)
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit+1))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := int64(len(msgs)) > limit
+	var next string
+	if hasMore {
+		msgs = msgs[:limit]
+		next = msgs[len(msgs)-1].ID.Hex()
+	}
+	if msgs == nil {
+		msgs = make([]models.Message, 0)
+	}
+	attachSenderProfiles(ctx, msgs)
+	signMessageMedia(msgs, user)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages":   msgs,
+		"nextCursor": next,
+		"hasMore":    hasMore,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -6,37 +6,47 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"naevis/db"
 	"naevis/middleware"
 	"naevis/models"
+	"naevis/ratelim"
 
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var (
-	// clients maps userID => *Client
+	// clients maps userID => that user's sockets on this instance, one per device
 	clients = struct {
 		sync.RWMutex
-		m map[string]*Client
-	}{m: make(map[string]*Client)}
+		m map[string]map[*Client]struct{}
+	}{m: make(map[string]map[*Client]struct{})}
 
 	upgrader = websocket.Upgrader{
 		// In production you should validate the Origin header.
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		Subprotocols:      []string{wsSubprotocolMsgpack, wsSubprotocolJSON},
+		EnableCompression: wsCompression, // permessage-deflate, see ws_compress.go
 	}
 )
 
 // Client represents a connected websocket client with a send queue
 type Client struct {
-	UserID string
-	Conn   *websocket.Conn
-	Send   chan interface{} // buffered outbound queue
+	UserID      string
+	Conn        *websocket.Conn
+	Send        chan interface{} // buffered outbound queue
+	ConnectedAt time.Time
+	DeviceID    string                     // optional ?device= from the client, used to skip echoes
+	Version     int                        // WS protocol version from ?v=, see ws_protocol.go
+	Msgpack     bool                       // negotiated the msgpack subprotocol
+	caps        atomic.Pointer[clientCaps] // set by the "hello" handshake
 	// optional: add a mutex if you need to mutate Conn concurrently (we serialize writes via Send)
 }
 
@@ -52,52 +62,71 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	ctx := r.Context()
 	rawToken := r.URL.Query().Get("token")
 	if rawToken == "" {
-		http.Error(w, "missing token", http.StatusUnauthorized)
+		writeErr(w, "missing token", http.StatusUnauthorized)
 		return
 	}
 
 	claims, err := middleware.ValidateJWT("Bearer " + rawToken)
 	if err != nil {
 		log.Println("WS: invalid token:", err)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		writeErr(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 	userID := claims.UserID
 	log.Println("WS connected:", userID)
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(wireCounter{w}, r, nil)
 	if err != nil {
 		log.Println("WS upgrade failed:", err)
 		return
 	}
+	if err := conn.SetCompressionLevel(wsCompressLevel); err != nil {
+		log.Printf("WS compression level %d: %v", wsCompressLevel, err)
+	}
+	if connectionCount() >= wsMaxConnections {
+		log.Println("WS rejecting connection at capacity:", userID)
+		closeClient(&Client{UserID: userID, Conn: conn}, closeOverloaded)
+		return
+	}
+	version, ok := protocolVersion(r)
+	if !ok {
+		log.Printf("WS rejecting protocol version %q (%s)", r.URL.Query().Get("v"), userID)
+		closeClient(&Client{UserID: userID, Conn: conn}, closeBadVersion)
+		return
+	}
 
 	client := &Client{
-		UserID: userID,
-		Conn:   conn,
-		Send:   make(chan interface{}, sendQueueSize),
+		UserID:      userID,
+		Conn:        conn,
+		Send:        make(chan interface{}, sendQueueSize),
+		ConnectedAt: time.Now(),
+		DeviceID:    r.URL.Query().Get("device"),
+		Version:     version,
+		Msgpack:     conn.Subprotocol() == wsSubprotocolMsgpack,
 	}
 
-	// register client
-	clients.Lock()
-	clients.m[userID] = client
-	clients.Unlock()
+	registerClient(client)
+	updatePresence(ctx, userID, true)
 
 	// ensure cleanup on return
 	done := make(chan struct{})
 	defer func() {
 		close(done)
-		// unregister and close
-		clients.Lock()
-		if c, ok := clients.m[userID]; ok {
-			delete(clients.m, userID)
-			// close send channel to stop writer goroutine
-			close(c.Send)
-		}
-		clients.Unlock()
+		last := unregisterClient(client)
 		_ = conn.Close()
+		if last {
+			// request context is gone once the handler returns, so use a fresh one
+			updatePresence(context.Background(), userID, false)
+		}
 		log.Println("WS disconnected:", userID)
 	}()
 
+	// close with auth_expired once the token lapses
+	if claims.ExpiresAt != nil {
+		expiry := time.AfterFunc(time.Until(claims.ExpiresAt.Time), func() { closeClient(client, closeAuthExpired) })
+		defer expiry.Stop()
+	}
+
 	// Setup pong handler and initial read deadline
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(appData string) error {
@@ -109,13 +138,21 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	// writer goroutine: serializes writes to this connection
 	go func() {
 		for msg := range client.Send {
-			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			if err := conn.WriteJSON(msg); err != nil {
-				log.Printf("WS write error for %s: %v", userID, err)
-				// closing connection will cause reader to exit and cleanup
-				_ = conn.Close()
-				return
+			for _, frame := range client.nextFrames(msg) {
+				out, err := encodeFrame(client.Version, frame)
+				if err != nil {
+					log.Printf("WS encode error for %s: %v", userID, err)
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				if err := client.writeFrame(out); err != nil {
+					log.Printf("WS write error for %s: %v", userID, err)
+					// closing connection will cause reader to exit and cleanup
+					_ = conn.Close()
+					return
+				}
 			}
+			sampleDelivery(msg)
 		}
 	}()
 
@@ -140,31 +177,62 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	}()
 
 	// Reader loop
+	limiter := newFrameLimiter()
+	sendLimiter := newMessageLimiter()
+	streams := make(streamAssembler)
 	for {
-		var in models.IncomingWSMessage
-		// Note: ReadJSON will block until message arrives or deadline/pong fails.
-		if err := conn.ReadJSON(&in); err != nil {
+		// Note: ReadMessage will block until message arrives or deadline/pong fails.
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
 			log.Printf("WS read error (%s): %v", userID, err)
 			break
 		}
+		if !limiter.Allow() {
+			log.Printf("WS rate limit exceeded (%s)", userID)
+			closeClient(client, closeRateLimited)
+			break
+		}
+		if data, err = client.frameJSON(kind, data); err != nil {
+			client.reject(models.IncomingWSMessage{}, errCodeInvalidFrame, err.Error(), nil)
+			continue
+		}
+		in, ferr := decodeFrame(client.Version, data)
+		if ferr == nil {
+			ferr = validateFrame(&in)
+		}
+		if ferr != nil {
+			client.reject(in, ferr.Code, ferr.Message, ferr.Details)
+			continue
+		}
 
 		switch in.Type {
+		case "hello":
+			handleHello(client, in.Capabilities)
 		case "message":
+			if wait := ratelim.RetryAfter(sendLimiter); wait > 0 {
+				client.reject(in, models.ErrCodeRateLimited, "sending too fast", map[string]int64{"retryAfterMs": wait.Milliseconds()})
+				continue
+			}
 			handleIncomingMessage(ctx, client, in)
+		case "message_chunk":
+			streams.handleChunk(ctx, client, in, sendLimiter)
 		case "typing":
-			broadcastToChat(ctx, in.ChatID, map[string]interface{}{
-				"type":   "typing",
-				"sender": userID,
-				"chatid": in.ChatID,
-			})
+			handleTyping(ctx, client, in)
 		case "presence":
-			broadcastGlobal(map[string]interface{}{
-				"type":   "presence",
-				"from":   userID,
-				"online": in.Online,
-			})
+			updatePresence(ctx, userID, in.Online)
+		case "ack":
+			recordReceipts(ctx, userID, parseMessageIDs(in.MessageIDs), statusDelivered)
+		case "read":
+			recordReceipts(ctx, userID, parseMessageIDs(in.MessageIDs), statusRead)
+		case "resume":
+			handleResume(ctx, client, in.Cursors)
+		case "call_offer", "call_answer", "ice_candidate", "call_end":
+			handleCallSignal(ctx, client, in)
+		case "location_update":
+			handleLocationUpdate(ctx, client, in)
 		default:
 			log.Printf("WS unknown type from %s: %s", userID, in.Type)
+			client.reject(in, errCodeUnknownType, "unknown frame type", map[string]string{"type": in.Type})
 		}
 	}
 }
@@ -175,22 +243,34 @@ func handleIncomingMessage(ctx context.Context, client *Client, in models.Incomi
 	userID := client.UserID
 
 	// verify user belongs to chat (chatid used consistently)
-	count, err := db.MereCollection.CountDocuments(ctx, bson.M{"chatid": cid, "participants": userID})
-	if err != nil {
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": cid, "participants": userID}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			log.Printf("WS unauthorized chat access (%s): %s", userID, in.ChatID)
+			client.reject(in, errCodeChatNotFound, "chat not found", nil)
+			return
+		}
 		log.Printf("WS membership check failed (%s): %v", userID, err)
-		return
-	}
-	if count == 0 {
-		log.Printf("WS unauthorized chat access (%s): %s", userID, in.ChatID)
+		client.reject(in, models.ErrCodeInternal, "internal error", nil)
 		return
 	}
 
-	msg, err := persistMessage(ctx, cid, userID, in.Content, in.MediaURL, in.MediaType)
+	_, err := sendChatMessage(ctx, &chat, userID, in.Content, in.MediaURL, in.MediaType, in.ReplyTo, in.ClientID)
 	if err != nil {
 		log.Printf("WS persist error (%s): %v", userID, err)
-		return
+		if rej, ok := asRejection(err); ok {
+			client.reject(in, errCodeContentRejected, rej.Reason, rejectionDetails(rej))
+		} else if e, ok := sendErrors[err]; ok {
+			client.reject(in, e.code, err.Error(), nil)
+		} else {
+			client.reject(in, models.ErrCodeInternal, "message not sent", nil)
+		}
 	}
+	// the outbox dispatcher broadcasts the stored message
+}
 
+// messagePayload is the WS representation of a stored message.
+func messagePayload(msg *models.Message) map[string]interface{} {
 	payload := map[string]interface{}{
 		"type":      "message",
 		"id":        msg.ID.Hex(),
@@ -200,11 +280,62 @@ func handleIncomingMessage(ctx context.Context, client *Client, in models.Incomi
 		"media":     msg.Media,
 		"chatid":    msg.ChatID,
 	}
-	if in.ClientID != "" {
-		payload["clientId"] = in.ClientID
+	if msg.SenderName != "" {
+		payload["senderName"] = msg.SenderName
 	}
-
-	broadcastToChat(ctx, cid, payload)
+	if msg.AvatarURL != "" {
+		payload["avatarUrl"] = msg.AvatarURL
+	}
+	if msg.Seq != 0 {
+		payload["seq"] = msg.Seq
+	}
+	if len(msg.MentionGroups) > 0 {
+		payload["mentionGroups"] = msg.MentionGroups
+	}
+	if len(msg.Mentions) > 0 {
+		payload["mentions"] = msg.Mentions
+	}
+	if msg.ReplyTo != nil {
+		payload["replyTo"] = msg.ReplyTo.Hex()
+	}
+	if msg.Quote != nil {
+		payload["quote"] = msg.Quote
+	}
+	if msg.LinkPreview != nil {
+		payload["linkPreview"] = msg.LinkPreview
+	}
+	if msg.Kind != "" {
+		payload["kind"] = msg.Kind
+	}
+	if msg.Payment != nil {
+		payload["payment"] = msg.Payment
+	}
+	if msg.Card != nil {
+		payload["card"] = msg.Card
+	}
+	if msg.Task != nil {
+		payload["task"] = msg.Task
+	}
+	if msg.SenderBadge != "" {
+		payload["senderBadge"] = msg.SenderBadge
+	}
+	if msg.Event != nil {
+		payload["event"] = msg.Event
+		payload["rsvpCounts"] = msg.Event.RSVPCounts()
+	}
+	if msg.EditedAt != nil {
+		payload["editedAt"] = msg.EditedAt
+	}
+	if msg.System != nil {
+		payload["system"] = msg.System
+	}
+	if len(msg.Entities) > 0 {
+		payload["entities"] = msg.Entities
+	}
+	if msg.ExpiresAt != nil {
+		payload["expiresAt"] = msg.ExpiresAt
+	}
+	return payload
 }
 
 //
@@ -219,80 +350,94 @@ func broadcastToChat(ctx context.Context, chatHex string, payload interface{}) {
 		return
 	}
 
-	clients.RLock()
-	targets := make(map[string]*Client, len(chat.Participants))
-	for _, p := range chat.Participants {
-		if c, ok := clients.m[p]; ok {
-			targets[p] = c
-		}
-	}
-	clients.RUnlock()
-
-	for uid, client := range targets {
-		// non-blocking send: drop if the client's send buffer is full
-		select {
-		case client.Send <- payload:
-		default:
-			// slow client; drop message and optionally log
-			log.Printf("WS dropping message to %s (slow client)", uid)
-		}
-	}
+	sendToUsers(chat.Participants, payload)
 }
 
 func broadcastGlobal(payload interface{}) {
-	clients.RLock()
-	conns := make([]*Client, 0, len(clients.m))
-	for _, c := range clients.m {
-		conns = append(conns, c)
-	}
-	clients.RUnlock()
-
-	for _, client := range conns {
-		select {
-		case client.Send <- payload:
-		default:
-			log.Printf("WS dropping global message to %s (slow client)", client.UserID)
-		}
-	}
+	sendToUsers(nil, payload)
 }
 
 //
 // ==== Persistence ====
 //
 
-func persistMediaMessage(ctx context.Context, chatID string, sender, mediaURL, mediaType string) (*models.Message, error) {
-	return persistMessage(ctx, chatID, sender, "", mediaURL, mediaType)
+func persistMediaMessage(ctx context.Context, chatID string, sender string, media *models.Media) (*models.Message, error) {
+	if media == nil || (media.URL == "" && media.Location == nil) {
+		return nil, errors.New("empty media")
+	}
+	return insertMessage(ctx, &models.Message{
+		ChatID:    chatID,
+		UserID:    sender,
+		Media:     media,
+		CreatedAt: time.Now(),
+		Status:    statusSent,
+	})
 }
 
-func persistMessage(ctx context.Context, chatID string, sender, content, mediaURL, mediaType string) (*models.Message, error) {
+// buildMessage validates and assembles a message without storing it.
+func buildMessage(chatID string, sender, content, mediaURL, mediaType string) (*models.Message, error) {
 	if content == "" && mediaURL == "" {
 		return nil, errors.New("empty content and media")
 	}
+	if len(content) > maxMessageLen {
+		return nil, errMessageTooLong
+	}
 
 	var media *models.Media
+	if strings.HasPrefix(mediaURL, gifProxyPath+"?") {
+		mediaType = models.MediaGIF // proxied GIFs are their own media type whatever the client says
+	}
 	if mediaURL != "" && mediaType != "" {
 		media = &models.Media{URL: mediaURL, Type: mediaType}
 	}
 
-	msg := &models.Message{
+	return &models.Message{
 		ChatID:    chatID,
 		UserID:    sender,
 		Content:   content,
 		Media:     media,
 		CreatedAt: time.Now(),
-	}
+		Status:    statusSent,
+	}, nil
+}
 
-	res, err := db.MessagesCollection.InsertOne(ctx, msg)
-	if err != nil {
+// insertMessage stores a prepared message and bumps the chat's updatedAt. Callers
+// broadcast it themselves.
+func insertMessage(ctx context.Context, msg *models.Message) (*models.Message, error) {
+	return storeMessage(ctx, msg, nil)
+}
+
+// storeMessage commits msg, with event queued in the outbox when non-nil, then runs the
+// post-commit hooks. Every send path ends here, so suspensions and content filters are
+// enforced here.
+func storeMessage(ctx context.Context, msg *models.Message, event *models.OutboxEvent) (*models.Message, error) {
+	if err := checkSuspended(ctx, msg.UserID); err != nil {
+		return nil, err
+	}
+	if err := filterMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+	if msg.ExpiresAt == nil {
+		msg.ExpiresAt = messageExpiry(ctx, msg.ChatID, msg.CreatedAt)
+	}
+	fillSenderProfile(ctx, msg)
+	if msg.Media != nil && msg.Media.URL != "" && mediaProcessing(ctx, msg.ChatID, msg.Media.URL) {
+		msg.Media.Status = models.MediaProcessing
+	}
+	if err := commitMessage(ctx, msg, event); err != nil {
 		return nil, err
 	}
-	msg.ID = res.InsertedID.(primitive.ObjectID)
 
-	// update chat's updatedAt by chatid
-	_, _ = db.MereCollection.UpdateOne(ctx,
-		bson.M{"chatid": chatID},
-		bson.M{"$set": bson.M{"updatedAt": time.Now()}},
-	)
+	trackSentMessage(ctx, msg)
+	if msg.Media != nil && msg.Media.URL != "" {
+		linkAttachment(ctx, msg.ChatID, msg.Media.URL, msg.ID)
+		if msg.Media.Status == models.MediaProcessing {
+			// processing may have finished while the message was committed
+			settleMediaStatus(ctx, msg.Media.URL)
+		}
+	}
+	recordCompliance(ctx, "message.created", msg)
+	go dispatchWebhooks(*msg)
 	return msg, nil
 }
 
@@ -300,12 +445,64 @@ func persistMessage(ctx context.Context, chatID string, sender, content, mediaUR
 // ==== Misc ===
 //
 
-func parseInt64(s string) (int64, error) {
-	return strconv.ParseInt(s, 10, 64)
+func registerClient(c *Client) {
+	clients.Lock()
+	defer clients.Unlock()
+	conns := clients.m[c.UserID]
+	if conns == nil {
+		conns = make(map[*Client]struct{})
+		clients.m[c.UserID] = conns
+	}
+	conns[c] = struct{}{}
+}
+
+// unregisterClient removes c, leaving the user's other devices connected, and closes its
+// send queue to stop its writer. It reports whether c was the user's last socket here.
+func unregisterClient(c *Client) bool {
+	clients.Lock()
+	defer clients.Unlock()
+	conns := clients.m[c.UserID]
+	if _, ok := conns[c]; ok {
+		delete(conns, c)
+		close(c.Send)
+	}
+	if len(conns) == 0 {
+		delete(clients.m, c.UserID)
+		return true
+	}
+	return false
 }
 
-func writeErr(w http.ResponseWriter, msg string, code int) {
-	http.Error(w, msg, code)
+// send queues payload on this socket only, not the user's other devices, dropping it when
+// the queue is full or the socket is already gone.
+func (c *Client) send(payload interface{}) {
+	clients.RLock()
+	defer clients.RUnlock()
+	if _, ok := clients.m[c.UserID][c]; !ok {
+		return // unregistered, Send is closed
+	}
+	select {
+	case c.Send <- payload:
+	default:
+		log.Printf("WS dropping message to %s (slow client)", c.UserID)
+	}
+}
+
+// allClients lists every socket on this instance.
+func allClients() []*Client {
+	clients.RLock()
+	defer clients.RUnlock()
+	out := make([]*Client, 0, len(clients.m))
+	for _, conns := range clients.m {
+		for c := range conns {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func parseInt64(s string) (int64, error) {
+	return strconv.ParseInt(s, 10, 64)
 }
 
 // package discord
@@ -325,7 +522,6 @@ func writeErr(w http.ResponseWriter, msg string, code int) {
 // 	"github.com/gorilla/websocket"
 // 	"github.com/julienschmidt/httprouter"
 // 	"go.mongodb.org/mongo-driver/bson"
-// 	"go.mongodb.org/mongo-driver/bson/primitive"
 // )
 
 // var (
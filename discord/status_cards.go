@@ -0,0 +1,154 @@
+package discord
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// cardStatusOrder ranks card statuses; a card only moves forward, and cancelled is final.
+var cardStatusOrder = map[string]int{
+	models.CardPending:   0,
+	models.CardConfirmed: 1,
+	models.CardCompleted: 2,
+	models.CardCancelled: 3,
+}
+
+// PutStatusCard is the internal API other services (orders, bookings) use to post or advance
+// the status card of every chat bound to an entity. The first call posts the card; later
+// calls edit it in place and are broadcast as message_updated rather than new messages.
+func PutStatusCard(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	entityType, entityID := ps.ByName("entitytype"), ps.ByName("entityid")
+
+	var body struct {
+		Title   string `json:"title"`
+		Status  string `json:"status"`
+		Details string `json:"details"`
+		URL     string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	body.Title = strings.TrimSpace(body.Title)
+	if _, ok := cardStatusOrder[body.Status]; !ok {
+		writeErr(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := db.MereCollection.Find(ctx, bson.M{"entitytype": entityType, "entityid": entityID})
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(chats) == 0 {
+		writeErr(w, "no chat bound to entity", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	card := models.StatusCard{
+		EntityType: entityType,
+		EntityID:   entityID,
+		Title:      body.Title,
+		Status:     body.Status,
+		Details:    body.Details,
+		URL:        body.URL,
+		UpdatedAt:  now,
+	}
+
+	// every chat's card is checked before any is changed, so a rejected update leaves
+	// them all as they were
+	existing := make([]*models.Message, len(chats))
+	for i, chat := range chats {
+		var msg models.Message
+		err := db.MessagesCollection.FindOne(ctx, bson.M{
+			"chatid":        chat.ChatID,
+			"kind":          models.KindStatusCard,
+			"card.entityid": entityID,
+		}).Decode(&msg)
+		switch {
+		case err == mongo.ErrNoDocuments:
+			if card.Title == "" {
+				writeErr(w, "title required for a new card", http.StatusBadRequest)
+				return
+			}
+		case err != nil:
+			writeErr(w, err.Error(), http.StatusInternalServerError)
+			return
+		default:
+			from := msg.Card.Status
+			if from == models.CardCancelled || cardStatusOrder[body.Status] < cardStatusOrder[from] {
+				writeErr(w, "invalid status transition from "+from, http.StatusConflict)
+				return
+			}
+			existing[i] = &msg
+		}
+	}
+
+	updated := 0
+	for i, chat := range chats {
+		if msg := existing[i]; msg == nil {
+			msg := models.Message{
+				ChatID:    chat.ChatID,
+				UserID:    systemSender,
+				Kind:      models.KindStatusCard,
+				Content:   card.Title + ": " + card.Status,
+				Card:      &card,
+				CreatedAt: now,
+				Status:    statusSent,
+			}
+			if _, err := insertMessage(ctx, &msg); err != nil {
+				log.Printf("status card: post failed (%s): %v", chat.ChatID, err)
+				continue
+			}
+			sendToUsers(chat.Participants, messagePayload(&msg))
+		} else {
+			from := msg.Card.Status
+			next := card
+			if next.Title == "" {
+				next.Title = msg.Card.Title
+			}
+			msg.Card, msg.Content, msg.EditedAt = &next, next.Title+": "+next.Status, &now
+			res, err := db.MessagesCollection.UpdateOne(ctx,
+				bson.M{"_id": msg.ID, "card.status": from},
+				bson.M{"$set": bson.M{"card": msg.Card, "content": msg.Content, "editedAt": now}},
+			)
+			if err != nil {
+				log.Printf("status card: update failed (%s): %v", chat.ChatID, err)
+				continue
+			}
+			if res.MatchedCount == 0 {
+				continue // advanced concurrently; that update broadcast its own state
+			}
+			payload := messagePayload(msg)
+			payload["type"] = "message_updated"
+			sendToUsers(chat.Participants, payload)
+		}
+		updated++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"chats": updated,
+		"card":  card,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,284 @@
+package discord
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxStickersPerPack = 120
+	maxGIFBytes        = 10 << 20
+	gifProxyPath       = "/merechats/gif"
+)
+
+var (
+	// gifCacheDir holds proxied GIFs keyed by the hash of their source URL (GIF_CACHE_DIR).
+	gifCacheDir = envOr("GIF_CACHE_DIR", filepath.Join("static", "uploads", "gifcache"))
+	// gifCacheMaxBytes caps the cache (GIF_CACHE_MAX_BYTES, default 1 GB); the least recently
+	// served GIFs are evicted past it.
+	gifCacheMaxBytes = int64(envFloat("GIF_CACHE_MAX_BYTES", 1<<30))
+	gifCacheTrimming atomic.Bool
+)
+
+// UploadStickerPack creates a pack from the multipart "stickers" files, in upload order.
+func UploadStickerPack(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := utils.GetUserIDFromRequest(r)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeErr(w, "invalid multipart form", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 64 {
+		writeErr(w, "name required (max 64 characters)", http.StatusBadRequest)
+		return
+	}
+	if n := len(r.MultipartForm.File["stickers"]); n == 0 || n > maxStickersPerPack {
+		writeErr(w, fmt.Sprintf("a pack holds 1 to %d stickers", maxStickersPerPack), http.StatusBadRequest)
+		return
+	}
+
+	files, err := filemgr.SaveFormFiles(r.MultipartForm, "stickers", filemgr.EntitySticker, filemgr.PicPhoto, true)
+	if err != nil {
+		for _, f := range files {
+			_ = filemgr.DeleteFile(filepath.Join(filemgr.ResolvePath(filemgr.EntitySticker, filemgr.PicPhoto), f))
+		}
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pack := models.StickerPack{Name: name, Owner: user, Stickers: files, CreatedAt: time.Now()}
+	res, err := db.StickersCollection.InsertOne(r.Context(), pack)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	pack.ID = res.InsertedID.(primitive.ObjectID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(pack); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListStickerPacks lists sticker packs, newest first; ?owner= narrows to one uploader.
+func ListStickerPacks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	filter := bson.M{}
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		filter["owner"] = owner
+	}
+	cursor, err := db.StickersCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(100))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var packs []models.StickerPack
+	if err := cursor.All(ctx, &packs); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if packs == nil {
+		packs = make([]models.StickerPack, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(packs); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// SendSticker posts a sticker message referencing a pack entry.
+func SendSticker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	var ref models.StickerRef
+	if err := json.NewDecoder(r.Body).Decode(&ref); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	var pack models.StickerPack
+	if err := db.StickersCollection.FindOne(ctx, bson.M{"_id": ref.PackID}).Decode(&pack); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "sticker pack not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if ref.Index < 0 || ref.Index >= len(pack.Stickers) {
+		writeErr(w, "sticker not found", http.StatusNotFound)
+		return
+	}
+
+	msg, err := persistMediaMessage(ctx, chatID, user, &models.Media{
+		URL:     pack.Stickers[ref.Index],
+		Type:    models.MediaSticker,
+		Sticker: &ref,
+	})
+	if err != nil {
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
+		return
+	}
+	broadcastToChat(ctx, chatID, messagePayload(msg))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ProxyGIF serves a remote GIF through this server so clients never contact the GIF host
+// directly. The first request downloads it (with the link-preview SSRF protections) and
+// caches it on disk; later requests are served from the cache.
+func ProxyGIF(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	raw := r.URL.Query().Get("url")
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		writeErr(w, "https url required", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256([]byte(u.String()))
+	path := filepath.Join(gifCacheDir, hex.EncodeToString(sum[:])+".gif")
+
+	if _, err := os.Stat(path); err != nil {
+		if err := fetchGIF(r, u.String(), path); err != nil {
+			log.Printf("gif proxy: %s: %v", u.Host, err)
+			writeErr(w, "could not fetch gif", http.StatusBadGateway)
+			return
+		}
+		if gifCacheTrimming.CompareAndSwap(false, true) {
+			go func() {
+				defer gifCacheTrimming.Store(false)
+				trimGIFCache()
+			}()
+		}
+	} else {
+		// the mtime is the last use, which trimGIFCache evicts by
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, path)
+}
+
+// trimGIFCache deletes the least recently served GIFs until the cache fits gifCacheMaxBytes.
+func trimGIFCache() {
+	entries, err := os.ReadDir(gifCacheDir)
+	if err != nil {
+		return
+	}
+	type cached struct {
+		path string
+		size int64
+		used time.Time
+	}
+	files := make([]cached, 0, len(entries))
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, cached{filepath.Join(gifCacheDir, e.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	if total <= gifCacheMaxBytes {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	for _, f := range files {
+		if total <= gifCacheMaxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("gif proxy: evict %s: %v", filepath.Base(f.path), err)
+			continue
+		}
+		total -= f.size
+	}
+}
+
+// fetchGIF downloads url into path, accepting only real GIFs up to maxGIFBytes.
+func fetchGIF(r *http.Request, src, path string) error {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxGIFBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxGIFBytes {
+		return fmt.Errorf("larger than %d bytes", maxGIFBytes)
+	}
+	if http.DetectContentType(body) != "image/gif" {
+		return fmt.Errorf("not a gif")
+	}
+
+	if err := os.MkdirAll(gifCacheDir, 0o755); err != nil {
+		return err
+	}
+	// write then rename so concurrent readers never see a partial file
+	tmp := path + ".tmp-" + utils.GetUUID()
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
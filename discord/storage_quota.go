@@ -0,0 +1,266 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/middleware"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultStorageQuota is how many bytes of chat uploads a user may keep (STORAGE_QUOTA_MB,
+// default 1024; 0 disables quotas). Files shared through deduplication count for everyone
+// who uploaded them.
+var defaultStorageQuota = int64(envFloat("STORAGE_QUOTA_MB", 1024) * (1 << 20))
+
+const (
+	quotasSweepName    = "quotas"
+	largestUploadsShow = 20
+)
+
+func init() {
+	sweeps[quotasSweepName] = recountStorageQuotas
+}
+
+// quotaExceeded is returned when an upload would take a user over their quota.
+type quotaExceeded struct {
+	Used, Limit, Requested int64
+}
+
+func (q *quotaExceeded) Error() string {
+	return fmt.Sprintf("storage quota exceeded: %d of %d bytes used, %d requested", q.Used, q.Limit, q.Requested)
+}
+
+func asQuotaExceeded(err error) (*quotaExceeded, bool) {
+	var q *quotaExceeded
+	ok := errors.As(err, &q)
+	return q, ok
+}
+
+// writeQuotaErr answers an upload refused by the quota with the numbers the client needs to
+// tell the user how much to free.
+func writeQuotaErr(w http.ResponseWriter, q *quotaExceeded) {
+	writeErrCode(w, http.StatusRequestEntityTooLarge, errCodeQuotaExceeded, "storage quota exceeded", map[string]interface{}{
+		"used":      q.Used,
+		"limit":     q.Limit,
+		"requested": q.Requested,
+		"usageUrl":  "/merechats/storage/usage",
+	})
+}
+
+// loadQuota returns the user's quota row, zero if they have never uploaded.
+func loadQuota(ctx context.Context, user string) (models.StorageQuota, error) {
+	q := models.StorageQuota{UserID: user}
+	err := db.StorageQuotasCollection.FindOne(ctx, bson.M{"_id": user}).Decode(&q)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return q, err
+	}
+	return q, nil
+}
+
+// quotaLimit is the byte limit that applies to q, 0 for none.
+func quotaLimit(q models.StorageQuota) int64 {
+	switch {
+	case q.Limit > 0:
+		return q.Limit
+	case q.Limit < 0:
+		return 0
+	default:
+		return defaultStorageQuota
+	}
+}
+
+// checkQuota fails with *quotaExceeded when storing size more bytes would exceed the user's
+// limit. Concurrent uploads can overshoot by one file each; the next upload is refused.
+func checkQuota(ctx context.Context, user string, size int64) error {
+	q, err := loadQuota(ctx, user)
+	if err != nil {
+		return err
+	}
+	limit := quotaLimit(q)
+	if limit > 0 && q.Bytes+size > limit {
+		return &quotaExceeded{Used: q.Bytes, Limit: limit, Requested: size}
+	}
+	return nil
+}
+
+// chargeQuota adds (or, with negative values, removes) stored bytes and files to a user's total.
+func chargeQuota(ctx context.Context, user string, bytes, files int64) {
+	if user == "" {
+		return
+	}
+	_, err := db.StorageQuotasCollection.UpdateOne(ctx, bson.M{"_id": user},
+		bson.M{"$inc": bson.M{"bytes": bytes, "files": files}, "$set": bson.M{"updatedAt": time.Now()}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("storage quota: charge %s failed: %v", user, err)
+	}
+}
+
+// GetStorageUsage shows the caller's stored bytes against their quota, broken down by media
+// type, with their largest uploads so they know what to delete.
+func GetStorageUsage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	q, err := loadQuota(ctx, user)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	cursor, err := db.AttachmentsCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "uploader", Value: user}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{bson.D{{Key: "$split", Value: bson.A{"$mime", "/"}}}, 0}}}},
+			{Key: "bytes", Value: bson.D{{Key: "$sum", Value: "$size"}}},
+			{Key: "files", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var groups []struct {
+		Type  string `bson:"_id"`
+		Bytes int64  `bson:"bytes"`
+		Files int64  `bson:"files"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	byType := make(map[string]interface{}, len(groups))
+	for _, g := range groups {
+		if g.Type == "" {
+			g.Type = "other"
+		}
+		byType[g.Type] = map[string]int64{"bytes": g.Bytes, "files": g.Files}
+	}
+
+	largest := []models.Attachment{}
+	cursor, err = db.AttachmentsCollection.Find(ctx, bson.M{"uploader": user}, options.Find().
+		SetSort(bson.D{{Key: "size", Value: -1}}).
+		SetLimit(largestUploadsShow).
+		SetProjection(bson.M{"path": 0, "variants": 0, "sha256": 0}))
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := cursor.All(ctx, &largest); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	usage := map[string]interface{}{
+		"bytes":   q.Bytes,
+		"files":   q.Files,
+		"byType":  byType,
+		"largest": largest,
+	}
+	if limit := quotaLimit(q); limit > 0 {
+		usage["limit"] = limit
+		usage["remaining"] = max(limit-q.Bytes, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// OperatorSetStorageQuota overrides a user's quota: {"limitMb": n}; 0 restores the default
+// and a negative value removes the limit.
+func OperatorSetStorageQuota(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := ps.ByName("userid")
+	var body struct {
+		LimitMB float64 `json:"limitMb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	limit := int64(body.LimitMB * (1 << 20))
+	if body.LimitMB < 0 {
+		limit = -1
+	}
+
+	update := bson.M{"$set": bson.M{"limit": limit, "updatedAt": time.Now()}}
+	if limit == 0 {
+		update = bson.M{"$unset": bson.M{"limit": ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	}
+	var q models.StorageQuota
+	err := db.StorageQuotasCollection.FindOneAndUpdate(r.Context(), bson.M{"_id": user}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&q)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	middleware.AuditDetail(r, "limitMb", body.LimitMB)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(q); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// recountStorageQuotas rebuilds every user's totals from their attachment rows, fixing drift
+// from charges lost to errors. It returns how many users were updated.
+func recountStorageQuotas(ctx context.Context) (int, error) {
+	cursor, err := db.AttachmentsCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$uploader"},
+			{Key: "bytes", Value: bson.D{{Key: "$sum", Value: "$size"}}},
+			{Key: "files", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var totals []struct {
+		User  string `bson:"_id"`
+		Bytes int64  `bson:"bytes"`
+		Files int64  `bson:"files"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	users := make([]string, 0, len(totals))
+	updated := 0
+	for _, t := range totals {
+		if t.User == "" {
+			continue
+		}
+		users = append(users, t.User)
+		res, err := db.StorageQuotasCollection.UpdateOne(ctx, bson.M{"_id": t.User},
+			bson.M{"$set": bson.M{"bytes": t.Bytes, "files": t.Files, "updatedAt": now}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return updated, err
+		}
+		updated += int(res.ModifiedCount + res.UpsertedCount)
+	}
+	res, err := db.StorageQuotasCollection.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$nin": users}, "files": bson.M{"$ne": 0}},
+		bson.M{"$set": bson.M{"bytes": 0, "files": 0, "updatedAt": now}})
+	if err != nil {
+		return updated, err
+	}
+	return updated + int(res.ModifiedCount), nil
+}
@@ -0,0 +1,161 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	systemSender = "system"
+
+	systemJoin  = "join"
+	systemLeave = "leave"
+
+	// joinLeaveWindow is how long an aggregated join/leave entry keeps absorbing new events.
+	joinLeaveWindow = 2 * time.Minute
+)
+
+// postSystemEvent records that users joined or left a chat. In large chats, events arriving
+// within joinLeaveWindow of the latest entry of the same kind are folded into it
+// ("5 people joined") instead of adding a message each.
+func postSystemEvent(ctx context.Context, chat *models.Chat, action string, users []string) {
+	if len(users) == 0 {
+		return
+	}
+
+	if len(chat.Participants) > bigChatThreshold {
+		var msg models.Message
+		err := db.MessagesCollection.FindOneAndUpdate(ctx,
+			bson.M{
+				"chatid":        chat.ChatID,
+				"sender":        systemSender,
+				"system.action": action,
+				"createdAt":     bson.M{"$gte": time.Now().Add(-joinLeaveWindow)},
+			},
+			bson.M{"$addToSet": bson.M{"system.users": bson.M{"$each": users}}},
+			options.FindOneAndUpdate().
+				SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+				SetReturnDocument(options.After),
+		).Decode(&msg)
+		if err == nil {
+			msg.Content = systemEventText(msg.System)
+			if _, err := db.MessagesCollection.UpdateOne(ctx, bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"content": msg.Content}}); err != nil {
+				log.Printf("system message: relabel failed (%s): %v", chat.ChatID, err)
+			}
+			payload := messagePayload(&msg)
+			payload["type"] = "message_updated"
+			sendToUsers(chat.Participants, payload)
+			return
+		}
+		if err != mongo.ErrNoDocuments {
+			log.Printf("system message: aggregate lookup failed (%s): %v", chat.ChatID, err)
+		}
+	}
+
+	event := &models.SystemEvent{Action: action, Users: users}
+	msg, err := insertMessage(ctx, &models.Message{
+		ChatID:    chat.ChatID,
+		UserID:    systemSender,
+		Content:   systemEventText(event),
+		System:    event,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("system message: insert failed (%s): %v", chat.ChatID, err)
+		return
+	}
+	sendToUsers(chat.Participants, messagePayload(msg))
+}
+
+// systemEventText renders the human-readable line for a join/leave entry.
+func systemEventText(e *models.SystemEvent) string {
+	verb := "joined"
+	if e.Action == systemLeave {
+		verb = "left"
+	}
+	if len(e.Users) == 1 {
+		return fmt.Sprintf("%s %s", e.Users[0], verb)
+	}
+	return fmt.Sprintf("%d people %s", len(e.Users), verb)
+}
+
+// LeaveChat removes the caller from a chat and announces it. The last participant leaving
+// deletes the chat.
+func LeaveChat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(chat.Participants) == 1 {
+		if err := deleteChat(ctx, &chat); err != nil {
+			writeErr(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"left":    chatID,
+			"deleted": true,
+		}); err != nil {
+			writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID},
+		bson.M{
+			"$pull":  bson.M{"participants": user, "admins": user},
+			"$unset": bson.M{"joinedAt." + user: "", "settings." + user: ""},
+			"$set":   bson.M{"updatedAt": time.Now()},
+		},
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	remaining := make([]string, 0, len(chat.Participants))
+	for _, p := range chat.Participants {
+		if p != user {
+			remaining = append(remaining, p)
+		}
+	}
+	chat.Participants = remaining
+	refreshSummaryMembers(ctx, &chat)
+	for _, coll := range []*mongo.Collection{db.MembershipsCollection, db.ChatUserStateCollection} {
+		if _, err := coll.DeleteOne(ctx, bson.M{"chatid": chatID, "userid": user}); err != nil {
+			log.Printf("leave: %s of %s in %s: %v", coll.Name(), user, chatID, err)
+		}
+	}
+	postSystemEvent(ctx, &chat, systemLeave, []string{user})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"left": chatID,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
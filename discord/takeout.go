@@ -0,0 +1,206 @@
+package discord
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const jobKindTakeout = "takeout"
+
+func init() {
+	jobRunners[jobKindTakeout] = buildTakeout
+}
+
+var (
+	// takeoutDir holds finished archives until their job expires (TAKEOUT_DIR).
+	takeoutDir = envOr("TAKEOUT_DIR", filepath.Join(os.TempDir(), "merechats-takeout"))
+	// takeoutChunkBytes starts a new archive part once the current one passes it (TAKEOUT_CHUNK_BYTES).
+	takeoutChunkBytes = int64(envFloat("TAKEOUT_CHUNK_BYTES", 1<<30))
+)
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// RequestTakeout starts an archive of all of the caller's chats: chat metadata, the messages
+// they sent and the files they uploaded. Only one takeout runs per user at a time.
+func RequestTakeout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+
+	var active models.Job
+	err := db.JobsCollection.FindOne(ctx, bson.M{
+		"userid": user,
+		"kind":   jobKindTakeout,
+		"status": bson.M{"$in": bson.A{models.JobPending, models.JobRunning}},
+	}).Decode(&active)
+	if err == nil {
+		writeErrCode(w, http.StatusConflict, errCodeJobInProgress, "a job is already in progress", active)
+		return
+	}
+
+	job, err := startJob(ctx, jobKindTakeout, user, nil)
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/merechats/jobs/"+job.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// buildTakeout writes the user's data into one or more zip parts of about takeoutChunkBytes each.
+func buildTakeout(ctx context.Context, job *models.Job, report func(int)) ([]models.JobPart, error) {
+	if err := os.MkdirAll(takeoutDir, 0o700); err != nil {
+		return nil, err
+	}
+	cursor, err := db.MereCollection.Find(ctx, bson.M{"participants": job.UserID})
+	if err != nil {
+		return nil, err
+	}
+	var chats []models.Chat
+	if err := cursor.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+
+	arc := &takeoutArchive{prefix: filepath.Join(takeoutDir, job.ID.Hex())}
+	defer arc.close()
+
+	for i, chat := range chats {
+		dir := "chats/" + chat.ChatID + "/"
+		if err := arc.writeJSON(dir+"chat.json", chat); err != nil {
+			return arc.parts, err
+		}
+
+		msgs, err := db.MessagesCollection.Find(ctx,
+			bson.M{"chatid": chat.ChatID, "sender": job.UserID},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}),
+		)
+		if err != nil {
+			return arc.parts, err
+		}
+		var mine []models.Message
+		if err := msgs.All(ctx, &mine); err != nil {
+			return arc.parts, err
+		}
+		if mine == nil {
+			mine = make([]models.Message, 0)
+		}
+		if err := arc.writeJSON(dir+"messages.json", mine); err != nil {
+			return arc.parts, err
+		}
+
+		files, err := db.AttachmentsCollection.Find(ctx, bson.M{"chatid": chat.ChatID, "uploader": job.UserID})
+		if err != nil {
+			return arc.parts, err
+		}
+		var uploads []models.Attachment
+		if err := files.All(ctx, &uploads); err != nil {
+			return arc.parts, err
+		}
+		for _, a := range uploads {
+			if err := arc.copyFile(dir+"media/"+a.Name, a.Path); err != nil {
+				return arc.parts, err
+			}
+		}
+
+		report((i + 1) * 99 / len(chats))
+	}
+	if err := arc.close(); err != nil {
+		return arc.parts, err
+	}
+	return arc.parts, nil
+}
+
+// takeoutArchive writes zip entries, rolling over to a new part file past takeoutChunkBytes.
+type takeoutArchive struct {
+	prefix string
+	parts  []models.JobPart
+	file   *os.File
+	zw     *zip.Writer
+}
+
+func (a *takeoutArchive) writer(name string) (io.Writer, error) {
+	if a.zw != nil {
+		if info, err := a.file.Stat(); err == nil && info.Size() >= takeoutChunkBytes {
+			if err := a.close(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if a.zw == nil {
+		path := fmt.Sprintf("%s-part%d.zip", a.prefix, len(a.parts)+1)
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		a.file, a.zw = f, zip.NewWriter(f)
+		a.parts = append(a.parts, models.JobPart{Name: filepath.Base(path), Path: path})
+	}
+	return a.zw.Create(name)
+}
+
+func (a *takeoutArchive) writeJSON(name string, v interface{}) error {
+	w, err := a.writer(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (a *takeoutArchive) copyFile(name, path string) error {
+	src, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil // removed since upload; nothing to archive
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	w, err := a.writer(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// close finishes the current part and records its size.
+func (a *takeoutArchive) close() error {
+	if a.zw == nil {
+		return nil
+	}
+	err := a.zw.Close()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	if info, serr := os.Stat(a.file.Name()); serr == nil {
+		a.parts[len(a.parts)-1].Size = info.Size()
+	}
+	a.zw, a.file = nil, nil
+	return err
+}
@@ -0,0 +1,201 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxTaskTitleLen = 300
+
+// CreateTask posts a task, optionally assigned to a participant with a due date.
+func CreateTask(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkWritable(&chat); err != nil {
+		writeReadOnly(w)
+		return
+	}
+
+	var body struct {
+		Title    string     `json:"title"`
+		Assignee string     `json:"assignee"`
+		DueAt    *time.Time `json:"dueAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	body.Title = strings.TrimSpace(body.Title)
+	if body.Title == "" || len([]rune(body.Title)) > maxTaskTitleLen {
+		writeErr(w, "title required (max 300 characters)", http.StatusBadRequest)
+		return
+	}
+	if body.Assignee != "" && !utils.Contains(chat.Participants, body.Assignee) {
+		writeErr(w, "assignee must be a participant", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := buildMessage(chatID, user, body.Title, "", "")
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg.Kind = models.KindTask
+	msg.Task = &models.Task{Title: body.Title, Assignee: body.Assignee, DueAt: body.DueAt}
+	if _, err := insertMessage(ctx, msg); err != nil {
+		if !writeSendErr(w, err) {
+			writeErr(w, "failed to persist message", http.StatusInternalServerError)
+		}
+		return
+	}
+	sendToUsers(chat.Participants, messagePayload(msg))
+	if body.Assignee != "" && body.Assignee != user {
+		sendToUsers([]string{body.Assignee}, map[string]interface{}{
+			"type":   "task_assigned",
+			"id":     msg.ID.Hex(),
+			"chatid": chatID,
+			"by":     user,
+			"title":  body.Title,
+			"dueAt":  body.DueAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// SetTaskDone marks a task done or reopens it. The creator, the assignee and chat admins may.
+func SetTaskDone(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	msgID, err := primitive.ObjectIDFromHex(ps.ByName("messageid"))
+	if err != nil {
+		writeErr(w, "invalid messageId", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Done bool `json:"done"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var existing models.Message
+	if err := db.MessagesCollection.FindOne(ctx, bson.M{"_id": msgID, "chatid": chatID, "kind": models.KindTask}).Decode(&existing); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "task not found", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if user != existing.UserID && user != existing.Task.Assignee && !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"task.done": false}, "$unset": bson.M{"task.doneBy": "", "task.doneAt": ""}}
+	if body.Done {
+		update = bson.M{"$set": bson.M{"task.done": true, "task.doneBy": user, "task.doneAt": time.Now()}}
+	}
+	var msg models.Message
+	if err := db.MessagesCollection.FindOneAndUpdate(ctx, bson.M{"_id": msgID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&msg); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	payload := messagePayload(&msg)
+	payload["type"] = "message_updated"
+	sendToUsers(chat.Participants, payload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListOpenTasks lists a chat's open tasks, soonest due first; ?assignee= narrows the list.
+func ListOpenTasks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	filter := bson.M{"chatid": chatID, "kind": models.KindTask, "task.done": false, "deleted": bson.M{"$ne": true}}
+	if a := r.URL.Query().Get("assignee"); a != "" {
+		filter["task.assignee"] = a
+	}
+	applyHistoryFloor(filter, &chat, user)
+	// tasks without a due date sort last
+	cursor, err := db.MessagesCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$addFields", Value: bson.M{"_noDue": bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$task.dueAt", nil}}, nil}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_noDue", Value: 1}, {Key: "task.dueAt", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: 200}},
+		{{Key: "$project", Value: bson.M{"_noDue": 0}}},
+	})
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var tasks []models.Message
+	if err := cursor.All(ctx, &tasks); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tasks == nil {
+		tasks = make([]models.Message, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tasks); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
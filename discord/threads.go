@@ -0,0 +1,144 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errNoThreadRoot = errors.New("reply target not found")
+
+// resolveThreadRoot returns the root of the thread a reply joins. Replies to replies attach
+// to the same root so threads stay one level deep.
+func resolveThreadRoot(ctx context.Context, chatID, replyTo string) (*primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(replyTo)
+	if err != nil {
+		return nil, errNoThreadRoot
+	}
+	var target models.Message
+	err = db.MessagesCollection.FindOne(ctx,
+		bson.M{"_id": id, "chatid": chatID, "deleted": bson.M{"$ne": true}},
+		options.FindOne().SetProjection(bson.M{"replyTo": 1}),
+	).Decode(&target)
+	if err == mongo.ErrNoDocuments {
+		return nil, errNoThreadRoot
+	}
+	if err != nil {
+		return nil, err
+	}
+	if target.ReplyTo != nil {
+		return target.ReplyTo, nil
+	}
+	return &id, nil
+}
+
+// followThread makes the root author and each replier a watcher, unless they unwatched it.
+func followThread(ctx context.Context, root primitive.ObjectID, user string) {
+	_, err := db.MessagesCollection.UpdateOne(ctx,
+		bson.M{"_id": root, "unwatchedBy": bson.M{"$ne": user}},
+		bson.M{"$addToSet": bson.M{"watchers": user}},
+	)
+	if err != nil {
+		log.Printf("threads: follow %s failed (%s): %v", root.Hex(), user, err)
+	}
+}
+
+// loadThreadRoot fetches the watch lists of a reply's thread root; nil if msg is not a reply.
+func loadThreadRoot(ctx context.Context, msg *models.Message) *models.Message {
+	if msg.ReplyTo == nil {
+		return nil
+	}
+	var root models.Message
+	err := db.MessagesCollection.FindOne(ctx,
+		bson.M{"_id": *msg.ReplyTo},
+		options.FindOne().SetProjection(bson.M{"sender": 1, "watchers": 1, "unwatchedBy": 1}),
+	).Decode(&root)
+	if err != nil {
+		return nil
+	}
+	return &root
+}
+
+// notifyThreadWatchers tells the thread's watchers about a new reply, sender excluded.
+func notifyThreadWatchers(chat *models.Chat, msg *models.Message, root *models.Message) {
+	if root == nil {
+		return
+	}
+	var users []string
+	for _, u := range root.Watchers {
+		if u != msg.UserID && utils.Contains(chat.Participants, u) {
+			users = append(users, u)
+		}
+	}
+	for _, g := range groupByNotificationPrefs(chat, users) {
+		title, body := notificationPreview(msg, g.Preview)
+		sendToUsers(g.Users, map[string]interface{}{
+			"type":      "thread_reply",
+			"title":     title,
+			"body":      body,
+			"chatid":    msg.ChatID,
+			"id":        msg.ID.Hex(),
+			"root":      root.ID.Hex(),
+			"sender":    msg.UserID,
+			"createdAt": msg.CreatedAt,
+			"sound":     g.Sound,
+			"priority":  g.Priority,
+		})
+	}
+}
+
+// WatchThread subscribes the caller to replies on a thread root.
+func WatchThread(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	setThreadWatch(w, r, ps, true)
+}
+
+// UnwatchThread stops thread notifications for the caller, even in chats they otherwise follow.
+func UnwatchThread(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	setThreadWatch(w, r, ps, false)
+}
+
+func setThreadWatch(w http.ResponseWriter, r *http.Request, ps httprouter.Params, watch bool) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	root, err := resolveThreadRoot(ctx, chatID, ps.ByName("messageid"))
+	if err == errNoThreadRoot {
+		writeErr(w, "message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	update := bson.M{"$addToSet": bson.M{"watchers": user}, "$pull": bson.M{"unwatchedBy": user}}
+	if !watch {
+		update = bson.M{"$addToSet": bson.M{"unwatchedBy": user}, "$pull": bson.M{"watchers": user}}
+	}
+	if _, err := db.MessagesCollection.UpdateOne(ctx, bson.M{"_id": *root}, update); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,233 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/filemgr"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// transcribeJob is the media job kind that transcribes an audio upload.
+const transcribeJob = "transcribe"
+
+// transcript is what a transcription backend heard. Language may be empty.
+type transcript struct {
+	Text     string
+	Language string
+}
+
+// transcriber turns speech into text.
+type transcriber interface {
+	Transcribe(ctx context.Context, audio io.Reader, filename string) (transcript, error)
+}
+
+var (
+	// transcriptionProvider is nil (no transcripts) unless TRANSCRIBE_URL is set.
+	transcriptionProvider transcriber
+
+	// maxTranscribeDuration (TRANSCRIBE_MAX_SECONDS, default 600) skips longer recordings,
+	// which are rarely voice notes and expensive to transcribe.
+	maxTranscribeDuration = envFloat("TRANSCRIBE_MAX_SECONDS", 600)
+)
+
+func init() {
+	if url := os.Getenv("TRANSCRIBE_URL"); url != "" {
+		model := os.Getenv("TRANSCRIBE_MODEL")
+		if model == "" {
+			model = "whisper-1"
+		}
+		transcriptionProvider = &whisperTranscriber{
+			url:    url,
+			apiKey: os.Getenv("TRANSCRIBE_API_KEY"),
+			model:  model,
+			client: &http.Client{Timeout: 5 * time.Minute},
+		}
+	}
+}
+
+// whisperTranscriber speaks the OpenAI audio transcription API, which self-hosted Whisper
+// servers mimic: a multipart POST of file and model answered by {"text", "language"}.
+type whisperTranscriber struct {
+	url    string
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+func (t *whisperTranscriber) Transcribe(ctx context.Context, audio io.Reader, filename string) (transcript, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return transcript{}, err
+	}
+	if _, err := io.Copy(fw, audio); err != nil {
+		return transcript{}, err
+	}
+	_ = mw.WriteField("model", t.model)
+	_ = mw.WriteField("response_format", "json")
+	if err := mw.Close(); err != nil {
+		return transcript{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, &body)
+	if err != nil {
+		return transcript{}, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return transcript{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return transcript{}, fmt.Errorf("transcribe status %d", resp.StatusCode)
+	}
+	var out struct {
+		Text     string `json:"text"`
+		Language string `json:"language"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return transcript{}, fmt.Errorf("decode transcript: %w", err)
+	}
+	return transcript{Text: strings.TrimSpace(out.Text), Language: out.Language}, nil
+}
+
+// queueTranscription schedules a chat audio upload for transcription when a provider is
+// configured. Without the persistent queue it runs in a goroutine.
+func queueTranscription(picType filemgr.PictureType, saved filemgr.SavedFile) {
+	if transcriptionProvider == nil || saved.Audio == nil || saved.Audio.Duration > maxTranscribeDuration {
+		return
+	}
+	job := filemgr.MediaJob{Kind: transcribeJob, Entity: filemgr.EntityChat, PicType: picType, Name: saved.Name}
+	if filemgr.Jobs != nil {
+		err := filemgr.Jobs.Enqueue(job)
+		if err == nil {
+			return
+		}
+		log.Printf("transcribe: %s not queued, running now: %v", saved.Name, err)
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		if err := transcribeAttachment(ctx, &models.MediaJob{Kind: job.Kind, Entity: string(job.Entity), PicType: string(job.PicType), Name: job.Name}); err != nil {
+			log.Printf("transcribe: %s failed: %v", job.Name, err)
+		}
+	}()
+}
+
+// openUpload reads a saved upload from local disk or, once offloaded, from its backend.
+func openUpload(ctx context.Context, path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	link, err := filemgr.FileURL(ctx, path, mediaURLTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(link, "http") {
+		return nil, filemgr.ErrJobSourceGone // local backend and the file is gone
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, filemgr.ErrJobSourceGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch %s: status %d", filepath.Base(path), resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// transcribeAttachment transcribes an audio upload, stores the transcript with its media
+// metadata and on the messages carrying it (where search finds it), and sends their chats
+// a transcript_ready event. The message may still be in flight when a short recording is
+// done, hence the retries.
+func transcribeAttachment(ctx context.Context, job *models.MediaJob) error {
+	if transcriptionProvider == nil {
+		return nil // turned off since the job was queued
+	}
+	path := filepath.Join(filemgr.ResolvePath(filemgr.EntityType(job.Entity), filemgr.PictureType(job.PicType)), job.Name)
+	audio, err := openUpload(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer audio.Close()
+	t, err := transcriptionProvider.Transcribe(ctx, audio, job.Name)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := db.MediaMetadataCollection.UpdateOne(ctx, bson.M{"_id": job.Name}, bson.M{"$set": bson.M{
+		"transcript":         t.Text,
+		"transcriptLanguage": t.Language,
+		"transcribedAt":      now,
+	}}); err != nil {
+		return err
+	}
+	if t.Text == "" {
+		return nil // nothing said
+	}
+
+	filter := bson.M{"media.url": job.Name}
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(5 * time.Second)
+		}
+		res, err := db.MessagesCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"media.transcript": t.Text}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount > 0 {
+			break
+		}
+	}
+
+	cursor, err := db.MessagesCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "chatid": 1}))
+	if err != nil {
+		return nil // stored; only the event is lost
+	}
+	var msgs []models.Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		broadcastToChat(ctx, m.ChatID, map[string]interface{}{
+			"type":       "transcript_ready",
+			"id":         m.ID.Hex(),
+			"chatid":     m.ChatID,
+			"name":       job.Name,
+			"transcript": t.Text,
+			"language":   t.Language,
+		})
+	}
+	return nil
+}
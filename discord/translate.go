@@ -0,0 +1,207 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/rdx"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	translationCachePrefix = "translate:"
+	translationCacheTTL    = 7 * 24 * time.Hour
+)
+
+var langRe = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})?$`)
+
+// translator is the machine-translation provider. source may be empty to auto-detect.
+type translator interface {
+	Translate(ctx context.Context, text, source, target string) (string, error)
+}
+
+// translationProvider is nil (auto-translate off) unless TRANSLATE_URL is set.
+var translationProvider translator
+
+func init() {
+	if base := strings.TrimRight(os.Getenv("TRANSLATE_URL"), "/"); base != "" {
+		translationProvider = &httpTranslator{
+			url:    base,
+			apiKey: os.Getenv("TRANSLATE_API_KEY"),
+			client: &http.Client{Timeout: 5 * time.Second},
+		}
+	}
+}
+
+// httpTranslator calls POST {url} with {"text","source","target"} and expects {"translation"}.
+type httpTranslator struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (t *httpTranslator) Translate(ctx context.Context, text, source, target string) (string, error) {
+	body, err := json.Marshal(map[string]string{"text": text, "source": source, "target": target})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("translate status %d", resp.StatusCode)
+	}
+	var out struct {
+		Translation string `json:"translation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("decode translation: %w", err)
+	}
+	return out.Translation, nil
+}
+
+// translateCached translates through the provider, memoising results in Redis.
+func translateCached(ctx context.Context, text, source, target string) (string, error) {
+	sum := sha256.Sum256([]byte(source + "\x00" + text))
+	key := translationCachePrefix + target + ":" + hex.EncodeToString(sum[:])
+
+	if cached, err := rdx.Conn.Get(ctx, key).Result(); err == nil {
+		return cached, nil
+	}
+	out, err := translationProvider.Translate(ctx, text, source, target)
+	if err != nil {
+		return "", err
+	}
+	if err := rdx.Conn.Set(ctx, key, out, translationCacheTTL).Err(); err != nil {
+		log.Printf("translate: cache write failed: %v", err)
+	}
+	return out, nil
+}
+
+// translationTargets returns recipient => language for participants who want msg auto-translated:
+// their preferred language differs from the chat's and auto-translate is on (their own choice,
+// else the chat default).
+func translationTargets(chat *models.Chat, sender string) map[string]string {
+	targets := make(map[string]string)
+	for _, p := range chat.Participants {
+		if p == sender {
+			continue
+		}
+		s := chat.Settings[p]
+		if s.Language == "" || s.Language == chat.Language {
+			continue
+		}
+		auto := chat.AutoTranslate
+		if s.AutoTranslate != nil {
+			auto = *s.AutoTranslate
+		}
+		if auto {
+			targets[p] = s.Language
+		}
+	}
+	return targets
+}
+
+// deliverTranslations sends each opted-in recipient a "translation" frame for a new message,
+// translating once per target language.
+func deliverTranslations(chat models.Chat, msg models.Message) {
+	if translationProvider == nil || strings.TrimSpace(msg.Content) == "" {
+		return
+	}
+	targets := translationTargets(&chat, msg.UserID)
+	if len(targets) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	byLang := make(map[string][]string)
+	for user, lang := range targets {
+		byLang[lang] = append(byLang[lang], user)
+	}
+	for lang, users := range byLang {
+		text, err := translateCached(ctx, msg.Content, chat.Language, lang)
+		if err != nil {
+			log.Printf("translate: %s -> %s failed for %s: %v", chat.Language, lang, msg.ID.Hex(), err)
+			continue
+		}
+		sendToUsers(users, map[string]interface{}{
+			"type":     "translation",
+			"id":       msg.ID.Hex(),
+			"chatid":   msg.ChatID,
+			"language": lang,
+			"content":  text,
+		})
+	}
+}
+
+// SetChatLanguage lets a chat admin set the chat's primary language and whether members
+// with a different preferred language get messages auto-translated by default.
+func SetChatLanguage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Language      string `json:"language"`
+		AutoTranslate bool   `json:"autoTranslate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if body.Language != "" && !langRe.MatchString(body.Language) {
+		writeErr(w, "invalid language", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx,
+		bson.M{"chatid": chatID},
+		bson.M{"$set": bson.M{"language": body.Language, "autoTranslate": body.AutoTranslate, "updatedAt": time.Now()}},
+	); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// badgeTTL bounds how long a resolved badge is reused; grants and revokes on another
+// instance show up here after at most this long.
+const badgeTTL = time.Minute
+
+type cachedBadge struct {
+	badge   string
+	expires time.Time
+}
+
+var (
+	badgeMu    sync.Mutex
+	badgeCache = make(map[string]cachedBadge) // tenant + "|" + userid => badge
+)
+
+var validBadges = map[string]bool{
+	models.BadgeOfficial: true,
+	models.BadgeBot:      true,
+	models.BadgeStaff:    true,
+}
+
+// senderBadges resolves the verification badge of each user in the chat's tenant. A tenant
+// grant wins over a global one; users without a grant fall back to the accounts service's
+// verified flag. Users without a badge are left out.
+func senderBadges(ctx context.Context, chat *models.Chat, users []string) map[string]string {
+	out := make(map[string]string, len(users))
+	var missing []string
+
+	now := time.Now()
+	badgeMu.Lock()
+	for _, u := range users {
+		if _, seen := out[u]; seen {
+			continue
+		}
+		if c, ok := badgeCache[chat.EntityId+"|"+u]; ok && now.Before(c.expires) {
+			out[u] = c.badge
+			continue
+		}
+		out[u] = ""
+		missing = append(missing, u)
+	}
+	badgeMu.Unlock()
+
+	if len(missing) > 0 {
+		resolved, err := lookupBadges(ctx, chat.EntityId, missing)
+		if err != nil {
+			log.Printf("verification lookup failed (%s): %v", chat.ChatID, err)
+		} else {
+			badgeMu.Lock()
+			for _, u := range missing {
+				out[u] = resolved[u]
+				badgeCache[chat.EntityId+"|"+u] = cachedBadge{badge: resolved[u], expires: now.Add(badgeTTL)}
+			}
+			badgeMu.Unlock()
+		}
+	}
+
+	for u, b := range out {
+		if b == "" {
+			delete(out, u)
+		}
+	}
+	return out
+}
+
+func lookupBadges(ctx context.Context, tenant string, users []string) (map[string]string, error) {
+	out := make(map[string]string, len(users))
+
+	// accounts-service flag first so grants below override it
+	cursor, err := db.UsersCollection.Find(ctx,
+		bson.M{"userid": bson.M{"$in": users}, "verified": true},
+		options.Find().SetProjection(bson.M{"userid": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var verified []struct {
+		UserID string `bson:"userid"`
+	}
+	if err := cursor.All(ctx, &verified); err != nil {
+		return nil, err
+	}
+	for _, v := range verified {
+		out[v.UserID] = models.BadgeOfficial
+	}
+
+	cursor, err = db.VerificationsCollection.Find(ctx, bson.M{
+		"userid": bson.M{"$in": users},
+		"tenant": bson.M{"$in": bson.A{models.GlobalTenant, tenant}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var grants []models.Verification
+	if err := cursor.All(ctx, &grants); err != nil {
+		return nil, err
+	}
+	for _, g := range grants {
+		if g.Tenant == models.GlobalTenant {
+			out[g.UserID] = g.Badge
+		}
+	}
+	for _, g := range grants {
+		if g.Tenant != models.GlobalTenant {
+			out[g.UserID] = g.Badge
+		}
+	}
+	return out, nil
+}
+
+// attachSenderBadges fills SenderBadge on messages about to be returned to a client.
+func attachSenderBadges(ctx context.Context, chat *models.Chat, msgs []models.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	senders := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		senders = append(senders, m.UserID)
+	}
+	badges := senderBadges(ctx, chat, senders)
+	for i := range msgs {
+		msgs[i].SenderBadge = badges[msgs[i].UserID]
+	}
+}
+
+func forgetBadge(tenant, user string) {
+	badgeMu.Lock()
+	defer badgeMu.Unlock()
+	if tenant != models.GlobalTenant {
+		delete(badgeCache, tenant+"|"+user)
+		return
+	}
+	for key := range badgeCache {
+		if strings.HasSuffix(key, "|"+user) {
+			delete(badgeCache, key)
+		}
+	}
+}
+
+// ListVerifications lists the badges granted in a tenant; "global" lists the global ones.
+func ListVerifications(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	cursor, err := db.VerificationsCollection.Find(ctx, bson.M{"tenant": ps.ByName("tenant")},
+		options.Find().SetSort(bson.M{"grantedAt": -1}).SetLimit(500))
+	if err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var grants []models.Verification
+	if err := cursor.All(ctx, &grants); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if grants == nil {
+		grants = make([]models.Verification, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(grants); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GrantVerification gives a user a badge in a tenant, replacing any badge they had there.
+func GrantVerification(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	admin := utils.GetUserIDFromRequest(r)
+	tenant, user := ps.ByName("tenant"), ps.ByName("userid")
+
+	var body struct {
+		Badge string `json:"badge"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if !validBadges[body.Badge] {
+		writeErr(w, "badge must be official, bot or staff", http.StatusBadRequest)
+		return
+	}
+
+	grant := models.Verification{Tenant: tenant, UserID: user, Badge: body.Badge, GrantedBy: admin, GrantedAt: time.Now()}
+	if _, err := db.VerificationsCollection.ReplaceOne(ctx,
+		bson.M{"tenant": tenant, "userid": user}, grant,
+		options.Replace().SetUpsert(true),
+	); err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	forgetBadge(tenant, user)
+	log.Printf("verification granted: %s=%s in %s by %s", user, body.Badge, tenant, admin)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(grant); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RevokeVerification removes a user's badge in a tenant.
+func RevokeVerification(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	tenant, user := ps.ByName("tenant"), ps.ByName("userid")
+
+	res, err := db.VerificationsCollection.DeleteOne(ctx, bson.M{"tenant": tenant, "userid": user})
+	if err != nil {
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeErr(w, "not found", http.StatusNotFound)
+		return
+	}
+	forgetBadge(tenant, user)
+	log.Printf("verification revoked: %s in %s by %s", user, tenant, utils.GetUserIDFromRequest(r))
+	w.WriteHeader(http.StatusNoContent)
+}
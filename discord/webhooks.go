@@ -0,0 +1,207 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	webhookSignatureHeader = "X-Merechats-Signature" // "sha256=<hex hmac of timestamp.body>"
+	webhookTimestampHeader = "X-Merechats-Timestamp"
+	webhookAttempts        = 3
+)
+
+// webhookClient only reaches public addresses, checked when dialing as validateWebhookURL
+// cannot see what a hostname resolves to later. Redirects are not followed: the response
+// to the first hop is the delivery result.
+var webhookClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		Proxy:                  nil,
+		DialContext:            publicDialer(5 * time.Second),
+		MaxResponseHeaderBytes: 16 << 10,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// RegisterWebhook adds an outbound webhook to a chat. Only chat admins may register;
+// when no secret is given one is generated and returned once.
+func RegisterWebhook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookURL(body.URL); err != nil {
+		writeErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Secret == "" {
+		body.Secret = utils.GenerateRandomString(32)
+	}
+
+	hook := models.Webhook{
+		ChatID:    chatID,
+		URL:       body.URL,
+		Secret:    body.Secret,
+		CreatedBy: user,
+		CreatedAt: time.Now(),
+	}
+	if _, err := db.WebhooksCollection.InsertOne(ctx, hook); err != nil {
+		writeErr(w, "failed to register webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"chatid": chatID,
+		"url":    hook.URL,
+		"secret": hook.Secret,
+	}); err != nil {
+		writeErr(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// validateWebhookURL accepts absolute http(s) URLs that do not point at loopback or private addresses.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast()) {
+		return fmt.Errorf("webhook url must be publicly reachable")
+	}
+	if u.Hostname() == "localhost" {
+		return fmt.Errorf("webhook url must be publicly reachable")
+	}
+	return nil
+}
+
+// dispatchWebhooks POSTs a new message to every webhook registered on its chat.
+func dispatchWebhooks(msg models.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := db.WebhooksCollection.Find(ctx, bson.M{"chatid": msg.ChatID})
+	if err != nil {
+		log.Printf("webhooks: lookup failed (%s): %v", msg.ChatID, err)
+		return
+	}
+	var hooks []models.Webhook
+	if err := cursor.All(ctx, &hooks); err != nil || len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type":    "message",
+		"chatid":  msg.ChatID,
+		"message": msg,
+	})
+	if err != nil {
+		return
+	}
+	for _, h := range hooks {
+		deliverWebhook(ctx, h, body)
+	}
+}
+
+// deliverWebhook signs and sends one payload, retrying transient failures with backoff. A
+// payload that is rejected or still failing after webhookAttempts is dead-lettered.
+func deliverWebhook(ctx context.Context, hook models.Webhook, body []byte) {
+	if err := sendWebhook(ctx, hook, body, webhookAttempts); err != nil {
+		recordDeadLetter(ctx, models.DeadLetter{
+			Kind:      models.DeadLetterWebhook,
+			ChatID:    hook.ChatID,
+			WebhookID: hook.ID,
+			URL:       hook.URL,
+			Payload:   string(body),
+			Reason:    err.Error(),
+			Attempts:  webhookAttempts,
+		})
+	}
+}
+
+// sendWebhook makes up to attempts signed deliveries of body. 5xx and network errors are
+// retried; any other non-2xx status is a rejection and returned at once.
+func sendWebhook(ctx context.Context, hook models.Webhook, body []byte, attempts int) error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+		if reqErr != nil {
+			log.Printf("webhooks: bad request for %s: %v", hook.ID.Hex(), reqErr)
+			return reqErr
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, signature)
+
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				if resp.StatusCode >= 300 {
+					log.Printf("webhooks: %s rejected delivery with %d", hook.ID.Hex(), resp.StatusCode)
+					return fmt.Errorf("rejected with status %d", resp.StatusCode)
+				}
+				return nil
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("webhooks: delivery to %s failed (attempt %d): %v", hook.ID.Hex(), attempt, err)
+		if attempt < attempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
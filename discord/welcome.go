@@ -0,0 +1,163 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxWelcomeLen   = 2000
+	maxWelcomeLinks = 5
+)
+
+// SetWelcomeDM lets a chat admin configure the welcome message a bot in the chat sends new
+// members. Empty text turns it off.
+func SetWelcomeDM(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	user := utils.GetUserIDFromRequest(r)
+	chatID := ps.ByName("chatid")
+
+	var chat models.Chat
+	if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": chatID, "participants": user}).Decode(&chat); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeErr(w, "not found or access denied", http.StatusNotFound)
+			return
+		}
+		writeErr(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !isChatAdmin(&chat, user) {
+		writeErr(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body models.WelcomeDM
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	body.Text = strings.TrimSpace(body.Text)
+
+	update := bson.M{"$unset": bson.M{"welcome": ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	if body.Text != "" {
+		if len([]rune(body.Text)) > maxWelcomeLen {
+			writeErr(w, "text too long", http.StatusBadRequest)
+			return
+		}
+		if !isBotUser(body.BotID) || !utils.Contains(chat.Participants, body.BotID) {
+			writeErr(w, "botId must be a bot in this chat", http.StatusBadRequest)
+			return
+		}
+		if len(body.Links) > maxWelcomeLinks {
+			writeErr(w, "too many links", http.StatusBadRequest)
+			return
+		}
+		for _, l := range body.Links {
+			u, err := url.Parse(l)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				writeErr(w, "links must be http(s) URLs", http.StatusBadRequest)
+				return
+			}
+		}
+		update = bson.M{"$set": bson.M{"welcome": body, "updatedAt": time.Now()}}
+	}
+
+	if _, err := db.MereCollection.UpdateOne(ctx, bson.M{"chatid": chatID}, update); err != nil {
+		writeErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendWelcomeDMs has the chat's welcome bot message each new member in their direct chat
+// with it, then tells the bot so it can follow up.
+func sendWelcomeDMs(chat models.Chat, users []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	welcome := chat.Welcome
+	if !utils.Contains(chat.Participants, welcome.BotID) {
+		return // bot was removed since the welcome was configured
+	}
+	var bot models.Bot
+	if err := db.BotsCollection.FindOne(ctx, bson.M{"userid": welcome.BotID}).Decode(&bot); err != nil {
+		log.Printf("welcome: bot %s of %s: %v", welcome.BotID, chat.ChatID, err)
+		return
+	}
+
+	content := welcome.Text
+	if len(welcome.Links) > 0 {
+		content += "\n\n" + strings.Join(welcome.Links, "\n")
+	}
+
+	for _, u := range users {
+		if isBotUser(u) {
+			continue
+		}
+		dm, err := botDirectChat(ctx, bot.UserID, u)
+		if err != nil {
+			log.Printf("welcome: direct chat %s/%s: %v", bot.UserID, u, err)
+			continue
+		}
+		if _, err := sendChatMessage(ctx, dm, bot.UserID, content, "", "", "", ""); err != nil {
+			log.Printf("welcome: send to %s: %v", u, err)
+			continue
+		}
+
+		if bot.CallbackURL == "" {
+			continue
+		}
+		body, err := json.Marshal(map[string]interface{}{
+			"type":     "member_welcomed",
+			"chatid":   chat.ChatID,
+			"userid":   u,
+			"dmChatid": dm.ChatID,
+		})
+		if err != nil {
+			continue
+		}
+		deliverWebhook(ctx, models.Webhook{ID: bot.ID, URL: bot.CallbackURL, Secret: bot.TokenHash}, body)
+	}
+}
+
+// botDirectChat finds or creates the one-to-one chat between a bot and a user.
+func botDirectChat(ctx context.Context, botID, user string) (*models.Chat, error) {
+	participants := []string{botID, user}
+	sort.Strings(participants)
+
+	var chat models.Chat
+	err := db.MereCollection.FindOne(ctx, bson.M{"participants": participants, "entitytype": ""}).Decode(&chat)
+	if err == nil {
+		return &chat, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	now := time.Now()
+	chat = models.Chat{
+		ChatID:       utils.GenerateRandomString(16),
+		Participants: participants,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Admins:       []string{botID},
+	}
+	if _, err := db.MereCollection.InsertOne(ctx, chat); err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
@@ -0,0 +1,212 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// WS capabilities a client may declare in its "hello" frame.
+const (
+	capBatching           = "batching"            // several events per frame as {"type":"batch","events":[...]}
+	capPartial            = "partial"             // large messages split into message_part frames
+	capReceiptAggregation = "receipt_aggregation" // delivered/read receipts merged per reader
+)
+
+const (
+	maxBatchFrames   = 64
+	partialChunkSize = 16 << 10 // bytes of content per message_part
+)
+
+// wsProtocolVersions are the WS protocol versions this server speaks.
+var wsProtocolVersions = func() []int {
+	var out []int
+	for v := wsProtocolV1; v <= wsProtocolV2; v++ {
+		out = append(out, v)
+	}
+	return out
+}()
+
+// wsEncodings are the frame encodings this server can send; msgpack is chosen with the
+// merechats.msgpack subprotocol (see wsSubprotocolMsgpack).
+var wsEncodings = []string{"json", "msgpack"}
+
+// serverCapabilities are the capabilities this server can honour, in the order advertised.
+var serverCapabilities = []string{capBatching, capPartial, capReceiptAggregation}
+
+// clientCaps is what was negotiated for one connection. Old clients never say hello and
+// keep the zero value: one plain JSON event per frame.
+type clientCaps struct {
+	Batching           bool
+	Partial            bool
+	ReceiptAggregation bool
+}
+
+// handleHello negotiates capabilities: the accepted set is what both sides support.
+func handleHello(client *Client, requested []string) {
+	want := make(map[string]bool, len(requested))
+	for _, c := range requested {
+		want[strings.ToLower(c)] = true
+	}
+	accepted := make([]string, 0, len(serverCapabilities))
+	for _, c := range serverCapabilities {
+		if want[c] {
+			accepted = append(accepted, c)
+		}
+	}
+
+	client.caps.Store(&clientCaps{
+		Batching:           want[capBatching],
+		Partial:            want[capPartial],
+		ReceiptAggregation: want[capReceiptAggregation],
+	})
+
+	// the handshake is per socket, so answer this socket rather than the user's devices
+	client.send(map[string]interface{}{
+		"type":         "hello",
+		"capabilities": accepted,
+		"available":    serverCapabilities,
+	})
+}
+
+// capabilities returns the negotiated capabilities (zero value before hello).
+func (c *Client) capabilities() clientCaps {
+	if p := c.caps.Load(); p != nil {
+		return *p
+	}
+	return clientCaps{}
+}
+
+// nextFrames turns the next queued event (and, with batching, whatever else is already
+// queued) into the frames to write, shaped by the client's capabilities.
+func (c *Client) nextFrames(first interface{}) []interface{} {
+	caps := c.capabilities()
+	events := []interface{}{first}
+
+	if caps.Batching {
+	drain:
+		for len(events) < maxBatchFrames {
+			select {
+			case ev, ok := <-c.Send:
+				if !ok {
+					break drain
+				}
+				events = append(events, ev)
+			default:
+				break drain
+			}
+		}
+	}
+	if caps.ReceiptAggregation || caps.Partial {
+		decodeRelayed(events)
+	}
+	if caps.ReceiptAggregation {
+		events = aggregateReceipts(events)
+	}
+	var parts []interface{}
+	if caps.Partial {
+		events, parts = splitLargeMessages(events)
+	}
+
+	if caps.Batching && len(events) > 1 {
+		events = []interface{}{map[string]interface{}{"type": "batch", "events": events}}
+	}
+	return append(events, parts...)
+}
+
+// decodeRelayed replaces events that arrived as raw JSON through the redis fan-out with
+// their decoded form, so they are aggregated and split like events published locally.
+func decodeRelayed(events []interface{}) {
+	for i, ev := range events {
+		raw, ok := ev.(json.RawMessage)
+		if !ok {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber() // keep seqs and ids exact
+		var m map[string]interface{}
+		if dec.Decode(&m) == nil {
+			events[i] = m
+		}
+	}
+}
+
+// aggregateReceipts folds delivered/read receipts from the same reader into one "receipts"
+// event placed where the first of them was.
+func aggregateReceipts(events []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(events))
+	groups := make(map[string]map[string]interface{})
+	for _, ev := range events {
+		m, ok := ev.(map[string]interface{})
+		kind, _ := m["type"].(string)
+		if !ok || (kind != statusDelivered && kind != statusRead) {
+			out = append(out, ev)
+			continue
+		}
+		by, _ := m["by"].(string)
+		item := map[string]interface{}{"id": m["id"], "chatid": m["chatid"], "status": m["status"]}
+
+		key := kind + "\x00" + by
+		if g, ok := groups[key]; ok {
+			g["items"] = append(g["items"].([]map[string]interface{}), item)
+			continue
+		}
+		g := map[string]interface{}{"type": "receipts", "kind": kind, "by": by, "items": []map[string]interface{}{item}}
+		groups[key] = g
+		out = append(out, g)
+	}
+	return out
+}
+
+// splitLargeMessages truncates message events whose content exceeds partialChunkSize and
+// returns the remainder as ordered message_part events.
+func splitLargeMessages(events []interface{}) ([]interface{}, []interface{}) {
+	var parts []interface{}
+	for i, ev := range events {
+		m, ok := ev.(map[string]interface{})
+		if !ok || m["type"] != "message" {
+			continue
+		}
+		content, _ := m["content"].(string)
+		if len(content) <= partialChunkSize {
+			continue
+		}
+
+		chunks := chunkString(content, partialChunkSize)
+		head := make(map[string]interface{}, len(m)+2)
+		for k, v := range m {
+			head[k] = v
+		}
+		head["content"] = chunks[0]
+		head["partial"] = true
+		head["parts"] = len(chunks)
+		events[i] = head
+
+		for n, chunk := range chunks[1:] {
+			parts = append(parts, map[string]interface{}{
+				"type":    "message_part",
+				"id":      m["id"],
+				"chatid":  m["chatid"],
+				"index":   n + 1,
+				"parts":   len(chunks),
+				"content": chunk,
+			})
+		}
+	}
+	return events, parts
+}
+
+// chunkString splits s into pieces of at most size bytes without cutting a UTF-8 sequence.
+func chunkString(s string, size int) []string {
+	var out []string
+	for len(s) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		out = append(out, s[:cut])
+		s = s[cut:]
+	}
+	return append(out, s)
+}
@@ -0,0 +1,95 @@
+package discord
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// Close codes for server-initiated disconnects. Clients use them to decide whether and
+// how to reconnect: refresh the token, back off, give up, or retry after a restart.
+const (
+	closeAuthExpired = 4001                          // token expired; refresh before reconnecting
+	closeBadVersion  = 4002                          // unknown protocol version; upgrade the client
+	closeRateLimited = 4008                          // too many frames; back off
+	closeRevoked     = 4013                          // session revoked; do not reconnect with it
+	closeRestart     = websocket.CloseServiceRestart // 1012: instance restarting; reconnect
+)
+
+// closeReasons are the machine-readable reason strings sent alongside each code.
+var closeReasons = map[int]string{
+	closeAuthExpired: "auth_expired",
+	closeBadVersion:  "unsupported_version",
+	closeRateLimited: "rate_limited",
+	closeRevoked:     "revoked",
+	closeRestart:     "restart",
+	closeOverloaded:  "overloaded",
+}
+
+// wsFrameRate and wsFrameBurst bound inbound frames per connection (WS_FRAME_RATE, WS_FRAME_BURST).
+var (
+	wsFrameRate  = envFloat("WS_FRAME_RATE", 10)
+	wsFrameBurst = int(envFloat("WS_FRAME_BURST", 30))
+
+	// wsMessageRate and wsMessageBurst bound "message" frames per connection
+	// (WS_MESSAGE_RATE, WS_MESSAGE_BURST). Excess messages are refused, not disconnected.
+	wsMessageRate  = envFloat("WS_MESSAGE_RATE", 1)
+	wsMessageBurst = int(envFloat("WS_MESSAGE_BURST", 6))
+)
+
+func envFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// newFrameLimiter returns the inbound limiter for one connection.
+func newFrameLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(wsFrameRate), wsFrameBurst)
+}
+
+// newMessageLimiter returns the send limiter for one connection.
+func newMessageLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(wsMessageRate), wsMessageBurst)
+}
+
+// closeReason encodes the close frame reason as JSON, e.g. {"reason":"rate_limited"}.
+// Restart and overload closes add a reconnectAfterMs hint.
+func closeReason(code int) string {
+	reason := map[string]interface{}{"reason": closeReasons[code]}
+	if carriesReconnectHint(code) {
+		reason["reconnectAfterMs"] = reconnectHint().Milliseconds()
+	}
+	raw, _ := json.Marshal(reason)
+	return string(raw)
+}
+
+// closeClient sends a typed close frame and drops the connection; the reader loop then cleans up.
+// WriteControl is safe to call concurrently with the writer goroutine.
+func closeClient(c *Client, code int) {
+	msg := websocket.FormatCloseMessage(code, closeReason(code))
+	if err := c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout)); err != nil {
+		log.Printf("WS close frame to %s failed: %v", c.UserID, err)
+	}
+	_ = c.Conn.Close()
+}
+
+// CloseAllClients disconnects every socket on this instance with code, e.g. on shutdown.
+func CloseAllClients(code int) {
+	targets := allClients()
+	for _, c := range targets {
+		closeClient(c, code)
+	}
+	log.Printf("WS closed %d connections (%s)", len(targets), closeReasons[code])
+}
+
+// CloseForRestart tells every connected client the instance is restarting.
+func CloseForRestart() {
+	CloseAllClients(closeRestart)
+}
@@ -0,0 +1,87 @@
+package discord
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// permessage-deflate settings. WS_COMPRESSION=off disables negotiation; frames smaller than
+// WS_COMPRESS_MIN_BYTES go uncompressed as deflate would barely shrink them;
+// WS_COMPRESS_LEVEL is the flate level (1 fastest, 9 smallest). gorilla/websocket only
+// negotiates no_context_takeover, so each message is compressed on its own: no window is
+// kept per connection, which bounds memory at the cost of ratio on short messages.
+var (
+	wsCompression     = os.Getenv("WS_COMPRESSION") != "off"
+	wsCompressMin     = int(envFloat("WS_COMPRESS_MIN_BYTES", 256))
+	wsCompressLevel   = min(int(envFloat("WS_COMPRESS_LEVEL", flate.BestSpeed)), flate.BestCompression)
+	wsCompressionStat struct {
+		framesCompressed atomic.Int64
+		framesPlain      atomic.Int64
+		rawBytes         atomic.Int64 // payload bytes before compression, all frames
+		wireBytes        atomic.Int64 // bytes written to sockets: handshakes, framing and pings included
+	}
+)
+
+// compressFrame turns compression on for a frame of n bytes when it is worth it. Without
+// a negotiated extension gorilla ignores the setting.
+func (c *Client) compressFrame(n int) {
+	compress := wsCompression && n >= wsCompressMin
+	c.Conn.EnableWriteCompression(compress)
+	if compress {
+		wsCompressionStat.framesCompressed.Add(1)
+	} else {
+		wsCompressionStat.framesPlain.Add(1)
+	}
+	wsCompressionStat.rawBytes.Add(int64(n))
+}
+
+// wireCounter hands the upgrader a connection that counts the bytes written to it.
+type wireCounter struct {
+	http.ResponseWriter
+}
+
+func (w wireCounter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return countingConn{conn}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	wsCompressionStat.wireBytes.Add(int64(n))
+	return n, err
+}
+
+// compressionMetrics reports compressed against raw outbound bytes for GetMetrics.
+func compressionMetrics() map[string]interface{} {
+	raw, wire := wsCompressionStat.rawBytes.Load(), wsCompressionStat.wireBytes.Load()
+	ratio := 0.0
+	if raw > 0 {
+		ratio = float64(wire) / float64(raw)
+	}
+	return map[string]interface{}{
+		"enabled":          wsCompression,
+		"minBytes":         wsCompressMin,
+		"level":            wsCompressLevel,
+		"framesCompressed": wsCompressionStat.framesCompressed.Load(),
+		"framesPlain":      wsCompressionStat.framesPlain.Load(),
+		"rawBytes":         raw,
+		"wireBytes":        wire,
+		"wireToRawRatio":   ratio,
+	}
+}
@@ -0,0 +1,95 @@
+package discord
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	closeOverloaded = websocket.CloseTryAgainLater // 1013: instance at capacity; retry later
+
+	degradedLoad       = 0.8 // fraction of wsMaxConnections at which clients are warned
+	reconnectMinDelay  = time.Second
+	reconnectMaxSpread = time.Minute // upper bound of the reconnect window at full load
+)
+
+// wsMaxConnections caps sockets per instance (WS_MAX_CONNECTIONS).
+var wsMaxConnections = int(envFloat("WS_MAX_CONNECTIONS", 10000))
+
+// connectionCount is the number of sockets on this instance.
+func connectionCount() int {
+	clients.RLock()
+	defer clients.RUnlock()
+	n := 0
+	for _, conns := range clients.m {
+		n += len(conns)
+	}
+	return n
+}
+
+// currentLoad is the instance's connection count relative to its capacity.
+func currentLoad() float64 {
+	return float64(connectionCount()) / float64(wsMaxConnections)
+}
+
+// reconnectHint picks a randomized delay within a window that widens with load, so clients
+// disconnected together (a deploy, an overload) come back spread out rather than all at once.
+func reconnectHint() time.Duration {
+	load := min(currentLoad(), 1)
+	window := reconnectMinDelay + time.Duration(load*float64(reconnectMaxSpread))
+	return reconnectMinDelay + rand.N(window)
+}
+
+// carriesReconnectHint reports whether a close code tells clients to come back.
+func carriesReconnectHint(code int) bool {
+	return code == closeRestart || code == closeOverloaded
+}
+
+// serverStatus tracks whether clients were last told the instance is degraded.
+var serverStatus = "ok"
+
+// StartLoadMonitor periodically warns clients while the instance is near capacity and tells
+// them once it recovers. Run it in its own goroutine.
+func StartLoadMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		load := currentLoad()
+		status := "ok"
+		if load >= degradedLoad {
+			status = "degraded"
+		}
+		if status == "ok" && serverStatus == "ok" {
+			continue
+		}
+		if status != serverStatus {
+			log.Printf("WS server status %s (load %.2f)", status, load)
+		}
+		serverStatus = status
+		notifyServerStatus(status, load)
+	}
+}
+
+// notifyServerStatus sends each local client a server_status event with its own reconnect hint.
+func notifyServerStatus(status string, load float64) {
+	clients.RLock()
+	users := make([]string, 0, len(clients.m))
+	for uid := range clients.m {
+		users = append(users, uid)
+	}
+	clients.RUnlock()
+
+	for _, uid := range users {
+		payload := map[string]interface{}{
+			"type":   "server_status",
+			"status": status,
+			"load":   load,
+		}
+		if status != "ok" {
+			payload["reconnectAfterMs"] = reconnectHint().Milliseconds()
+		}
+		deliverLocal([]string{uid}, payload)
+	}
+}
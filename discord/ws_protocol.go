@@ -0,0 +1,166 @@
+package discord
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"naevis/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// WS protocol versions, chosen with ?v= on connect. Version 1 is the original flat frames
+// ({type, chatid, ...}) and the default; version 2 wraps every frame in a WSEnvelope.
+const (
+	wsProtocolV1 = 1
+	wsProtocolV2 = 2
+)
+
+// Codes of WS error frames, on top of the send errors in api_errors.go.
+const (
+	errCodeInvalidFrame   = "invalid_frame"
+	errCodeBadVersion     = "unsupported_version"
+	errCodeUnknownType    = "unknown_type"
+	errCodeValidation     = "validation_failed"
+	errCodeCallNotFound   = "call_not_found"
+	errCodeMessageMissing = "message_not_found"
+)
+
+// protocolVersion reads ?v=, reporting false for versions this server does not speak.
+func protocolVersion(r *http.Request) (int, bool) {
+	raw := r.URL.Query().Get("v")
+	if raw == "" {
+		return wsProtocolV1, true
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < wsProtocolV1 || v > wsProtocolV2 {
+		return 0, false
+	}
+	return v, true
+}
+
+// decodeFrame parses an inbound frame. On error the returned message still carries
+// whatever was readable, so the error frame can echo the request id.
+func decodeFrame(version int, data []byte) (models.IncomingWSMessage, *models.APIError) {
+	var in models.IncomingWSMessage
+	if version == wsProtocolV1 {
+		if err := json.Unmarshal(data, &in); err != nil {
+			return in, &models.APIError{Code: errCodeInvalidFrame, Message: "frame is not valid JSON"}
+		}
+		return in, nil
+	}
+
+	var env models.WSEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return in, &models.APIError{Code: errCodeInvalidFrame, Message: "frame is not a valid envelope"}
+	}
+	in.RequestID = env.ID
+	if env.V != version {
+		return in, &models.APIError{Code: errCodeBadVersion, Message: "frame version does not match the connection",
+			Details: map[string]int{"v": version}}
+	}
+	if len(env.Payload) > 0 {
+		if err := json.Unmarshal(env.Payload, &in); err != nil {
+			return in, &models.APIError{Code: errCodeInvalidFrame, Message: "payload is not a valid object"}
+		}
+	}
+	// the envelope is authoritative over anything repeated in the payload
+	in.Type, in.RequestID = env.Type, env.ID
+	return in, nil
+}
+
+// validateFrame checks that a frame has the fields its type needs.
+func validateFrame(in *models.IncomingWSMessage) *models.APIError {
+	missing := func(field string) *models.APIError {
+		return &models.APIError{Code: errCodeValidation, Message: field + " is required", Details: map[string]string{"field": field}}
+	}
+	switch in.Type {
+	case "":
+		return missing("type")
+	case "message", "message_chunk", "typing", "call_offer":
+		if in.ChatID == "" {
+			return missing("chatid")
+		}
+	case "ack", "read":
+		if len(in.MessageIDs) == 0 {
+			return missing("messageIds")
+		}
+	case "call_answer", "ice_candidate", "call_end":
+		if in.CallID == "" {
+			return missing("callId")
+		}
+	case "location_update":
+		if in.MessageID == "" {
+			return missing("messageId")
+		}
+		if in.Location == nil {
+			return missing("location")
+		}
+	}
+	if in.Type == "typing" && in.Activity != "" && !validActivities[in.Activity] {
+		return &models.APIError{Code: errCodeValidation, Message: "unknown activity", Details: map[string]string{"field": "activity"}}
+	}
+	return nil
+}
+
+// encodeFrame shapes an outbound frame for the connection's protocol version. Version 2
+// moves the frame into the payload of an envelope, taking its id from requestId.
+func encodeFrame(version int, frame interface{}) (interface{}, error) {
+	if version == wsProtocolV1 {
+		return frame, nil
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return nil, err
+	}
+	var head struct {
+		Type      string `json:"type"`
+		RequestID string `json:"requestId"`
+	}
+	_ = json.Unmarshal(data, &head)
+	return models.WSEnvelope{V: version, Type: head.Type, ID: head.RequestID, Payload: data}, nil
+}
+
+// reject answers a client's frame with an error frame on this socket only.
+func (c *Client) reject(in models.IncomingWSMessage, code, msg string, details interface{}) {
+	c.send(wsError(in, code, msg, details))
+}
+
+// Subprotocols offered in Sec-WebSocket-Protocol. Without one, or with the JSON one,
+// frames are JSON text; with msgpack they are MessagePack binary frames of the same shape.
+const (
+	wsSubprotocolJSON    = "merechats.json"
+	wsSubprotocolMsgpack = "merechats.msgpack"
+)
+
+// writeFrame writes one outbound frame in the connection's negotiated encoding.
+func (c *Client) writeFrame(frame interface{}) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if !c.Msgpack {
+		c.compressFrame(len(data))
+		return c.Conn.WriteMessage(websocket.TextMessage, data)
+	}
+	packed, err := jsonToMsgpack(data)
+	if err != nil {
+		return err
+	}
+	c.compressFrame(len(packed))
+	return c.Conn.WriteMessage(websocket.BinaryMessage, packed)
+}
+
+// frameJSON returns an inbound frame as JSON. Text frames are JSON whatever the
+// subprotocol; binary frames must be MessagePack on a msgpack connection.
+func (c *Client) frameJSON(kind int, data []byte) ([]byte, error) {
+	if kind != websocket.BinaryMessage {
+		return data, nil
+	}
+	if !c.Msgpack {
+		return nil, errors.New("binary frames need the " + wsSubprotocolMsgpack + " subprotocol")
+	}
+	return msgpackToJSON(data)
+}
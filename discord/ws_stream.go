@@ -0,0 +1,152 @@
+package discord
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+	"naevis/ratelim"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/time/rate"
+)
+
+// Long messages may be sent as a stream of "message_chunk" frames sharing a clientId, with
+// increasing index from 0 and final set on the last. Other participants see each chunk as a
+// "message_partial" event as it arrives; the final chunk stores one message, broadcast as
+// usual with the same clientId so clients can swap the partial for it.
+const (
+	streamChunkMax    = partialChunkSize // bytes of content per chunk
+	maxOpenStreams    = 4                // concurrent streams per connection
+	streamIdleTimeout = time.Minute      // a stream with no chunk for this long is dropped
+)
+
+type inboundStream struct {
+	chat    models.Chat
+	replyTo string
+	content strings.Builder
+	next    int
+	touched time.Time
+}
+
+// streamAssembler holds one connection's open streams. It is only used by that
+// connection's reader goroutine.
+type streamAssembler map[string]*inboundStream
+
+// handleChunk appends a chunk to its stream, relays it, and sends the message once the
+// final chunk arrives. A stream counts once against the send rate limit, on its first chunk.
+func (s streamAssembler) handleChunk(ctx context.Context, client *Client, in models.IncomingWSMessage, limiter *rate.Limiter) {
+	s.expire(client)
+	fail := func(code, msg string, details interface{}) {
+		if st, ok := s[in.ClientID]; ok {
+			s.abort(client, in.ClientID, st)
+		}
+		client.reject(in, code, msg, details)
+	}
+	if in.ClientID == "" {
+		fail("stream_id_required", "streamed messages need a clientId", nil)
+		return
+	}
+	if len(in.Content) > streamChunkMax {
+		fail("chunk_too_large", "chunk is too large", nil)
+		return
+	}
+
+	st, ok := s[in.ClientID]
+	if !ok {
+		if in.Index != 0 {
+			fail("stream_out_of_order", "chunk is out of order", nil)
+			return
+		}
+		if len(s) >= maxOpenStreams {
+			fail("too_many_streams", "too many open streams", nil)
+			return
+		}
+		if wait := ratelim.RetryAfter(limiter); wait > 0 {
+			client.reject(in, models.ErrCodeRateLimited, "sending too fast", map[string]int64{"retryAfterMs": wait.Milliseconds()})
+			return
+		}
+		st = &inboundStream{replyTo: in.ReplyTo}
+		if err := db.MereCollection.FindOne(ctx, bson.M{"chatid": in.ChatID, "participants": client.UserID}).Decode(&st.chat); err != nil {
+			fail(errCodeChatNotFound, "chat not found", nil)
+			return
+		}
+		if err := checkWritable(&st.chat); err != nil {
+			fail(errCodeReadOnly, err.Error(), nil)
+			return
+		}
+		s[in.ClientID] = st
+	}
+	if in.ChatID != st.chat.ChatID || in.Index != st.next {
+		fail("stream_out_of_order", "chunk is out of order", nil)
+		return
+	}
+	if st.content.Len()+len(in.Content) > maxMessageLen {
+		fail(errCodeMessageTooLong, errMessageTooLong.Error(), nil)
+		return
+	}
+	st.content.WriteString(in.Content)
+	// filters see the whole text so far, so nothing is relayed that the final send would refuse
+	if err := filterContent(&st.chat, client.UserID, st.content.String()); err != nil {
+		if rej, ok := asRejection(err); ok {
+			fail(errCodeContentRejected, rej.Reason, rejectionDetails(rej))
+		} else if e, ok := sendErrors[err]; ok {
+			fail(e.code, err.Error(), nil)
+		} else {
+			log.Printf("WS stream filter failed (%s): %v", client.UserID, err)
+			fail(models.ErrCodeInternal, "internal error", nil)
+		}
+		return
+	}
+	st.next++
+	st.touched = time.Now()
+
+	if !in.Final {
+		sendToUsers(subtract(st.chat.Participants, []string{client.UserID}), map[string]interface{}{
+			"type":     "message_partial",
+			"chatid":   st.chat.ChatID,
+			"streamId": in.ClientID,
+			"sender":   client.UserID,
+			"index":    in.Index,
+			"content":  in.Content,
+		})
+		return
+	}
+
+	delete(s, in.ClientID)
+	handleIncomingMessage(ctx, client, models.IncomingWSMessage{
+		Type:     "message",
+		ChatID:   st.chat.ChatID,
+		Content:  st.content.String(),
+		ClientID: in.ClientID,
+		ReplyTo:  st.replyTo,
+	})
+}
+
+// abort drops a stream and tells recipients to discard what they were shown of it.
+func (s streamAssembler) abort(client *Client, id string, st *inboundStream) {
+	delete(s, id)
+	if st.next == 0 {
+		return // nothing was relayed
+	}
+	sendToUsers(subtract(st.chat.Participants, []string{client.UserID}), map[string]interface{}{
+		"type":     "message_partial",
+		"chatid":   st.chat.ChatID,
+		"streamId": id,
+		"sender":   client.UserID,
+		"aborted":  true,
+	})
+}
+
+// expire aborts streams that went idle.
+func (s streamAssembler) expire(client *Client) {
+	cutoff := time.Now().Add(-streamIdleTimeout)
+	for id, st := range s {
+		if st.touched.Before(cutoff) {
+			s.abort(client, id, st)
+		}
+	}
+}
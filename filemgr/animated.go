@@ -0,0 +1,168 @@
+package filemgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	animatedPreviewWidth = 320
+	// maxPreviewPixels bounds the work of compositing a GIF (width * height * frames)
+	maxPreviewPixels = 400_000_000
+)
+
+var errNotAnimated = errors.New("not animated")
+
+// isAnimated reports whether a saved GIF or WebP has more than one frame.
+func isAnimated(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif":
+		f, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		g, err := gif.DecodeAll(f)
+		return err == nil && len(g.Image) > 1
+	case ".webp":
+		f, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		head := make([]byte, 21)
+		if _, err := io.ReadFull(f, head); err != nil {
+			return false
+		}
+		// RIFF....WEBPVP8X....<flags>: bit 1 of the flags marks an animation
+		return string(head[0:4]) == "RIFF" && string(head[8:16]) == "WEBPVP8X" &&
+			binary.LittleEndian.Uint32(head[16:20]) >= 10 && head[20]&0x02 != 0
+	}
+	return false
+}
+
+// decodeImage decodes a saved image for thumbnailing: its first frame if animated, upright.
+// Go has no WebP decoder, so WebP goes through the libwebp tools (webpmux for the first
+// frame of an animation, dwebp to PNG) when they are installed.
+func decodeImage(path string) (image.Image, error) {
+	img, err := decodeOriented(path)
+	if err == nil || strings.ToLower(filepath.Ext(path)) != ".webp" {
+		return img, err
+	}
+
+	tmp, err := os.MkdirTemp("", "webp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	src := path
+	if isAnimated(path) {
+		src = filepath.Join(tmp, "frame.webp")
+		if err := exec.Command("webpmux", "-get", "frame", "1", path, "-o", src).Run(); err != nil {
+			return nil, fmt.Errorf("webpmux: %w", err)
+		}
+	}
+	out := filepath.Join(tmp, "frame.png")
+	if err := exec.Command("dwebp", "-quiet", src, "-png", "-o", out).Run(); err != nil {
+		return nil, fmt.Errorf("dwebp: %w", err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// generateAnimatedPreview writes a small looping GIF of an animated GIF into the entity's
+// thumb folder as <base>_anim.gif; the static poster is the regular thumbnail. Animated
+// WebPs get none, the original already plays everywhere WebP does.
+func generateAnimatedPreview(fullPath string, entity EntityType) (ImageVariant, error) {
+	if strings.ToLower(filepath.Ext(fullPath)) != ".gif" {
+		return ImageVariant{}, errNotAnimated
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return ImageVariant{}, err
+	}
+	g, err := gif.DecodeAll(f)
+	_ = f.Close()
+	if err != nil {
+		return ImageVariant{}, err
+	}
+	if len(g.Image) < 2 {
+		return ImageVariant{}, errNotAnimated
+	}
+	w, h := g.Config.Width, g.Config.Height
+	if w <= 0 || h <= 0 {
+		w, h = g.Image[0].Bounds().Dx(), g.Image[0].Bounds().Dy()
+	}
+	if w*h*len(g.Image) > maxPreviewPixels {
+		return ImageVariant{}, fmt.Errorf("%d frames of %dx%d is too large to preview", len(g.Image), w, h)
+	}
+	tw := min(animatedPreviewWidth, w)
+	th := max(1, h*tw/w)
+
+	// frames only hold what changed, so composite them onto a canvas before scaling
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	preview := &gif.GIF{LoopCount: g.LoopCount, Delay: g.Delay}
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		scaled := imaging.Resize(canvas, tw, th, imaging.Box)
+		out := image.NewPaletted(scaled.Bounds(), frame.Palette)
+		draw.FloydSteinberg.Draw(out, out.Bounds(), scaled, image.Point{})
+		preview.Image = append(preview.Image, out)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	thumbDir := ResolvePath(entity, PicThumb)
+	if err := os.MkdirAll(thumbDir, 0o755); err != nil {
+		return ImageVariant{}, err
+	}
+	base := strings.TrimSuffix(filepath.Base(fullPath), filepath.Ext(fullPath))
+	path := filepath.Join(thumbDir, base+"_anim.gif")
+	out, err := os.Create(path)
+	if err != nil {
+		return ImageVariant{}, err
+	}
+	err = gif.EncodeAll(out, preview)
+	_ = out.Close()
+	if err != nil {
+		_ = os.Remove(path)
+		return ImageVariant{}, err
+	}
+	v, ok := storeVariant(path, "image/gif", tw, th)
+	if !ok {
+		return ImageVariant{}, fmt.Errorf("store %s failed", path)
+	}
+	v.Animated = true
+	return v, nil
+}
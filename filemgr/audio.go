@@ -0,0 +1,150 @@
+package filemgr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	waveformBuckets    = 64   // bars in the scrubber
+	waveformSampleRate = 8000 // decode rate; plenty for an amplitude envelope
+)
+
+// AudioInfo is what clients need to render a voice message scrubber before downloading it,
+// plus the stream details ffprobe reports.
+type AudioInfo struct {
+	Duration float64 `json:"duration"` // seconds
+	Waveform []int   `json:"waveform"` // waveformBuckets peak levels, 0-100
+
+	Bitrate    int    `json:"bitrate,omitempty"`    // bit/s, overall
+	Codec      string `json:"codec,omitempty"`      // e.g. "opus", "aac", "mp3"
+	SampleRate int    `json:"sampleRate,omitempty"` // Hz
+	Channels   int    `json:"channels,omitempty"`
+	Format     string `json:"format,omitempty"` // container, e.g. "ogg", "mov,mp4,m4a,3gp,3g2,mj2"
+}
+
+// isAudioExt checks the extensions accepted for audio and voice recordings
+func isAudioExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".mp3", ".wav", ".aac", ".ogg", ".opus", ".m4a":
+		return true
+	default:
+		return false
+	}
+}
+
+// ProbeAudio reads the duration, bitrate and codec of an audio file with ffprobe and builds
+// its waveform by decoding it to mono PCM with ffmpeg.
+func ProbeAudio(path string) (AudioInfo, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "format=duration,bit_rate,format_name:stream=codec_name,sample_rate,channels",
+		"-of", "json", path).Output()
+	if err != nil {
+		return AudioInfo{}, fmt.Errorf("ffprobe %s: %w", path, err)
+	}
+	// ffprobe prints most numbers as strings
+	var probe struct {
+		Format struct {
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+			FormatName string `json:"format_name"`
+		} `json:"format"`
+		Streams []struct {
+			CodecName  string `json:"codec_name"`
+			SampleRate string `json:"sample_rate"`
+			Channels   int    `json:"channels"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return AudioInfo{}, fmt.Errorf("ffprobe %s: %w", path, err)
+	}
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil || duration <= 0 || len(probe.Streams) == 0 {
+		return AudioInfo{}, fmt.Errorf("ffprobe %s: no audio stream", path)
+	}
+	info := AudioInfo{Duration: duration, Format: probe.Format.FormatName}
+	info.Bitrate, _ = strconv.Atoi(probe.Format.BitRate)
+	info.Codec, info.Channels = probe.Streams[0].CodecName, probe.Streams[0].Channels
+	info.SampleRate, _ = strconv.Atoi(probe.Streams[0].SampleRate)
+
+	if info.Waveform, err = audioWaveform(path, duration); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// AudioMIME is the type to serve an audio file as, by extension. Sniffing reports m4a as
+// video/mp4 and Ogg as application/ogg, which some players refuse for <audio>.
+func AudioMIME(name string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		return "audio/mpeg", true
+	case ".m4a":
+		return "audio/mp4", true
+	case ".aac":
+		return "audio/aac", true
+	case ".ogg", ".opus":
+		return "audio/ogg", true
+	case ".wav":
+		return "audio/wav", true
+	default:
+		return "", false
+	}
+}
+
+// audioWaveform streams 16-bit mono samples from ffmpeg and keeps the peak of each bucket,
+// scaled so the loudest bucket is 100.
+func audioWaveform(path string, duration float64) ([]int, error) {
+	cmd := exec.Command("ffmpeg", "-v", "error", "-i", path, "-ac", "1",
+		"-ar", strconv.Itoa(waveformSampleRate), "-f", "s16le", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ffmpeg %s: %w", path, err)
+	}
+
+	perBucket := int(math.Ceil(duration * waveformSampleRate / waveformBuckets))
+	if perBucket < 1 {
+		perBucket = 1
+	}
+	peaks := make([]float64, waveformBuckets)
+	r := bufio.NewReader(stdout)
+	var sample int16
+	for i := 0; ; i++ {
+		if err := binary.Read(r, binary.LittleEndian, &sample); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				_ = cmd.Wait()
+				return nil, fmt.Errorf("read pcm: %w", err)
+			}
+			break
+		}
+		b := min(i/perBucket, waveformBuckets-1)
+		peaks[b] = math.Max(peaks[b], math.Abs(float64(sample)))
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg %s: %w", path, err)
+	}
+
+	var loudest float64
+	for _, p := range peaks {
+		loudest = math.Max(loudest, p)
+	}
+	levels := make([]int, waveformBuckets)
+	if loudest == 0 {
+		return levels, nil
+	}
+	for i, p := range peaks {
+		levels[i] = int(math.Round(p / loudest * 100))
+	}
+	return levels, nil
+}
@@ -5,6 +5,25 @@ import "errors"
 type EntityType string
 type PictureType string
 
+// SavedFile describes a file persisted by SaveFileVerified
+type SavedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	MIME   string `json:"mime"`
+	SHA256 string `json:"sha256"`
+
+	Audio    *AudioInfo    `json:"audio,omitempty"`    // set for audio uploads ffprobe could read
+	Document *DocumentInfo `json:"document,omitempty"` // set for PDFs when a PDFRenderer is available
+
+	Moderation *ModerationVerdict `json:"moderation,omitempty"` // set for images when a Classifier is configured
+
+	Processing []string `json:"processing,omitempty"` // media job kinds still to finish (see ProcessedFunc, HLSFunc)
+
+	Animated     bool   `json:"animated,omitempty"`     // a GIF or WebP with more than one frame
+	Deduplicated bool   `json:"deduplicated,omitempty"` // an identical stored file was reused (see DedupeFunc)
+	HLS          string `json:"-"`                      // master playlist of a reused video, if transcoded
+}
+
 const (
 	EntityArtist  EntityType = "artist"
 	EntityUser    EntityType = "user"
@@ -20,6 +39,8 @@ const (
 	EntityMedia   EntityType = "media"
 	EntityFeed    EntityType = "feed"
 	EntityProduct EntityType = "product"
+	EntitySticker EntityType = "sticker"
+	EntityJob     EntityType = "job" // background job output, e.g. takeout archives
 
 	PicBanner   PictureType = "banner"
 	PicPhoto    PictureType = "photo"
@@ -33,35 +54,41 @@ const (
 	PicFile     PictureType = "file"
 )
 
+// entityTypes lists every EntityType, for per-entity configuration.
+var entityTypes = []EntityType{
+	EntityArtist, EntityUser, EntityBaito, EntityWorker, EntitySong, EntityPost, EntityChat, EntityEvent,
+	EntityFarm, EntityCrop, EntityPlace, EntityMedia, EntityFeed, EntityProduct, EntitySticker, EntityJob,
+}
+
 var (
 	AllowedExtensions = map[PictureType][]string{
-		PicPhoto:    {".jpg", ".jpeg", ".png", ".gif", ".webp"},
+		PicPhoto:    {".jpg", ".jpeg", ".png", ".gif", ".webp", ".svg", ".heic", ".heif", ".tif", ".tiff"}, // HEIC/HEIF and TIFF are converted on save
 		PicThumb:    {".jpg"},
 		PicPoster:   {".jpg", ".jpeg", ".png", ".webp"},
 		PicBanner:   {".jpg", ".jpeg", ".png", ".webp"},
 		PicMember:   {".jpg", ".jpeg", ".png", ".webp"},
 		PicSeating:  {".jpg", ".jpeg", ".png", ".webp"},
-		PicAudio:    {".mp3", ".wav", ".aac"},
+		PicAudio:    {".mp3", ".wav", ".aac", ".ogg", ".opus", ".m4a"},
 		PicVideo:    {".mp4", ".webm"},
 		PicDocument: {".pdf"},
-		PicFile:     {".pdf", ".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp3", ".mp4", ".webm"},
+		PicFile:     {".pdf", ".jpg", ".jpeg", ".png", ".gif", ".webp", ".svg", ".mp3", ".mp4", ".webm"},
 	}
 
 	AllowedMIMEs = map[PictureType][]string{
-		PicPhoto:   {"image/jpeg", "image/png", "image/gif", "image/webp"},
+		PicPhoto:   {"image/jpeg", "image/png", "image/gif", "image/webp", "image/svg+xml", "image/heic", "image/heif", "image/tiff"},
 		PicThumb:   {"image/jpeg"},
 		PicPoster:  {"image/jpeg", "image/png", "image/webp"},
 		PicBanner:  {"image/jpeg", "image/png", "image/webp"},
 		PicMember:  {"image/jpeg", "image/png", "image/webp"},
 		PicSeating: {"image/jpeg", "image/png", "image/webp"},
-		PicAudio:   {"audio/mpeg", "audio/wav", "audio/aac", "video/mp4"},
+		PicAudio:   {"audio/mpeg", "audio/wav", "audio/aac", "video/mp4", "audio/ogg", "application/ogg", "audio/opus", "audio/mp4", "audio/x-m4a"}, // m4a sniffs as video/mp4, ogg as application/ogg
 		PicVideo:   {"video/mp4", "video/webm"},
 		PicDocument: {
 			"application/pdf",
 		},
 		PicFile: {
 			"application/pdf",
-			"image/jpeg", "image/png", "image/gif", "image/webp",
+			"image/jpeg", "image/png", "image/gif", "image/webp", "image/svg+xml",
 			"audio/mpeg", "audio/wav",
 			"video/mp4", "video/webm",
 		},
@@ -83,6 +110,7 @@ var (
 	ErrInvalidExtension = errors.New("invalid file extension")
 	ErrInvalidMIME      = errors.New("invalid MIME type")
 	ErrFileTooLarge     = errors.New("file size exceeds limit")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
 
 	LogFunc func(path string, size int64, mimeType string)
 )
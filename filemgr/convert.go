@@ -0,0 +1,93 @@
+package filemgr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// heifBrands are the ISO-BMFF major brands of HEIC/HEIF stills (iPhone photos are "heic").
+var heifBrands = map[string]string{
+	"heic": "image/heic", "heix": "image/heic", "heim": "image/heic", "heis": "image/heic",
+	"hevc": "image/heic", "hevx": "image/heic",
+	"mif1": "image/heif", "msf1": "image/heif",
+}
+
+// sniffImageMIME recognises the image formats http.DetectContentType doesn't: TIFF and
+// HEIC/HEIF. It returns "" for anything else.
+func sniffImageMIME(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return heifBrands[string(head[8:12])]
+	}
+	return ""
+}
+
+// needsConversion reports whether an upload with this extension is converted to JPEG or PNG
+// before processing; browsers can't display these formats.
+func needsConversion(ext string) bool {
+	switch ext {
+	case ".heic", ".heif", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
+
+// convertImage replaces a saved HEIC/HEIF or TIFF file with a JPEG (PNG when a TIFF has
+// transparency) beside it and returns the new name and MIME type. TIFF is decoded in
+// process; HEIC goes through heif-convert (libheif) when installed, else ffmpeg.
+func convertImage(dir, name string) (string, string, error) {
+	src := filepath.Join(dir, name)
+	ext := strings.ToLower(filepath.Ext(name))
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+
+	if ext == ".tif" || ext == ".tiff" {
+		img, err := decodeOriented(src)
+		if err != nil {
+			return "", "", fmt.Errorf("decode %s: %w", name, err)
+		}
+		outName, mimeType := base+".jpg", "image/jpeg"
+		encode := func(buf *bytes.Buffer) error { return jpeg.Encode(buf, img, &jpeg.Options{Quality: 90}) }
+		if !opaque(img) {
+			outName, mimeType = base+".png", "image/png"
+			encode = func(buf *bytes.Buffer) error { return png.Encode(buf, img) }
+		}
+		if err := rewriteFile(filepath.Join(dir, outName), encode); err != nil {
+			return "", "", err
+		}
+		_ = os.Remove(src)
+		return outName, mimeType, nil
+	}
+
+	outName := base + ".jpg"
+	out := filepath.Join(dir, outName)
+	var err error
+	if path, lookErr := exec.LookPath("heif-convert"); lookErr == nil {
+		err = exec.Command(path, "-q", "90", src, out).Run()
+	} else {
+		// ffmpeg 7+ reassembles the tile grid iPhones store HEIC photos as
+		err = exec.Command("ffmpeg", "-y", "-v", "error", "-i", src, "-frames:v", "1", "-q:v", "2", out).Run()
+	}
+	if err != nil {
+		_ = os.Remove(out)
+		return "", "", fmt.Errorf("convert %s: %w", name, err)
+	}
+	_ = os.Remove(src)
+	return outName, "image/jpeg", nil
+}
+
+// opaque reports whether an image has no transparent pixels.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package filemgr
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DedupeFunc, when set, is asked for an already stored file with the same content (SHA-256
+// of the bytes as uploaded) in the same entity folder. Returning ok makes the new upload
+// reuse that file: the fresh copy is discarded before any processing and the caller is
+// expected to count references before deleting the shared file.
+var DedupeFunc func(entity EntityType, picType PictureType, sha256 string) (SavedFile, bool)
+
+// reuseStored swaps a just-saved upload for an identical stored file, if DedupeFunc knows
+// one. Audio is never shared since its duration and waveform come from probing the upload.
+func reuseStored(dir string, entity EntityType, picType PictureType, saved SavedFile) (SavedFile, bool) {
+	if DedupeFunc == nil || picType == PicAudio || saved.SHA256 == "" {
+		return saved, false
+	}
+	existing, ok := DedupeFunc(entity, picType, saved.SHA256)
+	if !ok || existing.Name == "" || existing.Name == saved.Name {
+		return saved, false
+	}
+	path := filepath.Join(dir, existing.Name)
+	if !IsRemote(entity) {
+		if _, err := os.Stat(path); err != nil {
+			return saved, false // the row outlived its file
+		}
+	}
+	_ = os.Remove(filepath.Join(dir, saved.Name))
+
+	existing.SHA256 = saved.SHA256
+	existing.Deduplicated = true
+	if manifest := filepath.Join(HLSDir(path), hlsMaster); fileExists(manifest) {
+		existing.HLS = manifest
+	}
+	return existing, true
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -1,27 +1,90 @@
 package filemgr
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-// DeleteFile deletes a saved file and its thumbnail (if exists)
+// DeleteFile deletes a saved file with its thumbnails, variants and HLS renditions (where
+// they exist), from the entity's storage backend as well as local disk.
 func DeleteFile(filePath string) error {
 	if filePath == "" {
 		return nil
 	}
+	derived := derivedPaths(filePath)
+	if key, entity, ok := StorageKey(filePath); ok && IsRemote(entity) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		store := StorageFor(entity)
+		if err := store.Delete(ctx, key); err != nil {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
+		for _, p := range derived {
+			if key, _, ok := StorageKey(p); ok {
+				_ = store.Delete(ctx, key)
+			}
+		}
+	}
 	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("delete %s: %w", filePath, err)
 	}
 
-	// Delete thumbnail if exists
+	for _, p := range derived {
+		if _, err := os.Stat(p); err == nil {
+			_ = os.Remove(p)
+		}
+	}
+	return DeleteHLS(HLSDir(filePath))
+}
+
+// DeleteHLS removes a video's HLS folder, and its segments from object storage.
+func DeleteHLS(dir string) error {
+	if _, entity, ok := StorageKey(dir); ok && IsRemote(entity) {
+		segments, err := HLSSegments(dir)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		for _, seg := range segments {
+			if key, _, ok := StorageKey(seg); ok {
+				if err := StorageFor(entity).Delete(ctx, key); err != nil {
+					return fmt.Errorf("delete %s: %w", key, err)
+				}
+			}
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("delete %s: %w", dir, err)
+	}
+	return nil
+}
+
+// derivedPaths lists the files generated from a saved file: the legacy thumbnail beside it,
+// WebP/AVIF variants, and the thumbnails and animated and blurred previews in the entity's
+// thumb folder.
+func derivedPaths(filePath string) []string {
 	dir := filepath.Dir(filePath)
 	base := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
-	thumbPath := filepath.Join(dir, base+".jpg")
-	if _, err := os.Stat(thumbPath); err == nil {
-		_ = os.Remove(thumbPath)
+	var out []string
+	for _, ext := range []string{".jpg", ".webp", ".avif"} {
+		if p := filepath.Join(dir, base+ext); p != filePath {
+			out = append(out, p)
+		}
 	}
-	return nil
+	if _, entity, ok := StorageKey(filePath); ok {
+		thumbs := ResolvePath(entity, PicThumb)
+		if thumbs != dir {
+			out = append(out, filepath.Join(thumbs, base+".jpg"))
+			for _, w := range ThumbWidths {
+				out = append(out, filepath.Join(thumbs, fmt.Sprintf("%s_%d.jpg", base, w)))
+			}
+			out = append(out, filepath.Join(thumbs, base+"_anim.gif"), filepath.Join(thumbs, base+"_blur.jpg"))
+		}
+	}
+	return out
 }
@@ -0,0 +1,153 @@
+package filemgr
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DocumentPreviewWidth is the width of the first-page preview rendered for PDFs.
+const DocumentPreviewWidth = 640
+
+const documentRenderTimeout = 30 * time.Second
+
+// DocumentInfo describes an uploaded PDF.
+type DocumentInfo struct {
+	Pages   int  `json:"pages"`
+	Preview bool `json:"preview"` // a first-page JPEG was rendered into the thumb folder
+}
+
+// DocumentRenderer turns the first page of a PDF into a JPEG and counts its pages.
+type DocumentRenderer interface {
+	RenderFirstPage(ctx context.Context, pdf, jpeg string, width int) error
+	PageCount(ctx context.Context, pdf string) (int, error)
+}
+
+// PDFRenderer renders PDF previews; nil disables them. It defaults to poppler's
+// pdftoppm/pdfinfo, or ImageMagick when only that is installed.
+var PDFRenderer = defaultDocumentRenderer()
+
+func defaultDocumentRenderer() DocumentRenderer {
+	if _, err := exec.LookPath("pdftoppm"); err == nil {
+		return PopplerRenderer{}
+	}
+	for _, bin := range []string{"magick", "convert"} {
+		if _, err := exec.LookPath(bin); err == nil {
+			return ImageMagickRenderer{Bin: bin}
+		}
+	}
+	return nil
+}
+
+// PopplerRenderer uses pdftoppm and pdfinfo.
+type PopplerRenderer struct{}
+
+func (PopplerRenderer) RenderFirstPage(ctx context.Context, pdf, jpeg string, width int) error {
+	// pdftoppm appends the extension itself
+	out := strings.TrimSuffix(jpeg, filepath.Ext(jpeg))
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-jpeg", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to-x", strconv.Itoa(width), "-scale-to-y", "-1", pdf, out)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pdftoppm: %w: %s", err, strings.TrimSpace(string(msg)))
+	}
+	if out+".jpg" != jpeg {
+		return os.Rename(out+".jpg", jpeg)
+	}
+	return nil
+}
+
+var pdfinfoPages = regexp.MustCompile(`(?m)^Pages:\s+(\d+)`)
+
+func (PopplerRenderer) PageCount(ctx context.Context, pdf string) (int, error) {
+	out, err := exec.CommandContext(ctx, "pdfinfo", pdf).Output()
+	if err != nil {
+		return 0, fmt.Errorf("pdfinfo: %w", err)
+	}
+	m := pdfinfoPages.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("pdfinfo: no page count")
+	}
+	return strconv.Atoi(string(m[1]))
+}
+
+// ImageMagickRenderer uses ImageMagick (Bin is "magick" for v7, "convert" for v6), which
+// needs Ghostscript for PDFs.
+type ImageMagickRenderer struct {
+	Bin string
+}
+
+func (m ImageMagickRenderer) RenderFirstPage(ctx context.Context, pdf, jpeg string, width int) error {
+	cmd := exec.CommandContext(ctx, m.Bin, "-density", "150", pdf+"[0]",
+		"-background", "white", "-alpha", "remove", "-resize", strconv.Itoa(width)+"x", "-quality", "85", jpeg)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", m.Bin, err, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (m ImageMagickRenderer) PageCount(ctx context.Context, pdf string) (int, error) {
+	args := []string{"-ping", "-format", "%n\n", pdf}
+	bin := "identify"
+	if m.Bin == "magick" {
+		bin, args = "magick", append([]string{"identify"}, args...)
+	}
+	out, err := exec.CommandContext(ctx, bin, args...).Output()
+	if err != nil {
+		return 0, fmt.Errorf("identify: %w", err)
+	}
+	// %n is printed once per page
+	first, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return strconv.Atoi(strings.TrimSpace(first))
+}
+
+// renderDocumentPreview counts a PDF's pages and renders its first page to
+// <thumb folder>/<base>.jpg, reported to VariantFunc like image thumbnails. A failed render
+// still returns the page count.
+func renderDocumentPreview(fullPath string, entity EntityType, picType PictureType) (*DocumentInfo, error) {
+	r := PDFRenderer
+	if r == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), documentRenderTimeout)
+	defer cancel()
+
+	pages, err := r.PageCount(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	info := &DocumentInfo{Pages: pages}
+
+	thumbDir := ResolvePath(entity, PicThumb)
+	if err := os.MkdirAll(thumbDir, 0o755); err != nil {
+		return info, err
+	}
+	name := filepath.Base(fullPath)
+	preview := filepath.Join(thumbDir, strings.TrimSuffix(name, filepath.Ext(name))+".jpg")
+	if err := r.RenderFirstPage(ctx, fullPath, preview, DocumentPreviewWidth); err != nil {
+		_ = os.Remove(preview)
+		return info, err
+	}
+	width, height := DocumentPreviewWidth, 0
+	if f, err := os.Open(preview); err == nil {
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			width, height = cfg.Width, cfg.Height
+		}
+		_ = f.Close()
+	}
+	v, ok := storeVariant(preview, "image/jpeg", width, height)
+	if !ok {
+		return info, fmt.Errorf("store preview of %s failed", name)
+	}
+	info.Preview = true
+	if VariantFunc != nil {
+		VariantFunc(entity, picType, name, []ImageVariant{v})
+	}
+	return info, nil
+}
@@ -0,0 +1,139 @@
+package filemgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// metadataPolicy holds per-entity overrides of StripsMetadata.
+var metadataPolicy = struct {
+	sync.RWMutex
+	m map[EntityType]bool
+}{m: make(map[EntityType]bool)}
+
+// SetStripMetadata turns metadata stripping of an entity's saved images on or off.
+func SetStripMetadata(entity EntityType, strip bool) {
+	metadataPolicy.Lock()
+	defer metadataPolicy.Unlock()
+	metadataPolicy.m[entity] = strip
+}
+
+// StripsMetadata reports whether an entity's saved images are stripped of metadata. It is on
+// unless turned off with SetStripMetadata or STRIP_METADATA_<ENTITY>=0 (e.g. for a photo
+// archive that wants to keep camera data).
+func StripsMetadata(entity EntityType) bool {
+	metadataPolicy.RLock()
+	strip, ok := metadataPolicy.m[entity]
+	metadataPolicy.RUnlock()
+	if ok {
+		return strip
+	}
+	return os.Getenv("STRIP_METADATA_"+strings.ToUpper(string(entity))) != "0"
+}
+
+// decodeOriented decodes an image with its EXIF orientation applied, so pixels, thumbnails
+// and variants are upright even after the tag is gone.
+func decodeOriented(path string) (image.Image, error) {
+	return imaging.Open(path, imaging.AutoOrientation(true))
+}
+
+// StripEXIF removes metadata (EXIF, XMP, comments; camera GPS positions in particular) from a
+// saved image in place, keeping its format. JPEG and PNG are re-encoded from img, which must
+// come from decodeOriented so the rotation the dropped orientation tag asked for is kept; a
+// nil img leaves them as they are. GIFs are re-encoded frame by frame and WebP metadata
+// chunks are cut out without touching the image data. Other formats are left alone.
+func StripEXIF(fullPath string, img image.Image) error {
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	switch ext {
+	case ".jpg", ".jpeg", ".png":
+		if img == nil {
+			return nil
+		}
+		return rewriteFile(fullPath, func(buf *bytes.Buffer) error {
+			if ext == ".png" {
+				return png.Encode(buf, img)
+			}
+			return jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
+		})
+	case ".gif":
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		anim, err := gif.DecodeAll(f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", filepath.Base(fullPath), err)
+		}
+		return rewriteFile(fullPath, func(buf *bytes.Buffer) error { return gif.EncodeAll(buf, anim) })
+	case ".webp":
+		return stripWebPMetadata(fullPath)
+	default:
+		return nil
+	}
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of a WebP file and clears their flags in the
+// VP8X header. WebP orientation tags aren't applied first; browsers ignore them anyway.
+func stripWebPMetadata(fullPath string) error {
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+
+	out := append([]byte(nil), data[:12]...)
+	for p := 12; p+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[p+4 : p+8]))
+		end := min(p+8+size+size&1, len(data)) // chunks are padded to even sizes
+		chunk := data[p:end]
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk = append([]byte(nil), chunk...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP present flags
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, chunk...)
+		}
+		p = end
+	}
+	if len(out) == len(data) {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return rewriteFile(fullPath, func(buf *bytes.Buffer) error {
+		_, err := buf.Write(out)
+		return err
+	})
+}
+
+// rewriteFile replaces a file with what encode writes, through a temporary file so a failed
+// encode leaves the original untouched.
+func rewriteFile(fullPath string, encode func(buf *bytes.Buffer) error) error {
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		return fmt.Errorf("re-encode %s: %w", filepath.Base(fullPath), err)
+	}
+	tmp := fullPath + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("create %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, fullPath)
+}
@@ -77,17 +77,6 @@ func ScanForViruses(filePath string) error {
 	return nil
 }
 
-// StripEXIF re-encodes an image.Image into JPEG and returns the bytes buffer.
-// Because standard image.Decode drops EXIF, this function is a convenient way to
-// obtain image bytes without EXIF metadata. Quality defaults to 90.
-func StripEXIF(img image.Image) (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 90}); err != nil {
-		return nil, fmt.Errorf("strip exif: encode failed: %w", err)
-	}
-	return buf, nil
-}
-
 // ExtractImageMetadata extracts basic metadata (width, height and an approximate byte-size)
 // from the provided image and persists or logs it. The uid parameter should be a stable
 // identifier for the image (filename, DB id, or generated unique id).
@@ -103,8 +92,8 @@ func ExtractImageMetadata(img image.Image, uid string) error {
 	height := b.Dy()
 
 	// approximate byte-size by encoding to JPEG in-memory (best-effort)
-	buf, err := StripEXIF(img)
-	if err != nil {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 90}); err != nil {
 		// don't fail hard on metadata extraction; return a warning error
 		return fmt.Errorf("extract metadata: encoding failed: %w", err)
 	}
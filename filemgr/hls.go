@@ -0,0 +1,220 @@
+package filemgr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HLSEnabled turns on background HLS transcoding of uploaded videos (VIDEO_HLS=1).
+var HLSEnabled = os.Getenv("VIDEO_HLS") == "1"
+
+// HLSFunc, when set, is told when a video's HLS renditions are ready (manifest is the local
+// path of the master playlist) or failed (err set).
+var HLSFunc func(entity EntityType, name, manifest string, err error)
+
+// hlsRendition is one quality level of the ladder.
+type hlsRendition struct {
+	Height  int
+	Bitrate int // video kbit/s
+}
+
+var hlsLadder = []hlsRendition{{360, 800}, {720, 2800}, {1080, 5000}}
+
+const (
+	hlsMaster      = "master.m3u8"
+	hlsQueueLength = 64
+)
+
+type hlsJob struct {
+	source string // work copy, removed when done
+	video  string // saved video path
+	entity EntityType
+	name   string
+}
+
+var (
+	hlsQueue     chan hlsJob
+	hlsStartOnce sync.Once
+)
+
+// HLSDir is the folder holding a video's playlists and segments.
+func HLSDir(videoPath string) string {
+	return strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + "_hls"
+}
+
+// enqueueHLS schedules a saved video for transcoding. The worker reads from a private copy
+// because the original may be offloaded to object storage before it gets to it. A full
+// queue drops the job; the video still plays as a plain download.
+func enqueueHLS(videoPath string, entity EntityType, name string) {
+	hlsStartOnce.Do(startHLSWorkers)
+
+	work := filepath.Join(StagingDir, "hls-"+filepath.Base(videoPath))
+	if err := os.MkdirAll(StagingDir, 0o755); err != nil {
+		hlsFailed(entity, name, err)
+		return
+	}
+	if err := os.Link(videoPath, work); err != nil {
+		if err := copyFile(videoPath, work); err != nil {
+			hlsFailed(entity, name, err)
+			return
+		}
+	}
+
+	select {
+	case hlsQueue <- hlsJob{source: work, video: videoPath, entity: entity, name: name}:
+	default:
+		_ = os.Remove(work)
+		hlsFailed(entity, name, fmt.Errorf("transcode queue full"))
+	}
+}
+
+// startHLSWorkers runs HLS_WORKERS (default 1) transcoders; ffmpeg is CPU bound, so keep it
+// at or below the core count.
+func startHLSWorkers() {
+	workers, err := strconv.Atoi(os.Getenv("HLS_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 1
+	}
+	hlsQueue = make(chan hlsJob, hlsQueueLength)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range hlsQueue {
+				manifest, err := transcodeHLS(job.source, HLSDir(job.video))
+				_ = os.Remove(job.source)
+				if err != nil {
+					_ = os.RemoveAll(HLSDir(job.video))
+					hlsFailed(job.entity, job.name, err)
+					continue
+				}
+				if HLSFunc != nil {
+					HLSFunc(job.entity, job.name, manifest, nil)
+				}
+			}
+		}()
+	}
+}
+
+func hlsFailed(entity EntityType, name string, err error) {
+	if LogFunc != nil {
+		LogFunc(fmt.Sprintf("warning: hls transcode failed for %s: %v", name, err), 0, "")
+	}
+	if HLSFunc != nil {
+		HLSFunc(entity, name, "", err)
+	}
+}
+
+// transcodeHLS writes one H.264/AAC rendition per ladder step the source is tall enough for
+// (at least the lowest) plus a master playlist into dir. Playlists stay on local disk so
+// they can be rewritten with signed links when served; segments are offloaded.
+func transcodeHLS(source, dir string) (string, error) {
+	width, height, err := probeVideoSize(source)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for i, step := range hlsLadder {
+		if step.Height > height && i > 0 {
+			break
+		}
+		h := min(step.Height, height) &^ 1
+		w := (width*h/height + 1) &^ 1
+		playlist := fmt.Sprintf("%dp.m3u8", h)
+		cmd := exec.Command("ffmpeg", "-y", "-v", "error", "-i", source,
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", fmt.Sprintf("scale=%d:%d", w, h),
+			"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main", "-crf", "23",
+			"-maxrate", fmt.Sprintf("%dk", step.Bitrate), "-bufsize", fmt.Sprintf("%dk", 2*step.Bitrate),
+			"-g", "48", "-keyint_min", "48", "-sc_threshold", "0",
+			"-c:a", "aac", "-b:a", "128k", "-ac", "2",
+			"-f", "hls", "-hls_time", "4", "-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(dir, fmt.Sprintf("%dp_%%03d.ts", h)),
+			filepath.Join(dir, playlist),
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("ffmpeg %dp: %w: %s", h, err, strings.TrimSpace(string(out)))
+		}
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s\n", (step.Bitrate+128)*1000, w, h, playlist)
+	}
+
+	manifest := filepath.Join(dir, hlsMaster)
+	if err := os.WriteFile(manifest, []byte(master.String()), 0o644); err != nil {
+		return "", err
+	}
+	segments, err := HLSSegments(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, seg := range segments {
+		if err := offloadFile(seg); err != nil {
+			return "", err
+		}
+	}
+	return manifest, nil
+}
+
+// HLSSegments lists the segment files referenced by the playlists in dir.
+func HLSSegments(dir string) ([]string, error) {
+	playlists, err := filepath.Glob(filepath.Join(dir, "*.m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, p := range playlists {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if strings.HasSuffix(line, ".ts") && !strings.HasPrefix(line, "#") {
+				out = append(out, filepath.Join(dir, filepath.Base(line)))
+			}
+		}
+		_ = f.Close()
+	}
+	return out, nil
+}
+
+func probeVideoSize(path string) (int, int, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height", "-of", "csv=p=0:s=x", path).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe: %w", err)
+	}
+	var w, h int
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(out)), "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("ffprobe: no video stream")
+	}
+	return w, h, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
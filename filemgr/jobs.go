@@ -0,0 +1,114 @@
+package filemgr
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// Media job kinds
+const (
+	JobImage  = "image"  // thumbnail, WebP/AVIF variants and metadata of a raster image
+	JobSVG    = "svg"    // raster thumbnail of a sanitized SVG
+	JobPoster = "poster" // poster frame of a video
+	JobHLS    = "hls"    // HLS transcode; reported through HLSFunc, not run by RunJob
+)
+
+// ErrJobSourceGone is returned by RunJob when the file a job derives from was deleted before
+// the job ran; retrying it is pointless.
+var ErrJobSourceGone = errors.New("media job source no longer exists")
+
+// MediaJob is deferred processing of a saved upload. Everything it needs is read back from
+// the file on disk, so it can run after a restart.
+type MediaJob struct {
+	Kind    string
+	Entity  EntityType
+	PicType PictureType
+	Name    string
+	Extra   []ImageVariant // variants made inline (e.g. a blurred preview), reported with the rest
+}
+
+// JobQueue persists media jobs for workers that call RunJob.
+type JobQueue interface {
+	Enqueue(job MediaJob) error
+}
+
+// Jobs queues derived-file generation; when nil, or when enqueueing fails, jobs run in a
+// goroutine and are lost if the process dies.
+var Jobs JobQueue
+
+// ProcessedFunc is told when a job run in a goroutine is over, err being its failure. A
+// JobQueue reports the jobs it runs itself.
+var ProcessedFunc func(entity EntityType, name, kind string, err error)
+
+// RunJob does the work of a media job. Every kind overwrites its output, so a job
+// interrupted midway can simply run again.
+func RunJob(job MediaJob) error {
+	fullPath := filepath.Join(ResolvePath(job.Entity, job.PicType), job.Name)
+	if !fileExists(fullPath) {
+		return ErrJobSourceGone
+	}
+
+	switch job.Kind {
+	case JobImage:
+		img, err := decodeImage(fullPath)
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", job.Name, err)
+		}
+		if err := generateThumbnail(img, job.Entity, job.Name, defaultThumbWidth); err != nil {
+			return fmt.Errorf("thumbnail: %w", err)
+		}
+		variants := append(generateVariants(img, fullPath, job.Entity), job.Extra...)
+		if VariantFunc != nil {
+			VariantFunc(job.Entity, job.PicType, job.Name, variants)
+		}
+		if err := ExtractImageMetadata(img, generateUniqueID()); err != nil {
+			return fmt.Errorf("metadata: %w", err)
+		}
+	case JobSVG:
+		return generateSVGThumbnail(fullPath, job.Entity, job.Name, defaultThumbWidth)
+	case JobPoster:
+		thumb, err := generateVideoPoster(fullPath, job.Entity, job.Name)
+		if err != nil {
+			return err
+		}
+		if LogFunc != nil {
+			LogFunc(thumb, 0, "image/jpeg")
+		}
+	default:
+		return fmt.Errorf("unknown media job kind %q", job.Kind)
+	}
+	return nil
+}
+
+// scheduleJob hands job to the queue and reports whether it is still to run. Files about
+// to be offloaded can't wait for a worker, so their jobs run inline.
+func scheduleJob(job MediaJob) bool {
+	if IsRemote(job.Entity) {
+		logJobErr(job, RunJob(job))
+		return false
+	}
+	if Jobs != nil {
+		err := Jobs.Enqueue(job)
+		if err == nil {
+			return true
+		}
+		if LogFunc != nil {
+			LogFunc(fmt.Sprintf("warning: %s job for %s not queued, running now: %v", job.Kind, job.Name, err), 0, "")
+		}
+	}
+	go func() {
+		err := RunJob(job)
+		logJobErr(job, err)
+		if ProcessedFunc != nil {
+			ProcessedFunc(job.Entity, job.Name, job.Kind, err)
+		}
+	}()
+	return true
+}
+
+func logJobErr(job MediaJob, err error) {
+	if err != nil && LogFunc != nil {
+		LogFunc(fmt.Sprintf("warning: %s processing failed for %s: %v", job.Kind, job.Name, err), 0, "")
+	}
+}
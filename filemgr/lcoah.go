@@ -1,9 +1,12 @@
 package filemgr
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"image"
 	"io"
+	"mime"
 	"mime/multipart"
 	"naevis/mq"
 	"net/http"
@@ -13,6 +16,7 @@ import (
 )
 
 // SaveFile saves a file with validation, size limit and virus scan.
+// A maxSize <= 0 falls back to the configured limit for the folder's picture type.
 // Returns the saved filename (base name).
 func SaveFile(
 	reader io.Reader,
@@ -21,25 +25,55 @@ func SaveFile(
 	maxSize int64,
 	customNameFn func(original string) string,
 ) (string, error) {
+	saved, err := SaveFileVerified(reader, header, destDir, maxSize, customNameFn, "")
+	return saved.Name, err
+}
+
+// SaveFileVerified behaves like SaveFile but hashes the upload while streaming it to disk.
+// When expectedSHA256 (hex) is non-empty the file is only kept if the digests match,
+// which catches truncated or corrupted uploads before anything else sees the file.
+func SaveFileVerified(
+	reader io.Reader,
+	header *multipart.FileHeader,
+	destDir string,
+	maxSize int64,
+	customNameFn func(original string) string,
+	expectedSHA256 string,
+) (SavedFile, error) {
 
 	ext := strings.ToLower(filepath.Ext(header.Filename))
 	picType := detectPicType(destDir)
 	if picType == "" {
-		return "", fmt.Errorf("unknown picture type for folder: %s", destDir)
+		return SavedFile{}, fmt.Errorf("unknown picture type for folder: %s", destDir)
 	}
 
 	if !isExtensionAllowed(ext, picType) {
-		return "", fmt.Errorf("%w: %s for %s", ErrInvalidExtension, ext, picType)
+		return SavedFile{}, fmt.Errorf("%w: %s for %s", ErrInvalidExtension, ext, picType)
+	}
+
+	if maxSize <= 0 {
+		_, entity, _ := StorageKey(destDir)
+		maxSize = MaxUploadSizeFor(entity, "", picType)
+	}
+	if header.Size > maxSize {
+		return SavedFile{}, fmt.Errorf("%w: %d bytes for %s (max %d)", ErrFileTooLarge, header.Size, picType, maxSize)
 	}
 
 	// Peek first 512 bytes for MIME detection
 	buf := make([]byte, 512)
 	n, err := io.ReadFull(io.LimitReader(reader, 512), buf)
 	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		return "", fmt.Errorf("read header: %w", err)
+		return SavedFile{}, fmt.Errorf("read header: %w", err)
 	}
 
 	mimeType := strings.ToLower(http.DetectContentType(buf[:n]))
+	if ext == ".svg" && looksLikeSVG(buf[:n]) {
+		// DetectContentType reports SVG as text/xml or text/plain
+		mimeType = svgMIME
+	}
+	if mimeType == "application/octet-stream" {
+		mimeType = cmp.Or(sniffImageMIME(buf[:n]), mimeType)
+	}
 	if mimeType == "application/octet-stream" {
 		formMime := strings.ToLower(header.Header.Get("Content-Type"))
 		if formMime != "" && isMIMEAllowed(formMime, picType) {
@@ -48,15 +82,15 @@ func SaveFile(
 	}
 
 	if !isMIMEAllowed(mimeType, picType) {
-		return "", fmt.Errorf("%w: %s for %s", ErrInvalidMIME, mimeType, picType)
+		return SavedFile{}, fmt.Errorf("%w: %s for %s", ErrInvalidMIME, mimeType, picType)
 	}
 
 	if !extMatchesMIME(ext, mimeType, picType) {
-		return "", fmt.Errorf("extension %s does not match MIME type %s for %s", ext, mimeType, picType)
+		return SavedFile{}, fmt.Errorf("extension %s does not match MIME type %s for %s", ext, mimeType, picType)
 	}
 
 	if err := os.MkdirAll(destDir, 0o755); err != nil {
-		return "", fmt.Errorf("mkdir %s: %w", destDir, err)
+		return SavedFile{}, fmt.Errorf("mkdir %s: %w", destDir, err)
 	}
 
 	filename := getSafeFilename(header.Filename, ext, customNameFn)
@@ -64,30 +98,48 @@ func SaveFile(
 
 	out, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
 	if err != nil {
-		return "", fmt.Errorf("create %s: %w", fullPath, err)
+		return SavedFile{}, fmt.Errorf("create %s: %w", fullPath, err)
 	}
 	defer out.Close()
 
+	hasher := sha256.New()
+	dst := io.MultiWriter(out, hasher)
+
 	// write initial bytes we already peeked
-	if _, err := out.Write(buf[:n]); err != nil {
-		return "", fmt.Errorf("write header: %w", err)
+	if _, err := dst.Write(buf[:n]); err != nil {
+		return SavedFile{}, fmt.Errorf("write header: %w", err)
 	}
 
-	written, err := io.Copy(out, io.LimitReader(reader, maxSize-int64(n)))
+	// read one byte past the limit so oversized bodies are detected instead of silently truncated
+	written, err := io.Copy(dst, io.LimitReader(reader, maxSize-int64(n)+1))
 	if err != nil {
-		return "", fmt.Errorf("write body: %w", err)
+		return SavedFile{}, fmt.Errorf("write body: %w", err)
 	}
 
 	totalWritten := written + int64(n)
-	if maxSize > 0 && totalWritten > maxSize {
+	if totalWritten > maxSize {
 		_ = os.Remove(fullPath)
-		return "", ErrFileTooLarge
+		return SavedFile{}, ErrFileTooLarge
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if expectedSHA256 != "" && !strings.EqualFold(strings.TrimSpace(expectedSHA256), sum) {
+		_ = os.Remove(fullPath)
+		return SavedFile{}, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expectedSHA256, sum)
+	}
+
+	// SVGs are sanitized in place so scripts and external refs never reach disk consumers
+	if mimeType == svgMIME {
+		if err := sanitizeSVGFile(fullPath); err != nil {
+			_ = os.Remove(fullPath)
+			return SavedFile{}, err
+		}
 	}
 
 	// Virus scan after full file present
 	if err := ScanForViruses(fullPath); err != nil {
 		_ = os.Remove(fullPath)
-		return "", fmt.Errorf("virus scan failed: %w", err)
+		return SavedFile{}, fmt.Errorf("virus scan failed: %w", err)
 	}
 
 	// Log via LogFunc if present
@@ -95,7 +147,7 @@ func SaveFile(
 		LogFunc(filename, totalWritten, mimeType)
 	}
 
-	return filename, nil
+	return SavedFile{Name: filename, Size: totalWritten, MIME: mimeType, SHA256: sum}, nil
 }
 
 // Convenience functions for saving form files
@@ -164,32 +216,31 @@ func SaveImageWithThumb(file multipart.File, header *multipart.FileHeader, entit
 	defer file.Close()
 
 	origPath := ResolvePath(entity, picType)
-	origName, err := SaveFile(file, header, origPath, maxUploadSize, nil)
+	origName, err := SaveFile(file, header, origPath, MaxUploadSizeFor(entity, "", picType), nil)
 	if err != nil {
 		return "", "", fmt.Errorf("save original: %w", err)
 	}
+	if needsConversion(strings.ToLower(filepath.Ext(origName))) {
+		converted, _, err := convertImage(origPath, origName)
+		if err != nil {
+			_ = os.Remove(filepath.Join(origPath, origName))
+			return "", "", fmt.Errorf("%w: %v", ErrInvalidMIME, err)
+		}
+		origName = converted
+	}
 
 	fullPath := filepath.Join(origPath, origName)
 
-	f, err := os.Open(fullPath)
-	if err != nil {
-		return origName, "", fmt.Errorf("open for decode: %w", err)
-	}
-	img, _, err := image.Decode(f)
-	_ = f.Close()
+	img, err := decodeOriented(fullPath)
 	if err != nil {
 		return origName, "", fmt.Errorf("decode %q: %w", header.Filename, err)
 	}
 
-	// Normalize to PNG
 	ext := strings.ToLower(filepath.Ext(fullPath))
-	newPath, err := normalizeImageFormat(fullPath, ext, img)
-	if err != nil {
-		return origName, "", err
-	}
-	if newPath != fullPath {
-		fullPath = newPath
-		origName = filepath.Base(newPath)
+	if StripsMetadata(entity) {
+		if err := StripEXIF(fullPath, img); err != nil {
+			return origName, "", err
+		}
 	}
 
 	if err := ValidateImageDimensions(img, 3000, 3000); err != nil {
@@ -211,7 +262,7 @@ func SaveImageWithThumb(file multipart.File, header *multipart.FileHeader, entit
 	}
 
 	if LogFunc != nil {
-		LogFunc(origName, 0, "image/png")
+		LogFunc(origName, 0, mime.TypeByExtension(ext))
 	}
 	return origName, "", nil
 }
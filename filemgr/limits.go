@@ -0,0 +1,187 @@
+package filemgr
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultMaxUploadSize is used for picture types without an explicit limit
+// (UPLOAD_LIMIT_DEFAULT, default 10 MB).
+var defaultMaxUploadSize int64 = 10 << 20
+
+// MaxUploadSizes holds the default per-PictureType upload limits in bytes.
+// Values can be overridden at startup with UPLOAD_LIMIT_<PICTYPE> (e.g. UPLOAD_LIMIT_VIDEO=200MB),
+// per entity with UPLOAD_LIMIT_<ENTITY>_<PICTYPE> (e.g. UPLOAD_LIMIT_CHAT_VIDEO=500MB), and per
+// tenant with UPLOAD_LIMIT_TENANTS="<tenant>:<pictype>=<size>,..." (e.g. "acme:video=1GB").
+var MaxUploadSizes = map[PictureType]int64{
+	PicPhoto:    10 << 20,
+	PicThumb:    2 << 20,
+	PicPoster:   10 << 20,
+	PicBanner:   10 << 20,
+	PicMember:   10 << 20,
+	PicSeating:  10 << 20,
+	PicAudio:    50 << 20,
+	PicVideo:    200 << 20,
+	PicDocument: 25 << 20,
+	PicFile:     25 << 20,
+}
+
+// entityLimits and tenantLimits hold overrides on top of MaxUploadSizes; tenants win.
+var (
+	entityLimits = struct {
+		sync.RWMutex
+		m map[EntityType]map[PictureType]int64
+	}{m: make(map[EntityType]map[PictureType]int64)}
+
+	tenantLimits = struct {
+		sync.RWMutex
+		m map[string]map[PictureType]int64
+	}{m: make(map[string]map[PictureType]int64)}
+)
+
+func init() {
+	if v, ok := parseSize(os.Getenv("UPLOAD_LIMIT_DEFAULT")); ok {
+		defaultMaxUploadSize = v
+	}
+	for picType := range MaxUploadSizes {
+		if v, ok := parseSize(os.Getenv("UPLOAD_LIMIT_" + strings.ToUpper(string(picType)))); ok {
+			MaxUploadSizes[picType] = v
+		}
+		for _, entity := range entityTypes {
+			env := "UPLOAD_LIMIT_" + strings.ToUpper(string(entity)) + "_" + strings.ToUpper(string(picType))
+			if v, ok := parseSize(os.Getenv(env)); ok {
+				SetEntityUploadLimit(entity, picType, v)
+			}
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("UPLOAD_LIMIT_TENANTS"), ",") {
+		key, size, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		tenant, kind, ok := strings.Cut(key, ":")
+		picType := PictureType(strings.ToLower(kind))
+		v, valid := parseSize(size)
+		if !ok || tenant == "" || !valid {
+			continue
+		}
+		if _, known := MaxUploadSizes[picType]; known {
+			SetTenantUploadLimit(tenant, picType, v)
+		}
+	}
+}
+
+// parseSize reads a byte count, optionally suffixed with KB, MB or GB (binary multiples).
+func parseSize(raw string) (int64, bool) {
+	raw = strings.ToUpper(strings.TrimSpace(raw))
+	mult := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if s, ok := strings.CutSuffix(raw, suffix); ok {
+			raw, mult = strings.TrimSpace(s), m
+			break
+		}
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v * mult, true
+}
+
+// SetEntityUploadLimit overrides the limit for one picture type of an entity.
+// A size <= 0 removes the override.
+func SetEntityUploadLimit(entity EntityType, picType PictureType, size int64) {
+	entityLimits.Lock()
+	defer entityLimits.Unlock()
+
+	if size <= 0 {
+		if limits, ok := entityLimits.m[entity]; ok {
+			delete(limits, picType)
+		}
+		return
+	}
+	if entityLimits.m[entity] == nil {
+		entityLimits.m[entity] = make(map[PictureType]int64)
+	}
+	entityLimits.m[entity][picType] = size
+}
+
+// SetTenantUploadLimit overrides the limit for one picture type for a tenant.
+// A size <= 0 removes the override.
+func SetTenantUploadLimit(tenant string, picType PictureType, size int64) {
+	tenantLimits.Lock()
+	defer tenantLimits.Unlock()
+
+	if size <= 0 {
+		if limits, ok := tenantLimits.m[tenant]; ok {
+			delete(limits, picType)
+		}
+		return
+	}
+	if tenantLimits.m[tenant] == nil {
+		tenantLimits.m[tenant] = make(map[PictureType]int64)
+	}
+	tenantLimits.m[tenant][picType] = size
+}
+
+// MaxUploadSize returns the effective limit for a picture type, honouring tenant overrides.
+// Pass an empty tenant for the global defaults.
+func MaxUploadSize(tenant string, picType PictureType) int64 {
+	return MaxUploadSizeFor("", tenant, picType)
+}
+
+// MaxUploadSizeFor returns the effective limit for a picture type of an entity: the tenant
+// override, else the entity override, else the picture type's limit. Empty entity or tenant
+// skip their level.
+func MaxUploadSizeFor(entity EntityType, tenant string, picType PictureType) int64 {
+	if tenant != "" {
+		tenantLimits.RLock()
+		size, ok := tenantLimits.m[tenant][picType]
+		tenantLimits.RUnlock()
+		if ok {
+			return size
+		}
+	}
+	if entity != "" {
+		entityLimits.RLock()
+		size, ok := entityLimits.m[entity][picType]
+		entityLimits.RUnlock()
+		if ok {
+			return size
+		}
+	}
+	if size, ok := MaxUploadSizes[picType]; ok {
+		return size
+	}
+	return defaultMaxUploadSize
+}
+
+// UploadLimits returns the effective limits for every known picture type, for advertising to clients.
+func UploadLimits(tenant string) map[PictureType]int64 {
+	return UploadLimitsFor("", tenant)
+}
+
+// UploadLimitsFor is UploadLimits for one entity's uploads.
+func UploadLimitsFor(entity EntityType, tenant string) map[PictureType]int64 {
+	out := make(map[PictureType]int64, len(MaxUploadSizes))
+	for picType := range MaxUploadSizes {
+		out[picType] = MaxUploadSizeFor(entity, tenant, picType)
+	}
+	return out
+}
+
+// LargestUploadSize is the biggest single upload any tenant may make for entity, e.g. to
+// bound how much of a request body is worth reading before the per-file checks run.
+func LargestUploadSize(entity EntityType) int64 {
+	largest := defaultMaxUploadSize
+	for picType := range MaxUploadSizes {
+		largest = max(largest, MaxUploadSizeFor(entity, "", picType))
+	}
+	tenantLimits.RLock()
+	defer tenantLimits.RUnlock()
+	for _, limits := range tenantLimits.m {
+		for _, size := range limits {
+			largest = max(largest, size)
+		}
+	}
+	return largest
+}
@@ -0,0 +1,201 @@
+package filemgr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// ErrContentRejected is returned when image moderation refuses an upload.
+var ErrContentRejected = errors.New("content rejected by moderation")
+
+// Moderation actions, from least to most severe.
+const (
+	ModerationAllow  = "allow"
+	ModerationFlag   = "flag"   // kept as is, queued for review
+	ModerationBlur   = "blur"   // kept, clients show a blurred preview until tapped
+	ModerationReject = "reject" // deleted before anyone sees it
+)
+
+// ImageClassifier scores an image per label (e.g. "nsfw", "violence") from 0 to 1. It may be
+// an external API or a local model behind a small HTTP server.
+type ImageClassifier interface {
+	Classify(ctx context.Context, path, mimeType string) (map[string]float64, error)
+}
+
+// ModerationVerdict is what moderation decided about an image.
+type ModerationVerdict struct {
+	Action string             `json:"action"`
+	Label  string             `json:"label,omitempty"` // highest scoring label
+	Score  float64            `json:"score,omitempty"`
+	Scores map[string]float64 `json:"scores,omitempty"`
+	At     time.Time          `json:"at"`
+}
+
+// ModerationThresholds map a label score to an action; a score at or above a threshold
+// takes that action. Zero disables a level.
+type ModerationThresholds struct {
+	Flag, Blur, Reject float64
+}
+
+var (
+	// Classifier moderates saved images; nil (the default unless IMAGE_MODERATION_URL is set)
+	// turns moderation off.
+	Classifier ImageClassifier
+
+	// ModerationPolicy holds the thresholds, from IMAGE_MODERATION_FLAG/_BLUR/_REJECT
+	// (defaults 0.5, 0.7, 0.95).
+	ModerationPolicy = ModerationThresholds{Flag: 0.5, Blur: 0.7, Reject: 0.95}
+
+	// ModerationFailClosed rejects uploads the classifier could not score
+	// (IMAGE_MODERATION_FAIL_CLOSED=1); by default they are let through unscored.
+	ModerationFailClosed = os.Getenv("IMAGE_MODERATION_FAIL_CLOSED") == "1"
+)
+
+func init() {
+	if url := os.Getenv("IMAGE_MODERATION_URL"); url != "" {
+		Classifier = &HTTPClassifier{
+			URL:    url,
+			APIKey: os.Getenv("IMAGE_MODERATION_API_KEY"),
+			Client: &http.Client{Timeout: 15 * time.Second},
+		}
+	}
+	for env, dst := range map[string]*float64{
+		"IMAGE_MODERATION_FLAG":   &ModerationPolicy.Flag,
+		"IMAGE_MODERATION_BLUR":   &ModerationPolicy.Blur,
+		"IMAGE_MODERATION_REJECT": &ModerationPolicy.Reject,
+	} {
+		if v, err := strconv.ParseFloat(os.Getenv(env), 64); err == nil && v >= 0 && v <= 1 {
+			*dst = v
+		}
+	}
+}
+
+// HTTPClassifier POSTs the image bytes to URL with their content type and expects
+// {"scores": {"<label>": <0..1>, ...}}.
+type HTTPClassifier struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func (c *HTTPClassifier) Classify(ctx context.Context, path, mimeType string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, f)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("classifier status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var out struct {
+		Scores map[string]float64 `json:"scores"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("classifier response: %w", err)
+	}
+	return out.Scores, nil
+}
+
+// decide applies the thresholds to the highest scoring label.
+func (t ModerationThresholds) decide(scores map[string]float64) ModerationVerdict {
+	labels := make([]string, 0, len(scores))
+	for l := range scores {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels) // ties go to the first label alphabetically
+	v := ModerationVerdict{Action: ModerationAllow, Scores: scores, At: time.Now()}
+	for _, l := range labels {
+		if scores[l] > v.Score {
+			v.Label, v.Score = l, scores[l]
+		}
+	}
+	switch {
+	case t.Reject > 0 && v.Score >= t.Reject:
+		v.Action = ModerationReject
+	case t.Blur > 0 && v.Score >= t.Blur:
+		v.Action = ModerationBlur
+	case t.Flag > 0 && v.Score >= t.Flag:
+		v.Action = ModerationFlag
+	}
+	return v
+}
+
+// moderateImage classifies a saved image before it is offloaded. Rejected images are deleted
+// and fail with ErrContentRejected.
+func moderateImage(fullPath, mimeType string) (*ModerationVerdict, error) {
+	if Classifier == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	scores, err := Classifier.Classify(ctx, fullPath, mimeType)
+	if err != nil {
+		if ModerationFailClosed {
+			_ = os.Remove(fullPath)
+			return nil, fmt.Errorf("%w: classifier unavailable: %v", ErrContentRejected, err)
+		}
+		if LogFunc != nil {
+			LogFunc(fmt.Sprintf("warning: moderation skipped for %s: %v", filepath.Base(fullPath), err), 0, "")
+		}
+		return nil, nil
+	}
+
+	v := ModerationPolicy.decide(scores)
+	if v.Action == ModerationReject {
+		_ = os.Remove(fullPath)
+		return &v, fmt.Errorf("%w: %s %.2f", ErrContentRejected, v.Label, v.Score)
+	}
+	return &v, nil
+}
+
+// blurredVariant writes a heavily blurred small JPEG of img, <thumb folder>/<base>_blur.jpg,
+// shown in place of images moderation wants blurred.
+func blurredVariant(img image.Image, fullPath string, entity EntityType) (ImageVariant, error) {
+	small := imaging.Blur(imaging.Resize(img, ThumbWidths[0], 0, imaging.Box), 12)
+	thumbDir := ResolvePath(entity, PicThumb)
+	if err := os.MkdirAll(thumbDir, 0o755); err != nil {
+		return ImageVariant{}, err
+	}
+	base := strings.TrimSuffix(filepath.Base(fullPath), filepath.Ext(fullPath))
+	path := filepath.Join(thumbDir, base+"_blur.jpg")
+	if err := rewriteFile(path, func(buf *bytes.Buffer) error {
+		return jpeg.Encode(buf, small, &jpeg.Options{Quality: 60})
+	}); err != nil {
+		return ImageVariant{}, err
+	}
+	v, ok := storeVariant(path, "image/jpeg", small.Bounds().Dx(), small.Bounds().Dy())
+	if !ok {
+		return ImageVariant{}, fmt.Errorf("store %s failed", path)
+	}
+	v.Blurred = true
+	return v, nil
+}
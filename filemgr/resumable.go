@@ -0,0 +1,244 @@
+package filemgr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrOffsetMismatch   = errors.New("chunk does not start at the upload offset")
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+)
+
+// StagingDir holds resumable uploads until they complete. It lives outside static/ so
+// partial files are never served, and must be shared by all instances behind the balancer
+// (UPLOAD_STAGING_DIR, default "uploads_staging").
+var StagingDir = stagingDir()
+
+func stagingDir() string {
+	if dir := os.Getenv("UPLOAD_STAGING_DIR"); dir != "" {
+		return dir
+	}
+	return "uploads_staging"
+}
+
+// Upload is a resumable upload in progress. Its metadata is kept next to the partial file as
+// <id>.json and the bytes received so far as <id>.part; the offset is the size of the latter.
+type Upload struct {
+	ID          string      `json:"id"`
+	Owner       string      `json:"owner"`
+	Filename    string      `json:"filename"`
+	ContentType string      `json:"contentType"`
+	Size        int64       `json:"size"`
+	SHA256      string      `json:"sha256,omitempty"`
+	Entity      EntityType  `json:"entity"`
+	Tenant      string      `json:"tenant,omitempty"` // for tenant upload limits
+	PicType     PictureType `json:"picType"`
+	Meta        string      `json:"meta,omitempty"` // caller data, e.g. the target chat
+	CreatedAt   time.Time   `json:"createdAt"`
+}
+
+// uploadLocks serialises chunk writes per upload on this instance.
+var uploadLocks sync.Map // id => *sync.Mutex
+
+func uploadLock(id string) *sync.Mutex {
+	mu, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+func (u *Upload) metaPath() string { return filepath.Join(StagingDir, u.ID+".json") }
+func (u *Upload) partPath() string { return filepath.Join(StagingDir, u.ID+".part") }
+
+// InitUpload validates the declared file against the picture type's rules and limit, then
+// creates an empty staged upload. maxSize <= 0 uses the limit for the upload's entity,
+// tenant and picture type, which Complete enforces again.
+func InitUpload(u Upload, maxSize int64) (*Upload, error) {
+	ext := strings.ToLower(filepath.Ext(u.Filename))
+	if !isExtensionAllowed(ext, u.PicType) {
+		return nil, fmt.Errorf("%w: %s for %s", ErrInvalidExtension, ext, u.PicType)
+	}
+	if u.ContentType != "" && !isMIMEAllowed(strings.ToLower(u.ContentType), u.PicType) {
+		return nil, fmt.Errorf("%w: %s for %s", ErrInvalidMIME, u.ContentType, u.PicType)
+	}
+	if maxSize <= 0 {
+		maxSize = MaxUploadSizeFor(u.Entity, u.Tenant, u.PicType)
+	}
+	if u.Size <= 0 || u.Size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes for %s (max %d)", ErrFileTooLarge, u.Size, u.PicType, maxSize)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	u.ID = hex.EncodeToString(id)
+	u.CreatedAt = time.Now()
+
+	if err := os.MkdirAll(StagingDir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", StagingDir, err)
+	}
+	meta, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(u.partPath(), nil, 0o644); err != nil {
+		return nil, fmt.Errorf("create %s: %w", u.partPath(), err)
+	}
+	if err := os.WriteFile(u.metaPath(), meta, 0o644); err != nil {
+		_ = os.Remove(u.partPath())
+		return nil, fmt.Errorf("create %s: %w", u.metaPath(), err)
+	}
+	return &u, nil
+}
+
+// LoadUpload reads a staged upload's metadata.
+func LoadUpload(id string) (*Upload, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return nil, ErrUploadNotFound
+	}
+	u := &Upload{ID: id}
+	raw, err := os.ReadFile(u.metaPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Offset is how many bytes have been received so far.
+func (u *Upload) Offset() (int64, error) {
+	info, err := os.Stat(u.partPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrUploadNotFound
+		}
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// WriteChunk appends the bytes read from r, which must start at the current offset and not
+// run past the declared size. A partially received chunk is kept, so the client resumes from
+// the returned offset after a dropped connection.
+func (u *Upload) WriteChunk(start int64, r io.Reader) (int64, error) {
+	mu := uploadLock(u.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	offset, err := u.Offset()
+	if err != nil {
+		return 0, err
+	}
+	if start != offset {
+		return offset, ErrOffsetMismatch
+	}
+
+	f, err := os.OpenFile(u.partPath(), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	// one byte past the declared size so overruns are detected rather than truncated
+	n, err := io.Copy(f, io.LimitReader(r, u.Size-offset+1))
+	offset += n
+	if offset > u.Size {
+		_ = f.Truncate(u.Size)
+		return u.Size, fmt.Errorf("%w: more than the declared %d bytes", ErrFileTooLarge, u.Size)
+	}
+	return offset, err
+}
+
+// Complete runs the finished file through the regular save pipeline (MIME sniffing, checksum,
+// virus scan, thumbnails and posters) and removes the staged copy.
+func (u *Upload) Complete() (SavedFile, error) {
+	mu := uploadLock(u.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	offset, err := u.Offset()
+	if err != nil {
+		return SavedFile{}, err
+	}
+	if offset != u.Size {
+		return SavedFile{}, fmt.Errorf("%w: %d of %d bytes", ErrUploadIncomplete, offset, u.Size)
+	}
+
+	f, err := os.Open(u.partPath())
+	if err != nil {
+		return SavedFile{}, err
+	}
+	header := &multipart.FileHeader{
+		Filename: u.Filename,
+		Size:     u.Size,
+		Header:   textproto.MIMEHeader{"Content-Type": {u.ContentType}},
+	}
+	saved, err := SaveFileForTenant(f, header, u.Entity, u.Tenant, u.PicType, u.SHA256) // closes f
+	if err != nil {
+		return saved, err
+	}
+	u.remove()
+	return saved, nil
+}
+
+// Abort discards a staged upload.
+func (u *Upload) Abort() {
+	mu := uploadLock(u.ID)
+	mu.Lock()
+	defer mu.Unlock()
+	u.remove()
+}
+
+func (u *Upload) remove() {
+	_ = os.Remove(u.partPath())
+	_ = os.Remove(u.metaPath())
+	uploadLocks.Delete(u.ID)
+}
+
+// SweepStaleUploads removes staged uploads that have not received data for maxAge and
+// returns how many were removed.
+func SweepStaleUploads(maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(StagingDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		u := &Upload{ID: id}
+		info, err := os.Stat(u.partPath())
+		if err == nil && info.ModTime().After(cutoff) {
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		u.Abort()
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,224 @@
+package filemgr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	s3MaxPresignTime = 7 * 24 * time.Hour
+)
+
+// S3Storage stores files in an S3-compatible bucket (AWS S3, MinIO, or GCS through its XML
+// interoperability API), signing requests with AWS Signature Version 4.
+type S3Storage struct {
+	Endpoint  *url.URL // e.g. https://s3.eu-west-1.amazonaws.com, http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool // bucket in the path instead of the host name (MinIO)
+	Client    *http.Client
+}
+
+// NewS3StorageFromEnv configures S3Storage from S3_ENDPOINT, S3_REGION (default us-east-1),
+// S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY and S3_PATH_STYLE=1.
+func NewS3StorageFromEnv() (*S3Storage, error) {
+	endpoint, err := url.Parse(os.Getenv("S3_ENDPOINT"))
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.New("S3_ENDPOINT is not a URL")
+	}
+	s := &S3Storage{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		PathStyle: os.Getenv("S3_PATH_STYLE") == "1",
+		Client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+		return nil, errors.New("S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required")
+	}
+	return s, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return s.do(req)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req) // S3 answers 204 for missing keys too
+}
+
+// URL presigns a GET for key, valid for ttl (at most 7 days).
+func (s *S3Storage) URL(_ context.Context, key string, ttl time.Duration) (string, error) {
+	if ttl <= 0 || ttl > s3MaxPresignTime {
+		ttl = s3MaxPresignTime
+	}
+	now := time.Now().UTC()
+	u := s.objectURL(key)
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", s3Algorithm)
+	q.Set("X-Amz-Credential", s.AccessKey+"/"+s.scope(now))
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		s3Query(q),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedBody,
+	}, "\n")
+	q.Set("X-Amz-Signature", s.sign(now, canonical))
+	u.RawQuery = s3Query(q)
+	return u.String(), nil
+}
+
+func (s *S3Storage) objectURL(key string) *url.URL {
+	host, path := s.Endpoint.Host, strings.TrimSuffix(s.Endpoint.EscapedPath(), "/")
+	if s.PathStyle {
+		path += "/" + s3Escape(s.Bucket, true)
+	} else {
+		host = s.Bucket + "." + host
+	}
+	// the strict escaping is kept as RawPath, so EscapedPath matches what was signed
+	u, _ := url.Parse(s.Endpoint.Scheme + "://" + host + path + "/" + s3Escape(key, false))
+	return u
+}
+
+// do signs req with the Authorization header and fails on non-2xx responses.
+func (s *S3Storage) do(req *http.Request) error {
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedBody)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedBody,
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		signed = append(signed, "content-type")
+		headers["content-type"] = ct
+	}
+	sort.Strings(signed)
+	var canonHeaders strings.Builder
+	for _, h := range signed {
+		canonHeaders.WriteString(h + ":" + strings.TrimSpace(headers[h]) + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonHeaders.String(),
+		strings.Join(signed, ";"),
+		s3UnsignedBody,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, s.scope(now), strings.Join(signed, ";"), s.sign(now, canonical)))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *S3Storage) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// sign returns the SigV4 signature of a canonical request.
+func (s *S3Storage) sign(t time.Time, canonical string) string {
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{s3Algorithm, t.Format("20060102T150405Z"), s.scope(t), hex.EncodeToString(digest[:])}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{t.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, keeping slashes unless
+// encodeSlash is set, as SigV4 canonical requests require.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical query string: sorted keys, strictly encoded.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
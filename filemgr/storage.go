@@ -0,0 +1,164 @@
+package filemgr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadsRoot is where every upload is first written and processed (sniffing, scans,
+// thumbnails); ResolvePath returns folders below it.
+var uploadsRoot = filepath.Join("static", "uploads")
+
+// Storage is where an entity's finished uploads live. Keys are slash-separated paths
+// relative to the uploads root, e.g. "chat/photo/<name>".
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Delete(ctx context.Context, key string) error
+	// URL returns where a client can download key; remote backends presign it for ttl.
+	URL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// LocalStorage keeps files under Root and serves them from BaseURL.
+type LocalStorage struct {
+	Root    string
+	BaseURL string
+}
+
+// DefaultLocal is the backend for entities with no other configured.
+var DefaultLocal = &LocalStorage{Root: uploadsRoot, BaseURL: "/static/uploads"}
+
+func (l *LocalStorage) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	path := filepath.Join(l.Root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(path), err)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	return err
+}
+
+func (l *LocalStorage) Delete(_ context.Context, key string) error {
+	err := os.Remove(filepath.Join(l.Root, filepath.FromSlash(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *LocalStorage) URL(_ context.Context, key string, _ time.Duration) (string, error) {
+	return strings.TrimSuffix(l.BaseURL, "/") + "/" + key, nil
+}
+
+// storages maps entities to their backend. STORAGE_<ENTITY>=s3 (e.g. STORAGE_CHAT=s3) moves
+// an entity to the S3-compatible backend configured by the S3_* variables; see NewS3Storage.
+var storages = struct {
+	sync.RWMutex
+	m map[EntityType]Storage
+}{m: make(map[EntityType]Storage)}
+
+func init() {
+	var s3 Storage
+	for _, entity := range entityTypes {
+		switch backend := os.Getenv("STORAGE_" + strings.ToUpper(string(entity))); backend {
+		case "", "local":
+		case "s3":
+			if s3 == nil {
+				st, err := NewS3StorageFromEnv()
+				if err != nil {
+					log.Printf("storage: %s stays local: %v", entity, err)
+					continue
+				}
+				s3 = st
+			}
+			SetStorage(entity, s3)
+		default:
+			log.Printf("storage: unknown backend %q for %s, using local", backend, entity)
+		}
+	}
+}
+
+// SetStorage moves an entity's uploads to s; nil restores the local default.
+func SetStorage(entity EntityType, s Storage) {
+	storages.Lock()
+	defer storages.Unlock()
+	if s == nil {
+		delete(storages.m, entity)
+		return
+	}
+	storages.m[entity] = s
+}
+
+// StorageFor returns the backend for an entity.
+func StorageFor(entity EntityType) Storage {
+	storages.RLock()
+	defer storages.RUnlock()
+	if s, ok := storages.m[entity]; ok {
+		return s
+	}
+	return DefaultLocal
+}
+
+// IsRemote reports whether an entity's uploads leave the local disk.
+func IsRemote(entity EntityType) bool {
+	return StorageFor(entity) != DefaultLocal
+}
+
+// StorageKey maps a path under the uploads root to its storage key and entity.
+func StorageKey(path string) (string, EntityType, bool) {
+	rel, err := filepath.Rel(uploadsRoot, filepath.Clean(path))
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", "", false
+	}
+	key := filepath.ToSlash(rel)
+	entity, _, _ := strings.Cut(key, "/")
+	return key, EntityType(entity), true
+}
+
+// offloadFile moves a processed local file to its entity's backend, if that isn't the local
+// disk. The local copy is removed once the backend has it.
+func offloadFile(path string) error {
+	key, entity, ok := StorageKey(path)
+	if !ok || !IsRemote(entity) {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	err = StorageFor(entity).Put(ctx, key, f, info.Size(), mime.TypeByExtension(filepath.Ext(path)))
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("offload %s: %w", key, err)
+	}
+	return os.Remove(path)
+}
+
+// FileURL returns a download URL for a file saved under the uploads root, presigned for ttl
+// when the entity uses object storage.
+func FileURL(ctx context.Context, path string, ttl time.Duration) (string, error) {
+	key, entity, ok := StorageKey(path)
+	if !ok {
+		return "", fmt.Errorf("%s is not an upload", path)
+	}
+	return StorageFor(entity).URL(ctx, key, ttl)
+}
@@ -0,0 +1,224 @@
+package filemgr
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/disintegration/imaging"
+)
+
+const svgMIME = "image/svg+xml"
+
+// svgBlockedElements are dropped together with their whole subtree.
+var svgBlockedElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"object":        true,
+	"embed":         true,
+	"audio":         true,
+	"video":         true,
+	"handler":       true,
+	"listener":      true,
+	"style":         true, // CSS can load external resources (@import, url()) in ways too many to filter
+}
+
+// svgAnimations can rewrite another attribute at runtime; they are dropped when they target a link.
+var svgAnimations = map[string]bool{
+	"animate":          true,
+	"set":              true,
+	"animatemotion":    true,
+	"animatetransform": true,
+}
+
+// svgExternalURL matches a url() reference to anything but a local #fragment.
+var svgExternalURL = regexp.MustCompile(`url\(\s*['"]?\s*[^#'"\s)]`)
+
+// looksLikeSVG reports whether the sniffed prefix of an upload is an SVG document.
+// http.DetectContentType reports SVGs as text/xml or text/plain, so we look for the root tag.
+func looksLikeSVG(prefix []byte) bool {
+	return bytes.Contains(bytes.ToLower(prefix), []byte("<svg"))
+}
+
+// SanitizeSVG strips scripts, stylesheets, event handlers, DOCTYPEs and external references
+// from an SVG document and returns the re-serialized markup. Local fragment references (href="#id") and
+// inline raster data URIs are kept so icons and gradients keep rendering.
+func SanitizeSVG(src []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(src))
+	dec.Strict = false
+
+	var out bytes.Buffer
+	skipDepth := 0
+	sawRoot := false
+
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sanitize svg: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 {
+				skipDepth++
+				continue
+			}
+			if svgBlockedElements[strings.ToLower(t.Name.Local)] || svgAnimatesLink(t) {
+				skipDepth = 1
+				continue
+			}
+			if strings.EqualFold(t.Name.Local, "svg") {
+				sawRoot = true
+			}
+			out.WriteByte('<')
+			out.WriteString(svgName(t.Name))
+			for _, a := range t.Attr {
+				if !svgAttrAllowed(a) {
+					continue
+				}
+				out.WriteByte(' ')
+				out.WriteString(svgName(a.Name))
+				out.WriteString(`="`)
+				_ = xml.EscapeText(&out, []byte(a.Value))
+				out.WriteByte('"')
+			}
+			out.WriteByte('>')
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			out.WriteString("</")
+			out.WriteString(svgName(t.Name))
+			out.WriteByte('>')
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			_ = xml.EscapeText(&out, t)
+		case xml.ProcInst:
+			if skipDepth == 0 && t.Target == "xml" {
+				out.WriteString("<?xml ")
+				out.Write(t.Inst)
+				out.WriteString("?>")
+			}
+		case xml.Comment, xml.Directive:
+			// comments may hide conditional markup and DOCTYPEs allow entity expansion; drop both
+		}
+	}
+
+	if !sawRoot {
+		return nil, fmt.Errorf("sanitize svg: no <svg> root element")
+	}
+	return out.Bytes(), nil
+}
+
+// svgName renders a raw (unresolved) xml.Name back to prefix:local form.
+func svgName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// svgAnimatesLink reports whether t is an animation whose target attribute is a link, which
+// would let it swap a checked href for a script URL after sanitizing.
+func svgAnimatesLink(t xml.StartElement) bool {
+	if !svgAnimations[strings.ToLower(t.Name.Local)] {
+		return false
+	}
+	for _, a := range t.Attr {
+		if strings.EqualFold(a.Name.Local, "attributeName") {
+			target := svgCompact(a.Value)
+			target = target[strings.LastIndex(target, ":")+1:] // xlink:href
+			return target == "href" || target == "src"
+		}
+	}
+	return false
+}
+
+// svgCompact lowercases v and drops ASCII whitespace and control characters, which browsers
+// ignore inside URLs ("java\tscript:" still runs).
+func svgCompact(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= 0x20 || r == 0x7f {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, v)
+}
+
+// svgAttrAllowed filters event handlers and anything that can load or execute external content.
+func svgAttrAllowed(a xml.Attr) bool {
+	local := strings.ToLower(a.Name.Local)
+	val := svgCompact(a.Value)
+
+	if strings.HasPrefix(local, "on") {
+		return false
+	}
+	switch local {
+	case "href", "src", "action", "formaction":
+		return strings.HasPrefix(val, "#") || strings.HasPrefix(val, "data:image/png") ||
+			strings.HasPrefix(val, "data:image/jpeg") || strings.HasPrefix(val, "data:image/gif") ||
+			strings.HasPrefix(val, "data:image/webp")
+	case "style":
+		return false
+	}
+	// presentation attributes (fill, filter, mask, clip-path...) are CSS and may only point
+	// inside the document; CSS escapes could spell url( in a way the pattern misses
+	if svgExternalURL.MatchString(val) || strings.Contains(val, `\`) || strings.Contains(val, "javascript:") ||
+		strings.Contains(val, "vbscript:") || strings.Contains(val, "data:text") {
+		return false
+	}
+	return true
+}
+
+// sanitizeSVGFile rewrites the SVG at path in place with its sanitized form.
+func sanitizeSVGFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read svg: %w", err)
+	}
+	clean, err := SanitizeSVG(raw)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, clean, 0o644); err != nil {
+		return fmt.Errorf("write svg: %w", err)
+	}
+	return nil
+}
+
+// generateSVGThumbnail rasterizes an SVG with rsvg-convert and stores a JPEG thumbnail
+// next to the other entity thumbnails.
+func generateSVGThumbnail(svgPath string, entity EntityType, baseFilename string, thumbWidth int) error {
+	tmp, err := os.CreateTemp("", "svgthumb-*.png")
+	if err != nil {
+		return fmt.Errorf("create temp png: %w", err)
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	defer os.Remove(tmpPath)
+
+	cmd := exec.Command("rsvg-convert", "-w", fmt.Sprint(thumbWidth), "-f", "png", "-o", tmpPath, svgPath)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rsvg-convert %s: %w", filepath.Base(svgPath), err)
+	}
+
+	img, err := imaging.Open(tmpPath)
+	if err != nil {
+		return fmt.Errorf("open rasterized svg: %w", err)
+	}
+	return generateThumbnail(img, entity, baseFilename, thumbWidth)
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"image"
 	"image/jpeg"
-	"image/png"
 	"mime/multipart"
 	"os"
 	"os/exec"
@@ -20,47 +19,106 @@ import (
 
 const (
 	defaultThumbWidth = 500
-	maxUploadSize     = 10 << 20 // 10 MB
 	defaultQuality    = 85
 )
 
 // SaveFileForEntity saves file and triggers image/video processing.
 func SaveFileForEntity(file multipart.File, header *multipart.FileHeader, entity EntityType, picType PictureType) (string, error) {
+	saved, err := SaveFileForEntityVerified(file, header, entity, picType, "")
+	return saved.Name, err
+}
+
+// SaveFileForEntityVerified is SaveFileForEntity with checksum verification (see SaveFileVerified).
+// The returned SHA256 is of the bytes as uploaded, even if the stored file is later re-encoded.
+// Once processed, the file moves to the entity's storage backend (see StorageFor).
+func SaveFileForEntityVerified(file multipart.File, header *multipart.FileHeader, entity EntityType, picType PictureType, expectedSHA256 string) (SavedFile, error) {
+	return SaveFileForTenant(file, header, entity, "", picType, expectedSHA256)
+}
+
+// SaveFileForTenant is SaveFileForEntityVerified under a tenant's upload limits (see
+// MaxUploadSizeFor); an empty tenant uses the entity's.
+func SaveFileForTenant(file multipart.File, header *multipart.FileHeader, entity EntityType, tenant string, picType PictureType, expectedSHA256 string) (SavedFile, error) {
+	saved, err := processEntityFile(file, header, entity, picType, expectedSHA256, MaxUploadSizeFor(entity, tenant, picType))
+	if err != nil {
+		return saved, err
+	}
+	if saved.Deduplicated {
+		return saved, nil // already in the backend
+	}
+	path := filepath.Join(ResolvePath(entity, picType), saved.Name)
+	if err := offloadFile(path); err != nil {
+		_ = os.Remove(path)
+		return SavedFile{}, err
+	}
+	return saved, nil
+}
+
+// processEntityFile saves and post-processes an upload on local disk. Derived files are
+// left to media jobs (see scheduleJob), which run inline when the original is about to be
+// offloaded.
+func processEntityFile(file multipart.File, header *multipart.FileHeader, entity EntityType, picType PictureType, expectedSHA256 string, maxSize int64) (SavedFile, error) {
 	defer file.Close()
 
 	path := ResolvePath(entity, picType)
-	filename, err := SaveFile(file, header, path, maxUploadSize, nil)
+	saved, err := SaveFileVerified(file, header, path, maxSize, nil, expectedSHA256)
 	if err != nil {
-		return "", err
+		return SavedFile{}, err
+	}
+	if existing, ok := reuseStored(path, entity, picType, saved); ok {
+		return existing, nil
+	}
+	if needsConversion(strings.ToLower(filepath.Ext(saved.Name))) {
+		name, mimeType, err := convertImage(path, saved.Name)
+		if err != nil {
+			_ = os.Remove(filepath.Join(path, saved.Name))
+			return SavedFile{}, fmt.Errorf("%w: %v", ErrInvalidMIME, err)
+		}
+		saved.Name, saved.MIME = name, mimeType
+		if info, err := os.Stat(filepath.Join(path, name)); err == nil {
+			saved.Size = info.Size()
+		}
 	}
+	filename := saved.Name
 
 	fullPath := filepath.Join(path, filename)
 	ext := strings.ToLower(filepath.Ext(fullPath))
 
+	// Handle SVGs: already sanitized by SaveFile, only a raster thumbnail is needed
+	if ext == ".svg" {
+		if scheduleJob(MediaJob{Kind: JobSVG, Entity: entity, PicType: picType, Name: filename}) {
+			saved.Processing = append(saved.Processing, JobSVG)
+		}
+
+		if LogFunc != nil {
+			LogFunc(filename, 0, svgMIME)
+		}
+		return saved, nil
+	}
+
 	// Handle images
 	if isImageType(picType) {
-		f, err := os.Open(fullPath)
-		if err != nil {
-			return "", fmt.Errorf("reopen saved file: %w", err)
+		img, decodeErr := decodeImage(fullPath)
+		saved.Animated = isAnimated(fullPath)
+
+		// The original keeps its format; browsers pick WebP/AVIF variants where they can
+		if StripsMetadata(entity) {
+			if err := StripEXIF(fullPath, img); err != nil {
+				return SavedFile{}, err
+			}
+			if info, err := os.Stat(fullPath); err == nil {
+				saved.Size = info.Size()
+			}
 		}
-		img, _, err := image.Decode(f)
-		_ = f.Close()
+		verdict, err := moderateImage(fullPath, saved.MIME)
 		if err != nil {
+			return SavedFile{}, err
+		}
+		saved.Moderation = verdict
+		if decodeErr != nil {
 			if LogFunc != nil {
 				LogFunc(filename, 0, "unknown")
 			}
-			return filename, nil
-		}
-
-		// Normalize to PNG
-		newPath, err := normalizeImageFormat(fullPath, ext, img)
-		if err != nil {
-			return "", err
-		}
-		if newPath != fullPath {
-			fullPath = newPath
-			filename = filepath.Base(newPath)
-			ext = ".png"
+			return saved, nil
 		}
 
 		// MQ notify
@@ -68,74 +126,66 @@ func SaveFileForEntity(file multipart.File, header *multipart.FileHeader, entity
 			_ = mq.NotifyImageSaved(p, ent, fname, pt, "")
 		}(fullPath, string(entity), filename, string(picType))
 
-		// Thumbnail
-		imgCopy := imaging.Clone(img)
-		go func(img image.Image, ent EntityType, fname string) {
-			if err := generateThumbnail(img, ent, fname, defaultThumbWidth); err != nil {
-				if LogFunc != nil {
-					LogFunc(fmt.Sprintf("warning: thumbnail failed for %s: %v", fname, err), 0, "")
-				}
+		// Blurred preview, made inline so it exists before the message is shown
+		var blurred []ImageVariant
+		if verdict != nil && verdict.Action == ModerationBlur {
+			if v, err := blurredVariant(img, fullPath, entity); err == nil {
+				blurred = append(blurred, v)
+			} else if LogFunc != nil {
+				LogFunc(fmt.Sprintf("warning: blurred preview failed for %s: %v", filename, err), 0, "")
 			}
-		}(imgCopy, entity, filename)
+		}
 
-		// Metadata extraction
-		go func(img image.Image, uid string) {
-			if err := ExtractImageMetadata(img, uid); err != nil {
-				if LogFunc != nil {
-					LogFunc(fmt.Sprintf("warning: metadata extraction failed for %s: %v", filename, err), 0, "")
-				}
-			}
-		}(imaging.Clone(img), generateUniqueID())
+		// Thumbnail, variants and metadata
+		if scheduleJob(MediaJob{Kind: JobImage, Entity: entity, PicType: picType, Name: filename, Extra: blurred}) {
+			saved.Processing = append(saved.Processing, JobImage)
+		}
 
 		if LogFunc != nil {
-			LogFunc(filename, 0, "image/png")
+			LogFunc(filename, 0, saved.MIME)
+		}
+		return saved, nil
+	}
+
+	// Handle audio: duration and waveform are needed in the message itself, so probe inline
+	if picType == PicAudio && isAudioExt(ext) {
+		info, err := ProbeAudio(fullPath)
+		if err != nil && LogFunc != nil {
+			LogFunc(fmt.Sprintf("warning: audio probe failed for %s: %v", filename, err), 0, "")
+		}
+		if info.Duration > 0 {
+			saved.Audio = &info
+		}
+	}
+
+	// Handle PDFs: the page count and preview go into the message, so render inline
+	if ext == ".pdf" {
+		doc, err := renderDocumentPreview(fullPath, entity, picType)
+		if err != nil && LogFunc != nil {
+			LogFunc(fmt.Sprintf("warning: pdf preview failed for %s: %v", filename, err), 0, "")
 		}
-		return filename, nil
+		saved.Document = doc
 	}
 
 	// Handle videos
 	if picType == PicVideo || isVideoExt(ext) {
-		go func(vpath string, ent EntityType, fname string) {
-			if thumb, err := generateVideoPoster(vpath, ent, fname); err != nil {
-				if LogFunc != nil {
-					LogFunc(fmt.Sprintf("warning: video poster generation failed for %s: %v", fname, err), 0, "")
-				}
-			} else {
-				if LogFunc != nil {
-					LogFunc(thumb, 0, "image/jpeg")
-				}
-			}
-		}(fullPath, entity, filename)
+		if scheduleJob(MediaJob{Kind: JobPoster, Entity: entity, PicType: picType, Name: filename}) {
+			saved.Processing = append(saved.Processing, JobPoster)
+		}
+		if HLSEnabled {
+			saved.Processing = append(saved.Processing, JobHLS)
+			enqueueHLS(fullPath, entity, filename)
+		}
 	}
 
 	if LogFunc != nil {
 		LogFunc(filename, 0, "")
 	}
-	return filename, nil
+	return saved, nil
 }
 
 // --- Utility functions for images/videos ---
 
-// normalizeImageFormat re-encodes non-PNG images into PNG
-func normalizeImageFormat(fullPath, ext string, img image.Image) (string, error) {
-	if ext == ".png" {
-		return fullPath, nil
-	}
-	pngPath := strings.TrimSuffix(fullPath, ext) + ".png"
-	out, err := os.Create(pngPath)
-	if err != nil {
-		return fullPath, fmt.Errorf("create png %s: %w", pngPath, err)
-	}
-	if err := png.Encode(out, img); err != nil {
-		_ = out.Close()
-		_ = os.Remove(pngPath)
-		return fullPath, fmt.Errorf("encode png: %w", err)
-	}
-	_ = out.Close()
-	_ = os.Remove(fullPath)
-	return pngPath, nil
-}
-
 // generateThumbnail creates a JPEG thumbnail for an image
 func generateThumbnail(img image.Image, entity EntityType, baseFilename string, thumbWidth int) error {
 	resized := imaging.Resize(img, thumbWidth, 0, imaging.Lanczos)
@@ -157,7 +207,7 @@ func generateThumbnail(img image.Image, entity EntityType, baseFilename string,
 	if LogFunc != nil {
 		LogFunc(path, 0, "image/jpeg")
 	}
-	return nil
+	return offloadFile(path)
 }
 
 // generateVideoPoster extracts a poster frame from a video
@@ -197,7 +247,7 @@ func generateVideoPoster(videoPath string, entity EntityType, baseFilename strin
 	if LogFunc != nil {
 		LogFunc(thumbPath, 0, "image/jpeg")
 	}
-	return thumbName, nil
+	return thumbName, offloadFile(thumbPath)
 }
 
 func generateUniqueID() string {
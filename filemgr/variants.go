@@ -0,0 +1,126 @@
+package filemgr
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ImageVariant is an alternative rendition of a saved image: a modern encoding of the full
+// image or a smaller thumbnail.
+type ImageVariant struct {
+	Path   string `json:"path"`
+	MIME   string `json:"mime"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+
+	Animated bool `json:"animated,omitempty"` // looping preview of an animated image
+	Blurred  bool `json:"blurred,omitempty"`  // obscured preview of an image moderation wants blurred
+}
+
+// ThumbWidths are the thumbnail sizes generated next to the default thumbnail.
+var ThumbWidths = []int{160, 320, 640}
+
+// VariantFunc, when set, receives the variants produced for a saved image so the caller can
+// record them alongside the file. It runs after the variants are stored.
+var VariantFunc func(entity EntityType, picType PictureType, name string, variants []ImageVariant)
+
+// generateVariants writes WebP and AVIF encodings of the image beside it and JPEG thumbnails
+// of each ThumbWidth narrower than the image into the entity's thumb folder. Encodings ffmpeg
+// can't produce are skipped; each variant is offloaded like the original. Thumbnails of an
+// animation show its first frame, and animated GIFs also get a looping preview.
+func generateVariants(img image.Image, fullPath string, entity EntityType) []ImageVariant {
+	b := img.Bounds()
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	base := strings.TrimSuffix(fullPath, filepath.Ext(fullPath))
+	animated := isAnimated(fullPath)
+	var out []ImageVariant
+
+	encodings := []struct {
+		ext, mime string
+		args      []string
+	}{
+		{".webp", "image/webp", []string{"-c:v", "libwebp", "-quality", "80"}},
+		{".avif", "image/avif", []string{"-c:v", "libaom-av1", "-still-picture", "1", "-crf", "30", "-b:v", "0"}},
+	}
+	for _, enc := range encodings {
+		if enc.ext == ext || (enc.ext == ".avif" && ext == ".gif") { // animated AVIF is too slow to encode
+			continue
+		}
+		if animated && ext == ".webp" {
+			break // ffmpeg can't decode animated WebP
+		}
+		path := base + enc.ext
+		args := append([]string{"-y", "-v", "error", "-i", fullPath, "-map_metadata", "-1"}, enc.args...)
+		if animated {
+			args = append(args, "-loop", "0")
+		}
+		if err := exec.Command("ffmpeg", append(args, path)...).Run(); err != nil {
+			_ = os.Remove(path)
+			if LogFunc != nil {
+				LogFunc(fmt.Sprintf("warning: %s variant failed for %s: %v", enc.ext, filepath.Base(fullPath), err), 0, "")
+			}
+			continue
+		}
+		if v, ok := storeVariant(path, enc.mime, b.Dx(), b.Dy()); ok {
+			out = append(out, v)
+		}
+	}
+
+	thumbDir := ResolvePath(entity, PicThumb)
+	if err := os.MkdirAll(thumbDir, 0o755); err != nil {
+		return out
+	}
+	for _, w := range ThumbWidths {
+		if w >= b.Dx() {
+			continue
+		}
+		resized := imaging.Resize(img, w, 0, imaging.Lanczos)
+		path := filepath.Join(thumbDir, fmt.Sprintf("%s_%d.jpg", filepath.Base(base), w))
+		f, err := os.Create(path)
+		if err != nil {
+			continue
+		}
+		err = jpeg.Encode(f, resized, &jpeg.Options{Quality: defaultQuality})
+		_ = f.Close()
+		if err != nil {
+			_ = os.Remove(path)
+			continue
+		}
+		if v, ok := storeVariant(path, "image/jpeg", resized.Bounds().Dx(), resized.Bounds().Dy()); ok {
+			out = append(out, v)
+		}
+	}
+
+	if animated {
+		if v, err := generateAnimatedPreview(fullPath, entity); err == nil {
+			out = append(out, v)
+		} else if err != errNotAnimated && LogFunc != nil {
+			LogFunc(fmt.Sprintf("warning: animated preview failed for %s: %v", filepath.Base(fullPath), err), 0, "")
+		}
+	}
+	return out
+}
+
+// storeVariant describes a written variant and moves it to the entity's backend.
+func storeVariant(path, mime string, width, height int) (ImageVariant, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ImageVariant{}, false
+	}
+	if err := offloadFile(path); err != nil {
+		if LogFunc != nil {
+			LogFunc(fmt.Sprintf("warning: variant offload failed for %s: %v", path, err), 0, "")
+		}
+		_ = os.Remove(path)
+		return ImageVariant{}, false
+	}
+	return ImageVariant{Path: path, MIME: mime, Width: width, Height: height, Size: info.Size()}, true
+}
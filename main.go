@@ -11,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	"naevis/discord"
 	"naevis/middleware"
 	"naevis/ratelim"
 	"naevis/routes"
@@ -69,16 +70,47 @@ func main() {
 	// Initialize rate limiter
 	rateLimiter := ratelim.NewRateLimiter(1, 6, 10*time.Minute, 10000)
 
+	// WS fan-out backend (BROADCAST_BACKEND=redis for multi-instance deployments)
+	discord.SetupBroadcaster("")
+
+	// Background janitor for uploads that never got attached to a message
+	go discord.StartAttachmentJanitor(time.Hour)
+
+	// Removes disappearing messages once their expiresAt passes
+	go discord.StartExpirySweeper(time.Minute)
+
+	// Hard-deletes soft-deleted messages past DELETED_RETENTION_DAYS
+	go discord.StartRetentionPurger(time.Hour)
+
+	// Deletes takeout archives and other job output once their links expire
+	go discord.StartJobJanitor(time.Hour)
+
+	// Streams message events of opted-in tenants to WORM storage (COMPLIANCE_TENANTS)
+	go discord.StartComplianceExporter()
+
+	// Makes thumbnails, variants and posters of uploads from the persistent media job queue
+	go discord.StartMediaJobWorkers(10 * time.Second)
+
+	// Redelivers message broadcasts whose dispatch failed or was interrupted
+	go discord.StartOutboxDispatcher(5 * time.Second)
+
+	// Tracks message delivery latency percentiles and alerts on SLO breaches (DELIVERY_SLO_*)
+	go discord.StartDeliveryMonitor(30 * time.Second)
+
+	// Warns WS clients with reconnect hints while this instance is near capacity
+	go discord.StartLoadMonitor(15 * time.Second)
+
 	// Build router
 	router := setupRouter(rateLimiter)
 	// routes.AddStaticRoutes(router)
 
-	// Apply middleware stack: Security → Logging → CORS
-	innerHandler := middleware.LoggingMiddleware(middleware.SecurityHeaders(router))
+	// Apply middleware stack: Security → Metrics → Logging → CORS
+	innerHandler := middleware.LoggingMiddleware(middleware.Instrument(router, middleware.SecurityHeaders(router)))
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   allowedOrigins,
 		AllowedMethods:   []string{"HEAD", "GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization", "Idempotency-Key", "X-Requested-With"},
+		AllowedHeaders:   []string{"Content-Type", "Content-Range", "Range", "Authorization", "Idempotency-Key", "X-Requested-With"},
+		ExposedHeaders:   []string{"Idempotent-Replayed", "Upload-Offset", "Accept-Ranges", "Content-Range", "X-Content-Duration"},
 		AllowCredentials: true,
 	}).Handler(innerHandler)
 
@@ -101,6 +133,9 @@ func main() {
 
 	server.RegisterOnShutdown(func() {
 		log.Println("Shutting down...")
+		// hijacked WebSocket connections are not closed by Shutdown
+		discord.CloseForRestart()
+		discord.FlushCompliance()
 	})
 
 	// Start server
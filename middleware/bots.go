@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"naevis/db"
+	"naevis/globals"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// HashBotToken is how bot API tokens are stored; the plain token is only shown once.
+func HashBotToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateBot verifies an "Authorization: Bot <token>" header and stores the bot's
+// chat identity in the context, so regular handlers act on its behalf.
+func AuthenticateBot(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bot ")
+		if !ok || token == "" {
+			writeError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var bot struct {
+			UserID string `bson:"userid"`
+		}
+		err := db.BotsCollection.FindOne(r.Context(),
+			bson.M{"tokenHash": HashBotToken(token)},
+			options.FindOne().SetProjection(bson.M{"userid": 1}),
+		).Decode(&bot)
+		if err != nil {
+			writeError(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), globals.UserIDKey, bot.UserID)
+		ctx = context.WithValue(ctx, globals.RoleKey, []string{"bot"})
+		next(w, r.WithContext(ctx), ps)
+	}
+}
@@ -34,7 +34,7 @@ func WithTxn(next httprouter.Handle) httprouter.Handle {
 		// Start a new session
 		session, err := client.StartSession()
 		if err != nil {
-			http.Error(w, "failed to start db session", http.StatusInternalServerError)
+			writeError(w, "failed to start db session", http.StatusInternalServerError)
 			return
 		}
 		defer session.EndSession(r.Context())
@@ -66,7 +66,8 @@ func WithTxn(next httprouter.Handle) httprouter.Handle {
 		})
 
 		if err != nil {
-			http.Error(w, "transaction failed: "+err.Error(), http.StatusInternalServerError)
+			log.Printf("transaction failed: %v", err)
+			writeError(w, "transaction failed", http.StatusInternalServerError)
 		}
 	}
 }
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"naevis/globals"
+	"naevis/rdx"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// IdempotencyHeader carries the client's retry key.
+	IdempotencyHeader = "Idempotency-Key"
+
+	maxIdempotencyKeyLen = 128
+	maxReplayBody        = 1 << 20 // larger responses are not cached
+	idempotencyPending   = "pending"
+	idempotencyLockTTL   = 2 * time.Minute // how long a crashed first attempt blocks retries
+)
+
+// storedResponse is a cached first response, replayed for retries with the same key.
+type storedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        []byte `json:"body"`
+	BodyHash    string `json:"bodyHash"` // sha256 of the request body the response answers
+}
+
+// hashingBody hashes a request body as the handler reads it, so large uploads aren't buffered.
+type hashingBody struct {
+	io.ReadCloser
+	h     hash.Hash
+	n     int64 // bytes hashed so far
+	limit int64
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	b.n += int64(n)
+	return n, err
+}
+
+// sum drains up to the limit of what the handler left unread and returns the body's hash,
+// or "" when the body is longer than the limit and so can't be compared.
+func (b *hashingBody) sum() string {
+	if b.n <= b.limit {
+		n, _ := io.Copy(b.h, io.LimitReader(b.ReadCloser, b.limit-b.n+1))
+		b.n += n
+	}
+	if b.n > b.limit {
+		return ""
+	}
+	return hex.EncodeToString(b.h.Sum(nil))
+}
+
+// idempotencyRecorder captures what the handler writes while passing it through.
+type idempotencyRecorder struct {
+	*ResponseWriterWithStatus
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *idempotencyRecorder) Write(p []byte) (int, error) {
+	if !rec.overflow {
+		if rec.body.Len()+len(p) > maxReplayBody {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Idempotent makes a handler safe to retry: the first response for a user's Idempotency-Key
+// on a route is cached for ttl and replayed verbatim for later requests with the same key.
+// A retry arriving while the first attempt is still running gets 409. Reusing a key with a
+// different request body, or one longer than maxBody, gets 422. Server errors are not cached
+// so the client can retry them. Requests without the header pass straight through.
+// Must run after Authenticate.
+func Idempotent(ttl time.Duration, maxBody int64) func(httprouter.Handle) httprouter.Handle {
+	return func(next httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			key := r.Header.Get(IdempotencyHeader)
+			if key == "" {
+				next(w, r, ps)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				writeError(w, "Idempotency-Key too long", http.StatusBadRequest)
+				return
+			}
+
+			user, _ := r.Context().Value(globals.UserIDKey).(string)
+			sum := sha256.Sum256([]byte(user + "\x00" + r.Method + " " + r.URL.Path + "\x00" + key))
+			redisKey := "idem:" + hex.EncodeToString(sum[:])
+			ctx := context.Background()
+
+			claimed, err := rdx.Conn.SetNX(ctx, redisKey, idempotencyPending, idempotencyLockTTL).Result()
+			if err != nil {
+				// without redis the guarantee can't be kept; serve the request rather than fail it
+				log.Printf("idempotency: claim failed: %v", err)
+				next(w, r, ps)
+				return
+			}
+			body := &hashingBody{ReadCloser: r.Body, h: sha256.New(), limit: maxBody}
+			if !claimed {
+				replayResponse(ctx, w, redisKey, body)
+				return
+			}
+
+			r.Body = body
+			rec := &idempotencyRecorder{ResponseWriterWithStatus: WrapResponseWriter(w)}
+			next(rec, r, ps)
+
+			bodyHash := body.sum()
+			if rec.status >= http.StatusInternalServerError || rec.overflow || bodyHash == "" {
+				rdx.Conn.Del(ctx, redisKey)
+				return
+			}
+			data, err := json.Marshal(storedResponse{
+				Status:      rec.status,
+				ContentType: rec.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+				BodyHash:    bodyHash,
+			})
+			if err == nil {
+				err = rdx.Conn.Set(ctx, redisKey, data, ttl).Err()
+			}
+			if err != nil {
+				log.Printf("idempotency: store failed: %v", err)
+				rdx.Conn.Del(ctx, redisKey)
+			}
+		}
+	}
+}
+
+func replayResponse(ctx context.Context, w http.ResponseWriter, redisKey string, body *hashingBody) {
+	raw, err := rdx.Conn.Get(ctx, redisKey).Bytes()
+	if err == redis.Nil || string(raw) == idempotencyPending {
+		writeError(w, "request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var stored storedResponse
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		writeError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if h := body.sum(); h == "" || stored.BodyHash != h {
+		writeError(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+		return
+	}
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	_, _ = w.Write(stored.Body)
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"naevis/db"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HandlerStat aggregates requests for one route.
+type HandlerStat struct {
+	Handler  string        `json:"handler"`
+	Count    int64         `json:"count"`
+	Errors   int64         `json:"errors"` // responses with status >= 500
+	Total    time.Duration `json:"totalNanos"`
+	Max      time.Duration `json:"maxNanos"`
+	Statuses map[int]int64 `json:"statuses"`
+}
+
+var handlerStats = struct {
+	sync.Mutex
+	m map[string]*HandlerStat
+}{m: make(map[string]*HandlerStat)}
+
+// Instrument names each request after its route pattern (e.g. "GET /merechats/chat/:chatid"),
+// tags the context so Mongo queries are attributed to it and records per-handler metrics.
+func Instrument(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := routeName(router, r)
+		rw := WrapResponseWriter(w)
+
+		start := time.Now()
+		next.ServeHTTP(rw, r.WithContext(db.WithHandler(r.Context(), name)))
+		recordHandler(name, rw.status, time.Since(start))
+	})
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. for WebSocket hijacking).
+func (rw *ResponseWriterWithStatus) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack passes WebSocket upgrades through to the underlying writer.
+func (rw *ResponseWriterWithStatus) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	rw.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// routeName maps a request back to the pattern it matched, keeping metric cardinality bounded.
+func routeName(router *httprouter.Router, r *http.Request) string {
+	handle, ps, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return r.Method + " (unmatched)"
+	}
+	segments := strings.Split(r.URL.Path, "/")
+	next := 0
+	for i, seg := range segments {
+		if next < len(ps) && seg == ps[next].Value {
+			segments[i] = ":" + ps[next].Key
+			next++
+		}
+	}
+	return r.Method + " " + strings.Join(segments, "/")
+}
+
+func recordHandler(name string, status int, took time.Duration) {
+	handlerStats.Lock()
+	defer handlerStats.Unlock()
+	s, ok := handlerStats.m[name]
+	if !ok {
+		s = &HandlerStat{Handler: name, Statuses: make(map[int]int64)}
+		handlerStats.m[name] = s
+	}
+	s.Count++
+	s.Total += took
+	if took > s.Max {
+		s.Max = took
+	}
+	s.Statuses[status]++
+	if status >= 500 {
+		s.Errors++
+	}
+}
+
+// HandlerStats returns a snapshot of per-handler metrics, busiest first.
+func HandlerStats() []HandlerStat {
+	handlerStats.Lock()
+	out := make([]HandlerStat, 0, len(handlerStats.m))
+	for _, s := range handlerStats.m {
+		c := *s
+		c.Statuses = make(map[int]int64, len(s.Statuses))
+		for k, v := range s.Statuses {
+			c.Statuses[k] = v
+		}
+		out = append(out, c)
+	}
+	handlerStats.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Total > out[j].Total })
+	return out
+}
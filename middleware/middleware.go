@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"naevis/globals" // adjust this import to your actual path
+	"naevis/models"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
@@ -30,7 +31,7 @@ func Authenticate(next httprouter.Handle) httprouter.Handle {
 
 		tokenString := r.Header.Get("Authorization")
 		if tokenString == "" || len(tokenString) < 8 || tokenString[:7] != "Bearer " {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
@@ -39,7 +40,7 @@ func Authenticate(next httprouter.Handle) httprouter.Handle {
 			return globals.JwtSecret, nil
 		})
 		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			writeError(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
@@ -51,6 +52,11 @@ func Authenticate(next httprouter.Handle) httprouter.Handle {
 	}
 }
 
+// writeError answers with the shared JSON error envelope.
+func writeError(w http.ResponseWriter, msg string, status int) {
+	models.WriteAPIError(w, status, models.APIError{Code: models.ErrCodeForStatus(status), Message: msg})
+}
+
 // OptionalAuth lets the request through even if JWT is invalid or missing
 func OptionalAuth(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -78,7 +84,7 @@ func RequireRoles(allowedRoles ...string) func(httprouter.Handle) httprouter.Han
 			rawRoles := r.Context().Value(globals.RoleKey)
 			roles, ok := rawRoles.([]string)
 			if !ok || roles == nil {
-				http.Error(w, "Forbidden", http.StatusForbidden)
+				writeError(w, "Forbidden", http.StatusForbidden)
 				return
 			}
 
@@ -91,7 +97,7 @@ func RequireRoles(allowedRoles ...string) func(httprouter.Handle) httprouter.Han
 				}
 			}
 
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			writeError(w, "Forbidden", http.StatusForbidden)
 		}
 	}
 }
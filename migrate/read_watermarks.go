@@ -0,0 +1,346 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"naevis/db"
+	"naevis/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReadWatermarksID names the readBy → lastReadSeq backfill in the migrations collection.
+const ReadWatermarksID = "readby-to-seq"
+
+// maxMentionSeqs matches the unread mentions the server keeps per membership.
+const maxMentionSeqs = 100
+
+// checkpoint records how far a migration got so an interrupted run can resume.
+type checkpoint struct {
+	ID         string    `bson:"_id"`
+	LastChatID string    `bson:"lastChatId"`
+	Done       bool      `bson:"done"`
+	UpdatedAt  time.Time `bson:"updatedAt"`
+}
+
+// Stats summarizes one backfill run.
+type Stats struct {
+	Chats       int64
+	Messages    int64
+	Memberships int64
+}
+
+// BackfillReadWatermarks numbers existing messages per chat (createdAt order) and converts readBy
+// arrays into per-member lastReadSeq watermarks, carrying over the mentions above them. Chats
+// are processed in chatid order, batchSize at a time, with a checkpoint after every chat;
+// rerunning continues where the last run stopped.
+// Messages that already carry a seq are left alone, so it should run before seq-on-write is enabled.
+func BackfillReadWatermarks(ctx context.Context, batchSize int64, dryRun bool) (Stats, error) {
+	var stats Stats
+
+	cp, err := loadCheckpoint(ctx, ReadWatermarksID)
+	if err != nil {
+		return stats, err
+	}
+	if cp.Done {
+		log.Printf("migrate: %s already complete", ReadWatermarksID)
+		return stats, nil
+	}
+
+	for {
+		opts := options.Find().SetSort(bson.D{{Key: "chatid", Value: 1}}).SetLimit(batchSize)
+		cursor, err := db.MereCollection.Find(ctx, bson.M{"chatid": bson.M{"$gt": cp.LastChatID}}, opts)
+		if err != nil {
+			return stats, fmt.Errorf("list chats: %w", err)
+		}
+		var chats []models.Chat
+		if err := cursor.All(ctx, &chats); err != nil {
+			return stats, fmt.Errorf("decode chats: %w", err)
+		}
+
+		for i := range chats {
+			msgs, members, err := backfillChat(ctx, &chats[i], dryRun)
+			if err != nil {
+				return stats, fmt.Errorf("chat %s: %w", chats[i].ChatID, err)
+			}
+			stats.Chats++
+			stats.Messages += msgs
+			stats.Memberships += members
+
+			cp.LastChatID = chats[i].ChatID
+			if !dryRun {
+				if err := saveCheckpoint(ctx, cp); err != nil {
+					return stats, err
+				}
+			}
+		}
+		log.Printf("migrate: %s progress chats=%d messages=%d memberships=%d (last chat %q)",
+			ReadWatermarksID, stats.Chats, stats.Messages, stats.Memberships, cp.LastChatID)
+
+		if int64(len(chats)) < batchSize {
+			break
+		}
+	}
+
+	cp.Done = true
+	if !dryRun {
+		if err := saveCheckpoint(ctx, cp); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// ResetCheckpoint forgets a migration's progress so the next run starts over.
+func ResetCheckpoint(ctx context.Context, id string) error {
+	_, err := db.MigrationsCollection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// backfillChat assigns seqs to unnumbered messages and upserts member watermarks.
+func backfillChat(ctx context.Context, chat *models.Chat, dryRun bool) (int64, int64, error) {
+	seq := chat.LastSeq
+	var numbered int64
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"_id": 1})
+	cursor, err := db.MessagesCollection.Find(ctx, bson.M{"chatid": chat.ChatID, "seq": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var writes []mongo.WriteModel
+	flush := func() error {
+		if len(writes) == 0 || dryRun {
+			writes = writes[:0]
+			return nil
+		}
+		_, err := db.MessagesCollection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		writes = writes[:0]
+		return err
+	}
+	for cursor.Next(ctx) {
+		var m struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := cursor.Decode(&m); err != nil {
+			return numbered, 0, err
+		}
+		seq++
+		numbered++
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": m.ID, "seq": bson.M{"$exists": false}}).
+			SetUpdate(bson.M{"$set": bson.M{"seq": seq}}))
+		if len(writes) >= 500 {
+			if err := flush(); err != nil {
+				return numbered, 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return numbered, 0, err
+	}
+
+	if !dryRun && seq > chat.LastSeq {
+		if _, err := db.MereCollection.UpdateOne(ctx,
+			bson.M{"chatid": chat.ChatID},
+			bson.M{"$max": bson.M{"lastSeq": seq}},
+		); err != nil {
+			return numbered, 0, err
+		}
+	}
+
+	watermarks, err := readWatermarks(ctx, chat.ChatID)
+	if err != nil {
+		return numbered, 0, err
+	}
+	mentions, err := mentionSeqs(ctx, chat.ChatID)
+	if err != nil {
+		return numbered, 0, err
+	}
+
+	var members int64
+	now := time.Now()
+	for _, p := range chat.Participants {
+		members++
+		if dryRun {
+			continue
+		}
+		set := bson.M{"updatedAt": now}
+		if unread := unreadMentions(mentions[p], watermarks[p]); len(unread) > 0 {
+			set["mentionSeqs"] = unread
+		}
+		_, err := db.MembershipsCollection.UpdateOne(ctx,
+			bson.M{"chatid": chat.ChatID, "userid": p},
+			bson.M{
+				"$max": bson.M{"lastReadSeq": watermarks[p]},
+				"$set": set,
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return numbered, members, err
+		}
+	}
+	return numbered, members, nil
+}
+
+// RebuildMemberCounters recomputes each participant's read watermark and unread mentions for
+// one chat from its messages, e.g. after the stored counters drifted. Watermarks only move
+// forward; mentionSeqs is replaced with the mentions above the resulting watermark. It returns
+// how many memberships were written.
+func RebuildMemberCounters(ctx context.Context, chat *models.Chat) (int64, error) {
+	watermarks, err := readWatermarks(ctx, chat.ChatID)
+	if err != nil {
+		return 0, err
+	}
+	mentions, err := mentionSeqs(ctx, chat.ChatID)
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := db.MembershipsCollection.Find(ctx, bson.M{"chatid": chat.ChatID},
+		options.Find().SetProjection(bson.M{"userid": 1, "lastReadSeq": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var existing []models.Membership
+	if err := cursor.All(ctx, &existing); err != nil {
+		return 0, err
+	}
+	for _, m := range existing {
+		watermarks[m.UserID] = max(watermarks[m.UserID], m.LastReadSeq)
+	}
+
+	var members int64
+	now := time.Now()
+	for _, p := range chat.Participants {
+		update := bson.M{
+			"$max": bson.M{"lastReadSeq": watermarks[p]},
+			"$set": bson.M{"updatedAt": now},
+		}
+		if unread := unreadMentions(mentions[p], watermarks[p]); len(unread) > 0 {
+			update["$set"].(bson.M)["mentionSeqs"] = unread
+		} else {
+			update["$unset"] = bson.M{"mentionSeqs": ""}
+		}
+		if _, err := db.MembershipsCollection.UpdateOne(ctx,
+			bson.M{"chatid": chat.ChatID, "userid": p},
+			update,
+			options.Update().SetUpsert(true),
+		); err != nil {
+			return members, err
+		}
+		members++
+	}
+	return members, nil
+}
+
+// readWatermarks returns, per user, the highest seq found in readBy for a chat.
+func readWatermarks(ctx context.Context, chatID string) (map[string]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "chatid", Value: chatID},
+			{Key: "seq", Value: bson.D{{Key: "$exists", Value: true}}},
+			{Key: "readBy.0", Value: bson.D{{Key: "$exists", Value: true}}},
+		}}},
+		{{Key: "$unwind", Value: "$readBy"}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$readBy"},
+			{Key: "seq", Value: bson.D{{Key: "$max", Value: "$seq"}}},
+		}}},
+	}
+	cursor, err := db.MessagesCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	out := make(map[string]int64)
+	for cursor.Next(ctx) {
+		var row struct {
+			User string `bson:"_id"`
+			Seq  int64  `bson:"seq"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		out[row.User] = row.Seq
+	}
+	return out, cursor.Err()
+}
+
+// mentionSeqs returns, per user, the seqs of a chat's messages mentioning them, ascending.
+func mentionSeqs(ctx context.Context, chatID string) (map[string][]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "chatid", Value: chatID},
+			{Key: "seq", Value: bson.D{{Key: "$exists", Value: true}}},
+			{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+			{Key: "mentions.0", Value: bson.D{{Key: "$exists", Value: true}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "seq", Value: 1}}}},
+		{{Key: "$unwind", Value: "$mentions"}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$mentions"},
+			{Key: "seqs", Value: bson.D{{Key: "$push", Value: "$seq"}}},
+		}}},
+	}
+	cursor, err := db.MessagesCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	out := make(map[string][]int64)
+	for cursor.Next(ctx) {
+		var row struct {
+			User string  `bson:"_id"`
+			Seqs []int64 `bson:"seqs"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		out[row.User] = row.Seqs
+	}
+	return out, cursor.Err()
+}
+
+// unreadMentions keeps the newest mention seqs above the watermark, as many as the server
+// tracks per membership.
+func unreadMentions(seqs []int64, watermark int64) []int64 {
+	var unread []int64
+	for _, s := range seqs {
+		if s > watermark {
+			unread = append(unread, s)
+		}
+	}
+	if len(unread) > maxMentionSeqs {
+		unread = unread[len(unread)-maxMentionSeqs:]
+	}
+	return unread
+}
+
+func loadCheckpoint(ctx context.Context, id string) (checkpoint, error) {
+	cp := checkpoint{ID: id}
+	err := db.MigrationsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&cp)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return cp, fmt.Errorf("load checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+func saveCheckpoint(ctx context.Context, cp checkpoint) error {
+	cp.UpdatedAt = time.Now()
+	_, err := db.MigrationsCollection.ReplaceOne(ctx, bson.M{"_id": cp.ID}, cp, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("save checkpoint: %w", err)
+	}
+	return nil
+}
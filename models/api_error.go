@@ -0,0 +1,73 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// APIError is the body of every JSON error response and of WS "error" frames. Code is
+// stable and machine-readable; Message is for humans and may change.
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Generic error codes, one per HTTP status class the API returns. Handlers use a more
+// specific code where the client can act on it.
+const (
+	ErrCodeBadRequest      = "bad_request"
+	ErrCodeUnauthorized    = "unauthorized"
+	ErrCodeForbidden       = "forbidden"
+	ErrCodeNotFound        = "not_found"
+	ErrCodeMethod          = "method_not_allowed"
+	ErrCodeConflict        = "conflict"
+	ErrCodeGone            = "gone"
+	ErrCodeTooLarge        = "payload_too_large"
+	ErrCodeUnsupported     = "unsupported_media_type"
+	ErrCodeUnprocessable   = "unprocessable"
+	ErrCodeRateLimited     = "rate_limited"
+	ErrCodeInternal        = "internal"
+	ErrCodeBadGateway      = "bad_gateway"
+	ErrCodeUnavailable     = "unavailable"
+	ErrCodeGatewayTimeout  = "gateway_timeout"
+	ErrCodeRangeNotSatisfy = "range_not_satisfiable"
+)
+
+var statusErrCodes = map[int]string{
+	http.StatusBadRequest:                   ErrCodeBadRequest,
+	http.StatusUnauthorized:                 ErrCodeUnauthorized,
+	http.StatusForbidden:                    ErrCodeForbidden,
+	http.StatusNotFound:                     ErrCodeNotFound,
+	http.StatusMethodNotAllowed:             ErrCodeMethod,
+	http.StatusConflict:                     ErrCodeConflict,
+	http.StatusGone:                         ErrCodeGone,
+	http.StatusRequestEntityTooLarge:        ErrCodeTooLarge,
+	http.StatusUnsupportedMediaType:         ErrCodeUnsupported,
+	http.StatusRequestedRangeNotSatisfiable: ErrCodeRangeNotSatisfy,
+	http.StatusUnprocessableEntity:          ErrCodeUnprocessable,
+	http.StatusTooManyRequests:              ErrCodeRateLimited,
+	http.StatusInternalServerError:          ErrCodeInternal,
+	http.StatusBadGateway:                   ErrCodeBadGateway,
+	http.StatusServiceUnavailable:           ErrCodeUnavailable,
+	http.StatusGatewayTimeout:               ErrCodeGatewayTimeout,
+}
+
+// ErrCodeForStatus is the generic code for an HTTP status.
+func ErrCodeForStatus(status int) string {
+	if code, ok := statusErrCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return ErrCodeInternal
+	}
+	return ErrCodeBadRequest
+}
+
+// WriteAPIError writes an APIError with the given status.
+func WriteAPIError(w http.ResponseWriter, status int, e APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Attachment tracks a file saved to disk and the message that owns it.
+// MessageID stays nil until the upload is attached; unattached rows are janitor candidates.
+type Attachment struct {
+	ID         primitive.ObjectID  `bson:"_id,omitempty"       json:"id"`
+	ChatID     string              `bson:"chatid"              json:"chatid"`
+	UploaderID string              `bson:"uploader"            json:"uploader"`
+	Name       string              `bson:"name"                json:"name"`
+	Path       string              `bson:"path"                json:"path"`
+	MIME       string              `bson:"mime"                json:"mime"`
+	Size       int64               `bson:"size"                json:"size"`
+	SHA256     string              `bson:"sha256,omitempty"    json:"sha256,omitempty"`
+	MessageID  *primitive.ObjectID `bson:"messageId,omitempty" json:"messageId,omitempty"`
+	CreatedAt  time.Time           `bson:"createdAt"           json:"createdAt"`
+
+	Variants []MediaVariant `bson:"variants,omitempty" json:"variants,omitempty"` // images: WebP/AVIF encodings and thumbnails; PDFs: first-page preview
+	Pages    int            `bson:"pages,omitempty"    json:"pages,omitempty"`    // PDFs
+
+	Processing       []string `bson:"processing,omitempty"       json:"processing,omitempty"`       // media job kinds still running
+	ProcessingFailed bool     `bson:"processingFailed,omitempty" json:"processingFailed,omitempty"` // one of them gave up
+}
+
+// MediaVariant is an alternative rendition of an uploaded image.
+type MediaVariant struct {
+	Path   string `bson:"path"   json:"path"`
+	MIME   string `bson:"mime"   json:"mime"`
+	Width  int    `bson:"width"  json:"width"`
+	Height int    `bson:"height" json:"height"`
+	Size   int64  `bson:"size"   json:"size"`
+
+	Animated bool `bson:"animated,omitempty" json:"animated,omitempty"` // looping preview of an animated image
+	Blurred  bool `bson:"blurred,omitempty"  json:"blurred,omitempty"`  // obscured preview of an image moderation wants blurred
+}
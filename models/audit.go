@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry records one action taken through the operator API
+type AuditEntry struct {
+	ID      primitive.ObjectID     `bson:"_id,omitempty"     json:"id"`
+	Actor   string                 `bson:"actor"             json:"actor"`
+	Action  string                 `bson:"action"            json:"action"`            // e.g. "message.delete"
+	Target  map[string]string      `bson:"target,omitempty"  json:"target,omitempty"`  // route params
+	Details map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"` // set by the handler
+	Status  int                    `bson:"status"            json:"status"`            // HTTP status of the action
+	At      time.Time              `bson:"at"                json:"at"`
+}
+
+// Suspension stops a user from sending messages until it expires or is lifted
+type Suspension struct {
+	UserID      string     `bson:"userid"                json:"userid"`
+	Reason      string     `bson:"reason"                json:"reason"`
+	SuspendedBy string     `bson:"suspendedBy"           json:"suspendedBy"`
+	CreatedAt   time.Time  `bson:"createdAt"             json:"createdAt"`
+	Until       *time.Time `bson:"until,omitempty"       json:"until,omitempty"` // nil: until lifted
+}
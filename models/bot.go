@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Bot is a non-human account that authenticates with an API token instead of a JWT.
+// UserID is the identity the bot has inside chats (participants, message sender).
+type Bot struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"         json:"id"`
+	UserID      string             `bson:"userid"                json:"userid"`
+	Name        string             `bson:"name"                  json:"name"`
+	OwnerID     string             `bson:"owner"                 json:"owner"`
+	TokenHash   string             `bson:"tokenHash"             json:"-"`
+	Commands    []string           `bson:"commands,omitempty"    json:"commands,omitempty"`    // slash commands the bot handles, without "/"
+	CallbackURL string             `bson:"callbackUrl,omitempty" json:"callbackUrl,omitempty"` // receives dispatched commands
+	CreatedAt   time.Time          `bson:"createdAt"             json:"createdAt"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Call statuses
+const (
+	CallRinging  = "ringing"
+	CallActive   = "active"
+	CallEnded    = "ended"
+	CallMissed   = "missed"   // ended before anyone answered
+	CallRejected = "rejected" // declined by the callee
+)
+
+// Call records a voice/video call signalled over the chat WebSocket.
+type Call struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"        json:"callId"`
+	ChatID     string             `bson:"chatid"               json:"chatid"`
+	Caller     string             `bson:"caller"               json:"caller"`
+	Answerer   string             `bson:"answerer,omitempty"   json:"answerer,omitempty"`
+	Type       string             `bson:"type"                 json:"type"` // "audio" or "video"
+	Status     string             `bson:"status"               json:"status"`
+	StartedAt  time.Time          `bson:"startedAt"            json:"startedAt"`
+	AnsweredAt *time.Time         `bson:"answeredAt,omitempty" json:"answeredAt,omitempty"`
+	EndedAt    *time.Time         `bson:"endedAt,omitempty"    json:"endedAt,omitempty"`
+	Duration   int64              `bson:"duration"             json:"duration"` // seconds connected
+}
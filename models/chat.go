@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -9,12 +10,44 @@ import (
 // IncomingWSMessage represents a generic WebSocket inbound payload
 type IncomingWSMessage struct {
 	Type      string `json:"type"`
+	RequestID string `json:"requestId,omitempty"` // echoed on error frames; v2 frames carry it as the envelope id
 	ChatID    string `json:"chatid"`
 	Content   string `json:"content"`
 	MediaURL  string `json:"mediaUrl"`
 	MediaType string `json:"mediaType"`
 	Online    bool   `json:"online"`
 	ClientID  string `json:"clientId,omitempty"`
+	ReplyTo   string `json:"replyTo,omitempty"` // message id this one replies to
+
+	Index int  `json:"index,omitempty"` // for "message_chunk": position in the stream, from 0
+	Final bool `json:"final,omitempty"` // for "message_chunk": last chunk of the stream
+
+	MessageIDs []string          `json:"messageIds,omitempty"` // for "ack" and "read" frames
+	Cursors    map[string]string `json:"cursors,omitempty"`    // for "resume": chatid => last message id or RFC3339 time
+
+	Capabilities []string `json:"capabilities,omitempty"` // for "hello": features the client understands
+
+	Activity string `json:"activity,omitempty"` // for "typing": typing, recording_voice, uploading_file or stopped
+
+	// call signaling: call_offer, call_answer, ice_candidate, call_end
+	CallID    string          `json:"callId,omitempty"`
+	CallType  string          `json:"callType,omitempty"` // "audio" or "video", on call_offer
+	SDP       string          `json:"sdp,omitempty"`
+	Candidate json.RawMessage `json:"candidate,omitempty"`
+	Reason    string          `json:"reason,omitempty"` // on call_end, e.g. "rejected"
+
+	// live location: location_update
+	MessageID string    `json:"messageId,omitempty"`
+	Location  *Location `json:"location,omitempty"`
+}
+
+// WSEnvelope wraps every frame of protocol version 2. Payload holds the fields a version 1
+// frame has at the top level; ID correlates a client request with the error it caused.
+type WSEnvelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 // Chat represents a chat document
@@ -25,12 +58,264 @@ type Chat struct {
 	UpdatedAt    time.Time `bson:"updatedAt"         json:"updatedAt"`
 	EntityType   string    `bson:"entitytype"        json:"entitytype"`
 	EntityId     string    `bson:"entityid"          json:"entityid"`
+
+	Admins []string            `bson:"admins,omitempty" json:"admins,omitempty"`
+	Groups map[string][]string `bson:"groups,omitempty" json:"groups,omitempty"` // custom mention groups
+
+	CustomEmoji map[string]string `bson:"customEmoji,omitempty" json:"customEmoji,omitempty"` // shortcode => image URL
+
+	ExpireAfter int64 `bson:"expireAfter,omitempty" json:"expireAfter,omitempty"` // seconds until new messages disappear; 0 keeps them
+
+	Language      string `bson:"language,omitempty"      json:"language,omitempty"`      // primary language, e.g. "en"
+	AutoTranslate bool   `bson:"autoTranslate,omitempty" json:"autoTranslate,omitempty"` // default for members speaking another language
+
+	ReadOnly bool `bson:"readOnly,omitempty" json:"readOnly,omitempty"` // sends rejected, reads allowed
+
+	Residency string `bson:"residency,omitempty" json:"residency,omitempty"` // region the chat's data must stay in
+
+	// ShareHistory controls whether members added later see earlier messages; nil means yes
+	ShareHistory *bool                `bson:"shareHistory,omitempty" json:"shareHistory,omitempty"`
+	JoinedAt     map[string]time.Time `bson:"joinedAt,omitempty"     json:"-"` // only set for members added after creation
+
+	LastSeq int64 `bson:"lastSeq,omitempty" json:"lastSeq,omitempty"` // seq of the newest message
+
+	Sandbox string `bson:"sandbox,omitempty" json:"-"` // tenant of a seeded sandbox chat; only the seeder sets it
+
+	JoinApproval bool `bson:"joinApproval,omitempty" json:"joinApproval,omitempty"` // non-members may ask to join; admins decide
+
+	Welcome *WelcomeDM `bson:"welcome,omitempty" json:"welcome,omitempty"` // sent privately to each new member
+
+	ContentFilter string `bson:"contentFilter,omitempty" json:"contentFilter,omitempty"` // "off", "standard" (default) or "strict"
+
+	// Summary is what the chat list shows, kept current by writers so listing needs no joins
+	Summary *ChatSummary `bson:"summary,omitempty" json:"summary,omitempty"`
+
+	// Settings holds per-participant preferences keyed by userID; never serialized to other members
+	Settings map[string]MemberSettings `bson:"settings,omitempty" json:"-"`
+}
+
+// SharesHistory reports whether late joiners can read messages sent before they joined.
+func (c *Chat) SharesHistory() bool {
+	return c.ShareHistory == nil || *c.ShareHistory
+}
+
+// MemberSettings are one participant's preferences for a chat
+type MemberSettings struct {
+	Muted                   bool `bson:"muted"                   json:"muted"`
+	SuppressChannelMentions bool `bson:"suppressChannelMentions" json:"suppressChannelMentions"` // ignore @all/@here while muted
+
+	Language      string `bson:"language,omitempty"      json:"language,omitempty"`      // preferred reading language
+	AutoTranslate *bool  `bson:"autoTranslate,omitempty" json:"autoTranslate,omitempty"` // nil follows the chat default
+
+	Sound    string `bson:"sound,omitempty"    json:"sound,omitempty"`    // notification sound name; empty is the device default
+	Priority string `bson:"priority,omitempty" json:"priority,omitempty"` // "silent", "normal" (default) or "urgent"
+	Preview  string `bson:"preview,omitempty"  json:"preview,omitempty"`  // "full" (default), "sender" or "generic"
+}
+
+// Notification preview modes, from most to least revealing
+const (
+	PreviewFull    = "full"
+	PreviewSender  = "sender"
+	PreviewGeneric = "generic"
+)
+
+// Notification priorities
+const (
+	PrioritySilent = "silent"
+	PriorityNormal = "normal"
+	PriorityUrgent = "urgent"
+)
+
+// NotificationPriority returns the member's priority, defaulting to normal.
+func (s MemberSettings) NotificationPriority() string {
+	if s.Priority == "" {
+		return PriorityNormal
+	}
+	return s.Priority
+}
+
+// SuppressesChannelMentions reports whether @all/@here should not notify this member.
+func (s MemberSettings) SuppressesChannelMentions() bool {
+	return s.Muted && s.SuppressChannelMentions
 }
 
 // Media represents media attached to a message
 type Media struct {
-	URL  string `bson:"url"  json:"url"`
-	Type string `bson:"type" json:"type"`
+	URL    string `bson:"url"              json:"url"`
+	Type   string `bson:"type"             json:"type"`
+	Size   int64  `bson:"size,omitempty"   json:"size,omitempty"`
+	SHA256 string `bson:"sha256,omitempty" json:"sha256,omitempty"`
+
+	SignedURL string `bson:"-" json:"signedUrl,omitempty"` // expiring download link for the reader, see GET /merechats/media
+
+	HLS    string `bson:"hls,omitempty" json:"-"`                // master playlist of a transcoded video, on local disk
+	HLSURL string `bson:"-"             json:"hlsUrl,omitempty"` // signed link to the master playlist, set per reader
+
+	StreamURL string `bson:"-" json:"streamUrl,omitempty"` // signed seekable audio stream, set per reader
+
+	Pages      int    `bson:"pages,omitempty"   json:"pages,omitempty"`      // PDFs
+	Preview    bool   `bson:"preview,omitempty" json:"-"`                    // a first-page image exists
+	PreviewURL string `bson:"-"                 json:"previewUrl,omitempty"` // signed link to it, set per reader
+
+	Animated bool `bson:"animated,omitempty" json:"animated,omitempty"` // GIF or WebP animation; thumbnails are its first frame
+
+	Status string `bson:"status,omitempty" json:"status,omitempty"` // MediaProcessing until thumbnails and transcodes are done
+
+	Sensitive bool   `bson:"sensitive,omitempty" json:"sensitive,omitempty"` // moderation wants it blurred until tapped
+	BlurURL   string `bson:"-"                   json:"blurUrl,omitempty"`   // signed link to the blurred preview, set per reader
+
+	Duration   float64 `bson:"duration,omitempty"   json:"duration,omitempty"`   // seconds, audio and voice messages
+	Waveform   []int   `bson:"waveform,omitempty"   json:"waveform,omitempty"`   // peak levels 0-100 for the scrubber
+	Transcript string  `bson:"transcript,omitempty" json:"transcript,omitempty"` // speech in audio, filled in once transcribed
+
+	Location  *Location   `bson:"location,omitempty"  json:"location,omitempty"`  // set when Type is MediaLocation
+	Sticker   *StickerRef `bson:"sticker,omitempty"   json:"sticker,omitempty"`   // set when Type is MediaSticker
+	LiveUntil *time.Time  `bson:"liveUntil,omitempty" json:"liveUntil,omitempty"` // live location accepts updates until then
+}
+
+// MediaLocation is the Media.Type of a shared location
+const MediaLocation = "location"
+
+// Media.Status values; media with nothing to process has none
+const (
+	MediaProcessing = "processing"
+	MediaReady      = "ready"
+	MediaFailed     = "failed" // some derived files are missing; clients fall back to the original
+)
+
+// Location is a point shared in a chat
+type Location struct {
+	Latitude  float64   `bson:"lat"                json:"lat"`
+	Longitude float64   `bson:"lng"                json:"lng"`
+	Label     string    `bson:"label,omitempty"    json:"label,omitempty"`
+	Accuracy  float64   `bson:"accuracy,omitempty" json:"accuracy,omitempty"` // meters
+	UpdatedAt time.Time `bson:"updatedAt"          json:"updatedAt"`
+}
+
+// Message kinds
+const (
+	KindPaymentRequest = "payment_request"
+	KindStatusCard     = "status_card"
+	KindEvent          = "event"
+	KindTask           = "task"
+)
+
+// ChatSummary is a denormalized digest of a chat for chat lists.
+type ChatSummary struct {
+	LastMessageID    primitive.ObjectID `bson:"lastMessageId,omitempty" json:"lastMessageId,omitempty"`
+	LastSnippet      string             `bson:"lastSnippet,omitempty"   json:"lastSnippet,omitempty"`
+	LastSender       string             `bson:"lastSender,omitempty"    json:"lastSender,omitempty"`
+	LastAt           *time.Time         `bson:"lastAt,omitempty"        json:"lastAt,omitempty"`
+	MessageCount     int64              `bson:"messageCount"            json:"messageCount"`
+	ParticipantCount int                `bson:"participantCount"        json:"participantCount"`
+	Members          []MemberPreview    `bson:"members"                 json:"members"` // first few participants' profiles, for display only
+}
+
+// MemberPreview is the public profile of a participant as shown in a chat list.
+type MemberPreview struct {
+	UserID   string `bson:"userid"             json:"userid"`
+	Username string `bson:"username,omitempty" json:"username,omitempty"`
+	Name     string `bson:"name,omitempty"     json:"name,omitempty"`
+	Avatar   string `bson:"avatar,omitempty"   json:"avatar,omitempty"`
+}
+
+// WelcomeDM is the direct message a chat's bot sends to members when they join.
+type WelcomeDM struct {
+	BotID string   `bson:"botId"           json:"botId"` // bot userid; must be a participant
+	Text  string   `bson:"text"            json:"text"`
+	Links []string `bson:"links,omitempty" json:"links,omitempty"`
+}
+
+// Task is a to-do posted in a chat, optionally assigned to a participant
+type Task struct {
+	Title    string     `bson:"title"              json:"title"`
+	Assignee string     `bson:"assignee,omitempty" json:"assignee,omitempty"`
+	DueAt    *time.Time `bson:"dueAt,omitempty"    json:"dueAt,omitempty"`
+	Done     bool       `bson:"done"               json:"done"`
+	DoneBy   string     `bson:"doneBy,omitempty"   json:"doneBy,omitempty"`
+	DoneAt   *time.Time `bson:"doneAt,omitempty"   json:"doneAt,omitempty"`
+}
+
+// RSVP responses
+const (
+	RSVPYes   = "yes"
+	RSVPNo    = "no"
+	RSVPMaybe = "maybe"
+)
+
+// CalendarEvent is a scheduled event posted in a chat; RSVPs maps participant => response
+type CalendarEvent struct {
+	Title       string            `bson:"title"                 json:"title"`
+	Description string            `bson:"description,omitempty" json:"description,omitempty"`
+	Location    string            `bson:"location,omitempty"    json:"location,omitempty"`
+	Start       time.Time         `bson:"start"                 json:"start"`
+	End         time.Time         `bson:"end"                   json:"end"`
+	RSVPs       map[string]string `bson:"rsvps,omitempty"       json:"rsvps,omitempty"`
+}
+
+// RSVPCounts tallies responses by kind.
+func (e *CalendarEvent) RSVPCounts() map[string]int {
+	counts := map[string]int{RSVPYes: 0, RSVPNo: 0, RSVPMaybe: 0}
+	for _, r := range e.RSVPs {
+		counts[r]++
+	}
+	return counts
+}
+
+// Status card statuses
+const (
+	CardPending   = "pending"
+	CardConfirmed = "confirmed"
+	CardCompleted = "completed"
+	CardCancelled = "cancelled"
+)
+
+// StatusCard tracks an order or booking of the entity a chat is bound to
+type StatusCard struct {
+	EntityType string    `bson:"entitytype"        json:"entitytype"`
+	EntityID   string    `bson:"entityid"          json:"entityid"`
+	Title      string    `bson:"title"             json:"title"`
+	Status     string    `bson:"status"            json:"status"`
+	Details    string    `bson:"details,omitempty" json:"details,omitempty"`
+	URL        string    `bson:"url,omitempty"     json:"url,omitempty"`
+	UpdatedAt  time.Time `bson:"updatedAt"         json:"updatedAt"`
+}
+
+// Payment request statuses
+const (
+	PaymentPending   = "pending"
+	PaymentPaid      = "paid"
+	PaymentCancelled = "cancelled"
+	PaymentFailed    = "failed"
+	PaymentExpired   = "expired"
+)
+
+// PaymentRequest is an actionable payment card; its status is driven by the payments service
+type PaymentRequest struct {
+	Reference string    `bson:"reference,omitempty" json:"reference,omitempty"` // id in the payments service
+	Amount    int64     `bson:"amount"              json:"amount"`              // minor units
+	Currency  string    `bson:"currency"            json:"currency"`            // ISO 4217
+	Payer     string    `bson:"payer"               json:"payer"`
+	Status    string    `bson:"status"              json:"status"`
+	UpdatedAt time.Time `bson:"updatedAt"           json:"updatedAt"`
+}
+
+// LinkPreview is the OpenGraph summary of a URL fetched server-side
+type LinkPreview struct {
+	URL         string `bson:"url"                   json:"url"`
+	Title       string `bson:"title,omitempty"       json:"title,omitempty"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	Image       string `bson:"image,omitempty"       json:"image,omitempty"`
+	SiteName    string `bson:"siteName,omitempty"    json:"siteName,omitempty"`
+}
+
+// Quote is a snapshot of a message quoted from another chat, with a backlink to it
+type Quote struct {
+	MessageID primitive.ObjectID `bson:"messageid" json:"messageid"`
+	ChatID    string             `bson:"chatid"    json:"chatid"`
+	Sender    string             `bson:"sender"    json:"sender"`
+	Content   string             `bson:"content"   json:"content"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
 }
 
 // Message represents a chat message
@@ -41,13 +326,66 @@ type Message struct {
 	SenderName string             `bson:"senderName,omitempty" json:"senderName,omitempty"`
 	AvatarURL  string             `bson:"avatarUrl,omitempty"   json:"avatarUrl,omitempty"`
 
+	Kind    string              `bson:"kind,omitempty"    json:"kind,omitempty"` // empty for plain messages, else e.g. KindPaymentRequest
 	Content string              `bson:"content"           json:"content"`
 	Media   *Media              `bson:"media,omitempty"   json:"media,omitempty"`
-	ReplyTo *primitive.ObjectID `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
+	ReplyTo *primitive.ObjectID `bson:"replyTo,omitempty" json:"replyTo,omitempty"` // thread root
+
+	Watchers    []string `bson:"watchers,omitempty"    json:"-"` // on thread roots: users notified of replies
+	UnwatchedBy []string `bson:"unwatchedBy,omitempty" json:"-"` // on thread roots: users who opted out
+
+	MentionGroups []string `bson:"mentionGroups,omitempty" json:"mentionGroups,omitempty"` // e.g. "all", "admins"
+	Mentions      []string `bson:"mentions,omitempty"      json:"mentions,omitempty"`      // participants mentioned by @userid
+	Quote         *Quote   `bson:"quote,omitempty"         json:"quote,omitempty"`         // message quoted from another chat
+
+	LinkPreview *LinkPreview    `bson:"linkPreview,omitempty" json:"linkPreview,omitempty"` // OpenGraph card for the first link
+	Payment     *PaymentRequest `bson:"payment,omitempty"     json:"payment,omitempty"`     // set on KindPaymentRequest
+	Card        *StatusCard     `bson:"card,omitempty"        json:"card,omitempty"`        // set on KindStatusCard
+	Event       *CalendarEvent  `bson:"event,omitempty"       json:"event,omitempty"`       // set on KindEvent
+	Task        *Task           `bson:"task,omitempty"        json:"task,omitempty"`        // set on KindTask
+
+	SenderBadge string `bson:"-" json:"senderBadge,omitempty"` // resolved per read, see models.Verification
+	Sandbox     string `bson:"sandbox,omitempty" json:"-"`     // tenant of a seeded sandbox message
 
 	CreatedAt time.Time  `bson:"createdAt"         json:"createdAt"`
 	EditedAt  *time.Time `bson:"editedAt,omitempty" json:"editedAt,omitempty"`
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"` // disappearing messages
 	Deleted   bool       `bson:"deleted"           json:"deleted"`
+	DeletedAt *time.Time `bson:"deletedAt,omitempty" json:"-"` // starts the retention window, see DELETED_RETENTION_DAYS
 	ReadBy    []string   `bson:"readBy,omitempty"  json:"readBy,omitempty"`
-	Status    string     `bson:"status,omitempty"  json:"status,omitempty"` // e.g. "sent", "read"
+	Status    string     `bson:"status,omitempty"  json:"status,omitempty"` // "sent", "delivered" or "read"
+
+	DeliveredTo []string `bson:"deliveredTo,omitempty" json:"deliveredTo,omitempty"`
+	Seq         int64    `bson:"seq,omitempty"         json:"seq,omitempty"` // per-chat, monotonically increasing
+
+	Score float64 `bson:"score,omitempty" json:"score,omitempty"` // text relevance, only set on search results
+
+	System *SystemEvent `bson:"system,omitempty" json:"system,omitempty"` // set on join/leave entries
+
+	Entities []Entity `bson:"entities,omitempty" json:"entities,omitempty"` // rich-text annotations of Content
+}
+
+// Entity types
+const (
+	EntityMention      = "mention"
+	EntityMentionGroup = "mention_group"
+	EntityLink         = "link"
+	EntityBold         = "bold"
+	EntityCode         = "code"
+)
+
+// Entity marks a span of a message's content; Offset and Length are in UTF-16 code units
+type Entity struct {
+	Type   string `bson:"type"             json:"type"`
+	Offset int    `bson:"offset"           json:"offset"`
+	Length int    `bson:"length"           json:"length"`
+	UserID string `bson:"userid,omitempty" json:"userid,omitempty"` // mention target
+	Group  string `bson:"group,omitempty"  json:"group,omitempty"`  // mention_group target
+	URL    string `bson:"url,omitempty"    json:"url,omitempty"`    // link target
+}
+
+// SystemEvent describes a generated membership message; Users grows when events are coalesced
+type SystemEvent struct {
+	Action string   `bson:"action" json:"action"` // "join" or "leave"
+	Users  []string `bson:"users"  json:"users"`
 }
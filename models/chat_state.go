@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// ChatUserState is how one user organizes a chat in their list; other members never see it.
+type ChatUserState struct {
+	ChatID      string    `bson:"chatid"                json:"chatid"`
+	UserID      string    `bson:"userid"                json:"userid"`
+	Archived    bool      `bson:"archived"              json:"archived"`
+	PinnedToTop bool      `bson:"pinnedToTop"           json:"pinnedToTop"`
+	CustomLabel string    `bson:"customLabel,omitempty" json:"customLabel,omitempty"`
+	UpdatedAt   time.Time `bson:"updatedAt"             json:"updatedAt"`
+}
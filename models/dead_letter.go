@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Dead-letter kinds: which delivery path gave up on the event
+const (
+	DeadLetterWebhook   = "webhook"   // outgoing webhook or bot callback
+	DeadLetterPush      = "push"      // offline push notification
+	DeadLetterBroadcast = "broadcast" // WS fan-out publish
+)
+
+// DeadLetter is an event a delivery path failed to deliver after its retries. It keeps what
+// is needed to replay it; secrets are looked up again at replay time.
+type DeadLetter struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"       json:"id"`
+	Kind      string             `bson:"kind"                json:"kind"`
+	ChatID    string             `bson:"chatid,omitempty"    json:"chatid,omitempty"`
+	WebhookID primitive.ObjectID `bson:"webhookId,omitempty" json:"webhookId,omitempty"` // webhook or bot _id
+	URL       string             `bson:"url,omitempty"       json:"url,omitempty"`
+	Users     []string           `bson:"users,omitempty"     json:"users,omitempty"` // broadcast and push recipients
+	Payload   string             `bson:"payload"             json:"payload"`         // JSON body as it would have been sent
+	Reason    string             `bson:"reason"              json:"reason"`
+	Attempts  int                `bson:"attempts"            json:"attempts"`
+	CreatedAt time.Time          `bson:"createdAt"           json:"createdAt"`
+
+	ReplayedAt  *time.Time `bson:"replayedAt,omitempty"  json:"replayedAt,omitempty"`
+	ReplayCount int        `bson:"replayCount"           json:"replayCount"`
+	LastError   string     `bson:"lastError,omitempty"   json:"lastError,omitempty"` // of the latest failed replay
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Invite is a shareable link token that adds whoever redeems it to a chat. Only the token's
+// hash is stored; the token itself is shown once, on creation.
+type Invite struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"       json:"id"`
+	ChatID    string             `bson:"chatid"              json:"chatid"`
+	TokenHash string             `bson:"tokenHash"           json:"-"`
+	CreatedBy string             `bson:"createdBy"           json:"createdBy"`
+	CreatedAt time.Time          `bson:"createdAt"           json:"createdAt"`
+	ExpiresAt *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	MaxUses   int64              `bson:"maxUses,omitempty"   json:"maxUses,omitempty"` // 0 means unlimited
+	Uses      int64              `bson:"uses"                json:"uses"`
+	Revoked   bool               `bson:"revoked,omitempty"   json:"revoked,omitempty"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Job states
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a long-running task started on behalf of a user and polled for progress.
+type Job struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"        json:"id"`
+	Kind       string             `bson:"kind"                 json:"kind"` // e.g. "takeout"
+	UserID     string             `bson:"userid"               json:"userid"`
+	Status     string             `bson:"status"               json:"status"`
+	Progress   int                `bson:"progress"             json:"progress"` // 0-100
+	Error      string             `bson:"error,omitempty"      json:"error,omitempty"`
+	Parts      []JobPart          `bson:"parts,omitempty"      json:"parts,omitempty"`
+	CreatedAt  time.Time          `bson:"createdAt"            json:"createdAt"`
+	FinishedAt *time.Time         `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+	ExpiresAt  *time.Time         `bson:"expiresAt,omitempty"  json:"expiresAt,omitempty"` // output is deleted afterwards
+	Params     map[string]string  `bson:"params,omitempty"     json:"-"`                   // runner arguments, e.g. the chat of an export
+	LeaseUntil *time.Time         `bson:"leaseUntil,omitempty" json:"-"`                   // a running job past its lease is taken over
+}
+
+// JobPart is one downloadable output file of a job.
+type JobPart struct {
+	Name string `bson:"name"           json:"name"`
+	Path string `bson:"path"           json:"-"`
+	Key  string `bson:"key,omitempty"  json:"-"` // set when the part lives in remote storage instead of Path
+	Size int64  `bson:"size"           json:"size"`
+	URL  string `bson:"-"              json:"url,omitempty"` // signed, filled in when the job is read
+}
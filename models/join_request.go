@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Join request statuses
+const (
+	JoinPending  = "pending"
+	JoinApproved = "approved"
+	JoinDenied   = "denied"
+)
+
+// JoinRequest is a non-member's request to join a chat that requires admin approval.
+type JoinRequest struct {
+	ChatID    string     `bson:"chatid"              json:"chatid"`
+	UserID    string     `bson:"userid"              json:"userid"`
+	Note      string     `bson:"note,omitempty"      json:"note,omitempty"`
+	Status    string     `bson:"status"              json:"status"`
+	CreatedAt time.Time  `bson:"createdAt"           json:"createdAt"`
+	DecidedBy string     `bson:"decidedBy,omitempty" json:"decidedBy,omitempty"`
+	DecidedAt *time.Time `bson:"decidedAt,omitempty" json:"decidedAt,omitempty"`
+}
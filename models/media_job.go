@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Media job statuses
+const (
+	MediaJobPending = "pending"
+	MediaJobRunning = "running"
+	MediaJobDone    = "done"
+	MediaJobFailed  = "failed" // gave up after its attempts; an admin can retry it
+)
+
+// MediaJob is queued processing of an upload: thumbnails, variants, posters and metadata.
+// Workers lease it like an outbox event, so a job whose worker died is picked up again.
+type MediaJob struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"         json:"id"`
+	Kind        string             `bson:"kind"                  json:"kind"`
+	Entity      string             `bson:"entity"                json:"entity"`
+	PicType     string             `bson:"picType"               json:"picType"`
+	Name        string             `bson:"name"                  json:"name"`
+	Host        string             `bson:"host,omitempty"        json:"host,omitempty"` // instance whose disk holds the source; only it runs the job
+	Extra       []MediaVariant     `bson:"extra,omitempty"       json:"-"`
+	Status      string             `bson:"status"                json:"status"`
+	Attempts    int                `bson:"attempts"              json:"attempts"`
+	LastError   string             `bson:"lastError,omitempty"   json:"lastError,omitempty"`
+	RunAt       time.Time          `bson:"runAt"                 json:"runAt"` // not before; pushed back after a failure
+	LockedUntil *time.Time         `bson:"lockedUntil,omitempty" json:"lockedUntil,omitempty"`
+	CreatedAt   time.Time          `bson:"createdAt"             json:"createdAt"`
+	FinishedAt  *time.Time         `bson:"finishedAt,omitempty"  json:"finishedAt,omitempty"`
+}
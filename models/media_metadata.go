@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// MediaMetadata is what probing (and transcribing) an uploaded audio file, or moderating an
+// uploaded image, found, keyed by its saved name.
+type MediaMetadata struct {
+	Name       string    `bson:"_id"                  json:"name"`
+	ChatID     string    `bson:"chatid"               json:"chatid"`
+	MIME       string    `bson:"mime"                 json:"mime"`
+	Size       int64     `bson:"size"                 json:"size"`
+	Duration   float64   `bson:"duration"             json:"duration"` // seconds
+	Bitrate    int       `bson:"bitrate,omitempty"    json:"bitrate,omitempty"`
+	Codec      string    `bson:"codec,omitempty"      json:"codec,omitempty"`
+	SampleRate int       `bson:"sampleRate,omitempty" json:"sampleRate,omitempty"`
+	Channels   int       `bson:"channels,omitempty"   json:"channels,omitempty"`
+	Format     string    `bson:"format,omitempty"     json:"format,omitempty"`
+	Waveform   []int     `bson:"waveform,omitempty"   json:"waveform,omitempty"`
+	CreatedAt  time.Time `bson:"createdAt"            json:"createdAt"`
+
+	Moderation *ModerationVerdict `bson:"moderation,omitempty" json:"moderation,omitempty"`
+
+	Transcript         string     `bson:"transcript,omitempty"         json:"transcript,omitempty"`
+	TranscriptLanguage string     `bson:"transcriptLanguage,omitempty" json:"transcriptLanguage,omitempty"`
+	TranscribedAt      *time.Time `bson:"transcribedAt,omitempty"      json:"transcribedAt,omitempty"`
+}
+
+// ModerationVerdict is what the image classifier decided about an upload.
+type ModerationVerdict struct {
+	Action string             `bson:"action"           json:"action"` // allow, flag or blur; rejected images are not kept
+	Label  string             `bson:"label,omitempty"  json:"label,omitempty"`
+	Score  float64            `bson:"score,omitempty"  json:"score,omitempty"`
+	Scores map[string]float64 `bson:"scores,omitempty" json:"scores,omitempty"`
+	At     time.Time          `bson:"at"               json:"at"`
+}
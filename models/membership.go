@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Membership is a user's per-chat state. LastReadSeq is the read watermark:
+// every message with Seq <= LastReadSeq counts as read by the user.
+type Membership struct {
+	ChatID      string    `bson:"chatid"      json:"chatid"`
+	UserID      string    `bson:"userid"      json:"userid"`
+	LastReadSeq int64     `bson:"lastReadSeq" json:"lastReadSeq"`
+	UpdatedAt   time.Time `bson:"updatedAt"   json:"updatedAt"`
+	Draft       *Draft    `bson:"draft,omitempty" json:"draft,omitempty"`
+
+	MentionSeqs []int64 `bson:"mentionSeqs,omitempty" json:"-"` // seqs of messages mentioning the user, pruned as they are read
+}
+
+// Draft is an unsent message kept server-side so it follows the user across devices.
+type Draft struct {
+	Content   string    `bson:"content"            json:"content"`
+	DeviceID  string    `bson:"deviceId,omitempty" json:"deviceId,omitempty"` // device that last edited it
+	UpdatedAt time.Time `bson:"updatedAt"          json:"updatedAt"`
+}
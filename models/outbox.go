@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Outbox event kinds
+const (
+	OutboxMessageCreated = "message.created"
+)
+
+// OutboxEvent is a broadcast committed in the same transaction as the write it announces.
+// A dispatcher delivers it and stamps DispatchedAt; events whose delivery lease lapses
+// are retried, so delivery is at least once.
+type OutboxEvent struct {
+	ID           primitive.ObjectID `bson:"_id"                    json:"id"`
+	Kind         string             `bson:"kind"                   json:"kind"`
+	ChatID       string             `bson:"chatid"                 json:"chatid"`
+	MessageID    primitive.ObjectID `bson:"messageId"              json:"messageId"`
+	ClientID     string             `bson:"clientId,omitempty"     json:"clientId,omitempty"` // echoed so the sender can match its optimistic copy
+	CreatedAt    time.Time          `bson:"createdAt"              json:"createdAt"`
+	Attempts     int                `bson:"attempts"               json:"attempts"`
+	LockedUntil  *time.Time         `bson:"lockedUntil,omitempty"  json:"lockedUntil,omitempty"`
+	DispatchedAt *time.Time         `bson:"dispatchedAt,omitempty" json:"dispatchedAt,omitempty"`
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// Presence is the last known online state of a user
+type Presence struct {
+	UserID     string     `json:"userid"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+}
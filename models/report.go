@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Report reasons
+const (
+	ReportSpam       = "spam"
+	ReportHarassment = "harassment"
+	ReportHate       = "hate"
+	ReportViolence   = "violence"
+	ReportSexual     = "sexual"
+	ReportScam       = "scam"
+	ReportOther      = "other"
+)
+
+// Report statuses
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// Moderation actions taken when resolving a report
+const (
+	ActionHideMessage = "hide"
+	ActionWarnUser    = "warn"
+)
+
+// Report is a participant's complaint about a message, queued for admin review.
+type Report struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"        json:"id"`
+	MessageID  primitive.ObjectID `bson:"messageId"            json:"messageId"`
+	ChatID     string             `bson:"chatid"               json:"chatid"`
+	Reporter   string             `bson:"reporter"             json:"reporter"`
+	Reported   string             `bson:"reported"             json:"reported"` // the message's sender
+	Reason     string             `bson:"reason"               json:"reason"`
+	Note       string             `bson:"note,omitempty"       json:"note,omitempty"`
+	Status     string             `bson:"status"               json:"status"`
+	Actions    []string           `bson:"actions,omitempty"    json:"actions,omitempty"`
+	ResolvedBy string             `bson:"resolvedBy,omitempty" json:"resolvedBy,omitempty"`
+	ResolvedAt *time.Time         `bson:"resolvedAt,omitempty" json:"resolvedAt,omitempty"`
+	CreatedAt  time.Time          `bson:"createdAt"            json:"createdAt"`
+}
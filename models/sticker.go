@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Media types for stickers and proxied GIFs
+const (
+	MediaSticker = "sticker"
+	MediaGIF     = "gif"
+)
+
+// StickerPack is a named, ordered set of sticker images uploaded by a user.
+type StickerPack struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name"          json:"name"`
+	Owner     string             `bson:"owner"         json:"owner"`
+	Stickers  []string           `bson:"stickers"      json:"stickers"` // saved file names; a sticker is addressed by index
+	CreatedAt time.Time          `bson:"createdAt"     json:"createdAt"`
+}
+
+// StickerRef points a sticker message at its pack entry.
+type StickerRef struct {
+	PackID primitive.ObjectID `bson:"packId" json:"packId"`
+	Index  int                `bson:"index"  json:"index"`
+}
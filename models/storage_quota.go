@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// StorageQuota is a user's running total of stored chat uploads, one row per user.
+// Limit overrides the STORAGE_QUOTA_MB default for the user: 0 keeps the default,
+// a negative value lifts the limit.
+type StorageQuota struct {
+	UserID    string    `bson:"_id"             json:"userid"`
+	Bytes     int64     `bson:"bytes"           json:"bytes"`
+	Files     int64     `bson:"files"           json:"files"`
+	Limit     int64     `bson:"limit,omitempty" json:"limit,omitempty"`
+	UpdatedAt time.Time `bson:"updatedAt"       json:"updatedAt"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Verification badges shown next to a sender's name
+const (
+	BadgeOfficial = "official"
+	BadgeBot      = "bot"
+	BadgeStaff    = "staff"
+)
+
+// GlobalTenant is the tenant key of verifications that apply in every chat.
+const GlobalTenant = "global"
+
+// Verification grants a badge to a user within a tenant (a chat's entity id) or globally.
+type Verification struct {
+	Tenant    string    `bson:"tenant"    json:"tenant"`
+	UserID    string    `bson:"userid"    json:"userid"`
+	Badge     string    `bson:"badge"     json:"badge"`
+	GrantedBy string    `bson:"grantedBy" json:"grantedBy"`
+	GrantedAt time.Time `bson:"grantedAt" json:"grantedAt"`
+}
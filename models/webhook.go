@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook is an outbound URL that receives every new message in a chat, signed with Secret.
+type Webhook struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ChatID    string             `bson:"chatid"        json:"chatid"`
+	URL       string             `bson:"url"           json:"url"`
+	Secret    string             `bson:"secret"        json:"-"`
+	CreatedBy string             `bson:"createdBy"     json:"createdBy"`
+	CreatedAt time.Time          `bson:"createdAt"     json:"createdAt"`
+}
@@ -1,12 +1,17 @@
 package ratelim
 
 import (
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"naevis/globals"
+	"naevis/models"
+
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/time/rate"
 )
@@ -76,15 +81,56 @@ func extractClientIP(r *http.Request) string {
 	return ip
 }
 
+// RetryAfter takes a token from l if one is available and returns 0. Otherwise it leaves the
+// bucket untouched and returns how long until a token frees up.
+func RetryAfter(l *rate.Limiter) time.Duration {
+	res := l.Reserve()
+	if !res.OK() {
+		return time.Minute
+	}
+	d := res.Delay()
+	if d > 0 {
+		res.Cancel()
+	}
+	return d
+}
+
+// tooManyRequests answers 429 with a Retry-After header in whole seconds.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	models.WriteAPIError(w, http.StatusTooManyRequests, models.APIError{
+		Code:    models.ErrCodeRateLimited,
+		Message: "Too many requests. Please try again later.",
+		Details: map[string]int64{"retryAfterMs": wait.Milliseconds()},
+	})
+}
+
 // Limit is the httprouter middleware for rate limiting
 func (rl *RateLimiter) Limit(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		ip := extractClientIP(r)
 		limiter := rl.getLimiter(ip)
 
-		if !limiter.Allow() {
-			// Optional logging could go here
-			http.Error(w, "Too many requests. Please try again later.", http.StatusTooManyRequests)
+		if wait := RetryAfter(limiter); wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		next(w, r, ps)
+	}
+}
+
+// LimitUser rate limits per authenticated user rather than per IP, so users behind one NAT
+// don't share a bucket. Must run after Authenticate; anonymous requests fall back to the IP.
+func (rl *RateLimiter) LimitUser(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := "ip:" + extractClientIP(r)
+		if user, ok := r.Context().Value(globals.UserIDKey).(string); ok && user != "" {
+			key = "user:" + user
+		}
+
+		if wait := RetryAfter(rl.getLimiter(key)); wait > 0 {
+			tooManyRequests(w, wait)
 			return
 		}
 
@@ -2,32 +2,161 @@ package routes
 
 import (
 	"naevis/discord"
+	"naevis/filemgr"
 	"naevis/middleware"
 	"naevis/ratelim"
 	"naevis/utils"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// idempotencyTTL is how long a create/upload response is replayed for retries.
+const idempotencyTTL = 24 * time.Hour
+
+// Request bodies hashed to match Idempotency-Key retries: JSON requests, and multipart
+// uploads of the largest chat file plus form overhead.
+const maxIdempotentJSON = 1 << 20
+
+var maxIdempotentUpload = filemgr.LargestUploadSize(filemgr.EntityChat) + 1<<20
+
 func AddDiscordRoutes(router *httprouter.Router, rateLimiter *ratelim.RateLimiter) {
 	router.GET("/merechats/all", middleware.Authenticate(discord.GetUserChats))
-	router.POST("/merechats/start", middleware.Authenticate(discord.StartNewChat))
+	router.POST("/merechats/start", middleware.Authenticate(middleware.Idempotent(idempotencyTTL, maxIdempotentJSON)(discord.StartNewChat)))
 	router.GET("/merechats/chat/:chatid", middleware.Authenticate(discord.GetChatByID))
 	router.GET("/merechats/chat/:chatid/messages", middleware.Authenticate(discord.GetChatMessages))
-	router.POST("/merechats/chat/:chatid/message", middleware.Authenticate(discord.SendMessageREST))
+	router.POST("/merechats/chat/:chatid/message", middleware.Authenticate(rateLimiter.LimitUser(discord.SendMessageREST)))
+	router.POST("/merechats/chat/:chatid/webhooks", middleware.Authenticate(discord.RegisterWebhook))
+	router.PUT("/merechats/chat/:chatid/emoji/:code", middleware.Authenticate(discord.SetCustomEmoji))
+	router.PUT("/merechats/chat/:chatid/groups/:group", middleware.Authenticate(discord.SetChatGroup))
+	router.GET("/merechats/chat/:chatid/settings", middleware.Authenticate(discord.GetChatSettings))
+	router.PUT("/merechats/chat/:chatid/settings", middleware.Authenticate(discord.UpdateChatSettings))
+	router.PUT("/merechats/chat/:chatid/state", middleware.Authenticate(discord.UpdateChatState))
 	router.PATCH("/merechats/messages/:messageid", middleware.Authenticate(discord.EditMessage))
 	router.DELETE("/merechats/messages/:messageid", middleware.Authenticate(discord.DeleteMessage))
+	router.POST("/merechats/messages/:messageid/reply-private", middleware.Authenticate(discord.ReplyPrivately))
+	router.POST("/merechats/messages/:messageid/report", middleware.Authenticate(discord.ReportMessage))
 
 	// WebSocket also needs auth to ensure only valid users connect
 	router.GET("/ws/merechat", middleware.Authenticate(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		discord.HandleWebSocket(w, r, httprouter.Params{})
 	}))
 
-	router.POST("/merechats/chat/:chatid/upload", middleware.Authenticate(discord.UploadAttachment))
+	router.POST("/merechats/chat/:chatid/upload", middleware.Authenticate(rateLimiter.LimitUser(middleware.Idempotent(idempotencyTTL, maxIdempotentUpload)(discord.UploadAttachment))))
+	router.GET("/merechats/chat/:chatid/media", middleware.Authenticate(discord.GetChatMedia))
+	router.GET("/merechats/chat/:chatid/media/:name", middleware.Authenticate(discord.GetAttachmentURL))
+	router.GET("/merechats/chat/:chatid/media/:name/metadata", middleware.Authenticate(discord.GetMediaMetadata))
+	router.GET("/merechats/chat/:chatid/media/:name/jobs", middleware.Authenticate(discord.GetMediaJobs))
+	router.GET("/merechats/media/:chatid/:name", discord.ServeAttachment)
+	router.GET("/merechats/media/:chatid/:name/hls/:file", discord.ServeAttachmentHLS)
+	router.GET("/merechats/media/:chatid/:name/stream", discord.StreamAttachmentAudio)
+	router.POST("/merechats/uploads", middleware.Authenticate(rateLimiter.LimitUser(middleware.Idempotent(idempotencyTTL, maxIdempotentJSON)(discord.InitResumableUpload))))
+	router.GET("/merechats/uploads/:uploadid", middleware.Authenticate(discord.GetResumableUpload))
+	router.PATCH("/merechats/uploads/:uploadid", middleware.Authenticate(discord.PatchResumableUpload))
+	router.POST("/merechats/uploads/:uploadid/complete", middleware.Authenticate(middleware.Idempotent(idempotencyTTL, maxIdempotentJSON)(discord.CompleteResumableUpload)))
+	router.DELETE("/merechats/uploads/:uploadid", middleware.Authenticate(discord.AbortResumableUpload))
+	router.GET("/merechats/storage/usage", middleware.Authenticate(discord.GetStorageUsage))
 	router.GET("/merechats/chat/:chatid/search", middleware.Authenticate(discord.SearchMessages))
+	router.GET("/merechats/search", middleware.Authenticate(discord.SearchAllChats))
 	router.GET("/merechats/messages/unread-count", middleware.Authenticate(discord.GetUnreadCount))
 	router.POST("/merechats/messages/:messageid/read", middleware.Authenticate(discord.MarkAsRead))
+	router.POST("/merechats/bots", middleware.Authenticate(discord.RegisterBot))
+	router.GET("/merechats/bots", middleware.Authenticate(discord.ListBots))
+	router.POST("/merechats/chat/:chatid/participants", middleware.Authenticate(discord.AddParticipants))
+	router.POST("/merechats/chat/:chatid/leave", middleware.Authenticate(discord.LeaveChat))
+	router.DELETE("/merechats/chat/:chatid", middleware.Authenticate(discord.DeleteChat))
+	router.GET("/merechats/chat/:chatid/draft", middleware.Authenticate(discord.GetDraft))
+	router.PUT("/merechats/chat/:chatid/draft", middleware.Authenticate(discord.SaveDraft))
+	router.PUT("/merechats/chat/:chatid/expiry", middleware.Authenticate(discord.SetChatExpiry))
+	router.PUT("/merechats/chat/:chatid/language", middleware.Authenticate(discord.SetChatLanguage))
+	router.PUT("/merechats/chat/:chatid/history", middleware.Authenticate(discord.SetHistorySharing))
+	router.PUT("/merechats/chat/:chatid/join-approval", middleware.Authenticate(discord.SetJoinApproval))
+	router.PUT("/merechats/chat/:chatid/welcome", middleware.Authenticate(discord.SetWelcomeDM))
+	router.PUT("/merechats/chat/:chatid/content-filter", middleware.Authenticate(discord.SetContentFilter))
+	router.POST("/merechats/chat/:chatid/join", middleware.Authenticate(discord.RequestToJoin))
+	router.POST("/merechats/chat/:chatid/invites", middleware.Authenticate(discord.CreateInvite))
+	router.DELETE("/merechats/chat/:chatid/invites/:inviteid", middleware.Authenticate(discord.RevokeInvite))
+	router.POST("/merechats/invites/:token/join", middleware.Authenticate(discord.JoinByInvite))
+	router.GET("/merechats/chat/:chatid/requests", middleware.Authenticate(discord.ListJoinRequests))
+	router.POST("/merechats/chat/:chatid/requests/:userid/approve", middleware.Authenticate(discord.ApproveJoinRequest))
+	router.POST("/merechats/chat/:chatid/requests/:userid/deny", middleware.Authenticate(discord.DenyJoinRequest))
+	router.POST("/merechats/chat/:chatid/bots", middleware.Authenticate(discord.AddBotToChat))
+	router.POST("/merechats/chat/:chatid/location", middleware.Authenticate(discord.ShareLocation))
+	router.DELETE("/merechats/chat/:chatid/location/:messageid", middleware.Authenticate(discord.StopLiveLocation))
+	router.GET("/merechats/chat/:chatid/tasks", middleware.Authenticate(discord.ListOpenTasks))
+	router.POST("/merechats/chat/:chatid/tasks", middleware.Authenticate(discord.CreateTask))
+	router.PUT("/merechats/chat/:chatid/tasks/:messageid/done", middleware.Authenticate(discord.SetTaskDone))
+	router.POST("/merechats/chat/:chatid/events", middleware.Authenticate(discord.CreateChatEvent))
+	router.PUT("/merechats/chat/:chatid/events/:messageid/rsvp", middleware.Authenticate(discord.RSVPChatEvent))
+	router.GET("/merechats/chat/:chatid/events/:messageid/ics", middleware.Authenticate(discord.ExportChatEventICS))
+	router.GET("/merechats/chat/:chatid/calls", middleware.Authenticate(discord.GetChatCalls))
+	router.POST("/merechats/chat/:chatid/payment-requests", middleware.Authenticate(discord.CreatePaymentRequest))
+	router.PUT("/merechats/payments/:messageid/status", discord.UpdatePaymentStatus)
+	router.PUT("/merechats/internal/cards/:entitytype/:entityid", middleware.Authenticate(middleware.RequireRoles("service", "admin")(discord.PutStatusCard)))
+	router.PUT("/merechats/internal/profiles/:userid", middleware.Authenticate(middleware.RequireRoles("service", "admin")(discord.UpdateSenderProfile)))
+	router.GET("/merechats/stickers", middleware.Authenticate(discord.ListStickerPacks))
+	router.POST("/merechats/stickers", middleware.Authenticate(discord.UploadStickerPack))
+	router.POST("/merechats/chat/:chatid/sticker", middleware.Authenticate(discord.SendSticker))
+	router.GET("/merechats/gif", middleware.Authenticate(discord.ProxyGIF))
+	router.POST("/merechats/takeout", middleware.Authenticate(discord.RequestTakeout))
+	router.POST("/merechats/erasure", middleware.Authenticate(discord.RequestErasure))
+	router.POST("/merechats/sandbox/seed", middleware.Authenticate(middleware.RequireRoles("admin")(discord.SeedSandbox)))
+	router.DELETE("/merechats/sandbox/:tenant", middleware.Authenticate(middleware.RequireRoles("admin")(discord.WipeSandbox)))
+	router.POST("/merechats/chat/:chatid/export", middleware.Authenticate(discord.RequestChatExport))
+	router.GET("/merechats/jobs/:jobid", middleware.Authenticate(discord.GetJob))
+	router.GET("/merechats/jobs/:jobid/parts/:part", discord.DownloadJobPart)
+	router.PUT("/merechats/chat/:chatid/thread/:messageid/watch", middleware.Authenticate(discord.WatchThread))
+	router.DELETE("/merechats/chat/:chatid/thread/:messageid/watch", middleware.Authenticate(discord.UnwatchThread))
+
+	// Bot API: same handlers, authenticated with "Authorization: Bot <token>"
+	router.POST("/merechats/bot/chat/:chatid/message", middleware.AuthenticateBot(rateLimiter.LimitUser(discord.SendMessageREST)))
+	router.GET("/merechats/bot/chat/:chatid/messages", middleware.AuthenticateBot(discord.GetChatMessages))
+
+	router.GET("/merechats/presence", middleware.Authenticate(discord.GetPresence))
+	router.GET("/merechats/capabilities", middleware.Authenticate(discord.GetCapabilities))
+
+	// Admin-only maintenance
+	router.GET("/merechats/admin/attachments/orphans", middleware.Authenticate(middleware.RequireRoles("admin")(discord.GetOrphanAttachments)))
+	router.POST("/merechats/admin/attachments/cleanup", middleware.Authenticate(middleware.RequireRoles("admin")(discord.CleanupOrphanAttachments)))
+	router.GET("/merechats/admin/read-only", middleware.Authenticate(middleware.RequireRoles("admin")(discord.GetReadOnly)))
+	router.PUT("/merechats/admin/read-only", middleware.Authenticate(middleware.RequireRoles("admin")(discord.SetReadOnly)))
+	router.PUT("/merechats/admin/chats/:chatid/read-only", middleware.Authenticate(middleware.RequireRoles("admin")(discord.SetChatReadOnly)))
+	router.POST("/merechats/admin/chats/:chatid/recompute", middleware.Authenticate(middleware.RequireRoles("admin")(discord.RecomputeChat)))
+	router.PUT("/merechats/admin/chats/:chatid/residency", middleware.Authenticate(middleware.RequireRoles("admin")(discord.SetChatResidency)))
+	router.GET("/merechats/admin/chats/:chatid/export", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ExportChat)))
+	router.GET("/merechats/admin/verifications/:tenant", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ListVerifications)))
+	router.PUT("/merechats/admin/verifications/:tenant/:userid", middleware.Authenticate(middleware.RequireRoles("admin")(discord.GrantVerification)))
+	router.DELETE("/merechats/admin/verifications/:tenant/:userid", middleware.Authenticate(middleware.RequireRoles("admin")(discord.RevokeVerification)))
+	router.GET("/merechats/admin/reports", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ListReports)))
+	router.POST("/merechats/admin/reports/:reportid/resolve", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ResolveReport)))
+	router.GET("/merechats/admin/dead-letters", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ListDeadLetters)))
+	router.POST("/merechats/admin/dead-letters/:id/replay", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ReplayDeadLetter)))
+	router.GET("/merechats/admin/media-jobs", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ListMediaJobs)))
+	router.POST("/merechats/admin/media-jobs/:id/retry", middleware.Authenticate(middleware.RequireRoles("admin")(discord.RetryMediaJob)))
+	router.GET("/merechats/admin/connections", middleware.Authenticate(middleware.RequireRoles("admin")(discord.ListConnections)))
+	router.DELETE("/merechats/admin/connections/:userid", middleware.Authenticate(middleware.RequireRoles("admin")(discord.CloseConnection)))
+	router.POST("/merechats/admin/indexes/rebuild", middleware.Authenticate(middleware.RequireRoles("admin")(discord.RebuildIndexes)))
+	router.GET("/merechats/admin/metrics", middleware.Authenticate(middleware.RequireRoles("admin")(discord.GetMetrics)))
+	router.POST("/merechats/admin/sweeps/:sweep", middleware.Authenticate(middleware.RequireRoles("admin")(discord.RunSweep)))
+}
+
+// AddOperatorRoutes registers the chat oversight API for staff with the "operator" role.
+// Every call that changes something is audited.
+func AddOperatorRoutes(router *httprouter.Router) {
+	operator := func(h httprouter.Handle) httprouter.Handle {
+		return middleware.Authenticate(middleware.RequireOperator(h))
+	}
+	audited := func(action string, h httprouter.Handle) httprouter.Handle {
+		return operator(middleware.Audited(action, h))
+	}
+	router.GET("/admin/merechats/chats", operator(discord.OperatorListChats))
+	router.GET("/admin/merechats/chats/:chatid/volume", operator(discord.OperatorChatVolume))
+	router.DELETE("/admin/merechats/messages/:messageid", audited("message.delete", discord.OperatorDeleteMessage))
+	router.PUT("/admin/merechats/users/:userid/suspension", audited("user.suspend", discord.OperatorSuspendUser))
+	router.DELETE("/admin/merechats/users/:userid/suspension", audited("user.unsuspend", discord.OperatorLiftSuspension))
+	router.PUT("/admin/merechats/users/:userid/storage-quota", audited("user.quota", discord.OperatorSetStorageQuota))
+	router.GET("/admin/merechats/audit", operator(discord.OperatorAuditLog))
 }
 
 func AddUtilityRoutes(router *httprouter.Router, rateLimiter *ratelim.RateLimiter) {
@@ -8,5 +8,6 @@ import (
 
 func RoutesWrapper(router *httprouter.Router, rateLimiter *ratelim.RateLimiter) {
 	AddDiscordRoutes(router, rateLimiter)
+	AddOperatorRoutes(router)
 	AddUtilityRoutes(router, rateLimiter)
 }